@@ -65,3 +65,58 @@ func ConcatArray(arr SexpArray, expr Sexp) (SexpArray, error) {
 
 	return append(arr, arr2...), nil
 }
+
+// SeqToArray flattens anything doseq can walk into an array. Lists yield
+// their elements, hashes yield (key . value) pairs in insertion order,
+// strings yield chars and data yields its bytes as ints.
+func SeqToArray(expr Sexp) (SexpArray, error) {
+	switch t := expr.(type) {
+	case SexpArray:
+		return t, nil
+	case SexpPair:
+		arr := make([]Sexp, 0)
+		var cur Sexp = t
+		for {
+			pair, ok := cur.(SexpPair)
+			if !ok {
+				break
+			}
+			arr = append(arr, pair.head)
+			cur = pair.tail
+		}
+		if cur != SexpNull {
+			arr = append(arr, cur)
+		}
+		return SexpArray(arr), nil
+	case SexpHash:
+		arr := make([]Sexp, 0, len(*t.KeyOrder))
+		for _, key := range *t.KeyOrder {
+			val, err := t.HashGetDefault(key, SexpEnd)
+			if err != nil {
+				return nil, err
+			}
+			if val == SexpEnd {
+				continue
+			}
+			arr = append(arr, Cons(key, val))
+		}
+		return SexpArray(arr), nil
+	case SexpStr:
+		arr := make([]Sexp, 0, len(t))
+		for _, r := range string(t) {
+			arr = append(arr, SexpChar(r))
+		}
+		return SexpArray(arr), nil
+	case SexpData:
+		arr := make([]Sexp, len(t))
+		for i, b := range []byte(t) {
+			arr[i] = SexpInt(b)
+		}
+		return SexpArray(arr), nil
+	case SexpSentinel:
+		if t == SexpNull {
+			return SexpArray{}, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot iterate over %T", expr)
+}
@@ -0,0 +1,36 @@
+package glisp_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/chrhlnd/glisp"
+	glispext "github.com/chrhlnd/glisp/extensions"
+)
+
+func benchmarkFile(b *testing.B, file string) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+	env := glisp.NewGlisp()
+	glispext.ImportRandom(env)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		env.Clear()
+		if err := env.LoadString(string(src)); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := env.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkArrayMult(b *testing.B) {
+	benchmarkFile(b, "benchmarks/array-mult.glisp")
+}
+
+func BenchmarkFib(b *testing.B) {
+	benchmarkFile(b, "benchmarks/fib.glisp")
+}
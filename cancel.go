@@ -0,0 +1,135 @@
+package glisp
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrCancelled matches (with errors.Is) every error returned because a run
+// was stopped from the outside, whatever the reason
+var ErrCancelled = errors.New("execution cancelled")
+
+var ErrBudgetExhausted = errors.New("instruction budget exhausted")
+
+// CancelError is returned when a run is stopped by its context, its deadline
+// or the instruction budget. It can't be caught by try.
+type CancelError struct {
+	Reason error
+}
+
+func (c *CancelError) Error() string {
+	return ErrCancelled.Error() + ": " + c.Reason.Error()
+}
+
+func (c *CancelError) Unwrap() error {
+	return c.Reason
+}
+
+func (c *CancelError) Is(target error) bool {
+	return target == ErrCancelled
+}
+
+// SetInstructionBudget limits how many instructions a run may execute,
+// 0 means no limit
+func (env *Glisp) SetInstructionBudget(n int) {
+	env.budget = n
+}
+
+// SetTimeout gives every run a wall-clock deadline d after it starts,
+// 0 means no limit. Use a context for an absolute deadline.
+func (env *Glisp) SetTimeout(d time.Duration) {
+	env.timeout = d
+}
+
+// RunContext is Run that stops with a CancelError once ctx is done. The
+// env is cleared after a cancel so it can be used again.
+func (env *Glisp) RunContext(ctx context.Context) (Sexp, error) {
+	if env.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, env.timeout)
+		defer cancel()
+	}
+
+	outer := env.ctx
+	env.ctx = ctx
+	if env.rundepth == 0 {
+		env.steps = 0
+	}
+
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		env.interrupt(context.Cause(ctx))
+		close(fired)
+	})
+
+	res, err := env.run()
+
+	if !stop() {
+		<-fired
+	}
+	env.ctx = outer
+	if outer == nil || outer.Err() == nil {
+		env.stopping.Store(false)
+	}
+
+	if err != nil && errors.Is(err, ErrCancelled) && env.rundepth == 0 {
+		env.Clear()
+	}
+	return res, err
+}
+
+func (env *Glisp) EvalStringContext(ctx context.Context, str string) (Sexp, error) {
+	err := env.LoadString(str)
+	if err != nil {
+		return SexpNull, err
+	}
+
+	return env.RunContext(ctx)
+}
+
+// Done is closed when the current run is cancelled, blocking builtins should
+// select on it. It's nil (never ready) outside of a cancellable run.
+func (env *Glisp) Done() <-chan struct{} {
+	if env.ctx == nil {
+		return nil
+	}
+	return env.ctx.Done()
+}
+
+// Interrupted returns the CancelError for the current run once it has been
+// stopped, nil otherwise
+func (env *Glisp) Interrupted() error {
+	if env.stopping.Load() {
+		return &CancelError{env.stopReason}
+	}
+	if env.ctx != nil && env.ctx.Err() != nil {
+		return &CancelError{context.Cause(env.ctx)}
+	}
+	if env.budget > 0 && env.steps > env.budget {
+		return &CancelError{ErrBudgetExhausted}
+	}
+	return nil
+}
+
+// interrupt is safe to call from any goroutine, the vm notices before the
+// next instruction
+func (env *Glisp) interrupt(reason error) {
+	env.stopReason = reason
+	env.stopping.Store(true)
+}
+
+// checkInterrupt runs before every instruction
+func (env *Glisp) checkInterrupt() error {
+	env.steps++
+	if env.budget > 0 && env.steps > env.budget {
+		return &CancelError{ErrBudgetExhausted}
+	}
+	if env.stopping.Load() {
+		return &CancelError{env.stopReason}
+	}
+	if env.sandbox != nil {
+		return env.sandbox.check(env)
+	}
+	return nil
+}
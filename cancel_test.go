@@ -0,0 +1,105 @@
+package glisp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chrhlnd/glisp"
+	glispext "github.com/chrhlnd/glisp/extensions"
+)
+
+func TestInstructionBudget(t *testing.T) {
+	env := glisp.NewGlisp()
+	env.SetInstructionBudget(1000)
+
+	_, err := env.EvalString("(while true 1)")
+	if !errors.Is(err, glisp.ErrBudgetExhausted) || !errors.Is(err, glisp.ErrCancelled) {
+		t.Fatalf("an endless loop gave %v", err)
+	}
+
+	// every run gets the whole budget again
+	for i := 0; i < 3; i++ {
+		expr, err := env.EvalStringContext(context.Background(), "(def n 0) (dotimes [i 50] (set! 'n (+ n i))) n")
+		if err != nil || expr != glisp.SexpInt(1225) {
+			t.Fatalf("run %d gave %v, %v", i, expr, err)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	env := glisp.NewGlisp()
+	env.SetTimeout(20 * time.Millisecond)
+
+	start := time.Now()
+	_, err := env.EvalStringContext(context.Background(), "(while true 1)")
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, glisp.ErrCancelled) {
+		t.Fatalf("an endless loop gave %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("the timeout took %v", time.Since(start))
+	}
+
+	// and the env is cleared for the next one
+	expr, err := env.EvalStringContext(context.Background(), "(+ 1 2)")
+	if err != nil || expr != glisp.SexpInt(3) {
+		t.Errorf("after the timeout gave %v, %v", expr, err)
+	}
+}
+
+// Builtins that block return once the run is cancelled, and try can't
+// catch the cancel.
+func TestCancelBlocked(t *testing.T) {
+	tests := []string{
+		"(sleep 100000)",
+		"(<! (make-chan 0))",
+		"(send! (make-chan 0) 1)",
+		"(wait (event) 0)",
+		"(wait (event) 10)",
+		"(def e (event)) (go (sleep 100000) (event e 1)) (wait e 0)",
+		"(try (sleep 100000) (catch e 'caught))",
+		"(try (<! (make-chan 0)) (catch e 'caught) (finally 'cleaned))",
+		"(try (while true 1) (catch e 'caught))",
+		"(eval '(sleep 100000))",
+		"(eval '(while true 1))",
+	}
+	stop := errors.New("stopped by the test")
+	for _, src := range tests {
+		env := glisp.NewGlisp()
+		env.ImportEval()
+		glispext.ImportChannels(env)
+		glispext.ImportCoroutines(env)
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		time.AfterFunc(20*time.Millisecond, func() { cancel(stop) })
+
+		done := make(chan error, 1)
+		go func() {
+			expr, err := env.EvalStringContext(ctx, src)
+			if err == nil {
+				t.Errorf("%s finished with %v", src, expr)
+			}
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, stop) || !errors.Is(err, glisp.ErrCancelled) {
+				t.Errorf("%s gave %v", src, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s didn't stop", src)
+		}
+	}
+}
+
+// A run inside a builtin, as apply and eval do, stops with the outer one.
+func TestCancelNested(t *testing.T) {
+	env := glisp.NewGlisp()
+	env.ImportEval()
+	env.SetInstructionBudget(1000)
+	_, err := env.EvalString(`(try (eval (read "(while true 1)")) (catch e 'caught))`)
+	if !errors.Is(err, glisp.ErrBudgetExhausted) {
+		t.Errorf("the nested loop gave %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package glisp
+
+import "maps"
+
+// Checkpoint is what an env had defined at some point, its globals,
+// macros and imports. Restore goes back to it.
+type Checkpoint struct {
+	globals map[int]Sexp
+	macros  map[SexpSymbol]SexpFunction
+	imports map[string]struct{}
+}
+
+func (env *Glisp) Checkpoint() *Checkpoint {
+	cp := &Checkpoint{}
+	env.globals.lock.RLock()
+	cp.globals = maps.Clone(env.globals.vars)
+	env.globals.lock.RUnlock()
+
+	env.registry.lock.RLock()
+	cp.macros = maps.Clone(env.registry.macros)
+	cp.imports = maps.Clone(env.registry.imports)
+	env.registry.lock.RUnlock()
+	return cp
+}
+
+// Restore forgets everything defined since cp was made and puts back what
+// was redefined. Values changed in place stay changed. The stacks are
+// cleared too, so don't call it while the env is running.
+func (env *Glisp) Restore(cp *Checkpoint) {
+	env.globals.lock.Lock()
+	env.globals.vars = maps.Clone(cp.globals)
+	env.globals.lock.Unlock()
+
+	env.registry.lock.Lock()
+	env.registry.macros = maps.Clone(cp.macros)
+	env.registry.imports = maps.Clone(cp.imports)
+	env.registry.lock.Unlock()
+
+	env.Clear()
+}
@@ -0,0 +1,33 @@
+package glisp
+
+import "testing"
+
+func TestCheckpoint(t *testing.T) {
+	env := NewGlisp()
+	if _, err := env.EvalString("(def kept 1) (def changed 2)"); err != nil {
+		t.Fatal(err)
+	}
+	cp := env.Checkpoint()
+
+	_, err := env.EvalString(`
+		(def added 3)
+		(def changed 4)
+		(defmac mac [] 5)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Restore(cp)
+
+	if _, found := env.FindObject("added"); found {
+		t.Error("added is still defined")
+	}
+	if obj, _ := env.FindObject("changed"); obj != SexpInt(2) {
+		t.Errorf("changed is %v, want 2", obj)
+	}
+	if obj, _ := env.FindObject("kept"); obj != SexpInt(1) {
+		t.Errorf("kept is %v, want 1", obj)
+	}
+	if _, err := env.EvalString("(mac)"); err == nil {
+		t.Error("mac is still a macro")
+	}
+}
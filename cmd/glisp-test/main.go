@@ -0,0 +1,147 @@
+// Command glisp-test runs the deftest tests in glisp scripts and reports
+// them as TAP or JUnit XML. Files and directories are given as arguments,
+// directories are searched for *_test.glisp files. It exits with 1 if
+// anything failed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/chrhlnd/glisp"
+	"github.com/chrhlnd/glisp/extensions"
+)
+
+var format = flag.String("format", "tap", "report format, tap or junit")
+var output = flag.String("o", "", "write the report to file instead of stdout")
+var run = flag.String("run", "", "only run tests whose names match this regexp")
+
+// discover finds the test scripts under each path
+func discover(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(file string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && file != path && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && strings.HasSuffix(file, "_test.glisp") {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func newEnv() (*glisp.Glisp, *glispext.TestSuite) {
+	env := glisp.NewGlisp()
+	env.ImportEval()
+	glispext.ImportRandom(env)
+	glispext.ImportTime(env)
+	glispext.ImportChannels(env)
+	glispext.ImportCoroutines(env)
+	glispext.ImportRegex(env)
+	glispext.ImportFileSys(env)
+	return env, glispext.ImportTesting(env)
+}
+
+// runFile loads file, which defines its tests, then runs them. A script
+// that fails to load is reported as a test that errored.
+func runFile(file string, match func(string) bool) []*glispext.TestResult {
+	env, suite := newEnv()
+	suite.File = file
+
+	f, err := os.Open(file)
+	if err == nil {
+		err = env.LoadFile(f)
+		f.Close()
+	}
+	if err == nil {
+		_, err = env.Run()
+	}
+	if err != nil {
+		load := &glispext.TestResult{Name: "(load)", File: file, Err: fmt.Errorf("%s", env.GetStackTrace(err))}
+		return append(suite.Results(), load)
+	}
+
+	suite.Run(env, match)
+	return suite.Results()
+}
+
+func main() {
+	flag.Parse()
+
+	var match func(string) bool
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		match = re.MatchString
+	}
+
+	paths := flag.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	files, err := discover(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var results []*glispext.TestResult
+	for _, file := range files {
+		results = append(results, runFile(file, match)...)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case "tap":
+		err = glispext.WriteTAP(w, results)
+	case "junit":
+		err = glispext.WriteJUnit(w, results)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	for _, r := range results {
+		if !r.Passed() {
+			os.Exit(1)
+		}
+	}
+}
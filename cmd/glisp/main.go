@@ -0,0 +1,292 @@
+// Command glisp runs glisp programs and the repl.
+//
+//	glisp [flags] script.glisp [args...]   run a script
+//	glisp [flags] -e '(expr)' [args...]    run an expression
+//	glisp [flags] - [args...]              run the program on stdin
+//	glisp [flags]                          the repl, or stdin when it isn't a terminal
+//	glisp lsp                              a language server on stdin and stdout
+//
+// The program sees what follows it on the command line in the *args* array
+// and can set the exit status with (exit n). A program that fails exits
+// with 1, bad flags exit with 2.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/chrhlnd/glisp"
+	"github.com/chrhlnd/glisp/extensions"
+	"github.com/chrhlnd/glisp/lsp"
+	"github.com/chrhlnd/glisp/repl"
+)
+
+var expression = flag.String("e", "", "run this expression instead of a script")
+var interactive = flag.Bool("i", false,
+	"start the repl once the program has run, even if it failed")
+var extensions = flag.String("ext", "all",
+	"comma separated extensions to load, all or none ("+strings.Join(extensionNames, ",")+")")
+var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+var memprofile = flag.String("memprofile", "", "write mem profile to file")
+var countFuncCalls = flag.Bool("countcalls", false,
+	"count how many times each function is run")
+var breakpoints = flag.String("break", "",
+	"comma separated breakpoints to set before running the program")
+var profile = flag.String("profile", "",
+	"write a pprof profile of the program's glisp functions to file")
+var folded = flag.String("folded", "",
+	"write the program's call stacks to file for a flame graph")
+var sampleRate = flag.Duration("sample", 0,
+	"profile by sampling this often instead of timing every instruction")
+var optLevel = flag.Int("O", glisp.DefaultOptLevel,
+	"how much to optimize, 0 turns the optimizer off. Debugging with -break always uses 0")
+
+var extensionNames = []string{
+	"eval", "random", "time", "channels", "coroutines", "regex", "filesys", "os", "testing",
+}
+
+var importers = map[string]func(env *glisp.Glisp){
+	"eval":       (*glisp.Glisp).ImportEval,
+	"random":     glispext.ImportRandom,
+	"time":       glispext.ImportTime,
+	"channels":   glispext.ImportChannels,
+	"coroutines": glispext.ImportCoroutines,
+	"regex":      glispext.ImportRegex,
+	"filesys":    glispext.ImportFileSys,
+	"os":         glispext.ImportOs,
+	"testing":    func(env *glisp.Glisp) { glispext.ImportTesting(env) },
+}
+
+var precounts map[string]int
+var postcounts map[string]int
+
+func CountPreHook(env *glisp.Glisp, name string, args []glisp.Sexp) {
+	precounts[name] += 1
+}
+
+func CountPostHook(env *glisp.Glisp, name string, retval glisp.Sexp) {
+	postcounts[name] += 1
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] [script.glisp | -e expr | -] [args...]\n",
+		os.Args[0])
+	flag.PrintDefaults()
+}
+
+// importExtensions loads the extensions named in list
+func importExtensions(env *glisp.Glisp, list string) error {
+	var names []string
+	switch list {
+	case "all":
+		names = extensionNames
+	case "", "none":
+	default:
+		names = strings.Split(list, ",")
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		importer, ok := importers[name]
+		if !ok {
+			return fmt.Errorf("unknown extension %q", name)
+		}
+		importer(env)
+	}
+	return nil
+}
+
+// load parses the program without running it. Its arguments, whatever
+// follows it on the command line, are returned.
+func load(env *glisp.Glisp, args []string) ([]string, error) {
+	if *expression != "" {
+		exprs, err := env.ParseNamedStream(strings.NewReader(*expression), "-e")
+		if err != nil {
+			return args, err
+		}
+		return args, env.LoadExpressions(exprs)
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		if len(args) > 0 {
+			args = args[1:]
+		}
+		exprs, err := env.ParseNamedStream(os.Stdin, "stdin")
+		if err != nil {
+			return args, err
+		}
+		return args, env.LoadExpressions(exprs)
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return args[1:], err
+	}
+	defer file.Close()
+	return args[1:], env.LoadFile(file)
+}
+
+// isTerminal is true when stdin is typed at rather than redirected
+func isTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// exitCode is the status to exit with after err, printing it if it's a
+// failure rather than an (exit n)
+func exitCode(env *glisp.Glisp, err error) int {
+	var exit *glisp.ExitError
+	if errors.As(err, &exit) {
+		return exit.Code
+	}
+	if err != nil {
+		fmt.Fprint(os.Stderr, env.GetStackTrace(err))
+		return 1
+	}
+	return 0
+}
+
+// runProgram loads and runs the program given by the flags and arguments,
+// returning the status to exit with
+func runProgram(env *glisp.Glisp, args []string) int {
+	if *breakpoints != "" {
+		for _, spec := range strings.Split(*breakpoints, ",") {
+			repl.SetBreakpoint(env, spec)
+		}
+	}
+
+	args, err := load(env, args)
+	scriptArgs := make(glisp.SexpArray, len(args))
+	for i, arg := range args {
+		scriptArgs[i] = glisp.SexpStr(arg)
+	}
+	env.AddGlobal("*args*", scriptArgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var profiler *glisp.Profiler
+	if *profile != "" || *folded != "" {
+		if *sampleRate > 0 {
+			profiler = glisp.NewSamplingProfiler(env, *sampleRate)
+		} else {
+			profiler = glisp.NewProfiler(env)
+		}
+	}
+
+	_, err = env.Run()
+	if profiler != nil {
+		profiler.Stop()
+		writeProfile(*profile, profiler.WritePprof)
+		writeProfile(*folded, profiler.WriteFolded)
+	}
+	if *countFuncCalls {
+		fmt.Println("Pre:")
+		for name, count := range precounts {
+			fmt.Printf("\t%s: %d\n", name, count)
+		}
+		fmt.Println("Post:")
+		for name, count := range postcounts {
+			fmt.Printf("\t%s: %d\n", name, count)
+		}
+	}
+
+	var exit *glisp.ExitError
+	code := exitCode(env, err)
+	if *interactive && !errors.As(err, &exit) {
+		if err != nil {
+			env.Clear()
+		}
+		return exitCode(env, repl.Run(env))
+	}
+	return code
+}
+
+func writeProfile(fname string, write func(io.Writer) error) {
+	if fname == "" {
+		return
+	}
+	f, err := os.Create(fname)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer f.Close()
+	if err = write(f); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 1 && flag.Arg(0) == "lsp" {
+		if err := lsp.NewServer(nil).Serve(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	env := glisp.NewGlisp()
+	env.SetOptLevel(*optLevel)
+	if err := importExtensions(env, *extensions); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		usage()
+		os.Exit(2)
+	}
+
+	if *cpuprofile != "" {
+		f, err := os.Create(*cpuprofile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		err = pprof.StartCPUProfile(f)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+	}
+
+	precounts = make(map[string]int)
+	postcounts = make(map[string]int)
+
+	if *countFuncCalls {
+		env.AddPreHook(CountPreHook)
+		env.AddPostHook(CountPostHook)
+	}
+
+	var code int
+	args := flag.Args()
+	if len(args) == 0 && *expression == "" && isTerminal() {
+		env.AddGlobal("*args*", glisp.SexpArray{})
+		code = exitCode(env, repl.Run(env))
+	} else {
+		code = runProgram(env, args)
+	}
+
+	if *cpuprofile != "" {
+		pprof.StopCPUProfile()
+	}
+	if *memprofile != "" {
+		f, err := os.Create(*memprofile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		err = pprof.Lookup("heap").WriteTo(f, 1)
+		f.Close()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,335 @@
+package glisp_test
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chrhlnd/glisp"
+	glispext "github.com/chrhlnd/glisp/extensions"
+)
+
+// coroutines is how many go blocks the scripts below start, run these
+// with -race
+const coroutines = 32
+
+func concurrentEnv() *glisp.Glisp {
+	env := glisp.NewGlisp()
+	env.ImportEval()
+	glispext.ImportCoroutines(env)
+	glispext.ImportChannels(env)
+	return env
+}
+
+// Every coroutine interns new symbols, defines a macro and a global, and
+// passes its result through an event and then a shared channel.
+func TestCoroutinesEventsChannels(t *testing.T) {
+	var src strings.Builder
+	src.WriteString("(def done (make-chan 0))\n")
+	for i := 0; i < coroutines; i++ {
+		fmt.Fprintf(&src, `(go (send! done (eval (read "(begin (defmac m%[1]d [] %[1]d) (def g%[1]d (m%[1]d)) (def e%[1]d (event)) (event e%[1]d g%[1]d) (wait e%[1]d 0))"))))
+`, i)
+	}
+	src.WriteString("(def total 0)\n")
+	fmt.Fprintf(&src, "(dotimes [i %d] (set! 'total (+ total (<! done))))\n", coroutines)
+	src.WriteString("total\n")
+
+	env := concurrentEnv()
+	expr, err := env.EvalString(src.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := coroutines * (coroutines - 1) / 2
+	if expr != glisp.SexpInt(want) {
+		t.Fatalf("expected %d got %s", want, expr.SexpString())
+	}
+
+	for i := 0; i < coroutines; i++ {
+		name := fmt.Sprintf("g%d", i)
+		obj, ok := env.FindObject(name)
+		if !ok || obj != glisp.SexpInt(i) {
+			t.Errorf("%s is %v", name, obj)
+		}
+	}
+}
+
+// Duplicated environments share symbols, globals and macros with the
+// original while running on their own goroutines.
+func TestDuplicateConcurrently(t *testing.T) {
+	env := concurrentEnv()
+	if _, err := env.EvalString("(defmac twice [x] `(* 2 ~x))"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, coroutines)
+	for i := 0; i < coroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dup := env.Duplicate()
+			src := fmt.Sprintf("(def d%[1]d (twice %[1]d)) (symnum 'sym%[1]d) d%[1]d", i)
+			expr, err := dup.EvalString(src)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if expr != glisp.SexpInt(2*i) {
+				errs <- fmt.Errorf("d%d is %s", i, expr.SexpString())
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// every symbol got its own number
+	seen := make(map[int]string)
+	for i := 0; i < coroutines; i++ {
+		name := fmt.Sprintf("sym%d", i)
+		num := env.MakeSymbol(name).Number()
+		if other, ok := seen[num]; ok {
+			t.Errorf("%s and %s are both symbol %d", name, other, num)
+		}
+		seen[num] = name
+	}
+}
+
+// Firing an event that can't be fired is an error, not a hang or a panic,
+// however many coroutines try at once.
+func TestEventMisuse(t *testing.T) {
+	env := concurrentEnv()
+	env.AddGlobal("unknown", glisp.SexpEvent(1<<30))
+
+	// only one of the coroutines firing e at once gets to
+	var racing strings.Builder
+	fmt.Fprintf(&racing, "(def e (event)) (def fails (make-chan %d))\n", coroutines)
+	for i := 0; i < coroutines; i++ {
+		fmt.Fprintf(&racing, "(go (send! fails (try (begin (event e %d) 0) (catch err 1))))\n", i)
+	}
+	fmt.Fprintf(&racing, `(def failed 0)
+		(dotimes [i %d] (set! 'failed (+ failed (<! fails))))
+		(assert (= failed %d))
+		(event e 'again)`, coroutines, coroutines-1)
+	tests := []string{
+		"(def e (event)) (event e 1) (event e 2)",
+		"(def e (event)) (event e 1) (wait e 0) (event e 2)",
+		"(event unknown 1)",
+		"(event 'e 1)",
+		racing.String(),
+	}
+	for _, src := range tests {
+		done := make(chan error, 1)
+		go func() {
+			_, err := env.EvalString(src)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "event") {
+				t.Errorf("%s gave %v", src, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s hung", src)
+		}
+		env.Clear()
+	}
+}
+
+// Pooled envs start from the pool's globals every time and don't see
+// each other's changes.
+func TestEnvPool(t *testing.T) {
+	env := concurrentEnv()
+	if _, err := env.EvalString("(def shared 10) (defn bump [x] (+ x 1))"); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := glisp.NewEnvPool(env, "(set! 'shared (bump shared)) (def mine shared) mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, coroutines)
+	for i := 0; i < coroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				expr, err := pool.Run()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if expr != glisp.SexpInt(11) {
+					errs <- fmt.Errorf("expected 11 got %s", expr.SexpString())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if obj, _ := env.FindObject("shared"); obj != glisp.SexpInt(10) {
+		t.Errorf("shared is %v", obj)
+	}
+	if _, ok := env.FindObject("mine"); ok {
+		t.Error("mine leaked out of the pool")
+	}
+
+	// a failed run doesn't leave anything behind either
+	failing, err := glisp.NewEnvPool(env, "(def mine 1) (bump)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pooled := failing.Get()
+	if _, err := pooled.Run(); err == nil {
+		t.Fatal("expected an error")
+	}
+	failing.Put(pooled)
+	pooled = failing.Get()
+	if _, ok := pooled.FindObject("mine"); ok {
+		t.Error("mine survived the reset")
+	}
+	failing.Put(pooled)
+}
+
+// What one checked out env defines, macros included, and how it was set up
+// are gone once it's back in the pool, and never reach the pool's env.
+func TestEnvPoolPut(t *testing.T) {
+	env := concurrentEnv()
+	pool, err := glisp.NewEnvPool(env, "(defmac twice [x] `(* 2 ~x)) (def mine (twice 21)) mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pooled := pool.Get()
+	var out strings.Builder
+	pooled.SetOutput(&out)
+	pooled.SetOptLevel(0)
+	pooled.SetInstructionBudget(1000)
+	var hooked, stopped int
+	pooled.AddPreHook(func(*glisp.Glisp, string, []glisp.Sexp) { hooked++ })
+	debugger := glisp.NewDebugger(pooled, func(d *glisp.Debugger, _ glisp.DebugStop) {
+		stopped++
+		d.Continue()
+	})
+	debugger.BreakLine("", 1)
+	profiler := glisp.NewSamplingProfiler(pooled, time.Millisecond)
+	if _, err := pooled.EvalString(`(eval '(defmac thrice [x] (* 3 x)))`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pooled.EvalString(`(def extra (thrice 1)) (+ extra 1)`); err != nil {
+		t.Fatal(err)
+	}
+	if hooked == 0 || stopped == 0 {
+		t.Fatalf("the hook ran %d times, the debugger stopped %d", hooked, stopped)
+	}
+	pool.Put(pooled)
+	hooked, stopped = 0, 0
+
+	// sync.Pool may or may not hand the same env back, check them all
+	for i := 0; i < 4; i++ {
+		pooled := pool.Get()
+		for _, name := range []string{"mine", "extra"} {
+			if obj, ok := pooled.FindObject(name); ok {
+				t.Errorf("%s is still %v", name, obj)
+			}
+		}
+		if _, err := pooled.EvalString(`(eval '(thrice 1))`); err == nil {
+			t.Error("the macro defined by eval outlived Put")
+		}
+		if w, ok := pooled.Output().(*strings.Builder); ok && w == &out {
+			t.Error("the output outlived Put")
+		}
+		pooled.Clear()
+		expr, err := pooled.EvalString(`(print "") (dotimes [i 500] (+ 1 i)) (+ 1 (+ 2 3))`)
+		if err != nil || expr != glisp.SexpInt(6) {
+			t.Errorf("a reused env gave %v, %v", expr, err)
+		}
+		pool.Put(pooled)
+	}
+	if out.Len() != 0 {
+		t.Errorf("printed %q", out.String())
+	}
+	if hooked != 0 || stopped != 0 {
+		t.Errorf("after Put the hook ran %d times, the debugger stopped %d", hooked, stopped)
+	}
+	if len(profiler.Functions()) == 0 {
+		t.Error("the profiler saw nothing")
+	}
+
+	for _, src := range []string{"mine", "(twice 1)", "extra", "(thrice 1)"} {
+		if expr, err := env.EvalString(src); err == nil {
+			t.Errorf("the pool's env sees %s as %v", src, expr)
+		}
+		env.Clear()
+	}
+	if expr, err := pool.Run(); err != nil || expr != glisp.SexpInt(42) {
+		t.Errorf("the program gave %v, %v", expr, err)
+	}
+}
+
+// Clones share the env's test suite, each reports to its own output and
+// an is counts toward the test its own env is running.
+func TestTestSuiteClones(t *testing.T) {
+	env := concurrentEnv()
+	suite := glispext.ImportTesting(env)
+
+	clones := make([]*glisp.Glisp, coroutines)
+	outs := make([]strings.Builder, coroutines)
+	for i := range clones {
+		clones[i] = env.Clone()
+		clones[i].SetOutput(&outs[i])
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, coroutines)
+	for i, clone := range clones {
+		wg.Add(1)
+		go func(i int, clone *glisp.Glisp) {
+			defer wg.Done()
+			src := fmt.Sprintf(`(deftest t%[1]d (testing "g%[1]d" (is (= %[1]d (+ %[1]d 0))) (is false)))
+				(run-tests)`, i)
+			if _, err := clone.EvalString(src); err != nil {
+				errs <- err
+			}
+		}(i, clone)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var tap strings.Builder
+	for i := range outs {
+		tap.WriteString(outs[i].String())
+	}
+	results := suite.Results()
+	if len(results) != coroutines {
+		t.Fatalf("%d results, want %d", len(results), coroutines)
+	}
+	for _, r := range results {
+		group := "g" + strings.TrimPrefix(r.Name, "t")
+		if r.Assertions != 2 || len(r.Failures) != 1 {
+			t.Errorf("%s made %d assertions, %d failed", r.Name, r.Assertions, len(r.Failures))
+			continue
+		}
+		if ctx := r.Failures[0].Context; len(ctx) != 1 || ctx[0] != group {
+			t.Errorf("%s failed in %v", r.Name, ctx)
+		}
+		reported := regexp.MustCompile(`(?m)^not ok \d+ - ` + r.Name + `$`)
+		if !reported.MatchString(tap.String()) {
+			t.Errorf("%s isn't in the TAP output", r.Name)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package glisp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Debugger stops an env at breakpoints and once a step is done, and hands
+// it to OnStop to look around before it carries on. It's checked before
+// every instruction, so it also stops in code run from builtins like map.
+type Debugger struct {
+	env     *Glisp
+	OnStop  func(*Debugger, DebugStop)
+	breaks  []*Breakpoint
+	nextID  int
+	watches []string
+
+	// Verbose has Locals list the __ names macros bind, like a loop's
+	// counter, as well
+	Verbose bool
+
+	stopped bool // in OnStop
+
+	mode  stepMode
+	depth int        // call depth the step started at
+	pos   *SourcePos // line the step started on
+
+	// the last instruction that had a position, to tell when a line is
+	// entered
+	prevPos   *SourcePos
+	prevDepth int
+}
+
+type stepMode int
+
+const (
+	debugContinue stepMode = iota
+	debugStep
+	debugNext
+	debugOut
+)
+
+// Breakpoint stops on entering the function named Function, or else on
+// entering Line of File. An empty File matches any file, a File without a
+// directory matches by base name.
+type Breakpoint struct {
+	ID       int
+	Function string
+	File     string
+	Line     int
+}
+
+func (bp *Breakpoint) String() string {
+	if bp.Function != "" {
+		return fmt.Sprintf("%d: %s", bp.ID, bp.Function)
+	}
+	if bp.File == "" {
+		return fmt.Sprintf("%d: line %d", bp.ID, bp.Line)
+	}
+	return fmt.Sprintf("%d: %s:%d", bp.ID, bp.File, bp.Line)
+}
+
+func (bp *Breakpoint) matches(pos *SourcePos) bool {
+	if pos.Line != bp.Line {
+		return false
+	}
+	return bp.File == "" || pos.File == bp.File ||
+		(!strings.ContainsRune(bp.File, filepath.Separator) && filepath.Base(pos.File) == bp.File)
+}
+
+// DebugStop is where the env stopped, Breakpoint is nil when a step ended
+type DebugStop struct {
+	Breakpoint *Breakpoint
+	Function   string
+	Pos        *SourcePos
+}
+
+type Local struct {
+	Name  string
+	Value Sexp
+}
+
+type CallFrame struct {
+	Function string
+	Pos      *SourcePos
+}
+
+type WatchValue struct {
+	Expr  string
+	Value Sexp
+	Err   error
+}
+
+// NewDebugger attaches a debugger to env, onStop is called on the env's
+// goroutine whenever it stops. Until one of Step, Next or Out is called
+// it runs on to the next breakpoint.
+func NewDebugger(env *Glisp, onStop func(*Debugger, DebugStop)) *Debugger {
+	d := &Debugger{env: env, OnStop: onStop, nextID: 1}
+	env.debugger = d
+	return d
+}
+
+// Debugger is the debugger attached to env, nil if there isn't one
+func (env *Glisp) Debugger() *Debugger {
+	return env.debugger
+}
+
+// Detach lets the env run without stopping again
+func (d *Debugger) Detach() {
+	if d.env.debugger == d {
+		d.env.debugger = nil
+	}
+}
+
+func (d *Debugger) addBreakpoint(bp *Breakpoint) *Breakpoint {
+	bp.ID = d.nextID
+	d.nextID++
+	d.breaks = append(d.breaks, bp)
+	return bp
+}
+
+func (d *Debugger) BreakFunction(name string) *Breakpoint {
+	return d.addBreakpoint(&Breakpoint{Function: name})
+}
+
+func (d *Debugger) BreakLine(file string, line int) *Breakpoint {
+	return d.addBreakpoint(&Breakpoint{File: file, Line: line})
+}
+
+// RemoveBreakpoint is false if there's no breakpoint id
+func (d *Debugger) RemoveBreakpoint(id int) bool {
+	for i, bp := range d.breaks {
+		if bp.ID == id {
+			d.breaks = append(d.breaks[:i], d.breaks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return d.breaks
+}
+
+// Step stops at the next line run, in this function or one it calls
+func (d *Debugger) Step() {
+	d.mode = debugStep
+}
+
+// Next stops at the next line of this function, or wherever it returns to
+func (d *Debugger) Next() {
+	d.mode = debugNext
+}
+
+// Out stops once this function returns
+func (d *Debugger) Out() {
+	d.mode = debugOut
+}
+
+// Continue runs to the next breakpoint
+func (d *Debugger) Continue() {
+	d.mode = debugContinue
+}
+
+// Watch adds an expression to evaluate wherever the env stops
+func (d *Debugger) Watch(expr string) {
+	d.watches = append(d.watches, expr)
+}
+
+func (d *Debugger) WatchValues() []WatchValue {
+	values := make([]WatchValue, len(d.watches))
+	for i, expr := range d.watches {
+		values[i].Expr = expr
+		values[i].Value, values[i].Err = d.Eval(expr)
+	}
+	return values
+}
+
+func sameLine(a, b *SourcePos) bool {
+	return a != nil && b != nil && a.Line == b.Line && a.File == b.File
+}
+
+func (env *Glisp) callDepth() int {
+	return env.addrstack.tos + 1
+}
+
+// bodyStart is where a function's body starts, after the instructions
+// binding its arguments
+func (sf SexpFunction) bodyStart() int {
+	if sf.varargs {
+		return sf.nargs + 1
+	}
+	return sf.nargs
+}
+
+// check runs before each instruction
+func (d *Debugger) check() {
+	env := d.env
+	if env.pc < env.curfunc.bodyStart() {
+		// nothing to see until the arguments are bound
+		return
+	}
+	pos := env.curfunc.Position(env.pc)
+	depth := env.callDepth()
+
+	entering := pos != nil && (depth != d.prevDepth || !sameLine(pos, d.prevPos))
+	if entering && depth < d.prevDepth && env.pc > 0 &&
+		sameLine(pos, env.curfunc.Position(env.pc-1)) {
+		// back from a call made on this line, it was entered before
+		entering = false
+	}
+	if pos != nil || depth != d.prevDepth {
+		d.prevPos, d.prevDepth = pos, depth
+	}
+
+	var hit *Breakpoint
+	for _, bp := range d.breaks {
+		if bp.Function != "" {
+			if env.pc == env.curfunc.bodyStart() && env.curfunc.name == bp.Function {
+				hit = bp
+				break
+			}
+		} else if entering && bp.matches(pos) {
+			hit = bp
+			break
+		}
+	}
+
+	// stepping stops in whatever a return goes back to, not on the return
+	_, returning := env.curfunc.fun[env.pc].(ReturnInstr)
+
+	stop := hit != nil
+	if !stop && pos != nil && !returning {
+		switch d.mode {
+		case debugStep:
+			stop = depth != d.depth || !sameLine(pos, d.pos)
+		case debugNext:
+			stop = depth < d.depth || (depth == d.depth && !sameLine(pos, d.pos))
+		case debugOut:
+			stop = depth < d.depth
+		}
+	}
+	if !stop {
+		return
+	}
+
+	d.mode = debugContinue
+	d.depth, d.pos = depth, pos
+	if d.OnStop != nil {
+		d.stopped = true
+		defer func() { d.stopped = false }()
+		d.OnStop(d, DebugStop{hit, env.curfunc.name, pos})
+	}
+}
+
+// Stopped is true while OnStop has the env
+func (d *Debugger) Stopped() bool {
+	return d.stopped
+}
+
+// Locals are the variables visible where the env stopped, innermost
+// first. Globals aren't included, nor unless Verbose are the made up __
+// names.
+func (d *Debugger) Locals() []Local {
+	var locals []Local
+	seen := make(map[int]bool)
+	stack := d.env.scopestack
+	for i := stack.tos; i > 0; i-- {
+		frame, ok := stack.elements[i].(*Frame)
+		if !ok {
+			continue
+		}
+		for _, sym := range frame.Symbols() {
+			if seen[sym.number] {
+				continue
+			}
+			seen[sym.number] = true
+			if !d.Verbose && strings.HasPrefix(sym.name, "__") {
+				continue
+			}
+			val, _ := frame.lookup(sym)
+			locals = append(locals, Local{sym.name, val})
+		}
+	}
+	return locals
+}
+
+// Backtrace lists the calls the env is in, the current function first
+func (d *Debugger) Backtrace() []CallFrame {
+	env := d.env
+	frames := []CallFrame{{env.curfunc.name, env.curfunc.Position(env.pc)}}
+	for i := env.addrstack.tos; i >= 0; i-- {
+		addr := env.addrstack.elements[i].(Address)
+		// the return address, the call is just before it
+		frames = append(frames, CallFrame{addr.function.name, addr.function.Position(addr.position - 1)})
+	}
+	return frames
+}
+
+// Eval evaluates src where the env stopped, so it sees the locals
+func (d *Debugger) Eval(src string) (Sexp, error) {
+	evalenv := d.env.Duplicate()
+	evalenv.scopestack = d.env.scopestack.Clone()
+	return evalenv.EvalString(src)
+}
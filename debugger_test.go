@@ -0,0 +1,177 @@
+package glisp_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chrhlnd/glisp"
+)
+
+const debuggee = `(defn add [a b]
+  (+ a b))
+(def x (add 1 2))
+(def y (add x 3))
+y`
+
+// debugRun runs debuggee with breakpoints set by setup, resuming with
+// resume at every stop. It returns where it stopped, as function line:col
+// and the breakpoint if one was hit.
+func debugRun(t *testing.T, setup func(*glisp.Debugger), resume func(*glisp.Debugger)) []string {
+	t.Helper()
+	var stops []string
+	env := glisp.NewGlisp()
+	d := glisp.NewDebugger(env, func(d *glisp.Debugger, stop glisp.DebugStop) {
+		where := fmt.Sprintf("%s %s", stop.Function, stop.Pos)
+		if stop.Breakpoint != nil {
+			where += " at " + stop.Breakpoint.String()
+		}
+		stops = append(stops, where)
+		resume(d)
+	})
+	setup(d)
+	expr, err := env.EvalString(debuggee)
+	if err != nil || expr != glisp.SexpInt(6) {
+		t.Fatalf("the debuggee gave %v, %v", expr, err)
+	}
+	return stops
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	breakAdd := func(d *glisp.Debugger) { d.BreakFunction("add") }
+	breakLine := func(d *glisp.Debugger) { d.BreakLine("", 3) }
+
+	tests := []struct {
+		name   string
+		setup  func(*glisp.Debugger)
+		resume func(*glisp.Debugger)
+		stops  []string
+	}{
+		{"continue to a function", breakAdd, (*glisp.Debugger).Continue, []string{
+			"add 2:3 at 1: add",
+			"add 2:3 at 1: add",
+		}},
+		// coming back to the line from the call made on it isn't entering it
+		{"continue to a line", breakLine, (*glisp.Debugger).Continue, []string{
+			"__main 3:8 at 1: line 3",
+		}},
+		{"step", breakLine, (*glisp.Debugger).Step, []string{
+			"__main 3:8 at 1: line 3",
+			"add 2:3",
+			"__main 3:1",
+			"__main 4:8",
+			"add 2:3",
+			"__main 4:1",
+		}},
+		{"next", breakLine, (*glisp.Debugger).Next, []string{
+			"__main 3:8 at 1: line 3",
+			"__main 4:8",
+		}},
+		{"out", breakAdd, (*glisp.Debugger).Out, []string{
+			"add 2:3 at 1: add",
+			"__main 3:1",
+			"add 2:3 at 1: add",
+			"__main 4:1",
+		}},
+	}
+	for _, test := range tests {
+		stops := debugRun(t, test.setup, test.resume)
+		if !reflect.DeepEqual(stops, test.stops) {
+			t.Errorf("%s stopped at %q, want %q", test.name, stops, test.stops)
+		}
+	}
+}
+
+func TestDebuggerInspect(t *testing.T) {
+	var locals [][]glisp.Local
+	var watched []glisp.Sexp
+	var traces []string
+	env := glisp.NewGlisp()
+	d := glisp.NewDebugger(env, func(d *glisp.Debugger, stop glisp.DebugStop) {
+		if !d.Stopped() {
+			t.Error("stopped without Stopped")
+		}
+		locals = append(locals, d.Locals())
+		watched = append(watched, d.WatchValues()[0].Value)
+		var trace string
+		for _, frame := range d.Backtrace() {
+			trace += fmt.Sprintf("%s %s;", frame.Function, frame.Pos)
+		}
+		traces = append(traces, trace)
+	})
+	d.Watch("(* a b)")
+	bp := d.BreakFunction("add")
+	if env.Debugger() != d {
+		t.Error("the env doesn't have the debugger")
+	}
+	if _, err := env.EvalString(debuggee); err != nil {
+		t.Fatal(err)
+	}
+	if d.Stopped() {
+		t.Error("still Stopped after running")
+	}
+
+	wantLocals := [][]glisp.Local{
+		{{"b", glisp.SexpInt(2)}, {"a", glisp.SexpInt(1)}},
+		{{"b", glisp.SexpInt(3)}, {"a", glisp.SexpInt(3)}},
+	}
+	if !reflect.DeepEqual(locals, wantLocals) {
+		t.Errorf("locals were %v, want %v", locals, wantLocals)
+	}
+	if !reflect.DeepEqual(watched, []glisp.Sexp{glisp.SexpInt(2), glisp.SexpInt(9)}) {
+		t.Errorf("(* a b) was %v", watched)
+	}
+	wantTraces := []string{"add 2:3;__main 3:8;", "add 2:3;__main 4:8;"}
+	if !reflect.DeepEqual(traces, wantTraces) {
+		t.Errorf("backtraces were %q, want %q", traces, wantTraces)
+	}
+
+	// without the breakpoint, or detached, it runs straight through
+	if !d.RemoveBreakpoint(bp.ID) || d.RemoveBreakpoint(bp.ID) {
+		t.Error("removing the breakpoint once should work, twice shouldn't")
+	}
+	d.BreakLine("", 3)
+	d.Detach()
+	locals = nil
+	if _, err := env.EvalString(debuggee); err != nil || locals != nil {
+		t.Errorf("a detached debugger stopped %d times, %v", len(locals), err)
+	}
+	if env.Debugger() != nil {
+		t.Error("the env kept a detached debugger")
+	}
+}
+
+func TestDebuggerLocalsHidesMacroNames(t *testing.T) {
+	var names [][]string
+	env := glisp.NewGlisp()
+	d := glisp.NewDebugger(env, func(d *glisp.Debugger, stop glisp.DebugStop) {
+		var stopped []string
+		for _, local := range d.Locals() {
+			stopped = append(stopped, local.Name)
+		}
+		names = append(names, stopped)
+	})
+	d.BreakLine("", 2)
+	loop := "(dotimes [i 1]\n  (+ i 1))"
+	if _, err := env.EvalString(loop); err != nil {
+		t.Fatal(err)
+	}
+	d.Verbose = true
+	if _, err := env.EvalString(loop); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 2 || !reflect.DeepEqual(names[0], []string{"i"}) {
+		t.Fatalf("stopped with locals %q, want [i] first", names)
+	}
+	hidden := 0
+	for _, name := range names[1] {
+		if strings.HasPrefix(name, "__") {
+			hidden++
+		}
+	}
+	if hidden == 0 || len(names[1]) != hidden+1 {
+		t.Errorf("verbose locals were %q, want i and the loop's own", names[1])
+	}
+}
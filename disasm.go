@@ -0,0 +1,78 @@
+package glisp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Disassemble writes out fun's instructions, numbered. Jumps say where
+// they land and the instructions landed on are marked with a >. Each
+// source line instructions were compiled from is shown above the first
+// of them.
+func Disassemble(w io.Writer, fun SexpFunction) error {
+	if fun.user {
+		return fmt.Errorf("%s is written in Go", fun.name)
+	}
+
+	landing := make(map[int]bool)
+	for pc, instr := range fun.fun {
+		if target := jumpTarget(instr, pc); target >= 0 {
+			landing[target] = true
+		}
+	}
+
+	var positions []*SourcePos
+	if fun.info != nil {
+		positions = fun.info.positions
+	}
+	sources := make(map[string][]string)
+	var last SourcePos
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, %d instructions\n", fun.Signature(), len(fun.fun))
+	for pc, instr := range fun.fun {
+		if pc < len(positions) && positions[pc] != nil {
+			pos := positions[pc]
+			if pos.File != last.File || pos.Line != last.Line {
+				fmt.Fprintf(&b, "; %s\n", sourceLine(sources, pos))
+				last = *pos
+			}
+		}
+
+		mark := " "
+		if landing[pc] {
+			mark = ">"
+		}
+		fmt.Fprintf(&b, "%s %4d  %s", mark, pc, instr.InstrString())
+		if target := jumpTarget(instr, pc); target >= 0 {
+			fmt.Fprintf(&b, "  -> %d", target)
+		}
+		b.WriteString("\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// sourceLine is file:line and the text of the line if the file can be
+// read, files are read once into sources
+func sourceLine(sources map[string][]string, pos *SourcePos) string {
+	where := fmt.Sprintf("%d", pos.Line)
+	if pos.File != "" {
+		where = fmt.Sprintf("%s:%d", pos.File, pos.Line)
+	}
+
+	lines, ok := sources[pos.File]
+	if !ok && pos.File != "" {
+		if src, err := os.ReadFile(pos.File); err == nil {
+			lines = strings.Split(string(src), "\n")
+		}
+		sources[pos.File] = lines
+	}
+	if pos.Line < 1 || pos.Line > len(lines) {
+		return where
+	}
+	return where + "  " + strings.TrimSpace(lines[pos.Line-1])
+}
@@ -0,0 +1,206 @@
+package glisp
+
+import (
+	"strings"
+	"sync"
+)
+
+// Doc documents a builtin function or a special form
+type Doc struct {
+	Usage string // how it's called, like (cons a b)
+	Text  string
+}
+
+// Arity is how many arguments a builtin's usage takes, most is -1 when
+// there's no limit. Arguments in brackets are optional and the one before
+// ... can be left out or repeated. Usages joined by "or" take what any of
+// them does.
+func (doc Doc) Arity() (least int, most int) {
+	least = -1
+	for _, usage := range strings.Split(doc.Usage, " or ") {
+		fields := strings.Fields(strings.Trim(usage, "()"))
+		if len(fields) == 0 {
+			continue
+		}
+
+		required, total := 0, 0
+		optional, variadic := false, false
+		for _, field := range fields[1:] {
+			if field == "..." {
+				if !optional && total > 0 && !strings.HasSuffix(fields[total], "]") {
+					required--
+				}
+				variadic = true
+				continue
+			}
+			if strings.HasPrefix(field, "[") {
+				optional = true
+			}
+			total++
+			if !optional {
+				required++
+			}
+			if strings.HasSuffix(field, "]") {
+				optional = false
+			}
+		}
+
+		if least < 0 || required < least {
+			least = required
+		}
+		if variadic {
+			most = -1
+		} else if most >= 0 && total > most {
+			most = total
+		}
+	}
+	return max(least, 0), most
+}
+
+var docsLock sync.RWMutex
+
+var docs = map[string]Doc{
+	// special forms
+	"and":          {"(and a b ...)", "Evaluates its arguments in order until one is false, returning the last value evaluated."},
+	"or":           {"(or a b ...)", "Evaluates its arguments in order until one is true, returning the last value evaluated."},
+	"cond":         {"(cond test expr ... else)", "Evaluates the expr after the first test that's true, else when none are."},
+	"quote":        {"(quote expr)", "Returns expr without evaluating it, 'expr for short."},
+	"def":          {"(def name value)", "Binds name to value in the current scope."},
+	"fn":           {"(fn [args] body ...)", "Makes a function. [a & rest] collects any further arguments into rest."},
+	"defn":         {"(defn name [args] \"doc\" body ...)", "Defines a function called name, the docstring is optional."},
+	"begin":        {"(begin expr ...)", "Evaluates each expr in turn, returning the last."},
+	"let":          {"(let [name value ...] body ...)", "Binds each name to its value, all evaluated before any is bound, around body."},
+	"let*":         {"(let* [name value ...] body ...)", "Like let but each value sees the names bound before it."},
+	"assert":       {"(assert expr)", "Fails with an error naming expr when it's false."},
+	"defmac":       {"(defmac name [args] body ...)", "Defines a macro, a function from its unevaluated arguments to the code to run in their place."},
+	"macexpand":    {"(macexpand (macro args ...))", "Returns the code a macro call expands to."},
+	"syntax-quote": {"(syntax-quote expr)", "Quotes expr except where ~ unquotes and ~@ splices, `expr for short."},
+	"include":      {"(include \"file\" ...)", "Compiles the files in place, every time."},
+	"import":       {"(import \"file\" ...)", "Compiles the files in place, once per environment."},
+	"while":        {"(while test body ...)", "Evaluates body for as long as test is true."},
+	"dotimes":      {"(dotimes [i n] body ...)", "Evaluates body with i bound to 0 up to n-1."},
+	"doseq":        {"(doseq [x coll] body ...)", "Evaluates body with x bound to each element of a list or array."},
+	"loop":         {"(loop [name init ...] body ...)", "Evaluates body with the names bound, recur starts it again with new values."},
+	"recur":        {"(recur value ...)", "Goes back to the start of the enclosing loop, rebinding its names."},
+	"break":        {"(break)", "Leaves the enclosing loop."},
+	"continue":     {"(continue)", "Goes on to the next turn of the enclosing loop."},
+	"try":          {"(try body ... (catch e handler ...) (finally cleanup ...))", "Evaluates body, running the handler with e bound to the error if it fails. finally always runs."},
+	"throw":        {"(throw value)", "Raises value as an error, a catch gets value itself."},
+
+	// arithmetic and comparison
+	"+":       {"(+ a b ...)", "Adds numbers."},
+	"-":       {"(- a b ...)", "Subtracts the rest from a."},
+	"*":       {"(* a b ...)", "Multiplies numbers."},
+	"/":       {"(/ a b ...)", "Divides a by the rest, integers stay integers when they divide exactly."},
+	"mod":     {"(mod a b)", "The remainder of dividing integer a by b."},
+	"sll":     {"(sll a n)", "Shifts a left n bits."},
+	"sra":     {"(sra a n)", "Shifts a right n bits, keeping its sign."},
+	"srl":     {"(srl a n)", "Shifts a right n bits, filling with zeros."},
+	"bit-and": {"(bit-and a b)", "Bitwise and of two integers."},
+	"bit-or":  {"(bit-or a b)", "Bitwise or of two integers."},
+	"bit-xor": {"(bit-xor a b)", "Bitwise exclusive or of two integers."},
+	"bit-not": {"(bit-not a)", "Flips the bits of an integer."},
+	"<":       {"(< a b)", "True when a is less than b."},
+	">":       {"(> a b)", "True when a is greater than b."},
+	"<=":      {"(<= a b)", "True when a is at most b."},
+	">=":      {"(>= a b)", "True when a is at least b."},
+	"=":       {"(= a b)", "True when a and b are equal."},
+	"not=":    {"(not= a b)", "True when a and b differ."},
+	"not":     {"(not x)", "True when x is false."},
+
+	// type predicates
+	"seq?":    {"(seq? x)", "True for lists and arrays."},
+	"list?":   {"(list? x)", "True for proper lists, () included."},
+	"null?":   {"(null? x)", "True for ()."},
+	"array?":  {"(array? x)", "True for arrays."},
+	"hash?":   {"(hash? x)", "True for hashes."},
+	"number?": {"(number? x)", "True for ints, floats and chars."},
+	"int?":    {"(int? x)", "True for integers."},
+	"float?":  {"(float? x)", "True for floats."},
+	"char?":   {"(char? x)", "True for chars."},
+	"symbol?": {"(symbol? x)", "True for symbols."},
+	"string?": {"(string? x)", "True for strings."},
+	"zero?":   {"(zero? x)", "True for a zero int, float or char."},
+	"empty?":  {"(empty? x)", "True for (), and empty arrays, hashes and strings."},
+	"pair?":   {"(pair? x)", "True for a dotted pair."},
+	"data?":   {"(data? x)", "True for byte data."},
+	"bool?":   {"(bool? x)", "True for true and false."},
+	"fn?":     {"(fn? x)", "True for functions."},
+	"event?":  {"(event? x)", "True for events."},
+
+	// lists, arrays, hashes and strings
+	"cons":          {"(cons a b)", "Makes a pair of a and b, a list when b is one."},
+	"first":         {"(first coll)", "The first element of a list or array."},
+	"rest":          {"(rest coll)", "A list or array without its first element."},
+	"car":           {"(car coll)", "Same as first."},
+	"cdr":           {"(cdr coll)", "Same as rest."},
+	"list":          {"(list x ...)", "Makes a list."},
+	"array":         {"(array x ...)", "Makes an array, [x ...] for short."},
+	"hash":          {"(hash [key value] ...)", "Makes a hash, {key value ...} for short."},
+	"make-array":    {"(make-array n [fill])", "Makes an array of n elements, each fill or () without it."},
+	"aget":          {"(aget arr i)", "The element of arr at index i."},
+	"aset!":         {"(aset! arr i value)", "Replaces the element of arr at index i."},
+	"hget":          {"(hget h key [default])", "The value of key in h, default or an error when it's missing."},
+	"hset!":         {"(hset! h key value)", "Sets key in h to value."},
+	"hdel!":         {"(hdel! h key)", "Removes key from h."},
+	"hclear!":       {"(hclear! h)", "Removes every key from h."},
+	"slice":         {"(slice coll start end)", "The elements of an array or string from start up to end."},
+	"len":           {"(len coll)", "How many elements a list, array, hash or string has."},
+	"append":        {"(append coll x ...)", "An array or string with x added at the end."},
+	"?append":       {"(?append coll x ...)", "Like append but skips empty values."},
+	"concat":        {"(concat coll other ...)", "Joins arrays, lists or strings."},
+	"?concat":       {"(?concat coll other ...)", "Like concat but skips empty values."},
+	"sget":          {"(sget str i)", "The char of str at index i."},
+	"str":           {"(str x)", "The printed form of x as a string."},
+	"begins-with":   {"(begins-with s prefix)", "True when string or data s starts with prefix."},
+	"ends-with":     {"(ends-with s suffix)", "True when string or data s ends with suffix."},
+	"make-data":     {"(make-data x ...)", "Packs ints, strings and data into bytes."},
+	"symnum":        {"(symnum 'sym)", "The number a symbol is interned as."},
+	"cvert-str":     {"(cvert-str x)", "Converts x to a string."},
+	"cvert-int64":   {"(cvert-int64 x)", "Converts x to a 64 bit integer."},
+	"cvert-int32":   {"(cvert-int32 x)", "Converts x to a 32 bit integer."},
+	"cvert-float32": {"(cvert-float32 x)", "Converts x to a 32 bit float."},
+	"cvert-float64": {"(cvert-float64 x)", "Converts x to a 64 bit float."},
+
+	// functions and evaluation
+	"apply":   {"(apply f args)", "Calls f with the elements of a list or array as its arguments."},
+	"map":     {"(map f coll)", "Calls f on each element of a list or array, collecting the results."},
+	"foldl":   {"(foldl coll f acc)", "Reduces a list, array, hash, string or data from the left, acc becomes (f x acc) for each element x."},
+	"foldr":   {"(foldr coll f acc)", "Reduces coll from the right, acc becomes (f x acc) for each element x."},
+	"set!":    {"(set! 'name value)", "Changes the value name is bound to where it was bound."},
+	"read":    {"(read str)", "Parses the first expression in str without evaluating it."},
+	"eval":    {"(eval expr)", "Evaluates expr."},
+	"exit":    {"(exit [code])", "Ends the program with the exit code, 0 without one. try can't catch it."},
+	"print":   {"(print x ...)", "Prints its arguments, strings without quotes."},
+	"println": {"(println x ...)", "Prints its arguments and a newline."},
+	"plog":    {"(plog x ...)", "Writes its arguments to the log."},
+
+	// errors
+	"error?":        {"(error? x)", "True for the error a catch gets from a failing builtin."},
+	"error-message": {"(error-message e)", "The message of an error."},
+	"error-fn":      {"(error-fn e)", "The name of the function an error came from."},
+
+	// events
+	"event":       {"(event) or (event e value)", "Makes an event, or fires e with value."},
+	"?event":      {"(?event e value)", "Like event but does nothing when e is ()."},
+	"wait":        {"(wait e ms)", "Waits for e to fire and returns its value, checking every ms milliseconds or blocking when ms is 0."},
+	"?wait":       {"(?wait e ms)", "Like wait but returns () at once when e is ()."},
+	"sleep":       {"(sleep ms)", "Pauses for ms milliseconds."},
+	"source-file": {"(source-file \"file\" ...)", "Loads and runs files, lists or arrays of them too."},
+}
+
+// LookupDoc finds the documentation of a builtin or a special form
+func LookupDoc(name string) (Doc, bool) {
+	docsLock.RLock()
+	defer docsLock.RUnlock()
+	doc, ok := docs[name]
+	return doc, ok
+}
+
+// AddDoc documents a function added from Go, for :doc in the repl and for
+// editors
+func AddDoc(name string, doc Doc) {
+	docsLock.Lock()
+	defer docsLock.Unlock()
+	docs[name] = doc
+}
@@ -0,0 +1,132 @@
+package glisp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltinsDocumented(t *testing.T) {
+	env := NewGlisp()
+	env.ImportEval()
+	for name := range BuiltinFunctions {
+		if _, ok := LookupDoc(name); !ok {
+			t.Errorf("builtin %s has no doc", name)
+		}
+	}
+	for _, name := range SpecialForms {
+		if _, ok := LookupDoc(name); !ok {
+			t.Errorf("special form %s has no doc", name)
+		}
+	}
+	for _, name := range []string{"eval", "source-file"} {
+		if _, ok := LookupDoc(name); !ok {
+			t.Errorf("%s has no doc", name)
+		}
+	}
+}
+
+func TestFunctionDocs(t *testing.T) {
+	env := NewGlisp()
+	_, err := env.EvalString(`
+		(defn documented [a b & more] "adds things up" (+ a b))
+		(defn plain [x] "just a string")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, signature, doc string
+	}{
+		{"documented", "(documented a b & more)", "adds things up"},
+		// a string that's the whole body is what the function returns
+		{"plain", "(plain x)", ""},
+	}
+	for _, test := range tests {
+		obj, _ := env.FindObject(test.name)
+		fun := obj.(SexpFunction)
+		if fun.Signature() != test.signature {
+			t.Errorf("%s signature is %s, want %s", test.name, fun.Signature(), test.signature)
+		}
+		if fun.Doc() != test.doc {
+			t.Errorf("%s doc is %q, want %q", test.name, fun.Doc(), test.doc)
+		}
+	}
+
+	res, err := env.EvalString("(plain 1)")
+	if err != nil || res != SexpStr("just a string") {
+		t.Errorf("(plain 1) gave %v, %v", res, err)
+	}
+}
+
+func TestArity(t *testing.T) {
+	tests := []struct {
+		name        string
+		least, most int
+	}{
+		{"cons", 2, 2},
+		{"+", 1, -1},
+		{"list", 0, -1},
+		{"hash", 0, -1},
+		{"hget", 2, 3},
+		{"exit", 0, 1},
+		{"event", 0, 2},
+	}
+	for _, test := range tests {
+		doc, _ := LookupDoc(test.name)
+		least, most := doc.Arity()
+		if least != test.least || most != test.most {
+			t.Errorf("%s takes %d to %d, want %d to %d", test.name, least, most, test.least, test.most)
+		}
+	}
+}
+
+func TestFunctionDocsImage(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.glisp")
+	src := `(defn documented [a b & more] "adds things up" (+ a b))`
+	if err := os.WriteFile(lib, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(how string, env *Glisp) {
+		t.Helper()
+		obj, ok := env.FindObject("documented")
+		if !ok {
+			t.Fatalf("%s: documented isn't defined", how)
+		}
+		fun := obj.(SexpFunction)
+		if fun.Signature() != "(documented a b & more)" || fun.Doc() != "adds things up" {
+			t.Errorf("%s: %s is documented %q", how, fun.Signature(), fun.Doc())
+		}
+	}
+
+	var image bytes.Buffer
+	compiled := NewGlisp()
+	if err := compiled.LoadString(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := compiled.CompileToWriter(&image); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewGlisp()
+	if err := loaded.LoadCompiled(&image); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.Run(); err != nil {
+		t.Fatal(err)
+	}
+	check("LoadCompiled", loaded)
+
+	cache := t.TempDir()
+	for _, how := range []string{"cache miss", "cache hit"} {
+		env := NewGlisp()
+		env.SetImportCache(cache)
+		if _, err := env.EvalString(fmt.Sprintf("(import %q)", lib)); err != nil {
+			t.Fatal(err)
+		}
+		check(how, env)
+	}
+}
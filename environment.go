@@ -3,13 +3,15 @@ package glisp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strconv"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type PreHook func(*Glisp, string, []Sexp)
@@ -21,47 +23,64 @@ type Glisp struct {
 	scopestack   *Stack
 	addrstack    *Stack
 	stackstack   *Stack
-	symtable     map[string]int
-	revsymtable  map[int]string
-	builtins     map[int]SexpFunction
-	macros       map[int]SexpFunction
+	handlers     *Stack
+	globals      *GlobalScope
+	symbols      *symbolTable
+	builtins     map[int]SexpFunction // read only once NewGlisp is done
+	registry     *registry
 	curfunc      SexpFunction
 	mainfunc     SexpFunction
 	pc           int
-	nextsymbol   int
-	before       []PreHook
-	after        []PostHook
+	rundepth     int
+	before       []preHook
+	after        []postHook
+	tracers      []tracer
+	calls        []*CallEvent // the traced calls that haven't returned
 	queueLock    *sync.Mutex
-	queued       []QueueRun
+	queued       *[]QueueRun // shared with clones and duplicates
 	queuedDrain  bool
 	queuedHas    *atomic.Bool
 	queuedSignal *WaitCond
-	imports      map[string]struct{}
+	ctx          context.Context
+	stopping     atomic.Bool
+	stopReason   error
+	budget       int
+	steps        int
+	timeout      time.Duration
+	sandbox      *sandbox
+	importCache  string
+	includes     *[]sourceFile // the files the cached include being compiled takes in
+	optLevel     int
+	debugger     *Debugger
+	profiler     *Profiler
+	out          io.Writer // where print writes, nil for os.Stdout
 }
 
 const CallStackSize = 25
 const ScopeStackSize = 50
+const CallScopeSize = 8 // a call's frame, lets and loops before its scope stack grows
 const DataStackSize = 100
 const StackStackSize = 5
+const HandlerStackSize = 5
 
 func NewGlisp() *Glisp {
 	env := new(Glisp)
 	env.datastack = NewStack(DataStackSize)
+	env.globals = NewGlobalScope()
 	env.scopestack = NewStack(ScopeStackSize)
-	env.scopestack.PushScope()
+	env.scopestack.Push(env.globals)
 	env.stackstack = NewStack(StackStackSize)
 	env.addrstack = NewStack(CallStackSize)
+	env.handlers = NewStack(HandlerStackSize)
+	env.symbols = newSymbolTable()
 	env.builtins = make(map[int]SexpFunction)
-	env.macros = make(map[int]SexpFunction)
-	env.symtable = make(map[string]int)
-	env.revsymtable = make(map[int]string)
-	env.nextsymbol = 1
-	env.before = []PreHook{}
-	env.after = []PostHook{}
+	env.registry = newRegistry()
 	env.queueLock = &sync.Mutex{}
-	env.queued = make([]QueueRun, 0, 3)
+	queued := make([]QueueRun, 0, 3)
+	env.queued = &queued
 	env.queuedHas = &atomic.Bool{}
 	env.queuedSignal = NewWaitCond()
+	env.optLevel = DefaultOptLevel
 
 	for key, function := range BuiltinFunctions {
 		sym := env.MakeSymbol(key)
@@ -72,7 +91,6 @@ func NewGlisp() *Glisp {
 	env.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
 	env.curfunc = env.mainfunc
 	env.pc = 0
-	env.imports = make(map[string]struct{})
 	return env
 }
 
@@ -83,70 +101,75 @@ func (env *Glisp) Clone() *Glisp {
 	dupenv.stackstack = env.stackstack.Clone()
 	dupenv.scopestack = env.scopestack.Clone()
 	dupenv.addrstack = env.addrstack.Clone()
+	dupenv.handlers = env.handlers.Clone()
 
+	dupenv.globals = env.globals
+	dupenv.symbols = env.symbols
 	dupenv.builtins = env.builtins
-	dupenv.macros = env.macros
-	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
+	dupenv.registry = env.registry
 	dupenv.before = env.before
 	dupenv.after = env.after
+	dupenv.tracers = env.tracers
 	dupenv.queueLock = env.queueLock
 	dupenv.queued = env.queued
 	dupenv.queuedHas = env.queuedHas
 	dupenv.queuedSignal = env.queuedSignal
 
-	dupenv.scopestack.Push(env.scopestack.elements[0])
+	dupenv.scopestack.Push(env.globals)
 
 	dupenv.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
 	dupenv.curfunc = dupenv.mainfunc
 	dupenv.pc = 0
-	dupenv.imports = env.imports
+	dupenv.ctx = env.ctx
+	dupenv.sandbox = env.sandbox
+	dupenv.importCache = env.importCache
+	dupenv.optLevel = env.optLevel
+	dupenv.out = env.out
 	return dupenv
 }
 
 func (env *Glisp) Duplicate() *Glisp {
+	return env.duplicate(env.globals, env.registry)
+}
+
+func (env *Glisp) duplicate(globals *GlobalScope, reg *registry) *Glisp {
 	dupenv := new(Glisp)
 	dupenv.datastack = NewStack(DataStackSize)
 	dupenv.scopestack = NewStack(ScopeStackSize)
 	dupenv.stackstack = NewStack(StackStackSize)
 	dupenv.addrstack = NewStack(CallStackSize)
+	dupenv.handlers = NewStack(HandlerStackSize)
+	dupenv.globals = globals
+	dupenv.symbols = env.symbols
 	dupenv.builtins = env.builtins
-	dupenv.macros = env.macros
-	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
+	dupenv.registry = reg
 	dupenv.before = env.before
 	dupenv.after = env.after
+	dupenv.tracers = env.tracers
 	dupenv.queueLock = env.queueLock
 	dupenv.queued = env.queued
 	dupenv.queuedHas = env.queuedHas
 	dupenv.queuedSignal = env.queuedSignal
 
-	dupenv.scopestack.Push(env.scopestack.elements[0])
+	dupenv.scopestack.Push(globals)
 
 	dupenv.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
 	dupenv.curfunc = dupenv.mainfunc
 	dupenv.pc = 0
-	dupenv.imports = env.imports
+	dupenv.ctx = env.ctx
+	dupenv.sandbox = env.sandbox
+	dupenv.importCache = env.importCache
+	dupenv.optLevel = env.optLevel
+	dupenv.out = env.out
 	return dupenv
 }
 
 func (env *Glisp) MakeSymbol(name string) SexpSymbol {
-	symnum, ok := env.symtable[name]
-	if ok {
-		return SexpSymbol{name, symnum}
-	}
-	symbol := SexpSymbol{name, env.nextsymbol}
-	env.symtable[name] = symbol.number
-	env.revsymtable[symbol.number] = name
-	env.nextsymbol++
-	return symbol
+	return SexpSymbol{name, env.symbols.intern(name)}
 }
 
 func (env *Glisp) GenSymbol(prefix string) SexpSymbol {
-	symname := prefix + strconv.Itoa(env.nextsymbol)
-	return env.MakeSymbol(symname)
+	return env.symbols.gensym(prefix)
 }
 
 func (env *Glisp) CurrentFunctionSize() int {
@@ -175,21 +198,63 @@ func (env *Glisp) wrangleOptargs(fnargs, nargs int) error {
 }
 
 func (env *Glisp) CallFunction(function SexpFunction, nargs int) error {
+	var call *CallEvent
+	if len(env.tracers) > 0 {
+		call = env.traceCall(function.name, nargs, false)
+	}
+	scopestack, err := env.functionScopes(function, nargs)
+	if err != nil {
+		return err
+	}
+	env.stackstack.Push(env.scopestack)
+	env.addrstack.PushAddr(env.curfunc, env.pc+1)
+	env.scopestack = scopestack
+	env.curfunc = function
+	env.pc = 0
+	if call != nil {
+		env.traceEnter(call)
+	}
+	return nil
+}
+
+// TailCallFunction calls function in place of the current one, it takes
+// over our frame and returns straight to our caller
+func (env *Glisp) TailCallFunction(function SexpFunction, nargs int) error {
+	var call *CallEvent
+	if len(env.tracers) > 0 {
+		call = env.traceCall(function.name, nargs, false)
+	}
+	scopestack, err := env.functionScopes(function, nargs)
+	if err != nil {
+		return err
+	}
+	env.scopestack = scopestack
+	env.curfunc = function
+	env.pc = 0
+	if call != nil {
+		env.traceTail(call)
+	}
+	return nil
+}
+
+// functionScopes checks the arguments for a call to function and builds
+// the scope stack it runs with
+func (env *Glisp) functionScopes(function SexpFunction, nargs int) (*Stack, error) {
 	for _, prehook := range env.before {
 		expressions, err := env.datastack.GetExpressions(nargs)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		prehook(env, function.name, expressions)
+		prehook.fn(env, function.name, expressions)
 	}
 
 	if function.varargs {
 		err := env.wrangleOptargs(function.nargs, nargs)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	} else if nargs != function.nargs {
-		return errors.New(
+		return nil, errors.New(
 			fmt.Sprintf("%s expected %d arguments, got %d hmm(%v)",
 				function.name, function.nargs, nargs, StrFunction(function.fun)))
 	}
@@ -197,20 +262,23 @@ func (env *Glisp) CallFunction(function SexpFunction, nargs int) error {
 	if env.scopestack.IsEmpty() {
 		panic("where's the global scope?")
 	}
-	globalScope := env.scopestack.elements[0]
-	env.stackstack.Push(env.scopestack)
-	env.scopestack = NewStack(ScopeStackSize)
-	env.scopestack.Push(globalScope)
+	size := CallScopeSize
+	if function.closeScope != nil {
+		size += function.closeScope.tos + 1
+	}
+	scopestack := NewStack(size)
+	scopestack.Push(env.globals)
 
 	if function.closeScope != nil {
-		function.closeScope.PushAllTo(env.scopestack)
+		function.closeScope.PushAllTo(scopestack)
 	}
 
-	env.addrstack.PushAddr(env.curfunc, env.pc+1)
-	env.scopestack.PushScope()
-	env.curfunc = function
-	env.pc = 0
-	return nil
+	var frame []SexpSymbol
+	if function.info != nil {
+		frame = function.info.frame
+	}
+	scopestack.PushFrame(frame)
+	return scopestack, nil
 }
 
 func (env *Glisp) ReturnFromFunction() error {
@@ -219,7 +287,14 @@ func (env *Glisp) ReturnFromFunction() error {
 		if err != nil {
 			return err
 		}
-		posthook(env, env.curfunc.name, retval)
+		posthook.fn(env, env.curfunc.name, retval)
+	}
+	if len(env.calls) > 0 {
+		retval, err := env.datastack.GetExpr(0)
+		if err != nil {
+			return err
+		}
+		env.traceReturn(retval)
 	}
 
 	var err error
@@ -237,12 +312,16 @@ func (env *Glisp) ReturnFromFunction() error {
 }
 
 func (env *Glisp) CallUserFunction(function SexpFunction, name string, nargs int) error {
+	var call *CallEvent
+	if len(env.tracers) > 0 {
+		call = env.traceCall(function.name, nargs, true)
+	}
 	for _, prehook := range env.before {
 		expressions, err := env.datastack.GetExpressions(nargs)
 		if err != nil {
 			return err
 		}
-		prehook(env, function.name, expressions)
+		prehook.fn(env, function.name, expressions)
 	}
 
 	args, err := env.datastack.PopExpressions(nargs)
@@ -254,16 +333,25 @@ func (env *Glisp) CallUserFunction(function SexpFunction, name string, nargs int
 	env.addrstack.PushAddr(env.curfunc, env.pc+1)
 	env.curfunc = function
 	env.pc = -1
+	if call != nil {
+		env.traceEnter(call)
+	}
 
 	res, err := function.userfun(env, name, args)
 	if err != nil {
-		return errors.New(
-			fmt.Sprintf("Error calling %s: %v", name, err))
+		err = &CallError{name, err}
+		if call != nil {
+			env.traceUnwind(call.Depth, err)
+		}
+		return err
 	}
 	env.datastack.PushExpr(res)
 
 	for _, posthook := range env.after {
-		posthook(env, name, res)
+		posthook.fn(env, function.name, res)
+	}
+	if call != nil {
+		env.traceReturn(res)
 	}
 
 	env.curfunc, env.pc, _ = env.addrstack.PopAddr()
@@ -271,14 +359,19 @@ func (env *Glisp) CallUserFunction(function SexpFunction, name string, nargs int
 }
 
 func (env *Glisp) ParseStream(in io.Reader) ([]Sexp, error) {
-	lexer := NewLexerFromStream(bufio.NewReader(in))
+	return env.ParseNamedStream(in, "")
+}
+
+// ParseNamedStream, same as ParseStream but source positions refer to file
+func (env *Glisp) ParseNamedStream(in io.Reader, file string) ([]Sexp, error) {
+	lexer := NewLexerFromFile(bufio.NewReader(in), file)
 
 	var err error
 	var exp []Sexp
 
 	exp, err = ParseTokens(env, lexer)
 	if err != nil {
-		return nil, fmt.Errorf("Error on line %d: %v\n", lexer.Linenum(), err)
+		return nil, fmt.Errorf("Error at %s: %w\n", lexer.Pos(), err)
 	}
 
 	return exp, nil
@@ -293,7 +386,7 @@ func (env *Glisp) ParseFile(file string) ([]Sexp, error) {
 
 	var exp []Sexp
 
-	exp, err = env.ParseStream(in)
+	exp, err = env.ParseNamedStream(in, file)
 
 	in.Close()
 
@@ -309,11 +402,13 @@ func (env *Glisp) SourceExpressions(expressions []Sexp) error {
 	if err != nil {
 		return err
 	}
+	gen.optimize()
 
 	curfunc := env.curfunc
 	curpc := env.pc
 
 	env.curfunc = MakeFunction("__source", 0, false, gen.instructions)
+	env.curfunc.info.positions = gen.positions
 	env.pc = 0
 
 	env.datastack.PushExpr(SexpNull)
@@ -342,7 +437,13 @@ func (env *Glisp) SourceStream(stream io.Reader) error {
 }
 
 func (env *Glisp) SourceFile(file *os.File) error {
-	return env.SourceStream(bufio.NewReader(file))
+	expressions, err := env.ParseNamedStream(file, file.Name())
+
+	if err != nil {
+		return err
+	}
+
+	return env.SourceExpressions(expressions)
 }
 
 func (env *Glisp) LoadExpressions(expressions []Sexp) error {
@@ -354,8 +455,12 @@ func (env *Glisp) LoadExpressions(expressions []Sexp) error {
 	if err != nil {
 		return err
 	}
+	gen.optimize()
 
 	env.mainfunc.fun = append(env.mainfunc.fun, gen.instructions...)
+	env.mainfunc.info = &funcInfo{
+		positions: append(env.mainfunc.info.positions, gen.positions...),
+	}
 	env.curfunc = env.mainfunc
 
 	return nil
@@ -382,7 +487,13 @@ func (env *Glisp) EvalString(str string) (Sexp, error) {
 }
 
 func (env *Glisp) LoadFile(file *os.File) error {
-	return env.LoadStream(bufio.NewReader(file))
+	expressions, err := env.ParseNamedStream(file, file.Name())
+
+	if err != nil {
+		return err
+	}
+
+	return env.LoadExpressions(expressions)
 }
 
 func (env *Glisp) LoadString(str string) error {
@@ -394,13 +505,12 @@ func (env *Glisp) AddFunction(name string, function GlispUserFunction) {
 }
 
 func (env *Glisp) AddGlobal(name string, obj Sexp) {
-	sym := env.MakeSymbol(name)
-	env.scopestack.elements[0].(Scope)[sym.number] = obj
+	env.globals.bind(env.MakeSymbol(name), obj)
 }
 
 func (env *Glisp) AddMacro(name string, function GlispUserFunction) {
 	sym := env.MakeSymbol(name)
-	env.macros[sym.number] = MakeUserFunction(name, function)
+	env.registry.setMacro(sym, MakeUserFunction(name, function))
 }
 
 func (env *Glisp) ImportEval() {
@@ -460,20 +570,69 @@ func (env *Glisp) ReachedEnd() bool {
 }
 
 func (env *Glisp) GetStackTrace(err error) string {
-	str := fmt.Sprintf("error in %s:%d: %v\n",
-		env.curfunc.name, env.pc, err)
+	var str string
+	if _, ok := err.(*PositionError); ok {
+		str = fmt.Sprintf("error in %s: %v\n", env.curfunc.name, err)
+	} else {
+		str = fmt.Sprintf("error in %s:%d: %v\n",
+			env.curfunc.name, env.pc, err)
+	}
 	for !env.addrstack.IsEmpty() {
 		fun, pos, _ := env.addrstack.PopAddr()
-		str += fmt.Sprintf("in %s:%d\n", fun.name, pos)
+		// pos is the return address, the call is just before it
+		if source := fun.Position(pos - 1); source != nil {
+			str += fmt.Sprintf("in %s at %s\n", fun.name, source)
+		} else {
+			str += fmt.Sprintf("in %s:%d\n", fun.name, pos)
+		}
 	}
 	return str
 }
 
+// errorPos finds the source of the instruction that just failed
+func (env *Glisp) errorPos() *SourcePos {
+	if env.curfunc.user {
+		// a builtin failed, whoever called it is still on the addrstack
+		elem, err := env.addrstack.Get(0)
+		if err != nil {
+			return nil
+		}
+		addr := elem.(Address)
+		return addr.function.Position(addr.position - 1)
+	}
+	return env.curfunc.Position(env.pc)
+}
+
+// positionError tags err with where it was raised, unless it already
+// knows (an error thrown again keeps its first position)
+func (env *Glisp) positionError(err error) error {
+	if _, ok := err.(*PositionError); ok {
+		return err
+	}
+	pos := env.errorPos()
+	if pos == nil {
+		return err
+	}
+	return &PositionError{*pos, err}
+}
+
 func (env *Glisp) Clear() {
+	env.reset(MakeFunction("__main", 0, false, make([]Instruction, 0)))
+}
+
+// reset empties the stacks and makes main the function to run
+func (env *Glisp) reset(main SexpFunction) {
+	if !env.stackstack.IsEmpty() {
+		// an error left us in some function's scopes, go back to the outermost
+		env.scopestack = env.stackstack.elements[0].(*Stack)
+	}
 	env.datastack.tos = -1
 	env.scopestack.tos = 0
 	env.addrstack.tos = -1
-	env.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
+	env.stackstack.tos = -1
+	env.handlers.tos = -1
+	env.calls = nil
+	env.mainfunc = main
 	env.curfunc = env.mainfunc
 	env.pc = 0
 }
@@ -487,14 +646,55 @@ func (env *Glisp) FindObject(name string) (Sexp, bool) {
 	return obj, true
 }
 
+// GlobalNames lists what's bound globally, builtins and macros included,
+// along with the special forms, sorted
+func (env *Glisp) GlobalNames() []string {
+	seen := make(map[string]bool)
+	for _, name := range SpecialForms {
+		seen[name] = true
+	}
+	for _, sym := range env.symbols.all() {
+		if seen[sym.name] {
+			continue
+		}
+		_, builtin := env.builtins[sym.number]
+		_, global := env.globals.lookup(sym)
+		_, macro := env.registry.macro(sym)
+		if builtin || global || macro {
+			seen[sym.name] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (env *Glisp) SwapObject(sym SexpSymbol, to Sexp) error {
 	return env.scopestack.SwapSymbol(sym, to)
 }
 
+// SetOutput sends what print and println write to w, nil goes back to
+// os.Stdout. Clones and duplicates made afterwards write there too.
+func (env *Glisp) SetOutput(w io.Writer) {
+	env.out = w
+}
+
+// Output is where print and println write
+func (env *Glisp) Output() io.Writer {
+	if env.out == nil {
+		return os.Stdout
+	}
+	return env.out
+}
+
 func (env *Glisp) QueueRun(fn QueueRun) {
 	env.queueLock.Lock()
 	env.queuedHas.Store(true)
-	env.queued = append(env.queued, fn)
+	*env.queued = append(*env.queued, fn)
 	env.queueLock.Unlock()
 	env.queuedSignal.Signal()
 }
@@ -545,12 +745,28 @@ func (env *Glisp) Finish() (Sexp, error) {
 
 func (env *Glisp) Step() (Sexp, error) {
 	if !env.IsDone() {
+		if err := env.checkInterrupt(); err != nil {
+			return nil, err
+		}
+		if env.debugger != nil {
+			env.debugger.check()
+		}
+		if env.profiler != nil {
+			env.profiler.step()
+		}
+
 		instr := env.curfunc.fun[env.pc]
 
 		err := instr.Execute(env)
 
 		if err != nil {
-			return nil, err
+			if env.catch(err) {
+				if len(env.calls) > 0 {
+					env.traceUnwind(env.callDepth()+1, err)
+				}
+				return nil, nil
+			}
+			return nil, env.positionError(err)
 		}
 	}
 
@@ -572,9 +788,9 @@ func (env *Glisp) CallQueued() bool {
 
 	env.queueLock.Lock()
 	env.queuedHas.Store(false)
-	run := make([]QueueRun, len(env.queued))
-	copy(run, env.queued)
-	env.queued = env.queued[:0]
+	run := make([]QueueRun, len(*env.queued))
+	copy(run, *env.queued)
+	*env.queued = (*env.queued)[:0]
 	env.queueLock.Unlock()
 
 	env.queuedDrain = true
@@ -586,24 +802,37 @@ func (env *Glisp) CallQueued() bool {
 	return true
 }
 
+// Run executes until the current function is done. The outermost Run
+// goes through RunContext so the budget and timeout apply.
 func (env *Glisp) Run() (Sexp, error) {
+	if env.rundepth == 0 {
+		ctx := env.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		return env.RunContext(ctx)
+	}
+	return env.run()
+}
+
+func (env *Glisp) run() (Sexp, error) {
 	var exp Sexp
 	var err error
 
+	env.rundepth++
+	defer func() { env.rundepth-- }()
+	// the calls this run is in, an error it returns unwinds them
+	depth := env.callDepth()
+
 	for !env.IsDone() {
 		exp, err = env.Step()
 		if err != nil {
+			if len(env.calls) > 0 {
+				env.traceUnwind(depth, err)
+			}
 			return SexpNull, err
 		}
 	}
 
 	return exp, err
 }
-
-func (env *Glisp) AddPreHook(fun PreHook) {
-	env.before = append(env.before, fun)
-}
-
-func (env *Glisp) AddPostHook(fun PostHook) {
-	env.after = append(env.after, fun)
-}
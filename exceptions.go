@@ -0,0 +1,250 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CallError is returned when a Go builtin fails, it remembers which
+// function the error came out of.
+type CallError struct {
+	Function string
+	Err      error
+}
+
+func (c *CallError) Error() string {
+	return fmt.Sprintf("Error calling %s: %v", c.Function, c.Err)
+}
+
+func (c *CallError) Unwrap() error {
+	return c.Err
+}
+
+// ThrownError carries a value raised by throw until a catch picks it up.
+type ThrownError struct {
+	Value Sexp
+}
+
+func (t ThrownError) Error() string {
+	return "uncaught throw: " + t.Value.SexpString()
+}
+
+// ExitError is returned by exit, it ends the program with Code for the
+// host to pass on. Like a cancel it can't be caught by try.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// SexpError is what catch binds when the error wasn't thrown by script code,
+// i.e. a Go error out of a builtin or a failing instruction.
+type SexpError struct {
+	message  string
+	function string
+	err      error
+}
+
+func (e SexpError) SexpString() string {
+	return fmt.Sprintf("(error %q %q)", e.function, e.message)
+}
+
+func (e SexpError) Message() string {
+	return e.message
+}
+
+func (e SexpError) Function() string {
+	return e.function
+}
+
+func (e SexpError) Err() error {
+	return e.err
+}
+
+// Handler is pushed by try, it holds everything needed to unwind the
+// vm back to the try when an error is raised inside it.
+type Handler struct {
+	function   SexpFunction
+	catchpc    int
+	rundepth   int
+	datatop    int
+	scopestack *Stack
+	scopetop   int
+	addrtop    int
+	stacktop   int
+}
+
+func (h Handler) IsStackElem() {}
+
+func (stack *Stack) PushHandler(h Handler) {
+	stack.Push(h)
+}
+
+func (stack *Stack) PopHandler() (Handler, error) {
+	elem, err := stack.Pop()
+	if err != nil {
+		return Handler{}, err
+	}
+	return elem.(Handler), nil
+}
+
+// ErrorValue turns an error raised while running into the value a catch
+// clause sees.
+func (env *Glisp) ErrorValue(err error) Sexp {
+	var thrown ThrownError
+	if errors.As(err, &thrown) {
+		return thrown.Value
+	}
+
+	sexperr := SexpError{message: err.Error(), function: env.curfunc.name, err: err}
+
+	// the innermost builtin is where the error really came from
+	inner := err
+	for {
+		switch e := inner.(type) {
+		case *CallError:
+			sexperr.function = e.Function
+			inner = e.Err
+			continue
+		case *PositionError:
+			inner = e.Err
+			continue
+		}
+		break
+	}
+	sexperr.message = inner.Error()
+	return sexperr
+}
+
+// catch unwinds to the innermost handler, if it belongs to this run, and
+// leaves the error value on the datastack for the catch clause
+func (env *Glisp) catch(err error) bool {
+	var exit *ExitError
+	if env.handlers.IsEmpty() || errors.Is(err, ErrCancelled) || errors.As(err, &exit) {
+		return false
+	}
+	elem, _ := env.handlers.Get(0)
+	h := elem.(Handler)
+	if h.rundepth != env.rundepth {
+		// raised inside a builtin's Apply, let the builtin see the error
+		return false
+	}
+	env.handlers.Pop()
+
+	value := env.ErrorValue(err)
+
+	env.datastack.tos = h.datatop
+	env.scopestack = h.scopestack
+	env.scopestack.tos = h.scopetop
+	env.addrstack.tos = h.addrtop
+	env.stackstack.tos = h.stacktop
+	env.curfunc = h.function
+	env.pc = h.catchpc
+
+	env.datastack.PushExpr(value)
+	return true
+}
+
+// TryApply is Apply for builtins that carry on when fun fails, the env is
+// put back the way it was before the call, like a catch would
+func (env *Glisp) TryApply(fun SexpFunction, args []Sexp) (Sexp, error) {
+	h := Handler{
+		function:   env.curfunc,
+		catchpc:    env.pc,
+		datatop:    env.datastack.tos,
+		scopestack: env.scopestack,
+		scopetop:   env.scopestack.tos,
+		addrtop:    env.addrstack.tos,
+		stacktop:   env.stackstack.tos,
+	}
+	handlers := env.handlers.tos
+
+	res, err := env.Apply(fun, args)
+	if err != nil {
+		env.datastack.tos = h.datatop
+		env.scopestack = h.scopestack
+		env.scopestack.tos = h.scopetop
+		env.addrstack.tos = h.addrtop
+		env.stackstack.tos = h.stacktop
+		env.handlers.tos = handlers
+		env.curfunc = h.function
+		env.pc = h.catchpc
+	}
+	return res, err
+}
+
+type TryInstr struct {
+	location int
+}
+
+func (t TryInstr) InstrString() string {
+	return fmt.Sprintf("try %d", t.location)
+}
+
+func (t TryInstr) Execute(env *Glisp) error {
+	env.handlers.PushHandler(Handler{
+		function:   env.curfunc,
+		catchpc:    env.pc + t.location,
+		rundepth:   env.rundepth,
+		datatop:    env.datastack.tos,
+		scopestack: env.scopestack,
+		scopetop:   env.scopestack.tos,
+		addrtop:    env.addrstack.tos,
+		stacktop:   env.stackstack.tos,
+	})
+	env.pc++
+	return nil
+}
+
+type EndTryInstr int
+
+func (e EndTryInstr) InstrString() string {
+	return "endtry"
+}
+
+func (e EndTryInstr) Execute(env *Glisp) error {
+	_, err := env.handlers.PopHandler()
+	env.pc++
+	return err
+}
+
+type ThrowInstr int
+
+func (t ThrowInstr) InstrString() string {
+	return "throw"
+}
+
+func (t ThrowInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	// rethrowing a caught Go error raises the original again
+	if sexperr, ok := expr.(SexpError); ok && sexperr.err != nil {
+		return sexperr.err
+	}
+	return ThrownError{expr}
+}
+
+func ErrorFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+
+	sexperr, ok := args[0].(SexpError)
+	switch name {
+	case "error?":
+		return SexpBool(ok), nil
+	case "error-message":
+		if ok {
+			return SexpStr(sexperr.message), nil
+		}
+	case "error-fn":
+		if ok {
+			return SexpStr(sexperr.function), nil
+		}
+	}
+	return SexpNull, fmt.Errorf("%s expected error got %T", name, args[0])
+}
@@ -37,10 +37,16 @@ func (sent SexpSentinel) SexpString() string {
 type SexpPair struct {
 	head Sexp
 	tail Sexp
+	pos  *SourcePos // set by the parser on the first pair of a list
 }
 
 func Cons(a Sexp, b Sexp) SexpPair {
-	return SexpPair{a, b}
+	return SexpPair{head: a, tail: b}
+}
+
+// Pos is where the parser read this list from, nil if it was built at runtime
+func (pair SexpPair) Pos() *SourcePos {
+	return pair.pos
 }
 
 func (pair SexpPair) Head() Sexp {
@@ -189,12 +195,48 @@ type SexpFunction struct {
 	fun        GlispFunction
 	userfun    GlispUserFunction
 	closeScope *Stack
+	info       *funcInfo // nil for builtins
+}
+
+// funcInfo is what the generator knows about a function's code, kept
+// behind a pointer since SexpFunctions get copied onto the addrstack
+type funcInfo struct {
+	positions []*SourcePos // source of each instruction in fun
+	frame     []SexpSymbol // slot layout of the frame a call pushes
+	params    []string     // as written, & and all
+	doc       string       // the docstring of a defn
 }
 
 func (sf SexpFunction) SexpString() string {
 	return "fn [" + sf.name + "]"
 }
 
+func (sf SexpFunction) Name() string {
+	return sf.name
+}
+
+// Builtin is true for functions written in Go
+func (sf SexpFunction) Builtin() bool {
+	return sf.user
+}
+
+// Doc is the docstring of a defn, builtins are documented by LookupDoc
+func (sf SexpFunction) Doc() string {
+	if sf.info == nil {
+		return ""
+	}
+	return sf.info.doc
+}
+
+// Signature is how the function is called, like (f x & rest). Functions
+// written in Go can't tell, they're (f ...).
+func (sf SexpFunction) Signature() string {
+	if sf.user || sf.info == nil {
+		return "(" + sf.name + " ...)"
+	}
+	return "(" + strings.Join(append([]string{sf.name}, sf.info.params...), " ") + ")"
+}
+
 func IsTruthy(expr Sexp) bool {
 	switch e := expr.(type) {
 	case SexpBool:
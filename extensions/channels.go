@@ -50,11 +50,20 @@ func ChanTxFunction(env *glisp.Glisp, name string,
 		if len(args) != 2 {
 			return glisp.SexpNull, glisp.WrongNargs
 		}
-		channel <- args[1]
+		select {
+		case channel <- args[1]:
+		case <-env.Done():
+			return glisp.SexpNull, env.Interrupted()
+		}
 		return glisp.SexpNull, nil
 	}
 
-	return <-channel, nil
+	select {
+	case val := <-channel:
+		return val, nil
+	case <-env.Done():
+		return glisp.SexpNull, env.Interrupted()
+	}
 }
 
 func ImportChannels(env *glisp.Glisp) {
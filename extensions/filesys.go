@@ -12,6 +12,15 @@ import (
 )
 
 func currentDir(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+	if env.Sandboxed() {
+		// the jail root stands in for the working dir
+		root, err := env.SandboxPath(".")
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		return glisp.SexpStr(root), nil
+	}
+
 	dir, err := os.Getwd()
 	if err != nil {
 		return glisp.SexpNull, err
@@ -26,6 +35,10 @@ func changeDir(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, er
 
 	var err error
 
+	if env.Sandboxed() {
+		return glisp.SexpNull, glisp.ErrSandbox
+	}
+
 	switch t := args[0].(type) {
 	case glisp.SexpStr:
 		err = os.Chdir(string(t))
@@ -49,6 +62,15 @@ func readDir(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, erro
 		path = string(pathA)
 	}
 
+	if env.Sandboxed() {
+		if path == "" {
+			path = "."
+		}
+		if path, err = env.SandboxPath(path); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
+
 	if path == "" {
 		path, err = os.Getwd()
 		if err != nil {
@@ -94,7 +116,13 @@ func walkDir(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, erro
 		return glisp.SexpNull, fmt.Errorf("argument to %s must be a `fun [fileInfo]`", name)
 	}
 
-	dir, err := os.Getwd()
+	var dir string
+	var err error
+	if env.Sandboxed() {
+		dir, err = env.SandboxPath(".")
+	} else {
+		dir, err = os.Getwd()
+	}
 	if err != nil {
 		return glisp.SexpNull, err
 	}
@@ -226,9 +254,12 @@ func readFile(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, err
 		max = int64(m)
 	}
 
-	var err error
+	path, err := env.SandboxPath(string(fileName))
+	if err != nil {
+		return glisp.SexpNull, err
+	}
 	
-	stat, err := os.Stat(string(fileName))
+	stat, err := os.Stat(path)
 	if err != nil {
 		return glisp.SexpNull, err
 	}
@@ -237,7 +268,7 @@ func readFile(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, err
 		max = stat.Size() - offset
 	}
 
-	f, err := os.Open(string(fileName))	
+	f, err := os.Open(path)	
 	if err != nil {
 		return glisp.SexpNull, err
 	}
@@ -299,9 +330,12 @@ func readStreamFile(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sex
 		max = int64(m)
 	}
 
-	var err error
+	path, err := env.SandboxPath(string(fileName))
+	if err != nil {
+		return glisp.SexpNull, err
+	}
 	
-	stat, err := os.Stat(string(fileName))
+	stat, err := os.Stat(path)
 	if err != nil {
 		return glisp.SexpNull, err
 	}
@@ -310,7 +344,7 @@ func readStreamFile(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sex
 		max = stat.Size() - offset
 	}
 
-	f, err := os.Open(string(fileName))	
+	f, err := os.Open(path)	
 	if err != nil {
 		return glisp.SexpNull, err
 	}
@@ -372,7 +406,12 @@ func appendStreamFile(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.S
 		return glisp.SexpNull, fmt.Errorf("expected `function` got %T; for arg 1 (stream-fn)", args[1])
 	}
 
-	f, err := os.OpenFile(string(fileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)	
+	path, err := env.SandboxPath(string(fileName))
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)	
 	if err != nil {
 		return glisp.SexpNull, err
 	}
@@ -427,7 +466,12 @@ func appendFile(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, e
 		return glisp.SexpNull, fmt.Errorf("expected `string` got %T; for arg 0 (filename)", args[0])
 	}
 
-	f, err := os.OpenFile(string(fileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)	
+	path, err := env.SandboxPath(string(fileName))
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)	
 	if err != nil {
 		return glisp.SexpNull, err
 	}
@@ -467,7 +511,12 @@ func removeFile(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, e
 			return glisp.SexpNull, fmt.Errorf("invalid arg(%v) %T passed, expected string", i, arg)
 		}
 
-		err := os.Remove(string(file))
+		path, err := env.SandboxPath(string(file))
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+
+		err = os.Remove(path)
 		if err != nil {
 			return glisp.SexpNull, fmt.Errorf("arg(%v); error removing file %v; err %v", i, arg, err)
 		}
@@ -484,7 +533,12 @@ func truncFile(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, er
 			return glisp.SexpNull, fmt.Errorf("invalid arg(%v) %T passed, expected string", i, arg)
 		}
 
-		err := os.Truncate(string(file), 0)
+		path, err := env.SandboxPath(string(file))
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+
+		err = os.Truncate(path, 0)
 		if err != nil {
 			ret[i] = glisp.SexpBool(false)
 		} else {
@@ -502,7 +556,12 @@ func fileExists(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, e
 			return glisp.SexpNull, fmt.Errorf("invalid arg(%v) %T passed, expected string", i, arg)
 		}
 
-		stat, err := os.Stat(string(file))
+		path, err := env.SandboxPath(string(file))
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+
+		stat, err := os.Stat(path)
 		if os.IsNotExist(err) {
 			return glisp.SexpBool(false), nil
 		}
@@ -525,7 +584,12 @@ func fileInfo(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, err
 			return glisp.SexpNull, fmt.Errorf("invalid arg(%v) %T passed, expected string", i, arg)
 		}
 
-		info, err := os.Stat(string(file))
+		path, err := env.SandboxPath(string(file))
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+
+		info, err := os.Stat(path)
 
 		ginfo, _ := glisp.MakeHash(nil, "FileInfo")
 
@@ -689,7 +753,12 @@ func pathCreate(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, e
 		target = filepath.Join(target, string(s))
 	}
 
-	err := os.MkdirAll(target, 0755)
+	target, err := env.SandboxPath(target)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	err = os.MkdirAll(target, 0755)
 	if err != nil {
 		return glisp.SexpBool(false), nil
 	}
@@ -706,10 +775,23 @@ func createTempFile(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sex
 
 	var f *os.File
 	var err error
+
+	// sandboxed temp files live in the jail
+	dir := os.TempDir()
+	if env.Sandboxed() {
+		if dir, err = env.SandboxPath("."); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
+
 	if strings.Contains(pat, "*") {
-		f, err = os.CreateTemp("", pat)
+		f, err = os.CreateTemp(dir, pat)
 	} else {
-		f, err = os.Create(filepath.Join(os.TempDir(), pat))
+		var path string
+		if path, err = env.SandboxPath(filepath.Join(dir, pat)); err != nil {
+			return glisp.SexpNull, err
+		}
+		f, err = os.Create(path)
 	}
 
 	if err != nil {
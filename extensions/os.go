@@ -435,9 +435,21 @@ func execSpawn(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, er
 		return glisp.SexpNull, err
 	}
 
+	if err := env.SandboxCommand(cmds[0]); err != nil {
+		return glisp.SexpNull, err
+	}
+
 	cmd := exec.Command(cmds[0], cmds[1:]...)
 
 	cmd.Env = os.Environ()
+	if env.Sandboxed() {
+		// don't hand the host environment to the child
+		cmd.Env = []string{}
+		// it runs in the sandbox's root, a sandbox without one can't run it
+		if cmd.Dir, err = env.SandboxPath("."); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
 
 	for _, line := range args[1:] {
 		if sline, ok := line.(glisp.SexpStr); ok {
@@ -463,9 +475,21 @@ func execFunction(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp,
 		return glisp.SexpNull, err
 	}
 
+	if err := env.SandboxCommand(cmds[0]); err != nil {
+		return glisp.SexpNull, err
+	}
+
 	cmd := exec.Command(cmds[0], cmds[1:]...)
 
 	cmd.Env = os.Environ()
+	if env.Sandboxed() {
+		// don't hand the host environment to the child
+		cmd.Env = []string{}
+		// it runs in the sandbox's root, a sandbox without one can't run it
+		if cmd.Dir, err = env.SandboxPath("."); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
 
 	info, _ := glisp.MakeHash(nil, "ExecResult")
 
@@ -510,6 +534,10 @@ func lookPathFunction(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.S
 		return glisp.SexpNull, fmt.Errorf("Expected string arg")
 	}
 
+	if err := env.SandboxCommand(string(args[0].(glisp.SexpStr))); err != nil {
+		return glisp.SexpNull, err
+	}
+
 	abspath, err := exec.LookPath(string(args[0].(glisp.SexpStr)))
 	if err != nil {
 		return glisp.SexpNull, nil
@@ -527,6 +555,10 @@ func getEnvFunction(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sex
 		return glisp.SexpNull, fmt.Errorf("Expected string arg")
 	}
 
+	if env.Sandboxed() {
+		return glisp.SexpNull, glisp.ErrSandbox
+	}
+
 	val, exists := os.LookupEnv(string(args[0].(glisp.SexpStr)))
 
 	ret := make([]glisp.Sexp, 2)
@@ -542,6 +574,10 @@ func getEnvironFunction(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp
 		return glisp.SexpNull, glisp.WrongNargs
 	}
 
+	if env.Sandboxed() {
+		return glisp.SexpNull, glisp.ErrSandbox
+	}
+
 	envAry := os.Environ()
 
 	envArr := make([]glisp.Sexp, len(envAry))
@@ -0,0 +1,529 @@
+package glispext
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrhlnd/glisp"
+)
+
+// TestSuite collects the tests a script defines with deftest and what
+// happened when they ran. A failing is doesn't stop a test, it's counted
+// and the test carries on.
+//
+// Clones of the env share its suite like they share its globals, and may
+// run tests at the same time. An is counts toward the test the env it's
+// in is running.
+type TestSuite struct {
+	File     string
+	lock     sync.Mutex
+	tests    []*deftest
+	each     []glisp.SexpFunction
+	once     []glisp.SexpFunction
+	results  []*TestResult
+	toplevel *TestResult
+	running  map[*glisp.Glisp]*testRun
+}
+
+// testRun is where an env is in the tests, while it's in any
+type testRun struct {
+	current *TestResult
+	context []string
+}
+
+type deftest struct {
+	name string
+	fun  glisp.SexpFunction
+	pos  string
+	ran  bool
+}
+
+// TestResult is one test, it passed if it has no Failures and no Err
+type TestResult struct {
+	Name       string
+	File       string
+	Pos        string
+	Assertions int
+	Failures   []TestFailure
+	Err        error // what stopped the test, if something did
+	Duration   time.Duration
+}
+
+func (r *TestResult) Passed() bool {
+	return len(r.Failures) == 0 && r.Err == nil
+}
+
+// TestFailure is an is that didn't hold
+type TestFailure struct {
+	Context  []string // the testing groups it was in, outermost first
+	Pos      string
+	Form     string
+	Message  string
+	Expected string // set when the form was (= expected actual)
+	Actual   string
+	Diff     string
+	Err      error // set when the form threw instead
+}
+
+func (f TestFailure) String() string {
+	var b strings.Builder
+	if len(f.Context) > 0 {
+		fmt.Fprintf(&b, "%s: ", strings.Join(f.Context, " "))
+	}
+	if f.Message != "" {
+		fmt.Fprintf(&b, "%s: ", f.Message)
+	}
+	b.WriteString(f.Form)
+	if f.Pos != "" {
+		fmt.Fprintf(&b, " at %s", f.Pos)
+	}
+	if f.Err != nil {
+		fmt.Fprintf(&b, "\n  threw: %v", f.Err)
+	} else if f.Expected != "" || f.Actual != "" {
+		fmt.Fprintf(&b, "\n  expected: %s\n    actual: %s", f.Expected, f.Actual)
+		if f.Diff != "" {
+			fmt.Fprintf(&b, "\n      diff: %s", f.Diff)
+		}
+	}
+	return b.String()
+}
+
+// ImportTesting adds deftest, testing, is, throws?, use-fixtures and
+// run-tests to env. The suite they fill in is returned, for runners.
+//
+//	(deftest name body...)     defines a test, run-tests runs it
+//	(testing "what" body...)   groups the is inside under "what"
+//	(is form [message])        counts a failure if form is false or throws,
+//	                           (is (= expected actual)) shows both
+//	(throws? expr)             true if expr throws
+//	(use-fixtures 'each f...)  f is called with each test as a function,
+//	(use-fixtures 'once f...)  or once with all of them
+//	(run-tests)                runs the tests not run yet, prints TAP and
+//	                           returns {"passed" n "failed" n}
+func ImportTesting(env *glisp.Glisp) *TestSuite {
+	suite := &TestSuite{running: make(map[*glisp.Glisp]*testRun)}
+
+	env.AddMacro("deftest", suite.deftestMacro)
+	env.AddMacro("testing", suite.testingMacro)
+	env.AddMacro("is", suite.isMacro)
+	env.AddMacro("throws?", throwsMacro)
+	env.AddFunction("use-fixtures", suite.useFixtures)
+	env.AddFunction("run-tests", suite.runTestsFunction)
+	env.AddFunction("__deftest", suite.addTest)
+	env.AddFunction("__testing-push", suite.pushContext)
+	env.AddFunction("__testing-pop", suite.popContext)
+	env.AddFunction("__is", suite.is)
+	env.AddFunction("__is=", suite.is)
+	env.AddFunction("__is-error", suite.isError)
+	return suite
+}
+
+func posString(expr glisp.Sexp) glisp.Sexp {
+	if pos := glisp.PositionOf(expr); pos != nil {
+		return glisp.SexpStr(pos.String())
+	}
+	return glisp.SexpStr("")
+}
+
+func list(env *glisp.Glisp, head string, rest ...glisp.Sexp) glisp.Sexp {
+	return glisp.MakeList(append([]glisp.Sexp{env.MakeSymbol(head)}, rest...))
+}
+
+func quote(env *glisp.Glisp, expr glisp.Sexp) glisp.Sexp {
+	return list(env, "quote", expr)
+}
+
+// (deftest name body...) => (__deftest "name" (fn [] body...) "pos")
+func (suite *TestSuite) deftestMacro(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	sym, ok := args[0].(glisp.SexpSymbol)
+	if !ok {
+		return glisp.SexpNull, errors.New("deftest needs a name")
+	}
+	var pos glisp.Sexp = glisp.SexpStr("")
+	if len(args) > 1 {
+		pos = posString(args[1])
+	}
+
+	body := append([]glisp.Sexp{env.MakeSymbol("fn"), glisp.SexpArray{}}, args[1:]...)
+	return list(env, "__deftest", glisp.SexpStr(sym.Name()), glisp.MakeList(body), pos), nil
+}
+
+// (testing "what" body...) =>
+// (begin (__testing-push "what") (try (begin body...) (finally (__testing-pop))))
+func (suite *TestSuite) testingMacro(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	body := list(env, "begin", args[1:]...)
+	return list(env, "begin",
+		list(env, "__testing-push", args[0]),
+		list(env, "try", body, list(env, "finally", list(env, "__testing-pop")))), nil
+}
+
+// (is form msg) => (try (__is 'form form msg "pos") (catch e (__is-error 'form e msg "pos")))
+// with (= a b) as the form it's (__is= '(= a b) a b msg "pos") instead
+func (suite *TestSuite) isMacro(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	form := args[0]
+	var msg glisp.Sexp = glisp.SexpStr("")
+	if len(args) == 2 {
+		msg = args[1]
+	}
+	pos := posString(form)
+
+	check := list(env, "__is", quote(env, form), form, msg, pos)
+	if parts, err := glisp.ListToArray(form); err == nil && len(parts) == 3 {
+		if sym, ok := parts[0].(glisp.SexpSymbol); ok && sym.Name() == "=" {
+			check = list(env, "__is=", quote(env, form), parts[1], parts[2], msg, pos)
+		}
+	}
+
+	e := env.GenSymbol("__e")
+	return list(env, "try", check,
+		list(env, "catch", e, list(env, "__is-error", quote(env, form), e, msg, pos))), nil
+}
+
+// (throws? expr) => (try (begin expr false) (catch e true))
+func throwsMacro(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	return list(env, "try",
+		list(env, "begin", args[0], glisp.SexpBool(false)),
+		list(env, "catch", env.GenSymbol("__e"), glisp.SexpBool(true))), nil
+}
+
+func (suite *TestSuite) addTest(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 3 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	testName, ok1 := args[0].(glisp.SexpStr)
+	fun, ok2 := args[1].(glisp.SexpFunction)
+	pos, ok3 := args[2].(glisp.SexpStr)
+	if !ok1 || !ok2 || !ok3 {
+		return glisp.SexpNull, errors.New("__deftest expects a name, a function and a position")
+	}
+	suite.lock.Lock()
+	defer suite.lock.Unlock()
+	suite.tests = append(suite.tests, &deftest{name: string(testName), fun: fun, pos: string(pos)})
+	return glisp.SexpNull, nil
+}
+
+func (suite *TestSuite) pushContext(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	what := args[0].SexpString()
+	if str, ok := args[0].(glisp.SexpStr); ok {
+		what = string(str)
+	}
+	suite.lock.Lock()
+	defer suite.lock.Unlock()
+	run := suite.run(env)
+	run.context = append(run.context, what)
+	return glisp.SexpNull, nil
+}
+
+func (suite *TestSuite) popContext(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	suite.lock.Lock()
+	defer suite.lock.Unlock()
+	run := suite.run(env)
+	if len(run.context) > 0 {
+		run.context = run.context[:len(run.context)-1]
+	}
+	suite.settle(env)
+	return glisp.SexpNull, nil
+}
+
+// run is where env is in the tests, the lock must be held
+func (suite *TestSuite) run(env *glisp.Glisp) *testRun {
+	run, ok := suite.running[env]
+	if !ok {
+		run = &testRun{}
+		suite.running[env] = run
+	}
+	return run
+}
+
+// settle forgets env once it's out of every test and group, the lock must
+// be held
+func (suite *TestSuite) settle(env *glisp.Glisp) {
+	if run, ok := suite.running[env]; ok && run.current == nil && len(run.context) == 0 {
+		delete(suite.running, env)
+	}
+}
+
+// result is the test env is running, an is outside of any test goes to
+// one standing for the top level of the script. The lock must be held.
+func (suite *TestSuite) result(env *glisp.Glisp) *TestResult {
+	if run, ok := suite.running[env]; ok && run.current != nil {
+		return run.current
+	}
+	if suite.toplevel == nil {
+		suite.toplevel = &TestResult{Name: "(top level)", File: suite.File}
+		suite.results = append(suite.results, suite.toplevel)
+	}
+	return suite.toplevel
+}
+
+// failure needs the lock held
+func (suite *TestSuite) failure(env *glisp.Glisp, form, msg, pos glisp.Sexp) TestFailure {
+	var context []string
+	if run, ok := suite.running[env]; ok {
+		context = append(context, run.context...)
+	}
+	f := TestFailure{
+		Context: context,
+		Form:    form.SexpString(),
+	}
+	if str, ok := msg.(glisp.SexpStr); ok {
+		f.Message = string(str)
+	} else if msg != glisp.SexpNull {
+		f.Message = msg.SexpString()
+	}
+	if str, ok := pos.(glisp.SexpStr); ok {
+		f.Pos = string(str)
+	}
+	return f
+}
+
+// (__is form value msg pos) or (__is= form expected actual msg pos)
+func (suite *TestSuite) is(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	equal := name == "__is="
+	if (equal && len(args) != 5) || (!equal && len(args) != 4) {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	suite.lock.Lock()
+	defer suite.lock.Unlock()
+	r := suite.result(env)
+	r.Assertions++
+
+	n := len(args)
+	f := suite.failure(env, args[0], args[n-2], args[n-1])
+	if equal {
+		expected, actual := args[1], args[2]
+		if res, err := glisp.Compare(expected, actual); err == nil && res == 0 {
+			return glisp.SexpBool(true), nil
+		}
+		f.Expected = expected.SexpString()
+		f.Actual = actual.SexpString()
+		f.Diff = describeDiff(expected, actual)
+	} else if glisp.IsTruthy(args[1]) {
+		return glisp.SexpBool(true), nil
+	}
+	r.Failures = append(r.Failures, f)
+	return glisp.SexpBool(false), nil
+}
+
+// (__is-error form err msg pos)
+func (suite *TestSuite) isError(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 4 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	suite.lock.Lock()
+	defer suite.lock.Unlock()
+	r := suite.result(env)
+	r.Assertions++
+	f := suite.failure(env, args[0], args[2], args[3])
+	f.Err = errors.New(args[1].SexpString())
+	r.Failures = append(r.Failures, f)
+	return glisp.SexpBool(false), nil
+}
+
+// describeDiff says where expected and actual part ways, if they're the
+// same kind of thing
+func describeDiff(expected, actual glisp.Sexp) string {
+	a, aok := expected.(glisp.SexpStr)
+	b, bok := actual.(glisp.SexpStr)
+	if aok && bok {
+		ar, br := []rune(string(a)), []rune(string(b))
+		for i := 0; i < len(ar) && i < len(br); i++ {
+			if ar[i] != br[i] {
+				return fmt.Sprintf("at offset %d expected %q got %q", i, ar[i], br[i])
+			}
+		}
+		return fmt.Sprintf("expected %d characters got %d", len(ar), len(br))
+	}
+
+	aa, aok := sequence(expected)
+	ba, bok := sequence(actual)
+	if !aok || !bok {
+		if fmt.Sprintf("%T", expected) != fmt.Sprintf("%T", actual) {
+			return fmt.Sprintf("expected a %s got a %s", typeName(expected), typeName(actual))
+		}
+		return ""
+	}
+	for i := 0; i < len(aa) && i < len(ba); i++ {
+		if res, err := glisp.Compare(aa[i], ba[i]); err != nil || res != 0 {
+			return fmt.Sprintf("at index %d expected %s got %s",
+				i, aa[i].SexpString(), ba[i].SexpString())
+		}
+	}
+	return fmt.Sprintf("expected %d elements got %d", len(aa), len(ba))
+}
+
+func sequence(expr glisp.Sexp) ([]glisp.Sexp, bool) {
+	switch e := expr.(type) {
+	case glisp.SexpArray:
+		return e, true
+	case glisp.SexpPair:
+		arr, err := glisp.ListToArray(e)
+		return arr, err == nil
+	}
+	return nil, false
+}
+
+func typeName(expr glisp.Sexp) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", expr), "glisp.Sexp")
+}
+
+// (use-fixtures 'each f...) or (use-fixtures 'once f...)
+func (suite *TestSuite) useFixtures(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	kind, ok := args[0].(glisp.SexpSymbol)
+	if !ok || (kind.Name() != "each" && kind.Name() != "once") {
+		return glisp.SexpNull, errors.New("use-fixtures takes 'each or 'once first")
+	}
+	suite.lock.Lock()
+	defer suite.lock.Unlock()
+	for _, arg := range args[1:] {
+		fun, ok := arg.(glisp.SexpFunction)
+		if !ok {
+			return glisp.SexpNull, fmt.Errorf("fixture must be a function, got %s", arg.SexpString())
+		}
+		if kind.Name() == "each" {
+			suite.each = append(suite.each, fun)
+		} else {
+			suite.once = append(suite.once, fun)
+		}
+	}
+	return glisp.SexpNull, nil
+}
+
+// wrap has the fixtures call run, the first fixture outermost
+func wrap(env *glisp.Glisp, fixtures []glisp.SexpFunction,
+	run glisp.SexpFunction) glisp.SexpFunction {
+	for i := len(fixtures) - 1; i >= 0; i-- {
+		fixture, inner := fixtures[i], run
+		run = glisp.MakeUserFunction("__fixture",
+			func(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+				return env.Apply(fixture, []glisp.Sexp{inner})
+			})
+	}
+	return run
+}
+
+// Run runs the tests that haven't run yet and whose names match, match
+// can be nil to run them all. It returns their results.
+func (suite *TestSuite) Run(env *glisp.Glisp, match func(name string) bool) []*TestResult {
+	var pending []*deftest
+	suite.lock.Lock()
+	for _, t := range suite.tests {
+		if !t.ran && (match == nil || match(t.name)) {
+			t.ran = true
+			pending = append(pending, t)
+		}
+	}
+	once := suite.once
+	suite.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var results []*TestResult
+	all := glisp.MakeUserFunction("__run-tests",
+		func(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+			for _, t := range pending {
+				results = append(results, suite.runTest(env, t))
+			}
+			return glisp.SexpNull, nil
+		})
+
+	_, err := env.TryApply(wrap(env, once, all), nil)
+	if err != nil {
+		// a once fixture failed, whatever didn't run failed with it
+		suite.lock.Lock()
+		for _, t := range pending[len(results):] {
+			r := &TestResult{Name: t.name, File: suite.File, Pos: t.pos, Err: err}
+			suite.results = append(suite.results, r)
+			results = append(results, r)
+		}
+		suite.lock.Unlock()
+	}
+	return results
+}
+
+func (suite *TestSuite) runTest(env *glisp.Glisp, t *deftest) *TestResult {
+	r := &TestResult{Name: t.name, File: suite.File, Pos: t.pos}
+	suite.lock.Lock()
+	suite.results = append(suite.results, r)
+	run := suite.run(env)
+	outer, context := run.current, run.context
+	run.current, run.context = r, nil
+	each := suite.each
+	suite.lock.Unlock()
+	defer func() {
+		suite.lock.Lock()
+		run.current, run.context = outer, context
+		suite.settle(env)
+		suite.lock.Unlock()
+	}()
+
+	test := glisp.MakeUserFunction(t.name,
+		func(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+			return env.Apply(t.fun, nil)
+		})
+
+	start := time.Now()
+	_, err := env.TryApply(wrap(env, each, test), nil)
+	suite.lock.Lock()
+	r.Err = err
+	r.Duration = time.Since(start)
+	suite.lock.Unlock()
+	return r
+}
+
+// Results is everything that's run so far, in order
+func (suite *TestSuite) Results() []*TestResult {
+	suite.lock.Lock()
+	defer suite.lock.Unlock()
+	return append([]*TestResult(nil), suite.results...)
+}
+
+func (suite *TestSuite) runTestsFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	results := suite.Run(env, nil)
+	if err := WriteTAP(env.Output(), results); err != nil {
+		return glisp.SexpNull, err
+	}
+	passed := 0
+	for _, r := range results {
+		if r.Passed() {
+			passed++
+		}
+	}
+	return glisp.MakeHash([]glisp.Sexp{
+		glisp.SexpStr("passed"), glisp.SexpInt(passed),
+		glisp.SexpStr("failed"), glisp.SexpInt(len(results) - passed),
+	}, "hash")
+}
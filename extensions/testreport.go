@@ -0,0 +1,155 @@
+package glispext
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// WriteTAP reports results in the Test Anything Protocol, version 13.
+// What failed goes in the YAML block under each not ok.
+func WriteTAP(w io.Writer, results []*TestResult) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "TAP version 13\n1..%d\n", len(results))
+	for i, r := range results {
+		if r.Passed() {
+			fmt.Fprintf(&b, "ok %d - %s\n", i+1, r.Name)
+			continue
+		}
+		fmt.Fprintf(&b, "not ok %d - %s\n", i+1, r.Name)
+		b.WriteString("  ---\n")
+		if r.File != "" {
+			fmt.Fprintf(&b, "  file: %s\n", yamlString(r.File))
+		}
+		if r.Err != nil {
+			fmt.Fprintf(&b, "  error: %s\n", yamlString(r.Err.Error()))
+		}
+		if len(r.Failures) > 0 {
+			b.WriteString("  failures:\n")
+			for _, f := range r.Failures {
+				writeYAMLFailure(&b, f)
+			}
+		}
+		b.WriteString("  ...\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeYAMLFailure(b *strings.Builder, f TestFailure) {
+	field := func(name, value string) {
+		if value == "" {
+			return
+		}
+		fmt.Fprintf(b, "      %s: %s\n", name, yamlString(value))
+	}
+	fmt.Fprintf(b, "    - form: %s\n", yamlString(f.Form))
+	field("at", f.Pos)
+	field("testing", strings.Join(f.Context, " "))
+	field("message", f.Message)
+	field("expected", f.Expected)
+	field("actual", f.Actual)
+	field("diff", f.Diff)
+	if f.Err != nil {
+		field("threw", f.Err.Error())
+	}
+}
+
+// yamlString quotes s, JSON strings are YAML strings too
+func yamlString(s string) string {
+	return fmt.Sprintf("%q", s)
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit reports results as JUnit XML, a testsuite for each file. A
+// test with failing is has a failure, one stopped by an error has an
+// error.
+func WriteJUnit(w io.Writer, results []*TestResult) error {
+	var report junitSuites
+	suites := make(map[string]int)
+	var durations []time.Duration
+
+	for _, r := range results {
+		i, ok := suites[r.File]
+		if !ok {
+			i = len(report.Suites)
+			suites[r.File] = i
+			report.Suites = append(report.Suites, junitSuite{Name: r.File})
+			durations = append(durations, 0)
+		}
+		durations[i] += r.Duration
+		suite := &report.Suites[i]
+
+		c := junitCase{
+			Name:      r.Name,
+			Classname: r.File,
+			Time:      fmt.Sprintf("%.6f", r.Duration.Seconds()),
+		}
+		if len(r.Failures) > 0 {
+			texts := make([]string, len(r.Failures))
+			for j, f := range r.Failures {
+				texts[j] = f.String()
+			}
+			c.Failure = &junitProblem{
+				Message: fmt.Sprintf("%d of %d assertions failed", len(r.Failures), r.Assertions),
+				Text:    strings.Join(texts, "\n\n"),
+			}
+			suite.Failures++
+			report.Failures++
+		}
+		if r.Err != nil {
+			c.Error = &junitProblem{Message: r.Err.Error(), Text: r.Err.Error()}
+			suite.Errors++
+			report.Errors++
+		}
+		suite.Tests++
+		report.Tests++
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	for i, d := range durations {
+		report.Suites[i].Time = fmt.Sprintf("%.6f", d.Seconds())
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
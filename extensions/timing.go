@@ -63,9 +63,9 @@ func TimeitFunction(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sex
 		}
 	}
 
-	fmt.Printf("ran %d iterations in %f seconds\n",
+	fmt.Fprintf(env.Output(), "ran %d iterations in %f seconds\n",
 		iterations, elapsed.Seconds())
-	fmt.Printf("average %f seconds per run\n",
+	fmt.Fprintf(env.Output(), "average %f seconds per run\n",
 		elapsed.Seconds()/float64(iterations))
 
 	return glisp.SexpNull, nil
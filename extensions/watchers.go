@@ -143,7 +143,7 @@ func (p *ReadWatcher) run(onTerm func()) {
 				n, err := p.dataIn.Read(data[:])
 				if err != nil {
 					if err != io.EOF {
-						log.Println("Watcher had read error %v", err)
+						log.Printf("Watcher had read error %v", err)
 					}
 					closeWatchers()
 					p.dead.Store(true)
@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -566,8 +567,14 @@ func EvalFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	if err != nil {
 		return SexpNull, errors.New("failed to compile expression")
 	}
+	// what's left of the budget goes with the code, the context already has
+	if env.budget > 0 {
+		newenv.budget = max(env.budget-env.steps, 1)
+	}
 	newenv.pc = 0
-	return newenv.Run()
+	res, err := newenv.Run()
+	env.steps += newenv.steps
+	return res, err
 }
 
 func TypeQueryFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
@@ -696,7 +703,7 @@ func PrintFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		buf.WriteString("\n")
 	}
 
-	fmt.Print(buf.String())
+	env.Output().Write(buf.Bytes())
 
 	return SexpNull, nil
 }
@@ -938,7 +945,7 @@ func makeData(i *int, data *bytes.Buffer, thing Sexp) error {
 		data.WriteRune(rune(t))
 		*i++
 	default:
-		return fmt.Errorf("MakeData failed for item %v didn't know how to deal with %T type, %v data", thing, thing)
+		return fmt.Errorf("MakeData failed for item %v didn't know how to deal with %T type", thing, thing)
 	}
 	return nil
 }
@@ -1000,9 +1007,48 @@ func ConstructorFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	return SexpNull, errors.New("invalid constructor")
 }
 
+// events are shared by every environment, coroutines fire and wait on
+// them from their own goroutines
+var eventsLock sync.Mutex
 var eventId int
 var events map[int]chan Sexp = make(map[int]chan Sexp)
 
+// fired are the events fired but not yet waited on, their channels are
+// closed so firing again would panic
+var fired = make(map[int]struct{})
+
+func eventChan(id int) (chan Sexp, bool) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	ch, ok := events[id]
+	return ch, ok
+}
+
+func deleteEvent(id int) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	delete(events, id)
+	delete(fired, id)
+}
+
+// fireEvent hands val to the event's waiter, false if there's no such
+// event or it was fired already
+func fireEvent(id int, val Sexp) bool {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	ch, ok := events[id]
+	if !ok {
+		return false
+	}
+	if _, ok := fired[id]; ok {
+		return false
+	}
+	fired[id] = struct{}{}
+	ch <- val // buffered, this never blocks
+	close(ch)
+	return true
+}
+
 func EventFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	// in "try" mode if we have a null object do nothing
 	if strings.HasPrefix(name, "?") {
@@ -1017,19 +1063,30 @@ func EventFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 
 	switch len(args) {
 	case 0:
+		eventsLock.Lock()
 		eventId++
 		id := eventId
 		events[id] = make(chan Sexp, 1)
+		eventsLock.Unlock()
 		return SexpEvent(id), nil
 	case 2:
-		id := int(args[0].(SexpEvent))
-		events[id] <- args[1]
-		close(events[id])
+		event, ok := args[0].(SexpEvent)
+		if !ok {
+			return SexpNull, fmt.Errorf("%v, expected param1 to be an event got %v", name, args[0])
+		}
+		if !fireEvent(int(event), args[1]) {
+			return SexpNull, fmt.Errorf("%v, %v was already fired", name, args[0].SexpString())
+		}
 		return SexpNull, nil
 	}
 	return SexpNull, fmt.Errorf("%v, unknown event nargs %v", name, len(args))
 }
 
+// waitedError is for a wait that lost the event's value to another waiter
+func waitedError(name string, event int) error {
+	return fmt.Errorf("%v, %v was waited on by another", name, SexpEvent(event).SexpString())
+}
+
 func WaitFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	if len(args) != 2 {
 		return SexpNull, WrongNargs
@@ -1045,7 +1102,7 @@ func WaitFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	event := int(args[0].(SexpEvent))
 	delayMs := int(args[1].(SexpInt))
 
-	ch, ok := events[event]
+	ch, ok := eventChan(event)
 	if !ok {
 		return SexpNull, fmt.Errorf("%v, expected param1 to be an event got %v", name, args[0])
 	}
@@ -1058,10 +1115,15 @@ func WaitFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 			select {
 			case <-env.GetQueuedWaitCond().Channel():
 				env.CallQueued()
-			case val := <-ch:
+			case val, ok := <-ch:
+				if !ok {
+					return SexpNull, waitedError(name, event)
+				}
 				ret = val
-				delete(events, event)
+				deleteEvent(event)
 				break W1
+			case <-env.Done():
+				return SexpNull, env.Interrupted()
 			}
 		}
 	} else {
@@ -1070,14 +1132,21 @@ func WaitFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 			env.CallQueued()
 
 			select {
-			case val := <-ch:
+			case val, ok := <-ch:
+				if !ok {
+					return SexpNull, waitedError(name, event)
+				}
 				ret = val
-				delete(events, event)
+				deleteEvent(event)
 				break W2
 			default:
 			}
 
-			time.Sleep(time.Duration(delayMs) * time.Millisecond)
+			select {
+			case <-time.After(time.Duration(delayMs) * time.Millisecond):
+			case <-env.Done():
+				return SexpNull, env.Interrupted()
+			}
 		}
 	}
 
@@ -1091,7 +1160,14 @@ func SleepFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 
 	ms := int(args[0].(SexpInt))
 
-	time.Sleep(time.Duration(ms) * time.Millisecond)
+	timer := time.NewTimer(time.Duration(ms) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-env.Done():
+		return SexpNull, env.Interrupted()
+	}
 
 	return args[0], nil
 }
@@ -1136,7 +1212,12 @@ func SourceFileFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 			var f *os.File
 			var err error
 
-			if f, err = os.Open(string(t)); err != nil {
+			file, err := env.SandboxSource(string(t))
+			if err != nil {
+				return err
+			}
+
+			if f, err = os.Open(file); err != nil {
 				return err
 			}
 
@@ -1161,7 +1242,24 @@ func SourceFileFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	return SexpNull, nil
 }
 
-var MissingFunction = SexpFunction{"__missing", true, 0, false, nil, nil, nil}
+// ExitFunction stops the program, (exit) with status 0, (exit n) with n
+func ExitFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	code := 0
+	switch len(args) {
+	case 0:
+	case 1:
+		n, ok := args[0].(SexpInt)
+		if !ok {
+			return SexpNull, fmt.Errorf("%s expects an int, got %T", name, args[0])
+		}
+		code = int(n)
+	default:
+		return SexpNull, WrongNargs
+	}
+	return SexpNull, &ExitError{code}
+}
+
+var MissingFunction = SexpFunction{"__missing", true, 0, false, nil, nil, nil, nil}
 
 func MakeFunction(name string, nargs int, varargs bool,
 	fun GlispFunction) SexpFunction {
@@ -1171,6 +1269,7 @@ func MakeFunction(name string, nargs int, varargs bool,
 	sfun.nargs = nargs
 	sfun.varargs = varargs
 	sfun.fun = fun
+	sfun.info = &funcInfo{}
 	return sfun
 }
 
@@ -1229,6 +1328,7 @@ var BuiltinFunctions = map[string]GlispUserFunction{
 	"print":         PrintFunction,
 	"plog":          LogFunction,
 	"not":           NotFunction,
+	"exit":          ExitFunction,
 	"apply":         ApplyFunction,
 	"map":           MapFunction,
 	"foldl":         FoldLFunction,
@@ -1245,6 +1345,9 @@ var BuiltinFunctions = map[string]GlispUserFunction{
 	"hclear!":       HashClear,
 	"slice":         SliceFunction,
 	"len":           LenFunction,
+	"error?":        ErrorFunction,
+	"error-message": ErrorFunction,
+	"error-fn":      ErrorFunction,
 	"append":        AppendFunction,
 	"?append":       AppendFunction,
 	"concat":        ConcatFunction,
@@ -1487,7 +1590,7 @@ func ConvertFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		}
 	}
 
-	return SexpNull, fmt.Errorf("Failure of `%v` function, not implemented")
+	return SexpNull, fmt.Errorf("Failure of `%v` function, not implemented", name)
 }
 
 func StringifyFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
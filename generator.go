@@ -1,8 +1,10 @@
 package glisp
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 )
 
@@ -11,7 +13,13 @@ type Generator struct {
 	funcname     string
 	tail         bool
 	scopes       int
+	lexical      []*lexScope // visible local scopes, innermost last
+	frame        *lexScope   // the function's own frame
+	loops        []*Loop
+	tries        []*tryBlock
 	instructions []Instruction
+	positions    []*SourcePos // parallel to instructions
+	pos          *SourcePos   // source of the expression being generated
 }
 
 type Loop struct {
@@ -20,10 +28,37 @@ type Loop struct {
 	loopLen        int
 	breakOffset    int // i.e. relative to loopStart
 	continueOffset int // i.e. relative to loopStart
+	scopes         int // generator scopes once the loop scope is open
+	depth          SexpSymbol
+	bindings       []SexpSymbol // loop/recur targets
+	tries          int          // generator tries open outside the loop
 }
 
 func (loop *Loop) IsStackElem() {}
 
+// lexScope is the generator's view of a Frame, the symbols that have been
+// given slots in it so far
+type lexScope struct {
+	syms []SexpSymbol
+}
+
+func (scope *lexScope) slot(sym SexpSymbol) int {
+	for i, s := range scope.syms {
+		if s.number == sym.number {
+			return i
+		}
+	}
+	return -1
+}
+
+func (scope *lexScope) declare(sym SexpSymbol) int {
+	if i := scope.slot(sym); i >= 0 {
+		return i
+	}
+	scope.syms = append(scope.syms, sym)
+	return len(scope.syms) - 1
+}
+
 func NewGenerator(env *Glisp) *Generator {
 	gen := new(Generator)
 	gen.env = env
@@ -36,11 +71,73 @@ func NewGenerator(env *Glisp) *Generator {
 }
 
 func (gen *Generator) AddInstructions(instr []Instruction) {
-	gen.instructions = append(gen.instructions, instr...)
+	for _, i := range instr {
+		gen.AddInstruction(i)
+	}
 }
 
 func (gen *Generator) AddInstruction(instr Instruction) {
 	gen.instructions = append(gen.instructions, instr)
+	gen.positions = append(gen.positions, gen.pos)
+}
+
+// splice adds code from a sub generator keeping its positions
+func (gen *Generator) splice(instr []Instruction, positions []*SourcePos) {
+	gen.instructions = append(gen.instructions, instr...)
+	gen.positions = append(gen.positions, positions...)
+}
+
+// subGenerator starts a generator for code that gets spliced back into gen
+func (gen *Generator) subGenerator() *Generator {
+	subgen := NewGenerator(gen.env)
+	subgen.scopes = gen.scopes
+	subgen.lexical = gen.lexical[:len(gen.lexical):len(gen.lexical)]
+	subgen.frame = gen.frame
+	subgen.loops = gen.loops
+	subgen.tries = gen.tries
+	subgen.pos = gen.pos
+	return subgen
+}
+
+// openScope starts a new frame at runtime and a lexScope to match
+func (gen *Generator) openScope() *lexScope {
+	scope := &lexScope{}
+	gen.AddInstruction(AddScopeInstr{scope})
+	gen.lexical = append(gen.lexical, scope)
+	gen.scopes++
+	return scope
+}
+
+func (gen *Generator) closeScope() {
+	gen.AddInstruction(RemoveScopeInstr(0))
+	// capped so a scope opened later doesn't write over a saved lexical
+	n := len(gen.lexical) - 1
+	gen.lexical = gen.lexical[:n:n]
+	gen.scopes--
+}
+
+// bind pops the top of the datastack into sym in the innermost scope,
+// outside of any scope that's the global one
+func (gen *Generator) bind(sym SexpSymbol) {
+	if len(gen.lexical) == 0 {
+		gen.AddInstruction(PutInstr{sym})
+		return
+	}
+	slot := gen.lexical[len(gen.lexical)-1].declare(sym)
+	gen.AddInstruction(SetLocalInstr{0, slot, sym})
+}
+
+// lookup reads sym from the slot it resolves to, anything else is found
+// by name at runtime
+func (gen *Generator) lookup(sym SexpSymbol) {
+	for depth := 0; depth < len(gen.lexical); depth++ {
+		slot := gen.lexical[len(gen.lexical)-1-depth].slot(sym)
+		if slot >= 0 {
+			gen.AddInstruction(GetLocalInstr{depth, slot, sym})
+			return
+		}
+	}
+	gen.AddInstruction(GetInstr{sym})
 }
 
 func (gen *Generator) GenerateBegin(expressions []Sexp) error {
@@ -63,10 +160,15 @@ func (gen *Generator) GenerateBegin(expressions []Sexp) error {
 	return gen.Generate(expressions[size-1])
 }
 
+// buildSexpFun compiles a function, outer are the scopes it closes over
 func buildSexpFun(env *Glisp, name string, funcargs SexpArray,
-	funcbody []Sexp) (SexpFunction, error) {
+	funcbody []Sexp, pos *SourcePos, outer []*lexScope) (SexpFunction, error) {
 	gen := NewGenerator(env)
 	gen.tail = true
+	gen.pos = pos
+	frame := &lexScope{}
+	gen.lexical = append(outer[:len(outer):len(outer)], frame)
+	gen.frame = frame
 
 	if len(name) == 0 {
 		gen.funcname = env.GenSymbol("__anon").name
@@ -97,16 +199,23 @@ func buildSexpFun(env *Glisp, name string, funcargs SexpArray,
 	}
 
 	for i := len(argsyms) - 1; i >= 0; i-- {
-		gen.AddInstruction(PutInstr{argsyms[i]})
+		gen.bind(argsyms[i])
 	}
 	err := gen.GenerateBegin(funcbody)
 	if err != nil {
 		return MissingFunction, err
 	}
 	gen.AddInstruction(ReturnInstr{nil})
+	gen.optimize()
 
 	newfunc := GlispFunction(gen.instructions)
-	return MakeFunction(gen.funcname, nargs, varargs, newfunc), nil
+	sfun := MakeFunction(gen.funcname, nargs, varargs, newfunc)
+	sfun.info.positions = gen.positions
+	sfun.info.frame = frame.syms
+	for _, arg := range funcargs {
+		sfun.info.params = append(sfun.info.params, arg.(SexpSymbol).name)
+	}
+	return sfun, nil
 }
 
 func (gen *Generator) GenerateFn(args []Sexp) error {
@@ -124,7 +233,7 @@ func (gen *Generator) GenerateFn(args []Sexp) error {
 	}
 
 	funcbody := args[1:]
-	sfun, err := buildSexpFun(gen.env, "", funcargs, funcbody)
+	sfun, err := buildSexpFun(gen.env, "", funcargs, funcbody, gen.pos, gen.lexical)
 	if err != nil {
 		return err
 	}
@@ -151,11 +260,21 @@ func (gen *Generator) GenerateDef(args []Sexp) error {
 	if err != nil {
 		return err
 	}
-	gen.AddInstruction(PutInstr{sym})
+	gen.bind(sym)
 	gen.AddInstruction(PushInstr{SexpNull})
 	return nil
 }
 
+// splitDoc takes the docstring off the body of a defn or defmac. A string
+// with more of the body after it documents the function, a string that's
+// the whole body is what it returns.
+func splitDoc(body []Sexp) (string, []Sexp) {
+	if doc, ok := body[0].(SexpStr); ok && len(body) > 1 {
+		return string(doc), body[1:]
+	}
+	return "", body
+}
+
 func (gen *Generator) GenerateDefn(args []Sexp) error {
 	if len(args) < 3 {
 		return errors.New("Wrong number of arguments to defn")
@@ -177,13 +296,15 @@ func (gen *Generator) GenerateDefn(args []Sexp) error {
 		return errors.New("Definition name must by symbol")
 	}
 
-	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:])
+	doc, body := splitDoc(args[2:])
+	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, body, gen.pos, nil)
 	if err != nil {
 		return err
 	}
+	sfun.info.doc = doc
 
 	gen.AddInstruction(PushInstr{sfun})
-	gen.AddInstruction(PutInstr{sym})
+	gen.bind(sym)
 	gen.AddInstruction(PushInstr{SexpNull})
 
 	return nil
@@ -210,12 +331,14 @@ func (gen *Generator) GenerateDefmac(args []Sexp) error {
 		return errors.New("Definition name must by symbol")
 	}
 
-	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:])
+	doc, body := splitDoc(args[2:])
+	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, body, gen.pos, nil)
 	if err != nil {
 		return err
 	}
+	sfun.info.doc = doc
 
-	gen.env.macros[sym.number] = sfun
+	gen.env.registry.setMacro(sym, sfun)
 	gen.AddInstruction(PushInstr{SexpNull})
 
 	return nil
@@ -244,7 +367,7 @@ func (gen *Generator) GenerateMacexpand(args []Sexp) error {
 	if islist {
 		switch t := list.head.(type) {
 		case SexpSymbol:
-			macro, ismacrocall = gen.env.macros[t.number]
+			macro, ismacrocall = gen.env.registry.macro(t)
 		default:
 			ismacrocall = false
 		}
@@ -272,22 +395,23 @@ func (gen *Generator) GenerateMacexpand(args []Sexp) error {
 func (gen *Generator) GenerateShortCircuit(or bool, args []Sexp) error {
 	size := len(args)
 
-	subgen := NewGenerator(gen.env)
-	subgen.scopes = gen.scopes
+	subgen := gen.subGenerator()
 	subgen.tail = gen.tail
 	subgen.funcname = gen.funcname
 	subgen.Generate(args[size-1])
 	instructions := subgen.instructions
+	positions := subgen.positions
 
 	for i := size - 2; i >= 0; i-- {
-		subgen = NewGenerator(gen.env)
+		subgen = gen.subGenerator()
 		subgen.Generate(args[i])
 		subgen.AddInstruction(DupInstr(0))
 		subgen.AddInstruction(BranchInstr{or, len(instructions) + 2})
 		subgen.AddInstruction(PopInstr(0))
 		instructions = append(subgen.instructions, instructions...)
+		positions = append(subgen.positions, positions...)
 	}
-	gen.AddInstructions(instructions)
+	gen.splice(instructions, positions)
 
 	return nil
 }
@@ -297,44 +421,50 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 		return errors.New("missing default case")
 	}
 
-	subgen := NewGenerator(gen.env)
+	subgen := gen.subGenerator()
 	subgen.tail = gen.tail
-	subgen.scopes = gen.scopes
 	subgen.funcname = gen.funcname
 	err := subgen.Generate(args[len(args)-1])
 	if err != nil {
 		return err
 	}
 	instructions := subgen.instructions
+	positions := subgen.positions
 
 	for i := len(args)/2 - 1; i >= 0; i-- {
 		subgen.Reset()
+		subgen.scopes = gen.scopes
+		subgen.lexical = gen.lexical[:len(gen.lexical):len(gen.lexical)]
 		err := subgen.Generate(args[2*i])
 		if err != nil {
 			return err
 		}
 		pred_code := subgen.instructions
+		pred_pos := subgen.positions
 
 		subgen.Reset()
 		subgen.tail = gen.tail
 		subgen.scopes = gen.scopes
+		subgen.lexical = gen.lexical[:len(gen.lexical):len(gen.lexical)]
 		subgen.funcname = gen.funcname
 		err = subgen.Generate(args[2*i+1])
 		if err != nil {
 			return err
 		}
 		body_code := subgen.instructions
+		body_pos := subgen.positions
 
 		subgen.Reset()
-		subgen.AddInstructions(pred_code)
+		subgen.splice(pred_code, pred_pos)
 		subgen.AddInstruction(BranchInstr{false, len(body_code) + 2})
-		subgen.AddInstructions(body_code)
+		subgen.splice(body_code, body_pos)
 		subgen.AddInstruction(JumpInstr{len(instructions) + 1})
-		subgen.AddInstructions(instructions)
+		subgen.splice(instructions, positions)
 		instructions = subgen.instructions
+		positions = subgen.positions
 	}
 
-	gen.AddInstructions(instructions)
+	gen.splice(instructions, positions)
 	return nil
 }
 
@@ -375,8 +505,11 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 		rstatements = append(rstatements, bindings[2*i+1])
 	}
 
-	gen.AddInstruction(AddScopeInstr(0))
-	gen.scopes++
+	gen.openScope()
+
+	// only the body can be in tail position
+	oldtail := gen.tail
+	gen.tail = false
 
 	if name == "let*" {
 		for i, rs := range rstatements {
@@ -384,7 +517,7 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 			if err != nil {
 				return err
 			}
-			gen.AddInstruction(PutInstr{lstatements[i]})
+			gen.bind(lstatements[i])
 		}
 	} else if name == "let" {
 		for _, rs := range rstatements {
@@ -394,15 +527,15 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 			}
 		}
 		for i := len(lstatements) - 1; i >= 0; i-- {
-			gen.AddInstruction(PutInstr{lstatements[i]})
+			gen.bind(lstatements[i])
 		}
 	}
+	gen.tail = oldtail
 	err := gen.GenerateBegin(args[1:])
 	if err != nil {
 		return err
 	}
-	gen.AddInstruction(RemoveScopeInstr(0))
-	gen.scopes--
+	gen.closeScope()
 
 	return nil
 }
@@ -411,10 +544,13 @@ func (gen *Generator) GenerateAssert(args []Sexp) error {
 	if len(args) != 1 {
 		return WrongNargs
 	}
+	oldtail := gen.tail
+	gen.tail = false
 	err := gen.Generate(args[0])
 	if err != nil {
 		return err
 	}
+	gen.tail = oldtail
 
 	reterrmsg := fmt.Sprintf("Assertion failed: %s\n",
 		args[0].SexpString())
@@ -438,14 +574,18 @@ func (gen *Generator) GenerateImport(args []Sexp) error {
 
 	iname := filepath.Base(string(name))
 
-	if _, ok := gen.env.imports[iname]; ok {
-		// already imported
+	if !gen.env.registry.markImported(iname) {
+		// already imported, still an expression though
+		gen.AddInstruction(PushInstr{SexpNull})
 		return nil
 	}
 
-	gen.env.imports[iname] = struct{}{}
-
-	return gen.GenerateInclude(args)
+	if err := gen.GenerateInclude(args); err != nil {
+		// not imported, so trying again fails the same way
+		gen.env.registry.unmarkImported(iname)
+		return err
+	}
+	return nil
 }
 
 func (gen *Generator) GenerateInclude(args []Sexp) error {
@@ -476,10 +616,26 @@ func (gen *Generator) GenerateInclude(args []Sexp) error {
 				expr = list.tail
 			}
 		case SexpStr:
-			exps, err = gen.env.ParseFile(string(t))
+			var file string
+			file, err = gen.env.SandboxSource(string(t))
+			if err != nil {
+				return err
+			}
+
+			if gen.cacheable() {
+				return gen.includeCached(file)
+			}
+
+			var src []byte
+			src, err = os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			exps, err = gen.env.ParseNamedStream(bytes.NewReader(src), file)
 			if err != nil {
 				return err
 			}
+			gen.env.noteIncluded(file, src)
 
 			err = gen.GenerateBegin(exps)
 			if err != nil {
@@ -503,6 +659,591 @@ func (gen *Generator) GenerateInclude(args []Sexp) error {
 	return nil
 }
 
+// placeholder emitted by break, continue and recur. The target isn't known
+// until the whole loop has been generated (possibly through sub generators),
+// so endLoop swaps these for real jumps.
+type loopJumpInstr struct {
+	loop *Loop
+	cont bool
+}
+
+func (l loopJumpInstr) InstrString() string {
+	if l.cont {
+		return "continue " + l.loop.stmtname.name
+	}
+	return "break " + l.loop.stmtname.name
+}
+
+func (l loopJumpInstr) Execute(env *Glisp) error {
+	return fmt.Errorf("unresolved %s", l.InstrString())
+}
+
+// beginLoop opens the loop scope and records the datastack depth in it
+func (gen *Generator) beginLoop(name string) *Loop {
+	loop := &Loop{
+		stmtname:  gen.env.MakeSymbol(name),
+		loopStart: len(gen.instructions),
+		depth:     gen.env.GenSymbol("__depth"),
+		tries:     len(gen.tries),
+	}
+
+	gen.openScope()
+	loop.scopes = gen.scopes
+
+	gen.AddInstruction(StackDepthInstr(0))
+	gen.bind(loop.depth)
+
+	gen.loops = append(gen.loops, loop)
+	return loop
+}
+
+// endLoop emits the break target, closes the loop scope and resolves
+// every break and continue that ended up inside the loop body
+func (gen *Generator) endLoop(loop *Loop) {
+	loop.breakOffset = len(gen.instructions) - loop.loopStart
+	gen.closeScope()
+	gen.loops = gen.loops[:len(gen.loops)-1]
+
+	loop.loopLen = len(gen.instructions) - loop.loopStart
+
+	for i := loop.loopStart; i < len(gen.instructions); i++ {
+		lj, ok := gen.instructions[i].(loopJumpInstr)
+		if !ok || lj.loop != loop {
+			continue
+		}
+		target := loop.loopStart + loop.breakOffset
+		if lj.cont {
+			target = loop.loopStart + loop.continueOffset
+		}
+		gen.instructions[i] = JumpInstr{target - i}
+	}
+}
+
+func (gen *Generator) innerLoop(name string) (*Loop, error) {
+	if len(gen.loops) == 0 {
+		return nil, fmt.Errorf("%s outside of loop", name)
+	}
+	return gen.loops[len(gen.loops)-1], nil
+}
+
+// leaveLoop drops anything pending on the datastack except the top keep
+// values and pops the scopes and handlers opened inside the loop, running
+// the finally clause of every try it jumps out of
+func (gen *Generator) leaveLoop(loop *Loop, keep int) error {
+	gen.lookup(loop.depth)
+	gen.AddInstruction(UnwindInstr{keep})
+
+	scopes, lexical, tries := gen.scopes, gen.lexical, gen.tries
+	defer func() { gen.scopes, gen.lexical, gen.tries = scopes, lexical, tries }()
+
+	for len(gen.tries) > loop.tries {
+		try := gen.tries[len(gen.tries)-1]
+		for gen.scopes > try.scopes {
+			gen.closeScope()
+		}
+		gen.tries = gen.tries[:len(gen.tries)-1]
+		gen.AddInstruction(EndTryInstr(0))
+		err := gen.generateFinally(try.finally)
+		if err != nil {
+			return err
+		}
+	}
+	for gen.scopes > loop.scopes {
+		gen.closeScope()
+	}
+	return nil
+}
+
+// the body of the non value producing loops, every value is thrown away
+func (gen *Generator) generateLoopBody(body []Sexp) error {
+	if len(body) == 0 {
+		return nil
+	}
+	err := gen.GenerateBegin(body)
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(PopInstr(0))
+	return nil
+}
+
+// (while pred body...)
+func (gen *Generator) GenerateWhile(args []Sexp) error {
+	if len(args) < 1 {
+		return WrongNargs
+	}
+
+	oldtail := gen.tail
+	gen.tail = false
+
+	loop := gen.beginLoop("while")
+
+	loop.continueOffset = len(gen.instructions) - loop.loopStart
+	err := gen.Generate(args[0])
+	if err != nil {
+		return err
+	}
+	exit := len(gen.instructions)
+	gen.AddInstruction(BranchInstr{false, 0})
+
+	err = gen.generateLoopBody(args[1:])
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(JumpInstr{loop.loopStart + loop.continueOffset - len(gen.instructions)})
+
+	gen.instructions[exit] = BranchInstr{false, len(gen.instructions) - exit}
+	gen.AddInstruction(PushInstr{SexpNull})
+	gen.endLoop(loop)
+
+	gen.tail = oldtail
+	return nil
+}
+
+// shared by dotimes and doseq, counts a hidden index up to a hidden limit
+// (already bound by the caller) and binds each step in its own scope
+func (gen *Generator) generateCounted(loop *Loop, bind func(count SexpSymbol), body []Sexp) error {
+	count := gen.env.GenSymbol("__count")
+	limit := gen.env.GenSymbol("__limit")
+
+	gen.bind(limit)
+	gen.AddInstruction(PushInstr{SexpInt(0)})
+	gen.bind(count)
+
+	top := len(gen.instructions)
+	gen.lookup(count)
+	gen.lookup(limit)
+	gen.AddInstruction(CallInstr{gen.env.MakeSymbol("<"), 2})
+	exit := len(gen.instructions)
+	gen.AddInstruction(BranchInstr{false, 0})
+
+	// a fresh scope each time around so closures made in the body
+	// each see their own binding
+	gen.openScope()
+	bind(count)
+	err := gen.generateLoopBody(body)
+	if err != nil {
+		return err
+	}
+	gen.closeScope()
+
+	loop.continueOffset = len(gen.instructions) - loop.loopStart
+	gen.lookup(count)
+	gen.AddInstruction(PushInstr{SexpInt(1)})
+	gen.AddInstruction(CallInstr{gen.env.MakeSymbol("+"), 2})
+	gen.bind(count)
+	gen.AddInstruction(JumpInstr{top - len(gen.instructions)})
+
+	gen.instructions[exit] = BranchInstr{false, len(gen.instructions) - exit}
+	gen.AddInstruction(PushInstr{SexpNull})
+	return nil
+}
+
+func loopBinding(name string, args []Sexp) (SexpSymbol, Sexp, error) {
+	if len(args) < 1 {
+		return SexpSymbol{}, nil, WrongNargs
+	}
+	binding, ok := args[0].(SexpArray)
+	if !ok || len(binding) != 2 {
+		return SexpSymbol{}, nil, fmt.Errorf("%s expects a [symbol expr] binding", name)
+	}
+	sym, ok := binding[0].(SexpSymbol)
+	if !ok {
+		return SexpSymbol{}, nil, errors.New("cannot bind to non-symbol")
+	}
+	return sym, binding[1], nil
+}
+
+// (dotimes [i n] body...)
+func (gen *Generator) GenerateDotimes(args []Sexp) error {
+	sym, count, err := loopBinding("dotimes", args)
+	if err != nil {
+		return err
+	}
+
+	oldtail := gen.tail
+	gen.tail = false
+
+	loop := gen.beginLoop("dotimes")
+	err = gen.Generate(count)
+	if err != nil {
+		return err
+	}
+
+	err = gen.generateCounted(loop, func(count SexpSymbol) {
+		gen.lookup(count)
+		gen.bind(sym)
+	}, args[1:])
+	if err != nil {
+		return err
+	}
+	gen.endLoop(loop)
+
+	gen.tail = oldtail
+	return nil
+}
+
+// (doseq [x coll] body...) walks lists, arrays, hashes, strings and data
+func (gen *Generator) GenerateDoseq(args []Sexp) error {
+	sym, coll, err := loopBinding("doseq", args)
+	if err != nil {
+		return err
+	}
+
+	oldtail := gen.tail
+	gen.tail = false
+
+	loop := gen.beginLoop("doseq")
+	seq := gen.env.GenSymbol("__seq")
+	err = gen.Generate(coll)
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(SeqInstr(0))
+	gen.bind(seq)
+	gen.lookup(seq)
+	gen.AddInstruction(CallInstr{gen.env.MakeSymbol("len"), 1})
+
+	err = gen.generateCounted(loop, func(count SexpSymbol) {
+		gen.lookup(seq)
+		gen.lookup(count)
+		gen.AddInstruction(CallInstr{gen.env.MakeSymbol("aget"), 2})
+		gen.bind(sym)
+	}, args[1:])
+	if err != nil {
+		return err
+	}
+	gen.endLoop(loop)
+
+	gen.tail = oldtail
+	return nil
+}
+
+// (loop [a init b init] body...) binds like let*, (recur x y) rebinds
+// and jumps back to the top of the body
+func (gen *Generator) GenerateLoop(args []Sexp) error {
+	if len(args) < 2 {
+		return errors.New("malformed loop statement")
+	}
+
+	bindings, ok := args[0].(SexpArray)
+	if !ok {
+		return errors.New("loop bindings must be in array")
+	}
+	if len(bindings)%2 != 0 {
+		return errors.New("uneven loop binding list")
+	}
+
+	syms := make([]SexpSymbol, 0, len(bindings)/2)
+	for i := 0; i < len(bindings); i += 2 {
+		sym, ok := bindings[i].(SexpSymbol)
+		if !ok {
+			return errors.New("cannot bind to non-symbol")
+		}
+		syms = append(syms, sym)
+	}
+
+	oldtail := gen.tail
+	gen.tail = false
+
+	loop := gen.beginLoop("loop")
+	loop.bindings = syms
+
+	scope := gen.openScope()
+	for i, sym := range syms {
+		err := gen.Generate(bindings[2*i+1])
+		if err != nil {
+			return err
+		}
+		gen.bind(sym)
+	}
+	enter := len(gen.instructions)
+	gen.AddInstruction(JumpInstr{0})
+
+	// recur lands here with the new values on the stack
+	loop.continueOffset = len(gen.instructions) - loop.loopStart
+	gen.AddInstruction(AddScopeInstr{scope})
+	for i := len(syms) - 1; i >= 0; i-- {
+		gen.bind(syms[i])
+	}
+	gen.instructions[enter] = JumpInstr{len(gen.instructions) - enter}
+
+	// the loop value is the body value, so the body keeps our tail status
+	gen.tail = oldtail
+	err := gen.GenerateBegin(args[1:])
+	if err != nil {
+		return err
+	}
+	gen.closeScope()
+	gen.endLoop(loop)
+
+	gen.tail = oldtail
+	return nil
+}
+
+func (gen *Generator) GenerateRecur(args []Sexp) error {
+	loop, err := gen.innerLoop("recur")
+	if err != nil {
+		return err
+	}
+	if loop.stmtname.name != "loop" {
+		return fmt.Errorf("recur inside %s, recur only targets loop", loop.stmtname.name)
+	}
+	if len(args) != len(loop.bindings) {
+		return fmt.Errorf("recur expected %d arguments, got %d", len(loop.bindings), len(args))
+	}
+
+	oldtail := gen.tail
+	gen.tail = false
+	err = gen.GenerateAll(args)
+	if err != nil {
+		return err
+	}
+	gen.tail = oldtail
+
+	err = gen.leaveLoop(loop, len(args))
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(loopJumpInstr{loop, true})
+	return nil
+}
+
+// (break) or (break value), the loop evaluates to value or ()
+func (gen *Generator) GenerateBreak(args []Sexp) error {
+	loop, err := gen.innerLoop("break")
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return WrongNargs
+	}
+
+	if len(args) == 1 {
+		oldtail := gen.tail
+		gen.tail = false
+		err = gen.Generate(args[0])
+		if err != nil {
+			return err
+		}
+		gen.tail = oldtail
+	} else {
+		gen.AddInstruction(PushInstr{SexpNull})
+	}
+
+	err = gen.leaveLoop(loop, 1)
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(loopJumpInstr{loop, false})
+	return nil
+}
+
+func (gen *Generator) GenerateContinue(args []Sexp) error {
+	loop, err := gen.innerLoop("continue")
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return WrongNargs
+	}
+	if loop.stmtname.name == "loop" {
+		return errors.New("continue inside loop, use recur")
+	}
+
+	err = gen.leaveLoop(loop, 0)
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(loopJumpInstr{loop, true})
+	return nil
+}
+
+// an open try while generating its body or catch clause, scopes is the
+// generator scope count outside the try
+type tryBlock struct {
+	scopes  int
+	finally []Sexp
+}
+
+// the finally clause runs for its side effects only
+func (gen *Generator) generateFinally(body []Sexp) error {
+	if len(body) == 0 {
+		return nil
+	}
+	err := gen.GenerateBegin(body)
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(PopInstr(0))
+	return nil
+}
+
+// splits the body of a try from its (catch sym ...) and (finally ...) clauses
+func tryClauses(args []Sexp) (body []Sexp, catch []Sexp, finally []Sexp, err error) {
+	clauses := len(args)
+	for i, arg := range args {
+		if clauseName(arg) != "" {
+			clauses = i
+			break
+		}
+	}
+	body = args[:clauses]
+
+	for _, arg := range args[clauses:] {
+		name := clauseName(arg)
+		if name == "" {
+			return nil, nil, nil, errors.New("only catch and finally may follow them in a try")
+		}
+		rest, _ := ListToArray(arg.(SexpPair).tail)
+		switch name {
+		case "catch":
+			if catch != nil || finally != nil {
+				return nil, nil, nil, errors.New("catch must come once, before finally")
+			}
+			if len(rest) == 0 {
+				return nil, nil, nil, errors.New("catch needs a symbol to bind")
+			}
+			if _, ok := rest[0].(SexpSymbol); !ok {
+				return nil, nil, nil, errors.New("cannot bind to non-symbol")
+			}
+			catch = rest
+		case "finally":
+			if finally != nil {
+				return nil, nil, nil, errors.New("more than one finally")
+			}
+			finally = append([]Sexp{}, rest...)
+		}
+	}
+
+	if len(body) == 0 {
+		return nil, nil, nil, errors.New("try needs a body")
+	}
+	if catch == nil && finally == nil {
+		return nil, nil, nil, errors.New("try needs a catch or finally")
+	}
+	return body, catch, finally, nil
+}
+
+func clauseName(expr Sexp) string {
+	list, ok := expr.(SexpPair)
+	if !ok || !IsList(list) {
+		return ""
+	}
+	sym, ok := list.head.(SexpSymbol)
+	if !ok || (sym.name != "catch" && sym.name != "finally") {
+		return ""
+	}
+	return sym.name
+}
+
+// (try body... (catch e handler...) (finally cleanup...))
+//
+// the body runs under a handler, an error unwinds to the catch clause with
+// e bound to the thrown value or error. finally runs on the way out either
+// way, if nothing caught the error it's raised again afterwards.
+func (gen *Generator) GenerateTry(args []Sexp) error {
+	body, catch, finally, err := tryClauses(args)
+	if err != nil {
+		return err
+	}
+
+	// nothing in here is a tail call, the handler has to come off first
+	oldtail := gen.tail
+	gen.tail = false
+
+	try := &tryBlock{scopes: gen.scopes, finally: finally}
+
+	start := len(gen.instructions)
+	gen.AddInstruction(TryInstr{0})
+	gen.tries = append(gen.tries, try)
+	err = gen.GenerateBegin(body)
+	if err != nil {
+		return err
+	}
+	gen.tries = gen.tries[:len(gen.tries)-1]
+	gen.AddInstruction(EndTryInstr(0))
+	done := len(gen.instructions)
+	gen.AddInstruction(JumpInstr{0})
+
+	// an error in the catch clause still has to run finally
+	guard := start
+	if catch != nil {
+		gen.instructions[start] = TryInstr{len(gen.instructions) - start}
+		if finally != nil {
+			guard = len(gen.instructions)
+			gen.AddInstruction(TryInstr{0})
+			gen.tries = append(gen.tries, try)
+		}
+
+		gen.openScope()
+		gen.bind(catch[0].(SexpSymbol))
+		if len(catch) > 1 {
+			err = gen.GenerateBegin(catch[1:])
+			if err != nil {
+				return err
+			}
+		} else {
+			gen.AddInstruction(PushInstr{SexpNull})
+		}
+		gen.closeScope()
+
+		if finally != nil {
+			gen.tries = gen.tries[:len(gen.tries)-1]
+			gen.AddInstruction(EndTryInstr(0))
+		}
+	}
+	gen.instructions[done] = JumpInstr{len(gen.instructions) - done}
+
+	if finally != nil {
+		err = gen.generateFinally(finally)
+		if err != nil {
+			return err
+		}
+		skip := len(gen.instructions)
+		gen.AddInstruction(JumpInstr{0})
+
+		// the error is on the stack, raise it again once we've cleaned up
+		gen.instructions[guard] = TryInstr{len(gen.instructions) - guard}
+		err = gen.generateFinally(finally)
+		if err != nil {
+			return err
+		}
+		gen.AddInstruction(ThrowInstr(0))
+		gen.instructions[skip] = JumpInstr{len(gen.instructions) - skip}
+	}
+
+	gen.tail = oldtail
+	return nil
+}
+
+// (throw value) raises value, a catch clause gets it back as is
+func (gen *Generator) GenerateThrow(args []Sexp) error {
+	if len(args) != 1 {
+		return WrongNargs
+	}
+
+	oldtail := gen.tail
+	gen.tail = false
+	err := gen.Generate(args[0])
+	if err != nil {
+		return err
+	}
+	gen.tail = oldtail
+
+	gen.AddInstruction(ThrowInstr(0))
+	return nil
+}
+
+// SpecialForms are the names GenerateCallBySymbol compiles itself rather
+// than calling
+var SpecialForms = []string{
+	"and", "or", "cond", "quote", "def", "fn", "defn", "begin", "let", "let*",
+	"assert", "defmac", "macexpand", "syntax-quote", "include", "import",
+	"while", "dotimes", "doseq", "loop", "recur", "break", "continue", "try",
+	"throw",
+}
+
 func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 	switch sym.name {
 	case "and":
@@ -537,9 +1278,31 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 		return gen.GenerateInclude(args)
 	case "import":
 		return gen.GenerateImport(args)
+	case "while":
+		return gen.GenerateWhile(args)
+	case "dotimes":
+		return gen.GenerateDotimes(args)
+	case "doseq":
+		return gen.GenerateDoseq(args)
+	case "loop":
+		return gen.GenerateLoop(args)
+	case "recur":
+		return gen.GenerateRecur(args)
+	case "break":
+		return gen.GenerateBreak(args)
+	case "continue":
+		return gen.GenerateContinue(args)
+	case "try":
+		return gen.GenerateTry(args)
+	case "throw":
+		return gen.GenerateThrow(args)
+	}
+
+	if sym.name == "apply" && len(args) == 2 {
+		return gen.GenerateApply(args)
 	}
 
-	macro, found := gen.env.macros[sym.number]
+	macro, found := gen.env.registry.macro(sym)
 	if found {
 		// calling Apply on the current environment will screw up
 		// the stack, creating a duplicate environment is safer
@@ -559,12 +1322,16 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 	}
 	if oldtail && sym.name == gen.funcname {
 		// to do a tail call
-		// pop off all the extra scopes
+		// pop off all the extra scopes and swap in a fresh frame,
+		// closures may still hold the old one
 		// then jump to beginning of function
-		for i := 0; i < gen.scopes; i++ {
+		for i := 0; i <= gen.scopes; i++ {
 			gen.AddInstruction(RemoveScopeInstr(0))
 		}
+		gen.AddInstruction(AddScopeInstr{gen.frame})
 		gen.AddInstruction(GotoInstr{0})
+	} else if oldtail {
+		gen.AddInstruction(TailCallInstr{sym, len(args)})
 	} else {
 		gen.AddInstruction(CallInstr{sym, len(args)})
 	}
@@ -573,9 +1340,38 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 }
 
 func (gen *Generator) GenerateDispatch(fun Sexp, args []Sexp) error {
-	gen.GenerateAll(args)
-	gen.Generate(fun)
-	gen.AddInstruction(DispatchInstr{len(args)})
+	oldtail := gen.tail
+	gen.tail = false
+	err := gen.GenerateAll(args)
+	if err != nil {
+		return err
+	}
+	err = gen.Generate(fun)
+	if err != nil {
+		return err
+	}
+	gen.tail = oldtail
+
+	if gen.tail {
+		gen.AddInstruction(TailDispatchInstr{len(args)})
+	} else {
+		gen.AddInstruction(DispatchInstr{len(args)})
+	}
+	return nil
+}
+
+// (apply f args), done by the vm rather than the builtin so it can be a
+// tail call
+func (gen *Generator) GenerateApply(args []Sexp) error {
+	oldtail := gen.tail
+	gen.tail = false
+	err := gen.GenerateAll(args)
+	if err != nil {
+		return err
+	}
+	gen.tail = oldtail
+
+	gen.AddInstruction(ApplyInstr{gen.tail})
 	return nil
 }
 
@@ -589,10 +1385,13 @@ func (gen *Generator) GenerateCall(expr SexpPair) error {
 }
 
 func (gen *Generator) GenerateArray(arr SexpArray) error {
+	oldtail := gen.tail
+	gen.tail = false
 	err := gen.GenerateAll(arr)
 	if err != nil {
 		return err
 	}
+	gen.tail = oldtail
 	gen.AddInstruction(CallInstr{gen.env.MakeSymbol("array"), len(arr)})
 	return nil
 }
@@ -600,15 +1399,18 @@ func (gen *Generator) GenerateArray(arr SexpArray) error {
 func (gen *Generator) Generate(expr Sexp) error {
 	switch e := expr.(type) {
 	case SexpSymbol:
-		gen.AddInstruction(GetInstr{e})
+		gen.lookup(e)
 		return nil
 	case SexpPair:
+		if e.pos != nil {
+			outer := gen.pos
+			gen.pos = e.pos
+			defer func() { gen.pos = outer }()
+		}
 		if IsList(e) {
 			err := gen.GenerateCall(e)
 			if err != nil {
-				return errors.New(
-					fmt.Sprintf("Error generating %s:\n%v",
-						expr.SexpString(), err))
+				return &GenerateError{e.pos, expr, err}
 			}
 			return nil
 		} else {
@@ -623,6 +1425,23 @@ func (gen *Generator) Generate(expr Sexp) error {
 	return nil
 }
 
+// GenerateError is a list that couldn't be compiled. They nest, one for
+// each list the failing one is inside of, so the innermost says where the
+// problem is. Pos is nil for lists made by macros.
+type GenerateError struct {
+	Pos  *SourcePos
+	Expr Sexp
+	Err  error
+}
+
+func (e *GenerateError) Error() string {
+	return fmt.Sprintf("Error generating %s:\n%v", e.Expr.SexpString(), e.Err)
+}
+
+func (e *GenerateError) Unwrap() error {
+	return e.Err
+}
+
 func (gen *Generator) GenerateAll(expressions []Sexp) error {
 	for _, expr := range expressions {
 		err := gen.Generate(expr)
@@ -635,8 +1454,10 @@ func (gen *Generator) GenerateAll(expressions []Sexp) error {
 
 func (gen *Generator) Reset() {
 	gen.instructions = make([]Instruction, 0)
+	gen.positions = make([]*SourcePos, 0)
 	gen.tail = false
 	gen.scopes = 0
+	gen.lexical = nil
 }
 
 // side-effect (or main effect) has to be pushing an expression on the top of
@@ -648,6 +1469,11 @@ func (gen *Generator) GenerateSyntaxQuote(args []Sexp) error {
 	}
 	arg := args[0]
 
+	// the unquoted parts are never in tail position
+	oldtail := gen.tail
+	gen.tail = false
+	defer func() { gen.tail = oldtail }()
+
 	// need to handle arrays, since they can have unquotes
 	// in them too.
 	switch arg.(type) {
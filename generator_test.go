@@ -0,0 +1,127 @@
+package glisp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func generate(t *testing.T, env *Glisp, src string) ([]Instruction, error) {
+	t.Helper()
+	exprs, err := parse(env, src)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", src, err)
+	}
+	gen := NewGenerator(env)
+	err = gen.GenerateBegin(exprs)
+	return gen.instructions, err
+}
+
+func instrStrings(instrs []Instruction) []string {
+	strs := make([]string, len(instrs))
+	for i, instr := range instrs {
+		strs[i] = instr.InstrString()
+	}
+	return strs
+}
+
+func TestGenerator(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"1", []string{"push 1"}},
+		{"(def a 1)", []string{"push 1", "put a", "push ()"}},
+		{"(+ 1 2)", []string{"push 1", "push 2", "call + 2"}},
+		{"(cond true 1 2)", []string{"push true", "brn 3", "push 1", "jump 2", "push 2"}},
+		{"(and 1 2)", []string{"push 1", "dup", "brn 3", "pop", "push 2"}},
+		{"(let [x 1] x)", []string{"add scope", "push 1", "put x (0 0)", "get x (0 0)", "rem scope"}},
+		{"(quote (a b))", []string{"push (a b)"}},
+		{"[1 a]", []string{"push 1", "get a", "call array 2"}},
+	}
+
+	for _, test := range tests {
+		instrs, err := generate(t, NewGlisp(), test.src)
+		if err != nil {
+			t.Errorf("generating %q: %v", test.src, err)
+			continue
+		}
+		if got := instrStrings(instrs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("generating %q gave %q, want %q", test.src, got, test.want)
+		}
+	}
+}
+
+// A function calling itself in tail position loops, calling anything else
+// there is a tail call
+func TestGeneratorTailCalls(t *testing.T) {
+	env := NewGlisp()
+	_, err := env.EvalString(`
+		(defn f [x] (cond (= x 0) x (f (- x 1))))
+		(defn g [x] (f x))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := func(name string) []Instruction {
+		obj, _ := env.FindObject(name)
+		return obj.(SexpFunction).fun
+	}
+
+	loops := false
+	for _, instr := range code("f") {
+		switch instr := instr.(type) {
+		case CallInstr:
+			if instr.sym.name == "f" {
+				t.Errorf("f calls itself: %q", instrStrings(code("f")))
+			}
+		case GotoInstr:
+			loops = instr.location == 0
+		}
+	}
+	if !loops {
+		t.Errorf("f doesn't loop: %q", instrStrings(code("f")))
+	}
+
+	tail := false
+	for _, instr := range code("g") {
+		if call, ok := instr.(TailCallInstr); ok && call.sym.name == "f" {
+			tail = true
+		}
+	}
+	if !tail {
+		t.Errorf("g doesn't tail call f: %q", instrStrings(code("g")))
+	}
+}
+
+func TestGeneratorErrors(t *testing.T) {
+	for _, src := range []string{
+		"(def)",
+		"(def a 1 2)",
+		"(defn f)",
+		"(let [x] x)",
+		"(fn x)",
+		"(loop 2)",
+	} {
+		if _, err := generate(t, NewGlisp(), src); err == nil {
+			t.Errorf("generating %q should fail", src)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	env := NewGlisp()
+	if _, err := env.EvalString("(defn f [x] (cond x 1 2))"); err != nil {
+		t.Fatal(err)
+	}
+	obj, _ := env.FindObject("f")
+	var b strings.Builder
+	if err := Disassemble(&b, obj.(SexpFunction)); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{"(f x)", "brn 3  -> 5", ">    5  push 2"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("disassembly has no %q:\n%s", want, out)
+		}
+	}
+}
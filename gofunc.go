@@ -0,0 +1,600 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var (
+	sexpType     = reflect.TypeOf((*Sexp)(nil)).Elem()
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	envType      = reflect.TypeOf((*Glisp)(nil))
+	durationType = reflect.TypeOf(time.Duration(0))
+	bytesType    = reflect.TypeOf([]byte(nil))
+)
+
+// ErrCycle is wrapped by the error from converting a value that contains
+// itself, which has no end as a Sexp or as a Go value
+var ErrCycle = errors.New("value contains itself")
+
+// AddGoFunc binds an ordinary Go function. Arguments are converted from
+// Sexps by the parameter types, a *Glisp first parameter gets the env and
+// a trailing error result becomes the error of the call.
+func (env *Glisp) AddGoFunc(name string, fn interface{}) error {
+	userfun, err := MakeGoFunction(fn)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	env.AddFunction(name, userfun)
+	return nil
+}
+
+// MakeGoFunction wraps fn as a GlispUserFunction, see AddGoFunc
+func MakeGoFunction(fn interface{}) (GlispUserFunction, error) {
+	fval := reflect.ValueOf(fn)
+	ftype := fval.Type()
+	if ftype.Kind() != reflect.Func {
+		return nil, fmt.Errorf("expected a function got %T", fn)
+	}
+
+	first := 0
+	if ftype.NumIn() > 0 && ftype.In(0) == envType {
+		first = 1
+	}
+	for i := first; i < ftype.NumIn(); i++ {
+		t := ftype.In(i)
+		if ftype.IsVariadic() && i == ftype.NumIn()-1 {
+			t = t.Elem()
+		}
+		if !convertible(t) {
+			return nil, fmt.Errorf("can't convert to parameter %d of type %s", i, t)
+		}
+	}
+
+	results := ftype.NumOut()
+	returnsErr := results > 0 && ftype.Out(results-1) == errorType
+	if returnsErr {
+		results--
+	}
+
+	fixed := ftype.NumIn() - first
+	if ftype.IsVariadic() {
+		fixed--
+	}
+
+	return func(env *Glisp, name string, args []Sexp) (Sexp, error) {
+		if len(args) < fixed || (!ftype.IsVariadic() && len(args) != fixed) {
+			if ftype.IsVariadic() {
+				return SexpNull, fmt.Errorf("expected at least %d arguments got %d", fixed, len(args))
+			}
+			return SexpNull, fmt.Errorf("expected %d arguments got %d", fixed, len(args))
+		}
+
+		in := make([]reflect.Value, 0, first+len(args))
+		if first == 1 {
+			in = append(in, reflect.ValueOf(env))
+		}
+		for i, arg := range args {
+			var t reflect.Type
+			if i < fixed {
+				t = ftype.In(first + i)
+			} else {
+				t = ftype.In(ftype.NumIn() - 1).Elem()
+			}
+			val, err := sexpToValue(arg, t)
+			if err != nil {
+				return SexpNull, fmt.Errorf("argument %d: %w", i, err)
+			}
+			in = append(in, val)
+		}
+
+		out := fval.Call(in)
+
+		if returnsErr {
+			if err, _ := out[results].Interface().(error); err != nil {
+				return SexpNull, err
+			}
+		}
+
+		switch results {
+		case 0:
+			return SexpNull, nil
+		case 1:
+			return valueToSexp(out[0])
+		}
+		arr := make([]Sexp, results)
+		for i := range arr {
+			expr, err := valueToSexp(out[i])
+			if err != nil {
+				return SexpNull, err
+			}
+			arr[i] = expr
+		}
+		return SexpArray(arr), nil
+	}, nil
+}
+
+// convertible reports whether sexpToValue can produce a t
+func convertible(t reflect.Type) bool {
+	return convertibleType(t, make(map[reflect.Type]bool))
+}
+
+// convertibleType is convertible for a type met inside the ones in seen.
+// A type that holds itself, like a linked list node, is taken to be fine
+// when it's met again, what else it holds decides.
+func convertibleType(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == durationType || t == bytesType || t.Implements(sexpType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String, reflect.Bool, reflect.Interface:
+		return true
+	case reflect.Slice, reflect.Pointer, reflect.Map, reflect.Struct:
+		if seen[t] {
+			return true
+		}
+		seen[t] = true
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Pointer:
+		return convertibleType(t.Elem(), seen)
+	case reflect.Map:
+		return convertibleType(t.Key(), seen) && convertibleType(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.IsExported() && !convertibleType(field.Type, seen) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// visiting holds the containers a conversion is inside of, meeting one of
+// them again means it contains itself and converting would never end
+type visiting map[any]bool
+
+func (v visiting) enter(id any, what string) error {
+	if v[id] {
+		return fmt.Errorf("%w: %s", ErrCycle, what)
+	}
+	v[id] = true
+	return nil
+}
+
+// goVisit identifies a Go pointer, map or slice, the type tells a struct
+// from its first field
+type goVisit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// sexpIdentity is what copies of a hash or array share, for the ones that
+// could contain themselves
+func sexpIdentity(expr Sexp) (any, bool) {
+	switch e := expr.(type) {
+	case SexpHash:
+		return e.KeyOrder, true
+	case SexpArray:
+		if len(e) > 0 {
+			return &e[0], true
+		}
+	}
+	return nil, false
+}
+
+func typeError(expr Sexp, t reflect.Type) error {
+	return fmt.Errorf("expected %s got %T", t, expr)
+}
+
+// sexpToValue converts expr to a Go value of type t
+func sexpToValue(expr Sexp, t reflect.Type) (reflect.Value, error) {
+	return toValue(expr, t, make(visiting))
+}
+
+func toValue(expr Sexp, t reflect.Type, path visiting) (reflect.Value, error) {
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		v, err := sexpToInterface(expr, path)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(&[]interface{}{v}[0]).Elem(), nil
+	}
+	if reflect.TypeOf(expr).AssignableTo(t) {
+		val := reflect.New(t).Elem()
+		val.Set(reflect.ValueOf(expr))
+		return val, nil
+	}
+
+	val := reflect.New(t).Elem()
+
+	if expr == SexpNull {
+		switch t.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Pointer:
+			return val, nil
+		}
+		return val, typeError(expr, t)
+	}
+
+	if t == durationType {
+		switch e := expr.(type) {
+		case SexpInt:
+			val.SetInt(int64(time.Duration(e) * time.Millisecond))
+			return val, nil
+		case SexpStr:
+			d, err := time.ParseDuration(string(e))
+			if err != nil {
+				return val, err
+			}
+			val.SetInt(int64(d))
+			return val, nil
+		}
+		return val, typeError(expr, t)
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch e := expr.(type) {
+		case SexpInt:
+			i = int64(e)
+		case SexpChar:
+			i = int64(e)
+		default:
+			return val, typeError(expr, t)
+		}
+		if val.OverflowInt(i) {
+			return val, fmt.Errorf("%d overflows %s", i, t)
+		}
+		val.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var i int64
+		switch e := expr.(type) {
+		case SexpInt:
+			i = int64(e)
+		case SexpChar:
+			i = int64(e)
+		default:
+			return val, typeError(expr, t)
+		}
+		if i < 0 || val.OverflowUint(uint64(i)) {
+			return val, fmt.Errorf("%d overflows %s", i, t)
+		}
+		val.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		switch e := expr.(type) {
+		case SexpFloat:
+			val.SetFloat(float64(e))
+		case SexpInt:
+			val.SetFloat(float64(e))
+		default:
+			return val, typeError(expr, t)
+		}
+	case reflect.String:
+		switch e := expr.(type) {
+		case SexpStr:
+			val.SetString(string(e))
+		case SexpSymbol:
+			val.SetString(e.name)
+		case SexpChar:
+			val.SetString(string(rune(e)))
+		default:
+			return val, typeError(expr, t)
+		}
+	case reflect.Bool:
+		b, ok := expr.(SexpBool)
+		if !ok {
+			return val, typeError(expr, t)
+		}
+		val.SetBool(bool(b))
+	case reflect.Slice:
+		if t == bytesType {
+			switch e := expr.(type) {
+			case SexpData:
+				val.SetBytes([]byte(e))
+				return val, nil
+			case SexpStr:
+				val.SetBytes([]byte(e))
+				return val, nil
+			}
+		}
+		var items []Sexp
+		switch e := expr.(type) {
+		case SexpArray:
+			items = e
+		case SexpPair:
+			arr, err := ListToArray(e)
+			if err != nil {
+				return val, err
+			}
+			items = arr
+		default:
+			return val, typeError(expr, t)
+		}
+		if id, ok := sexpIdentity(expr); ok {
+			if err := path.enter(id, "the array holds itself"); err != nil {
+				return val, err
+			}
+			defer delete(path, id)
+		}
+		val.Set(reflect.MakeSlice(t, len(items), len(items)))
+		for i, item := range items {
+			elem, err := toValue(item, t.Elem(), path)
+			if err != nil {
+				return val, fmt.Errorf("index %d: %w", i, err)
+			}
+			val.Index(i).Set(elem)
+		}
+	case reflect.Map:
+		hash, ok := expr.(SexpHash)
+		if !ok {
+			return val, typeError(expr, t)
+		}
+		if err := path.enter(hash.KeyOrder, "the hash holds itself"); err != nil {
+			return val, err
+		}
+		defer delete(path, hash.KeyOrder)
+		pairs, err := hashPairs(hash)
+		if err != nil {
+			return val, err
+		}
+		val.Set(reflect.MakeMapWithSize(t, len(pairs)))
+		for _, pair := range pairs {
+			k, err := toValue(pair.head, t.Key(), path)
+			if err != nil {
+				return val, fmt.Errorf("key %s: %w", pair.head.SexpString(), err)
+			}
+			v, err := toValue(pair.tail, t.Elem(), path)
+			if err != nil {
+				return val, fmt.Errorf("key %s: %w", pair.head.SexpString(), err)
+			}
+			val.SetMapIndex(k, v)
+		}
+	case reflect.Struct:
+		hash, ok := expr.(SexpHash)
+		if !ok {
+			return val, typeError(expr, t)
+		}
+		if err := path.enter(hash.KeyOrder, "the hash holds itself"); err != nil {
+			return val, err
+		}
+		defer delete(path, hash.KeyOrder)
+		pairs, err := hashPairs(hash)
+		if err != nil {
+			return val, err
+		}
+		for _, pair := range pairs {
+			key, ok := keyName(pair.head)
+			if !ok {
+				continue
+			}
+			i, ok := structField(t, key)
+			if !ok {
+				continue
+			}
+			v, err := toValue(pair.tail, t.Field(i).Type, path)
+			if err != nil {
+				return val, fmt.Errorf("field %s: %w", key, err)
+			}
+			val.Field(i).Set(v)
+		}
+	case reflect.Pointer:
+		if hash, ok := expr.(SexpHash); ok {
+			if st, ok := hash.goStruct(); ok && st.Addr().Type() == t {
+				val.Set(st.Addr())
+				return val, nil
+			}
+		}
+		elem, err := toValue(expr, t.Elem(), path)
+		if err != nil {
+			return val, err
+		}
+		val.Set(reflect.New(t.Elem()))
+		val.Elem().Set(elem)
+	default:
+		return val, typeError(expr, t)
+	}
+	return val, nil
+}
+
+// sexpToInterface picks the natural Go type for an interface{} parameter
+func sexpToInterface(expr Sexp, path visiting) (interface{}, error) {
+	if id, ok := sexpIdentity(expr); ok {
+		if err := path.enter(id, "the "+TypeName(expr)+" holds itself"); err != nil {
+			return nil, err
+		}
+		defer delete(path, id)
+	}
+
+	switch e := expr.(type) {
+	case SexpInt:
+		return int(e), nil
+	case SexpFloat:
+		return float64(e), nil
+	case SexpStr:
+		return string(e), nil
+	case SexpBool:
+		return bool(e), nil
+	case SexpChar:
+		return rune(e), nil
+	case SexpData:
+		return []byte(e), nil
+	case SexpArray:
+		arr := make([]interface{}, len(e))
+		for i, item := range e {
+			v, err := sexpToInterface(item, path)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = v
+		}
+		return arr, nil
+	case SexpPair:
+		if items, err := ListToArray(e); err == nil {
+			return sexpToInterface(SexpArray(items), path)
+		}
+	case SexpHash:
+		pairs, err := hashPairs(e)
+		if err != nil {
+			break
+		}
+		m := make(map[string]interface{}, len(pairs))
+		for _, pair := range pairs {
+			if key, ok := keyName(pair.head); ok {
+				v, err := sexpToInterface(pair.tail, path)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+			}
+		}
+		return m, nil
+	}
+	if expr == SexpNull {
+		return nil, nil
+	}
+	return expr, nil
+}
+
+// hashPairs returns the live entries of a hash in key order
+func hashPairs(hash SexpHash) ([]SexpPair, error) {
+	pairs := make([]SexpPair, 0, len(*hash.KeyOrder))
+	for _, key := range *hash.KeyOrder {
+		val, err := hash.HashGetDefault(key, SexpEnd)
+		if err != nil {
+			return nil, err
+		}
+		if val == SexpEnd {
+			continue
+		}
+		pairs = append(pairs, Cons(key, val))
+	}
+	return pairs, nil
+}
+
+func keyName(key Sexp) (string, bool) {
+	switch k := key.(type) {
+	case SexpStr:
+		return string(k), true
+	case SexpSymbol:
+		return k.name, true
+	}
+	return "", false
+}
+
+// valueToSexp converts a Go result back into a Sexp
+func valueToSexp(val reflect.Value) (Sexp, error) {
+	return toSexp(val, make(visiting))
+}
+
+func toSexp(val reflect.Value, path visiting) (Sexp, error) {
+	if !val.IsValid() {
+		return SexpNull, nil
+	}
+	if val.Type().Implements(sexpType) {
+		if val.Kind() == reflect.Interface && val.IsNil() {
+			return SexpNull, nil
+		}
+		return val.Interface().(Sexp), nil
+	}
+	if val.Type() == durationType {
+		return SexpInt(val.Interface().(time.Duration) / time.Millisecond), nil
+	}
+
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return SexpInt(val.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return SexpInt(val.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return SexpFloat(val.Float()), nil
+	case reflect.String:
+		return SexpStr(val.String()), nil
+	case reflect.Bool:
+		return SexpBool(val.Bool()), nil
+	case reflect.Interface:
+		if val.IsNil() {
+			return SexpNull, nil
+		}
+		return toSexp(val.Elem(), path)
+	case reflect.Pointer:
+		if val.IsNil() {
+			return SexpNull, nil
+		}
+		id := goVisit{val.Pointer(), val.Type(), 0}
+		if err := path.enter(id, "a "+val.Type().String()+" points back to itself"); err != nil {
+			return SexpNull, err
+		}
+		defer delete(path, id)
+		return toSexp(val.Elem(), path)
+	case reflect.Slice, reflect.Array:
+		if val.Type() == bytesType {
+			return SexpData(val.Bytes()), nil
+		}
+		if val.Kind() == reflect.Slice && val.Len() > 0 {
+			id := goVisit{val.Pointer(), val.Type(), val.Len()}
+			if err := path.enter(id, "a "+val.Type().String()+" holds itself"); err != nil {
+				return SexpNull, err
+			}
+			defer delete(path, id)
+		}
+		arr := make([]Sexp, val.Len())
+		for i := range arr {
+			expr, err := toSexp(val.Index(i), path)
+			if err != nil {
+				return SexpNull, err
+			}
+			arr[i] = expr
+		}
+		return SexpArray(arr), nil
+	case reflect.Map:
+		if !val.IsNil() {
+			id := goVisit{val.Pointer(), val.Type(), 0}
+			if err := path.enter(id, "a "+val.Type().String()+" holds itself"); err != nil {
+				return SexpNull, err
+			}
+			defer delete(path, id)
+		}
+		hash, _ := MakeHash(nil, val.Type().String())
+		iter := val.MapRange()
+		for iter.Next() {
+			k, err := toSexp(iter.Key(), path)
+			if err != nil {
+				return SexpNull, err
+			}
+			v, err := toSexp(iter.Value(), path)
+			if err != nil {
+				return SexpNull, err
+			}
+			if err = hash.HashSet(k, v); err != nil {
+				return SexpNull, err
+			}
+		}
+		return hash, nil
+	case reflect.Struct:
+		hash, _ := MakeHash(nil, val.Type().Name())
+		for i := 0; i < val.NumField(); i++ {
+			name, ok := fieldName(val.Type().Field(i))
+			if !ok || !convertible(val.Type().Field(i).Type) {
+				continue
+			}
+			v, err := toSexp(val.Field(i), path)
+			if err != nil {
+				return SexpNull, err
+			}
+			hash.HashSet(SexpStr(name), v)
+		}
+		if val.CanAddr() {
+			*hash.GoStruct = val.Addr().Interface()
+		}
+		return hash, nil
+	}
+	return SexpNull, errors.New("can't convert " + val.Type().String() + " to a sexp")
+}
@@ -0,0 +1,182 @@
+package glisp_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrhlnd/glisp"
+)
+
+type Node struct {
+	Val  int
+	Next *Node
+}
+
+type Config struct {
+	Name    string `glisp:"name"`
+	Retries int    `glisp:"retries"`
+	Tags    []string
+	secret  chan int
+}
+
+func goFuncEnv(t *testing.T, funcs map[string]interface{}) *glisp.Glisp {
+	t.Helper()
+	env := glisp.NewGlisp()
+	for name, fn := range funcs {
+		if err := env.AddGoFunc(name, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return env
+}
+
+func TestGoFunc(t *testing.T) {
+	env := goFuncEnv(t, map[string]interface{}{
+		"add":   func(a, b int) int { return a + b },
+		"scale": func(x float64, by int8) float64 { return x * float64(by) },
+		"sum": func(xs ...int) int {
+			total := 0
+			for _, x := range xs {
+				total += x
+			}
+			return total
+		},
+		"join":   func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"upper":  func(b []byte) []byte { return []byte(strings.ToUpper(string(b))) },
+		"not":    func(b bool) bool { return !b },
+		"millis": func(d time.Duration) int64 { return d.Milliseconds() },
+		"count":  func(m map[string]int) int { return len(m) },
+		"split":  func(s string) (string, string) { a, b, _ := strings.Cut(s, "="); return a, b },
+		"div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, errors.New("no dividing by zero")
+			}
+			return a / b, nil
+		},
+		"check": func(ok bool) error {
+			if !ok {
+				return errors.New("not ok")
+			}
+			return nil
+		},
+		"name":   func(c Config) string { return fmt.Sprintf("%s/%d/%v", c.Name, c.Retries, c.Tags) },
+		"config": func() *Config { return &Config{Name: "made", Retries: 2} },
+		"length": func(n *Node) int {
+			count := 0
+			for ; n != nil; n = n.Next {
+				count++
+			}
+			return count
+		},
+		"nodes": func(n int) *Node {
+			var head *Node
+			for i := n; i > 0; i-- {
+				head = &Node{i, head}
+			}
+			return head
+		},
+		"kind":   func(x interface{}) string { return fmt.Sprintf("%T", x) },
+		"global": func(env *glisp.Glisp, name string) bool { _, ok := env.FindObject(name); return ok },
+	})
+
+	tests := []struct {
+		src, want string
+	}{
+		{"(add 1 2)", "3"},
+		{"(scale 1.5 2)", "3"},
+		{"(sum)", "0"},
+		{"(sum 1 2 3)", "6"},
+		{`(join "-")`, `""`},
+		{`(join "-" "a" "b")`, `"a-b"`},
+		{`(upper "abc")`, "<65,66,67>"},
+		{"(not false)", "true"},
+		{"(millis 250)", "250"},
+		{`(millis "2s")`, "2000"},
+		{"(count {'a 1 'b 2})", "2"},
+		{`(split "k=v")`, `["k" "v"]`},
+		{"(div 7 2)", "3"},
+		{"(check true)", "()"},
+		{`(name {'name "x" 'retries 3 'Tags ["a"]})`, "\"x/3/[a]\""},
+		{`(hget (config) "name")`, `"made"`},
+		{"(length (nodes 4))", "4"},
+		{"(hget (hget (nodes 2) \"Next\") \"Val\")", "2"},
+		{"(length {'Val 1 'Next {'Val 2 'Next {'Val 3}}})", "3"},
+		{"(length ())", "0"},
+		{"(kind [1 \"a\"])", `"[]interface {}"`},
+		{"(kind {'a 1})", `"map[string]interface {}"`},
+		{"(global \"add\")", "true"},
+	}
+	for _, test := range tests {
+		expr, err := env.EvalString(test.src)
+		if err != nil {
+			t.Errorf("%s failed: %v", test.src, err)
+		} else if expr.SexpString() != test.want {
+			t.Errorf("%s gave %s, expected %s", test.src, expr.SexpString(), test.want)
+		}
+		env.Clear()
+	}
+}
+
+func TestGoFuncErrors(t *testing.T) {
+	env := goFuncEnv(t, map[string]interface{}{
+		"add":    func(a, b int) int { return a + b },
+		"small":  func(x int8) int8 { return x },
+		"count":  func(x uint) uint { return x },
+		"join":   func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"div":    func(a, b int) (int, error) { return 0, errors.New("no dividing by zero") },
+		"words":  func(words []string) int { return len(words) },
+		"length": func(n *Node) int { return 0 },
+		"any":    func(x interface{}) int { return 0 },
+		"cycle": func() *Node {
+			n := &Node{Val: 1}
+			n.Next = n
+			return n
+		},
+		"loops": func() []interface{} {
+			s := []interface{}{1}
+			s[0] = s
+			return s
+		},
+	})
+
+	tests := []struct {
+		src, err string
+	}{
+		{"(add 1)", "expected 2 arguments got 1"},
+		{"(add 1 2 3)", "expected 2 arguments got 3"},
+		{"(join)", "expected at least 1 arguments got 0"},
+		{`(add "1" 2)`, "argument 0: expected int got glisp.SexpStr"},
+		{`(join "," "a" 3)`, "argument 2: expected string got glisp.SexpInt"},
+		{"(small 300)", "argument 0: 300 overflows int8"},
+		{"(count -1)", "argument 0: -1 overflows uint"},
+		{"(div 1 0)", "no dividing by zero"},
+		{`(words ["a" 2])`, "argument 0: index 1: expected string got glisp.SexpInt"},
+		{`(length {'Val "one"})`, "argument 0: field Val: expected int got glisp.SexpStr"},
+		{"(def h {'Val 1}) (hset! h 'Next h) (length h)", "value contains itself"},
+		{"(def a [1]) (aset! a 0 a) (any a)", "value contains itself"},
+		{"(cycle)", "value contains itself"},
+		{"(loops)", "value contains itself"},
+	}
+	for _, test := range tests {
+		_, err := env.EvalString(test.src)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s gave %v, expected %q", test.src, err, test.err)
+		}
+		env.Clear()
+	}
+
+	bad := []interface{}{
+		42,
+		func(c chan int) {},
+		func(x int, f func()) {},
+		func(m map[string]chan int) {},
+	}
+	for _, fn := range bad {
+		if _, err := glisp.MakeGoFunction(fn); err == nil {
+			t.Errorf("%T was bound", fn)
+		}
+	}
+}
@@ -40,7 +40,7 @@ func FoldrHash(env *Glisp, fun SexpFunction, hash SexpHash, acc Sexp) (Sexp, err
 			return acc, fmt.Errorf("Inconsistant hash object, got SexpEnd while walking the ordered list")
 		}
 
-		acc, err = env.Apply(fun, []Sexp{SexpPair{key, val}, acc})
+		acc, err = env.Apply(fun, []Sexp{Cons(key, val), acc})
 		if err != nil {
 			return acc, err
 		}
@@ -62,7 +62,7 @@ func FoldlHash(env *Glisp, fun SexpFunction, hash SexpHash, acc Sexp) (Sexp, err
 			return acc, fmt.Errorf("Inconsistant hash object, got SexpEnd while walking the ordered list")
 		}
 
-		acc, err = env.Apply(fun, []Sexp{SexpPair{key, val}, acc})
+		acc, err = env.Apply(fun, []Sexp{Cons(key, val), acc})
 		if err != nil {
 			return acc, err
 		}
@@ -88,7 +88,7 @@ func MapHash(env *Glisp, fun SexpFunction, hash SexpHash) (SexpArray, error) {
 			return SexpArray(result), fmt.Errorf("Inconsistant hash object, got SexpEnd while walking the ordered list")
 		}
 
-		result[i], err = env.Apply(fun, []Sexp{SexpPair{key, val}})
+		result[i], err = env.Apply(fun, []Sexp{Cons(key, val)})
 		if err != nil {
 			return SexpArray(result), err
 		}
@@ -168,6 +168,9 @@ func (hash *SexpHash) HashSet(key Sexp, val Sexp) error {
 	if err != nil {
 		return err
 	}
+	if err = hash.writeThrough(key, val); err != nil {
+		return err
+	}
 	arr, ok := hash.Map[hashval]
 
 	if !ok {
@@ -202,6 +205,9 @@ func (hash *SexpHash) HashDelete(key Sexp) error {
 	if err != nil {
 		return err
 	}
+	if err = hash.writeThrough(key, SexpEnd); err != nil {
+		return err
+	}
 	arr, ok := hash.Map[hashval]
 
 	// if it doesn't exist, no need to delete it
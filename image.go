@@ -0,0 +1,967 @@
+package glisp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// A compiled image is the code the generator made for a script, saved so
+// the script doesn't have to be parsed and compiled again. It's laid out
+// as the header, the files included into it, the glisp macros and
+// imports the compile registered and then the main function.
+//
+// Symbols are written by name and interned again when the image is
+// loaded, the first use of a symbol, scope layout or file name carries
+// its definition and later ones refer back to it. Functions written in Go
+// can't be saved, a reference to one is written as the name it's bound to
+// and looked up on load.
+
+const imageMagic = "GLISPIMG"
+
+// bumped whenever the layout below changes
+const imageFormat = 3
+
+// ErrImageVersion is wrapped by the error loading an image made by
+// another version of glisp
+var ErrImageVersion = errors.New("compiled image version mismatch")
+
+const (
+	opJump byte = iota + 1
+	opGoto
+	opBranch
+	opPushClosure
+	opPush
+	opPop
+	opDup
+	opGet
+	opPut
+	opGetLocal
+	opSetLocal
+	opCall
+	opTailCall
+	opDispatch
+	opTailDispatch
+	opApply
+	opReturn
+	opAddScope
+	opRemoveScope
+	opExplode
+	opSquash
+	opBindlist
+	opVectorize
+	opHashize
+	opStackDepth
+	opUnwind
+	opSeq
+	opTry
+	opEndTry
+	opThrow
+)
+
+const (
+	tagSentinel byte = iota + 1
+	tagInt
+	tagFloat
+	tagBool
+	tagChar
+	tagStr
+	tagData
+	tagSymbol
+	tagList
+	tagArray
+	tagHash
+	tagFunction
+	tagGoFunction
+)
+
+// positions, see writePos
+const (
+	posNone = iota
+	posSame
+	posNew
+)
+
+type imageWriter struct {
+	buf     []byte
+	symbols map[int]int
+	scopes  map[*lexScope]int
+	files   map[string]int
+	lastpos *SourcePos
+}
+
+// CompileToWriter saves everything loaded into env so far, and the macros
+// it knows, as an image LoadCompiled can read back
+func (env *Glisp) CompileToWriter(w io.Writer) error {
+	return env.writeImage(w, env.mainfunc,
+		env.registry.scriptMacros(true), env.registry.importNames(true), nil)
+}
+
+// LoadCompiled loads an image like LoadExpressions loads source
+func (env *Glisp) LoadCompiled(r io.Reader) error {
+	main, err := env.readImage(r, nil)
+	if err != nil {
+		return err
+	}
+	env.mainfunc.fun = append(env.mainfunc.fun, main.fun...)
+	env.mainfunc.info = &funcInfo{
+		positions: append(env.mainfunc.info.positions, main.info.positions...),
+	}
+	env.curfunc = env.mainfunc
+	return nil
+}
+
+func (env *Glisp) writeImage(w io.Writer, main SexpFunction,
+	macros map[SexpSymbol]SexpFunction, imports []string, sources []sourceFile) error {
+	iw := &imageWriter{
+		symbols: make(map[int]int),
+		scopes:  make(map[*lexScope]int),
+		files:   make(map[string]int),
+	}
+	iw.writeString(imageMagic)
+	iw.writeUint(imageFormat)
+	iw.writeString(Version())
+
+	iw.writeUint(len(sources))
+	for _, src := range sources {
+		iw.writeString(src.file)
+		iw.writeString(string(src.sum[:]))
+	}
+
+	// sorted so the same script always makes the same image
+	syms := make([]SexpSymbol, 0, len(macros))
+	for sym := range macros {
+		syms = append(syms, sym)
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i].name < syms[j].name })
+	iw.writeUint(len(syms))
+	for _, sym := range syms {
+		iw.writeSymbol(sym)
+		if err := iw.writeFunction(macros[sym]); err != nil {
+			return fmt.Errorf("macro %s: %v", sym.name, err)
+		}
+	}
+
+	sort.Strings(imports)
+	iw.writeUint(len(imports))
+	for _, name := range imports {
+		iw.writeString(name)
+	}
+
+	if err := iw.writeFunction(main); err != nil {
+		return err
+	}
+	_, err := w.Write(iw.buf)
+	return err
+}
+
+func (iw *imageWriter) writeUint(n int) {
+	iw.buf = binary.AppendUvarint(iw.buf, uint64(n))
+}
+
+func (iw *imageWriter) writeInt(n int) {
+	iw.buf = binary.AppendVarint(iw.buf, int64(n))
+}
+
+func (iw *imageWriter) writeBool(b bool) {
+	if b {
+		iw.buf = append(iw.buf, 1)
+	} else {
+		iw.buf = append(iw.buf, 0)
+	}
+}
+
+func (iw *imageWriter) writeString(s string) {
+	iw.writeUint(len(s))
+	iw.buf = append(iw.buf, s...)
+}
+
+func (iw *imageWriter) writeSymbol(sym SexpSymbol) {
+	if i, ok := iw.symbols[sym.number]; ok {
+		iw.writeUint(i)
+		return
+	}
+	i := len(iw.symbols)
+	iw.symbols[sym.number] = i
+	iw.writeUint(i)
+	iw.writeString(sym.name)
+}
+
+func (iw *imageWriter) writeSymbols(syms []SexpSymbol) {
+	iw.writeUint(len(syms))
+	for _, sym := range syms {
+		iw.writeSymbol(sym)
+	}
+}
+
+// writeScope keeps instructions that shared a lexScope sharing it
+func (iw *imageWriter) writeScope(scope *lexScope) {
+	if i, ok := iw.scopes[scope]; ok {
+		iw.writeUint(i)
+		return
+	}
+	i := len(iw.scopes)
+	iw.scopes[scope] = i
+	iw.writeUint(i)
+	iw.writeSymbols(scope.syms)
+}
+
+// writePos, runs of instructions mostly come from the same expression
+func (iw *imageWriter) writePos(pos *SourcePos) {
+	switch {
+	case pos == nil:
+		iw.writeUint(posNone)
+	case iw.lastpos != nil && *pos == *iw.lastpos:
+		iw.writeUint(posSame)
+	default:
+		iw.writeUint(posNew)
+		if i, ok := iw.files[pos.File]; ok {
+			iw.writeUint(i)
+		} else {
+			i = len(iw.files)
+			iw.files[pos.File] = i
+			iw.writeUint(i)
+			iw.writeString(pos.File)
+		}
+		iw.writeInt(pos.Line)
+		iw.writeInt(pos.Col)
+	}
+	iw.lastpos = pos
+}
+
+func (iw *imageWriter) writeFunction(f SexpFunction) error {
+	iw.writeString(f.name)
+	iw.writeInt(f.nargs)
+	iw.writeBool(f.varargs)
+
+	var positions []*SourcePos
+	var frame []SexpSymbol
+	var params []string
+	var doc string
+	if f.info != nil {
+		positions = f.info.positions
+		frame = f.info.frame
+		params = f.info.params
+		doc = f.info.doc
+	}
+	iw.writeSymbols(frame)
+	iw.writeUint(len(params))
+	for _, param := range params {
+		iw.writeString(param)
+	}
+	iw.writeString(doc)
+
+	iw.writeUint(len(f.fun))
+	for i, instr := range f.fun {
+		if err := iw.writeInstr(instr); err != nil {
+			return fmt.Errorf("%s instruction %d: %v", f.name, i, err)
+		}
+		var pos *SourcePos
+		if i < len(positions) {
+			pos = positions[i]
+		}
+		iw.writePos(pos)
+	}
+	return nil
+}
+
+func (iw *imageWriter) writeInstr(instr Instruction) error {
+	switch i := instr.(type) {
+	case JumpInstr:
+		iw.buf = append(iw.buf, opJump)
+		iw.writeInt(i.location)
+	case GotoInstr:
+		iw.buf = append(iw.buf, opGoto)
+		iw.writeInt(i.location)
+	case BranchInstr:
+		iw.buf = append(iw.buf, opBranch)
+		iw.writeBool(i.direction)
+		iw.writeInt(i.location)
+	case PushInstrClosure:
+		iw.buf = append(iw.buf, opPushClosure)
+		return iw.writeFunction(i.expr)
+	case PushInstr:
+		iw.buf = append(iw.buf, opPush)
+		return iw.writeValue(i.expr)
+	case PopInstr:
+		iw.buf = append(iw.buf, opPop)
+	case DupInstr:
+		iw.buf = append(iw.buf, opDup)
+	case GetInstr:
+		iw.buf = append(iw.buf, opGet)
+		iw.writeSymbol(i.sym)
+	case PutInstr:
+		iw.buf = append(iw.buf, opPut)
+		iw.writeSymbol(i.sym)
+	case GetLocalInstr:
+		iw.buf = append(iw.buf, opGetLocal)
+		iw.writeUint(i.depth)
+		iw.writeUint(i.slot)
+		iw.writeSymbol(i.sym)
+	case SetLocalInstr:
+		iw.buf = append(iw.buf, opSetLocal)
+		iw.writeUint(i.depth)
+		iw.writeUint(i.slot)
+		iw.writeSymbol(i.sym)
+	case CallInstr:
+		iw.buf = append(iw.buf, opCall)
+		iw.writeSymbol(i.sym)
+		iw.writeUint(i.nargs)
+	case TailCallInstr:
+		iw.buf = append(iw.buf, opTailCall)
+		iw.writeSymbol(i.sym)
+		iw.writeUint(i.nargs)
+	case DispatchInstr:
+		iw.buf = append(iw.buf, opDispatch)
+		iw.writeUint(i.nargs)
+	case TailDispatchInstr:
+		iw.buf = append(iw.buf, opTailDispatch)
+		iw.writeUint(i.nargs)
+	case ApplyInstr:
+		iw.buf = append(iw.buf, opApply)
+		iw.writeBool(i.tail)
+	case ReturnInstr:
+		iw.buf = append(iw.buf, opReturn)
+		iw.writeBool(i.err != nil)
+		if i.err != nil {
+			iw.writeString(i.err.Error())
+		}
+	case AddScopeInstr:
+		iw.buf = append(iw.buf, opAddScope)
+		iw.writeScope(i.scope)
+	case RemoveScopeInstr:
+		iw.buf = append(iw.buf, opRemoveScope)
+	case ExplodeInstr:
+		iw.buf = append(iw.buf, opExplode)
+	case SquashInstr:
+		iw.buf = append(iw.buf, opSquash)
+	case BindlistInstr:
+		iw.buf = append(iw.buf, opBindlist)
+		iw.writeSymbols(i.syms)
+	case VectorizeInstr:
+		iw.buf = append(iw.buf, opVectorize)
+	case HashizeInstr:
+		iw.buf = append(iw.buf, opHashize)
+		iw.writeInt(i.HashLen)
+		iw.writeString(i.TypeName)
+	case StackDepthInstr:
+		iw.buf = append(iw.buf, opStackDepth)
+	case UnwindInstr:
+		iw.buf = append(iw.buf, opUnwind)
+		iw.writeUint(i.keep)
+	case SeqInstr:
+		iw.buf = append(iw.buf, opSeq)
+	case TryInstr:
+		iw.buf = append(iw.buf, opTry)
+		iw.writeInt(i.location)
+	case EndTryInstr:
+		iw.buf = append(iw.buf, opEndTry)
+	case ThrowInstr:
+		iw.buf = append(iw.buf, opThrow)
+	default:
+		return fmt.Errorf("can't save instruction %T", instr)
+	}
+	return nil
+}
+
+func (iw *imageWriter) writeValue(expr Sexp) error {
+	switch e := expr.(type) {
+	case SexpSentinel:
+		iw.buf = append(iw.buf, tagSentinel)
+		iw.writeUint(int(e))
+	case SexpInt:
+		iw.buf = append(iw.buf, tagInt)
+		iw.writeInt(int(e))
+	case SexpFloat:
+		iw.buf = append(iw.buf, tagFloat)
+		iw.buf = binary.LittleEndian.AppendUint64(iw.buf, math.Float64bits(float64(e)))
+	case SexpBool:
+		iw.buf = append(iw.buf, tagBool)
+		iw.writeBool(bool(e))
+	case SexpChar:
+		iw.buf = append(iw.buf, tagChar)
+		iw.writeInt(int(e))
+	case SexpStr:
+		iw.buf = append(iw.buf, tagStr)
+		iw.writeString(string(e))
+	case SexpData:
+		iw.buf = append(iw.buf, tagData)
+		iw.writeString(string(e))
+	case SexpSymbol:
+		iw.buf = append(iw.buf, tagSymbol)
+		iw.writeSymbol(e)
+	case SexpPair:
+		// the pairs of a list one after the other, so long lists don't
+		// recurse
+		var pairs []SexpPair
+		var tail Sexp = e
+		for {
+			pair, ok := tail.(SexpPair)
+			if !ok {
+				break
+			}
+			pairs = append(pairs, pair)
+			tail = pair.tail
+		}
+		iw.buf = append(iw.buf, tagList)
+		iw.writeUint(len(pairs))
+		for _, pair := range pairs {
+			if err := iw.writeValue(pair.head); err != nil {
+				return err
+			}
+			iw.writePos(pair.pos)
+		}
+		return iw.writeValue(tail)
+	case SexpArray:
+		iw.buf = append(iw.buf, tagArray)
+		iw.writeUint(len(e))
+		for _, item := range e {
+			if err := iw.writeValue(item); err != nil {
+				return err
+			}
+		}
+	case SexpHash:
+		iw.buf = append(iw.buf, tagHash)
+		iw.writeString(*e.TypeName)
+		iw.writeUint(len(*e.KeyOrder))
+		for _, key := range *e.KeyOrder {
+			val, err := e.HashGet(key)
+			if err != nil {
+				return err
+			}
+			if err := iw.writeValue(key); err != nil {
+				return err
+			}
+			if err := iw.writeValue(val); err != nil {
+				return err
+			}
+		}
+	case SexpFunction:
+		if e.user {
+			iw.buf = append(iw.buf, tagGoFunction)
+			iw.writeString(e.name)
+			return nil
+		}
+		iw.buf = append(iw.buf, tagFunction)
+		return iw.writeFunction(e)
+	default:
+		return fmt.Errorf("can't save constant %s of type %T", expr.SexpString(), expr)
+	}
+	return nil
+}
+
+type imageReader struct {
+	env     *Glisp
+	r       *bufio.Reader
+	symbols []SexpSymbol
+	scopes  []*lexScope
+	files   []string
+	lastpos *SourcePos
+}
+
+// readImage reads an image, registering its macros and imports with env,
+// and returns its main function. If fresh is given it's asked whether the
+// files included into the image are as they were, before anything is
+// registered.
+func (env *Glisp) readImage(r io.Reader, fresh func([]sourceFile) bool) (SexpFunction, error) {
+	ir := &imageReader{env: env, r: bufio.NewReader(r)}
+
+	magic, err := ir.readString()
+	if err != nil || magic != imageMagic {
+		return MissingFunction, errors.New("not a compiled glisp image")
+	}
+	format, err := ir.readUint()
+	if err != nil {
+		return MissingFunction, err
+	}
+	version, err := ir.readString()
+	if err != nil {
+		return MissingFunction, err
+	}
+	if format != imageFormat || version != Version() {
+		return MissingFunction, fmt.Errorf("%w: image is %s format %d, this is %s format %d",
+			ErrImageVersion, version, format, Version(), imageFormat)
+	}
+
+	nsources, err := ir.readUint()
+	if err != nil {
+		return MissingFunction, err
+	}
+	sources := make([]sourceFile, nsources)
+	for i := range sources {
+		if sources[i].file, err = ir.readString(); err != nil {
+			return MissingFunction, err
+		}
+		sum, err := ir.readString()
+		if err != nil {
+			return MissingFunction, err
+		}
+		if len(sum) != len(sources[i].sum) {
+			return MissingFunction, fmt.Errorf("corrupt image, %s has a %d byte hash", sources[i].file, len(sum))
+		}
+		copy(sources[i].sum[:], sum)
+	}
+	if fresh != nil && !fresh(sources) {
+		return MissingFunction, errStaleImage
+	}
+
+	nmacros, err := ir.readUint()
+	if err != nil {
+		return MissingFunction, err
+	}
+	macros := make(map[SexpSymbol]SexpFunction, nmacros)
+	for i := 0; i < nmacros; i++ {
+		sym, err := ir.readSymbol()
+		if err != nil {
+			return MissingFunction, err
+		}
+		macros[sym], err = ir.readFunction()
+		if err != nil {
+			return MissingFunction, err
+		}
+	}
+
+	nimports, err := ir.readUint()
+	if err != nil {
+		return MissingFunction, err
+	}
+	imports := make([]string, nimports)
+	for i := range imports {
+		if imports[i], err = ir.readString(); err != nil {
+			return MissingFunction, err
+		}
+	}
+
+	main, err := ir.readFunction()
+	if err != nil {
+		return MissingFunction, err
+	}
+
+	// only once the whole image has been read
+	for sym, macro := range macros {
+		env.registry.setMacro(sym, macro)
+	}
+	for _, name := range imports {
+		env.registry.markImported(name)
+	}
+	return main, nil
+}
+
+func (ir *imageReader) readUint() (int, error) {
+	n, err := binary.ReadUvarint(ir.r)
+	if err != nil {
+		return 0, ir.truncated(err)
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("corrupt image, %d is out of range", n)
+	}
+	return int(n), nil
+}
+
+func (ir *imageReader) readInt() (int, error) {
+	n, err := binary.ReadVarint(ir.r)
+	return int(n), ir.truncated(err)
+}
+
+func (ir *imageReader) readBool() (bool, error) {
+	b, err := ir.r.ReadByte()
+	return b != 0, ir.truncated(err)
+}
+
+func (ir *imageReader) readString() (string, error) {
+	n, err := ir.readUint()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(ir.r, buf); err != nil {
+		return "", ir.truncated(err)
+	}
+	return string(buf), nil
+}
+
+func (ir *imageReader) truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// index reads a reference to entry of a table that has n entries, n
+// means the entry is defined right here
+func (ir *imageReader) index(n int, what string) (int, error) {
+	i, err := ir.readUint()
+	if err != nil {
+		return 0, err
+	}
+	if i > n {
+		return 0, fmt.Errorf("corrupt image, %s %d of %d", what, i, n)
+	}
+	return i, nil
+}
+
+func (ir *imageReader) readSymbol() (SexpSymbol, error) {
+	i, err := ir.index(len(ir.symbols), "symbol")
+	if err != nil {
+		return SexpSymbol{}, err
+	}
+	if i < len(ir.symbols) {
+		return ir.symbols[i], nil
+	}
+	name, err := ir.readString()
+	if err != nil {
+		return SexpSymbol{}, err
+	}
+	sym := ir.env.MakeSymbol(name)
+	ir.symbols = append(ir.symbols, sym)
+	return sym, nil
+}
+
+func (ir *imageReader) readSymbols() ([]SexpSymbol, error) {
+	n, err := ir.readUint()
+	if err != nil {
+		return nil, err
+	}
+	var syms []SexpSymbol
+	for i := 0; i < n; i++ {
+		sym, err := ir.readSymbol()
+		if err != nil {
+			return nil, err
+		}
+		syms = append(syms, sym)
+	}
+	return syms, nil
+}
+
+func (ir *imageReader) readScope() (*lexScope, error) {
+	i, err := ir.index(len(ir.scopes), "scope")
+	if err != nil {
+		return nil, err
+	}
+	if i < len(ir.scopes) {
+		return ir.scopes[i], nil
+	}
+	scope := &lexScope{}
+	ir.scopes = append(ir.scopes, scope)
+	scope.syms, err = ir.readSymbols()
+	return scope, err
+}
+
+func (ir *imageReader) readPos() (*SourcePos, error) {
+	kind, err := ir.readUint()
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case posNone:
+		ir.lastpos = nil
+	case posSame:
+		if ir.lastpos == nil {
+			return nil, errors.New("corrupt image, no position to repeat")
+		}
+	case posNew:
+		i, err := ir.index(len(ir.files), "file")
+		if err != nil {
+			return nil, err
+		}
+		if i == len(ir.files) {
+			file, err := ir.readString()
+			if err != nil {
+				return nil, err
+			}
+			ir.files = append(ir.files, file)
+		}
+		pos := &SourcePos{File: ir.files[i]}
+		if pos.Line, err = ir.readInt(); err != nil {
+			return nil, err
+		}
+		if pos.Col, err = ir.readInt(); err != nil {
+			return nil, err
+		}
+		ir.lastpos = pos
+	default:
+		return nil, fmt.Errorf("corrupt image, position kind %d", kind)
+	}
+	return ir.lastpos, nil
+}
+
+func (ir *imageReader) readFunction() (SexpFunction, error) {
+	name, err := ir.readString()
+	if err != nil {
+		return MissingFunction, err
+	}
+	nargs, err := ir.readInt()
+	if err != nil {
+		return MissingFunction, err
+	}
+	varargs, err := ir.readBool()
+	if err != nil {
+		return MissingFunction, err
+	}
+	frame, err := ir.readSymbols()
+	if err != nil {
+		return MissingFunction, err
+	}
+	n, err := ir.readUint()
+	if err != nil {
+		return MissingFunction, err
+	}
+	var params []string
+	for i := 0; i < n; i++ {
+		param, err := ir.readString()
+		if err != nil {
+			return MissingFunction, err
+		}
+		params = append(params, param)
+	}
+	doc, err := ir.readString()
+	if err != nil {
+		return MissingFunction, err
+	}
+
+	n, err = ir.readUint()
+	if err != nil {
+		return MissingFunction, err
+	}
+	fun := make(GlispFunction, n)
+	positions := make([]*SourcePos, n)
+	for i := range fun {
+		if fun[i], err = ir.readInstr(); err != nil {
+			return MissingFunction, fmt.Errorf("%s instruction %d: %v", name, i, err)
+		}
+		if positions[i], err = ir.readPos(); err != nil {
+			return MissingFunction, err
+		}
+	}
+
+	sfun := MakeFunction(name, nargs, varargs, fun)
+	sfun.info.positions = positions
+	sfun.info.frame = frame
+	sfun.info.params = params
+	sfun.info.doc = doc
+	return sfun, nil
+}
+
+func (ir *imageReader) readInstr() (Instruction, error) {
+	op, err := ir.r.ReadByte()
+	if err != nil {
+		return nil, ir.truncated(err)
+	}
+
+	switch op {
+	case opJump, opGoto, opTry:
+		location, err := ir.readInt()
+		switch op {
+		case opJump:
+			return JumpInstr{location}, err
+		case opGoto:
+			return GotoInstr{location}, err
+		}
+		return TryInstr{location}, err
+	case opBranch:
+		direction, err := ir.readBool()
+		if err != nil {
+			return nil, err
+		}
+		location, err := ir.readInt()
+		return BranchInstr{direction, location}, err
+	case opPushClosure:
+		f, err := ir.readFunction()
+		return PushInstrClosure{f}, err
+	case opPush:
+		expr, err := ir.readValue()
+		return PushInstr{expr}, err
+	case opGet, opPut:
+		sym, err := ir.readSymbol()
+		if op == opGet {
+			return GetInstr{sym}, err
+		}
+		return PutInstr{sym}, err
+	case opGetLocal, opSetLocal:
+		depth, err := ir.readUint()
+		if err != nil {
+			return nil, err
+		}
+		slot, err := ir.readUint()
+		if err != nil {
+			return nil, err
+		}
+		sym, err := ir.readSymbol()
+		if op == opGetLocal {
+			return GetLocalInstr{depth, slot, sym}, err
+		}
+		return SetLocalInstr{depth, slot, sym}, err
+	case opCall, opTailCall:
+		sym, err := ir.readSymbol()
+		if err != nil {
+			return nil, err
+		}
+		nargs, err := ir.readUint()
+		if op == opCall {
+			return CallInstr{sym, nargs}, err
+		}
+		return TailCallInstr{sym, nargs}, err
+	case opDispatch, opTailDispatch:
+		nargs, err := ir.readUint()
+		if op == opDispatch {
+			return DispatchInstr{nargs}, err
+		}
+		return TailDispatchInstr{nargs}, err
+	case opApply:
+		tail, err := ir.readBool()
+		return ApplyInstr{tail}, err
+	case opReturn:
+		haserr, err := ir.readBool()
+		if err != nil || !haserr {
+			return ReturnInstr{nil}, err
+		}
+		msg, err := ir.readString()
+		return ReturnInstr{errors.New(msg)}, err
+	case opAddScope:
+		scope, err := ir.readScope()
+		return AddScopeInstr{scope}, err
+	case opBindlist:
+		syms, err := ir.readSymbols()
+		return BindlistInstr{syms}, err
+	case opHashize:
+		hashlen, err := ir.readInt()
+		if err != nil {
+			return nil, err
+		}
+		typename, err := ir.readString()
+		return HashizeInstr{hashlen, typename}, err
+	case opUnwind:
+		keep, err := ir.readUint()
+		return UnwindInstr{keep}, err
+	case opPop:
+		return PopInstr(0), nil
+	case opDup:
+		return DupInstr(0), nil
+	case opRemoveScope:
+		return RemoveScopeInstr(0), nil
+	case opExplode:
+		return ExplodeInstr(0), nil
+	case opSquash:
+		return SquashInstr(0), nil
+	case opVectorize:
+		return VectorizeInstr(0), nil
+	case opStackDepth:
+		return StackDepthInstr(0), nil
+	case opSeq:
+		return SeqInstr(0), nil
+	case opEndTry:
+		return EndTryInstr(0), nil
+	case opThrow:
+		return ThrowInstr(0), nil
+	}
+	return nil, fmt.Errorf("corrupt image, unknown opcode %d", op)
+}
+
+func (ir *imageReader) readValue() (Sexp, error) {
+	tag, err := ir.r.ReadByte()
+	if err != nil {
+		return SexpNull, ir.truncated(err)
+	}
+
+	switch tag {
+	case tagSentinel:
+		n, err := ir.readUint()
+		return SexpSentinel(n), err
+	case tagInt:
+		n, err := ir.readInt()
+		return SexpInt(n), err
+	case tagFloat:
+		var bits [8]byte
+		if _, err := io.ReadFull(ir.r, bits[:]); err != nil {
+			return SexpNull, ir.truncated(err)
+		}
+		return SexpFloat(math.Float64frombits(binary.LittleEndian.Uint64(bits[:]))), nil
+	case tagBool:
+		b, err := ir.readBool()
+		return SexpBool(b), err
+	case tagChar:
+		n, err := ir.readInt()
+		return SexpChar(n), err
+	case tagStr:
+		s, err := ir.readString()
+		return SexpStr(s), err
+	case tagData:
+		s, err := ir.readString()
+		return SexpData(s), err
+	case tagSymbol:
+		return ir.readSymbol()
+	case tagList:
+		n, err := ir.readUint()
+		if err != nil {
+			return SexpNull, err
+		}
+		pairs := make([]SexpPair, n)
+		for i := range pairs {
+			if pairs[i].head, err = ir.readValue(); err != nil {
+				return SexpNull, err
+			}
+			if pairs[i].pos, err = ir.readPos(); err != nil {
+				return SexpNull, err
+			}
+		}
+		tail, err := ir.readValue()
+		if err != nil {
+			return SexpNull, err
+		}
+		for i := n - 1; i >= 0; i-- {
+			pairs[i].tail = tail
+			tail = pairs[i]
+		}
+		return tail, nil
+	case tagArray:
+		n, err := ir.readUint()
+		if err != nil {
+			return SexpNull, err
+		}
+		arr := make(SexpArray, n)
+		for i := range arr {
+			if arr[i], err = ir.readValue(); err != nil {
+				return SexpNull, err
+			}
+		}
+		return arr, nil
+	case tagHash:
+		typename, err := ir.readString()
+		if err != nil {
+			return SexpNull, err
+		}
+		n, err := ir.readUint()
+		if err != nil {
+			return SexpNull, err
+		}
+		args := make([]Sexp, 2*n)
+		for i := range args {
+			if args[i], err = ir.readValue(); err != nil {
+				return SexpNull, err
+			}
+		}
+		return MakeHash(args, typename)
+	case tagFunction:
+		return ir.readFunction()
+	case tagGoFunction:
+		name, err := ir.readString()
+		if err != nil {
+			return SexpNull, err
+		}
+		sym := ir.env.MakeSymbol(name)
+		if f, ok := ir.env.builtins[sym.number]; ok {
+			return f, nil
+		}
+		if f, ok := ir.env.globals.lookup(sym); ok {
+			if f, ok := f.(SexpFunction); ok && f.user {
+				return f, nil
+			}
+		}
+		return SexpNull, fmt.Errorf("Go function %s isn't bound in this environment", name)
+	}
+	return SexpNull, fmt.Errorf("corrupt image, unknown constant tag %d", tag)
+}
@@ -0,0 +1,142 @@
+package glisp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// sourceFile is a file included into a cached image and the hash of what
+// it held then
+type sourceFile struct {
+	file string
+	sum  [sha256.Size]byte
+}
+
+var errStaleImage = errors.New("an included file has changed")
+
+// SetImportCache makes include and import keep the code they compile in
+// dir, as images named by a hash of the file's path and contents, so a
+// file that hasn't changed isn't parsed again. Empty turns it off.
+//
+// A file's entry is used only while it and every file it includes are
+// unchanged. The cached code is compiled against the macros defined when
+// the file was first imported, change a macro a cached file uses from
+// outside of it and the cache needs clearing.
+func (env *Glisp) SetImportCache(dir string) {
+	env.importCache = dir
+}
+
+// cacheable is whether code generated here doesn't depend on where it's
+// generated, only top level code outside of any loop qualifies
+func (gen *Generator) cacheable() bool {
+	return gen.env.importCache != "" && len(gen.lexical) == 0 &&
+		gen.frame == nil && len(gen.loops) == 0
+}
+
+func (gen *Generator) includeCached(file string) error {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(append([]byte(file+"\x00"), src...))
+	path := filepath.Join(gen.env.importCache, hex.EncodeToString(sum[:])+".glc")
+
+	if in, err := os.Open(path); err == nil {
+		var sources []sourceFile
+		main, err := gen.env.readImage(in, func(included []sourceFile) bool {
+			sources = included
+			return gen.env.unchanged(included)
+		})
+		in.Close()
+		if err == nil {
+			gen.env.noteIncluded(file, src)
+			gen.env.noteSources(sources)
+			gen.splice(main.fun, main.info.positions)
+			return nil
+		}
+		// from another version, damaged or stale. Compile it again.
+	}
+
+	exps, err := gen.env.ParseNamedStream(bytes.NewReader(src), file)
+	if err != nil {
+		return err
+	}
+
+	// collect just the macros, imports and included files this file
+	// registers, they go into its image
+	reg, outer := gen.env.registry, gen.env.includes
+	var sources []sourceFile
+	gen.env.registry, gen.env.includes = reg.overlay(), &sources
+	subgen := gen.subGenerator()
+	err = subgen.GenerateBegin(exps)
+	own := gen.env.registry
+	gen.env.registry, gen.env.includes = reg, outer
+	if err != nil {
+		return err
+	}
+	gen.env.noteIncluded(file, src)
+	gen.env.noteSources(sources)
+
+	main := MakeFunction(file, 0, false, subgen.instructions)
+	main.info.positions = subgen.positions
+	var image bytes.Buffer
+	// the file still gets included without a cache entry
+	err = gen.env.writeImage(&image, main, own.scriptMacros(false), own.importNames(false), sources)
+	if err == nil {
+		writeCacheFile(path, image.Bytes())
+	}
+	own.commit()
+
+	gen.splice(subgen.instructions, subgen.positions)
+	return nil
+}
+
+// noteIncluded records that src, read from file, went into the code of
+// the cached include being compiled
+func (env *Glisp) noteIncluded(file string, src []byte) {
+	env.noteSources([]sourceFile{{file, sha256.Sum256(src)}})
+}
+
+func (env *Glisp) noteSources(sources []sourceFile) {
+	if env.includes != nil {
+		*env.includes = append(*env.includes, sources...)
+	}
+}
+
+// unchanged is whether the files still hold what they did, and may still
+// be loaded
+func (env *Glisp) unchanged(sources []sourceFile) bool {
+	for _, src := range sources {
+		if _, err := env.SandboxSource(src.file); err != nil {
+			return false
+		}
+		data, err := os.ReadFile(src.file)
+		if err != nil || sha256.Sum256(data) != src.sum {
+			return false
+		}
+	}
+	return true
+}
+
+// writeCacheFile goes through a temp file so a concurrent import never
+// reads half an image
+func writeCacheFile(path string, data []byte) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".glc-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
@@ -0,0 +1,111 @@
+package glisp_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chrhlnd/glisp"
+)
+
+func TestImportCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := t.TempDir()
+	lib := writeFile(t, dir, "lib.glisp", "(defmac twice [x] `(* 2 ~x)) (def answer (twice 21))")
+
+	// what a fresh env importing lib gets, and the cache entries after
+	load := func() (glisp.Sexp, []string) {
+		t.Helper()
+		env := glisp.NewGlisp()
+		env.SetImportCache(cache)
+		expr, err := env.EvalString(fmt.Sprintf("(import %q) (+ answer (twice 1))", lib))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := filepath.Glob(filepath.Join(cache, "*.glc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return expr, entries
+	}
+
+	expr, entries := load()
+	if expr != glisp.SexpInt(44) || len(entries) != 1 {
+		t.Fatalf("a miss gave %v and cached %v", expr, entries)
+	}
+	entry := entries[0]
+
+	// a hit reads the entry and leaves it be
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(entry, old, old); err != nil {
+		t.Fatal(err)
+	}
+	expr, entries = load()
+	if expr != glisp.SexpInt(44) || len(entries) != 1 {
+		t.Fatalf("a hit gave %v and cached %v", expr, entries)
+	}
+	if info, err := os.Stat(entry); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("a hit wrote the entry again, %v", err)
+	}
+
+	// a damaged entry is compiled again and replaced
+	if err := os.WriteFile(entry, []byte("GLISPIMG junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expr, entries = load()
+	if expr != glisp.SexpInt(44) || len(entries) != 1 {
+		t.Fatalf("a damaged entry gave %v and cached %v", expr, entries)
+	}
+	if info, err := os.Stat(entry); err != nil || info.Size() <= int64(len("GLISPIMG junk")) {
+		t.Errorf("the damaged entry wasn't replaced, %v", err)
+	}
+
+	// changing the file invalidates its entry
+	writeFile(t, dir, "lib.glisp", "(defmac twice [x] `(* 2 ~x)) (def answer (twice 50))")
+	expr, entries = load()
+	if expr != glisp.SexpInt(102) || len(entries) != 2 {
+		t.Errorf("a changed file gave %v and cached %v", expr, entries)
+	}
+}
+
+// An entry holds the code of the files its file includes, it's stale once
+// any of them changes
+func TestImportCacheNested(t *testing.T) {
+	dir := t.TempDir()
+	cache := t.TempDir()
+	b := writeFile(t, dir, "b.glisp", "(def bval 1)")
+	// includes inside a let aren't cached on their own
+	c := writeFile(t, dir, "c.glisp", "(+ x 10)")
+	a := writeFile(t, dir, "a.glisp", fmt.Sprintf("(include %q) (def cval (let [x 1] (include %q)))", b, c))
+
+	load := func() glisp.Sexp {
+		t.Helper()
+		env := glisp.NewGlisp()
+		env.SetImportCache(cache)
+		expr, err := env.EvalString(fmt.Sprintf("(include %q) [bval cval]", a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return expr
+	}
+
+	steps := []struct {
+		file, src, want string
+	}{
+		{"", "", "[1 11]"},
+		{"", "", "[1 11]"},
+		{"b.glisp", "(def bval 2)", "[2 11]"},
+		{"c.glisp", "(+ x 20)", "[2 21]"},
+		{"", "", "[2 21]"},
+	}
+	for _, step := range steps {
+		if step.file != "" {
+			writeFile(t, dir, step.file, step.src)
+		}
+		if got := load().SexpString(); got != step.want {
+			t.Errorf("after changing %q got %s, want %s", step.file, got, step.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"regexp"
 	"strconv"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -41,6 +42,11 @@ type Token struct {
 	str string
 }
 
+// Type is what kind of token t is, String gives its text
+func (t Token) Type() TokenType {
+	return t.typ
+}
+
 func (t Token) String() string {
 	switch t.typ {
 	case TokenLParen:
@@ -89,12 +95,17 @@ const (
 )
 
 type Lexer struct {
-	state    LexerState
-	tokens   []Token
-	buffer   *bytes.Buffer
-	stream   io.RuneReader
-	linenum  int
-	finished bool
+	state     LexerState
+	tokens    []Token
+	positions []SourcePos // where each pending token starts
+	buffer    *bytes.Buffer
+	start     SourcePos // where the buffered atom or string starts
+	stream    io.RuneReader
+	file      string
+	linenum   int
+	col       int
+	tokpos    SourcePos // where the last token returned started
+	finished  bool
 }
 
 var (
@@ -195,6 +206,20 @@ func DecodeAtom(atom string) (Token, error) {
 	return Token{}, errors.New("Unrecognized atom")
 }
 
+func (lexer *Lexer) emit(tok Token, pos SourcePos) {
+	lexer.tokens = append(lexer.tokens, tok)
+	lexer.positions = append(lexer.positions, pos)
+}
+
+// bufferRune adds to the atom being built, remembering where it started
+func (lexer *Lexer) bufferRune(r rune) error {
+	if lexer.buffer.Len() == 0 {
+		lexer.start = lexer.Pos()
+	}
+	_, err := lexer.buffer.WriteRune(r)
+	return err
+}
+
 func (lexer *Lexer) dumpBuffer() error {
 	if lexer.buffer.Len() <= 0 {
 		return nil
@@ -206,14 +231,14 @@ func (lexer *Lexer) dumpBuffer() error {
 	}
 
 	lexer.buffer.Reset()
-	lexer.tokens = append(lexer.tokens, tok)
+	lexer.emit(tok, lexer.start)
 	return nil
 }
 
 func (lexer *Lexer) dumpString() {
 	str := lexer.buffer.String()
 	lexer.buffer.Reset()
-	lexer.tokens = append(lexer.tokens, Token{TokenString, str})
+	lexer.emit(Token{TokenString, str}, lexer.start)
 }
 
 func DecodeBrace(brace rune) Token {
@@ -235,6 +260,8 @@ func DecodeBrace(brace rune) Token {
 }
 
 func (lexer *Lexer) LexNextRune(r rune) error {
+	defer lexer.advance(r)
+
 	if lexer.state == LexerComment {
 		if r == '\n' {
 			lexer.state = LexerNormal
@@ -265,21 +292,31 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 	}
 	if lexer.state == LexerUnquote {
 		if r == '@' {
-			lexer.tokens = append(
-				lexer.tokens, Token{TokenTildeAt, ""})
+			lexer.emit(Token{TokenTildeAt, ""}, lexer.start)
 		} else {
-			lexer.tokens = append(
-				lexer.tokens, Token{TokenTilde, ""})
-			lexer.buffer.WriteRune(r)
+			lexer.emit(Token{TokenTilde, ""}, lexer.start)
+			lexer.bufferRune(r)
 		}
 		lexer.state = LexerNormal
 		return nil
 	}
 
+	if lexer.inChar() && !unicode.IsSpace(r) {
+		if r == '!' && lexer.linenum == 1 && lexer.col == 2 && lexer.buffer.Len() == 1 {
+			// a #! line starting the file names the interpreter, skip it
+			lexer.buffer.Reset()
+			lexer.state = LexerComment
+			return nil
+		}
+		// #( and the like are chars, not a # and a paren
+		return lexer.bufferRune(r)
+	}
+
 	if r == '"' {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected quote")
 		}
+		lexer.start = lexer.Pos()
 		lexer.state = LexerStrLit
 		return nil
 	}
@@ -293,7 +330,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected quote")
 		}
-		lexer.tokens = append(lexer.tokens, Token{TokenQuote, ""})
+		lexer.emit(Token{TokenQuote, ""}, lexer.Pos())
 		return nil
 	}
 
@@ -301,7 +338,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected backtick")
 		}
-		lexer.tokens = append(lexer.tokens, Token{TokenBacktick, ""})
+		lexer.emit(Token{TokenBacktick, ""}, lexer.Pos())
 		return nil
 	}
 
@@ -309,6 +346,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected tilde")
 		}
+		lexer.start = lexer.Pos()
 		lexer.state = LexerUnquote
 		return nil
 	}
@@ -318,13 +356,10 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if err != nil {
 			return err
 		}
-		lexer.tokens = append(lexer.tokens, DecodeBrace(r))
+		lexer.emit(DecodeBrace(r), lexer.Pos())
 		return nil
 	}
 	if r == ' ' || r == '\n' || r == '\t' || r == '\r' {
-		if r == '\n' {
-			lexer.linenum++
-		}
 		err := lexer.dumpBuffer()
 		if err != nil {
 			return err
@@ -332,11 +367,25 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		return nil
 	}
 
-	_, err := lexer.buffer.WriteRune(r)
-	if err != nil {
-		return err
+	return lexer.bufferRune(r)
+}
+
+// inChar is true when the atom so far is # or #\, the start of a char
+// literal still waiting for its char
+func (lexer *Lexer) inChar() bool {
+	atom := lexer.buffer.Bytes()
+	return (len(atom) == 1 && atom[0] == '#') ||
+		(len(atom) == 2 && atom[0] == '#' && atom[1] == '\\')
+}
+
+// advance moves the position past a rune once it's been lexed
+func (lexer *Lexer) advance(r rune) {
+	if r == '\n' {
+		lexer.linenum++
+		lexer.col = 1
+	} else {
+		lexer.col++
 	}
-	return nil
 }
 
 func (lexer *Lexer) PeekNextToken() (Token, error) {
@@ -347,8 +396,15 @@ func (lexer *Lexer) PeekNextToken() (Token, error) {
 		r, _, err := lexer.stream.ReadRune()
 		if err != nil {
 			lexer.finished = true
+			switch lexer.state {
+			case LexerStrLit, LexerStrEscaped, LexerUnquote:
+				// a string or an unquote the input ended in the middle of
+				return Token{TokenEnd, ""}, UnexpectedEnd
+			}
 			if lexer.buffer.Len() > 0 {
-				lexer.dumpBuffer()
+				if err := lexer.dumpBuffer(); err != nil {
+					return Token{TokenEnd, ""}, err
+				}
 				return lexer.tokens[0], nil
 			}
 			return Token{TokenEnd, ""}, nil
@@ -369,21 +425,42 @@ func (lexer *Lexer) GetNextToken() (Token, error) {
 	if err != nil || tok.typ == TokenEnd {
 		return Token{TokenEnd, ""}, err
 	}
+	lexer.tokpos = lexer.positions[0]
 	lexer.tokens = lexer.tokens[1:]
+	lexer.positions = lexer.positions[1:]
 	return tok, nil
 }
 
 func NewLexerFromStream(stream io.RuneReader) *Lexer {
 	return &Lexer{
-		tokens:   make([]Token, 0, 10),
-		buffer:   new(bytes.Buffer),
-		state:    LexerNormal,
-		stream:   stream,
-		linenum:  1,
-		finished: false,
+		tokens:    make([]Token, 0, 10),
+		positions: make([]SourcePos, 0, 10),
+		buffer:    new(bytes.Buffer),
+		state:     LexerNormal,
+		stream:    stream,
+		linenum:   1,
+		col:       1,
+		finished:  false,
 	}
 }
 
+// NewLexerFromFile is NewLexerFromStream with positions naming file
+func NewLexerFromFile(stream io.RuneReader, file string) *Lexer {
+	lexer := NewLexerFromStream(stream)
+	lexer.file = file
+	return lexer
+}
+
 func (lexer *Lexer) Linenum() int {
 	return lexer.linenum
 }
+
+// Pos is the position of the next rune to be lexed
+func (lexer *Lexer) Pos() SourcePos {
+	return SourcePos{lexer.file, lexer.linenum, lexer.col}
+}
+
+// TokenPos is where the token last returned by GetNextToken started
+func (lexer *Lexer) TokenPos() SourcePos {
+	return lexer.tokpos
+}
@@ -0,0 +1,81 @@
+package glisp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func lexAll(t *testing.T, src string) ([]Token, []SourcePos) {
+	t.Helper()
+	lexer := NewLexerFromFile(strings.NewReader(src), "test.glisp")
+	var toks []Token
+	var positions []SourcePos
+	for {
+		tok, err := lexer.GetNextToken()
+		if err != nil {
+			t.Fatalf("lexing %q: %v", src, err)
+		}
+		if tok.typ == TokenEnd {
+			return toks, positions
+		}
+		toks = append(toks, tok)
+		positions = append(positions, lexer.TokenPos())
+	}
+}
+
+func TestLexer(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []Token
+	}{
+		{"(+ 1 2)", []Token{
+			{TokenLParen, ""}, {TokenSymbol, "+"}, {TokenDecimal, "1"},
+			{TokenDecimal, "2"}, {TokenRParen, ""}}},
+		{"[a] {b c}", []Token{
+			{TokenLSquare, ""}, {TokenSymbol, "a"}, {TokenRSquare, ""},
+			{TokenLCurly, ""}, {TokenSymbol, "b"}, {TokenSymbol, "c"}, {TokenRCurly, ""}}},
+		{"0x1F 0o17 0b101 -12 1.5 nil true", []Token{
+			{TokenHex, "1F"}, {TokenOct, "17"}, {TokenBinary, "101"},
+			{TokenDecimal, "-12"}, {TokenFloat, "1.5"}, {TokenNil, "nil"}, {TokenBool, "true"}}},
+		{`"a \"b\"\n" #c #\n`, []Token{
+			{TokenString, "a \"b\"\n"}, {TokenChar, "c"}, {TokenChar, "\n"}}},
+		{"'a `(b ~c ~@d) (x . y)", []Token{
+			{TokenQuote, ""}, {TokenSymbol, "a"},
+			{TokenBacktick, ""}, {TokenLParen, ""}, {TokenSymbol, "b"},
+			{TokenTilde, ""}, {TokenSymbol, "c"}, {TokenTildeAt, ""}, {TokenSymbol, "d"},
+			{TokenRParen, ""}, {TokenLParen, ""}, {TokenSymbol, "x"}, {TokenDot, ""},
+			{TokenSymbol, "y"}, {TokenRParen, ""}}},
+		{"a ; the rest is a comment (\nb", []Token{
+			{TokenSymbol, "a"}, {TokenSymbol, "b"}}},
+		{"#!/usr/bin/env glisp\n#! a", []Token{
+			{TokenChar, "!"}, {TokenSymbol, "a"}}},
+		{"(#( #) #; #\\\")", []Token{
+			{TokenLParen, ""}, {TokenChar, "("}, {TokenChar, ")"}, {TokenChar, ";"},
+			{TokenChar, "\""}, {TokenRParen, ""}}},
+	}
+
+	for _, test := range tests {
+		got, _ := lexAll(t, test.src)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("lexing %q gave %v, want %v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestLexerPositions(t *testing.T) {
+	_, got := lexAll(t, "(a\n  \"b\" c)")
+	want := []SourcePos{
+		{"test.glisp", 1, 1}, {"test.glisp", 1, 2}, {"test.glisp", 2, 3},
+		{"test.glisp", 2, 7}, {"test.glisp", 2, 8},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got positions %v, want %v", got, want)
+	}
+}
+
+func TestDecodeAtom(t *testing.T) {
+	if _, err := DecodeAtom("a'b"); err == nil {
+		t.Error("a'b shouldn't be an atom")
+	}
+}
@@ -0,0 +1,561 @@
+package lsp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/chrhlnd/glisp"
+)
+
+// token is a lexed token and where it is. Brackets know which token
+// matches them.
+type token struct {
+	typ   glisp.TokenType
+	text  string
+	pos   glisp.SourcePos
+	close int // the closing bracket for an opening one, -1 if it has none
+	depth int // how many brackets it's inside of
+}
+
+// definition is a def, defn or defmac found in a document
+type definition struct {
+	name  string
+	kind  string // def, defn or defmac
+	usage string // (name params ...) for functions and macros
+	doc   string
+	depth int // 0 for top level
+	uri   string
+	line  int
+	span  span // the name
+	whole span // the whole form
+}
+
+// include is a file named by an include or import
+type include struct {
+	file string // as it was written
+	path string // where it was found
+	span span
+}
+
+// document is what's known about a glisp source, read from its tokens
+// so most of it survives the source not parsing
+type document struct {
+	uri         string
+	path        string
+	version     int
+	text        string
+	lines       []string
+	tokens      []token
+	defs        []definition
+	includes    []include
+	diagnostics []diagnostic
+}
+
+// analyze reads text's tokens, definitions and includes, and reports
+// tokens that can't be read and brackets that don't balance
+func analyze(uri string, text string) *document {
+	doc := &document{
+		uri:   uri,
+		path:  uriPath(uri),
+		text:  text,
+		lines: strings.Split(text, "\n"),
+	}
+	doc.lex()
+	doc.match()
+	doc.findDefinitions()
+	doc.findIncludes()
+	return doc
+}
+
+// lex collects the tokens, up to where the lexer fails if it does
+func (doc *document) lex() {
+	lexer := glisp.NewLexerFromFile(strings.NewReader(doc.text), doc.path)
+	for {
+		tok, err := lexer.GetNextToken()
+		if errors.Is(err, glisp.UnexpectedEnd) {
+			doc.report(lexer.Pos(), lexer.Pos(), "the input ends inside a string")
+			return
+		}
+		if err != nil {
+			doc.report(lexer.Pos(), lexer.Pos(), err.Error())
+			return
+		}
+		if tok.Type() == glisp.TokenEnd {
+			return
+		}
+		doc.tokens = append(doc.tokens, token{
+			typ:   tok.Type(),
+			text:  tok.String(),
+			pos:   lexer.TokenPos(),
+			close: -1,
+		})
+	}
+}
+
+func opening(typ glisp.TokenType) bool {
+	return typ == glisp.TokenLParen || typ == glisp.TokenLSquare || typ == glisp.TokenLCurly
+}
+
+func closing(typ glisp.TokenType) bool {
+	return typ == glisp.TokenRParen || typ == glisp.TokenRSquare || typ == glisp.TokenRCurly
+}
+
+// match pairs up the brackets, reporting the ones that don't pair
+func (doc *document) match() {
+	var open []int
+	for i := range doc.tokens {
+		tok := &doc.tokens[i]
+		tok.depth = len(open)
+		switch {
+		case opening(tok.typ):
+			open = append(open, i)
+		case closing(tok.typ):
+			if len(open) == 0 {
+				doc.report(tok.pos, doc.end(i), tok.text+" with nothing open to close")
+				continue
+			}
+			o := &doc.tokens[open[len(open)-1]]
+			open = open[:len(open)-1]
+			tok.depth = len(open)
+			o.close = i
+			// ( is one less than ), and so on
+			if o.typ+1 != tok.typ {
+				doc.report(tok.pos, doc.end(i), fmt.Sprintf("%s closes the %s at %d:%d",
+					tok.text, o.text, o.pos.Line, o.pos.Col))
+			}
+		}
+	}
+	for _, i := range open {
+		tok := doc.tokens[i]
+		doc.report(tok.pos, doc.end(i), tok.text+" is never closed")
+	}
+}
+
+func (doc *document) findDefinitions() {
+	for i, tok := range doc.tokens {
+		if tok.typ != glisp.TokenLParen || i+2 >= len(doc.tokens) {
+			continue
+		}
+		form, name := doc.tokens[i+1], doc.tokens[i+2]
+		if form.typ != glisp.TokenSymbol || name.typ != glisp.TokenSymbol {
+			continue
+		}
+		if form.text != "def" && form.text != "defn" && form.text != "defmac" {
+			continue
+		}
+
+		def := definition{
+			name:  name.text,
+			kind:  form.text,
+			depth: tok.depth,
+			uri:   doc.uri,
+			line:  name.pos.Line,
+			span:  doc.span(name.pos, doc.end(i+2)),
+			whole: doc.span(tok.pos, doc.end(tok.close)),
+		}
+
+		params := i + 3
+		if def.kind != "def" && params < len(doc.tokens) &&
+			doc.tokens[params].typ == glisp.TokenLSquare && doc.tokens[params].close > 0 {
+			usage := []string{def.name}
+			end := doc.tokens[params].close
+			for _, param := range doc.tokens[params+1 : end] {
+				usage = append(usage, param.text)
+			}
+			def.usage = "(" + strings.Join(usage, " ") + ")"
+
+			// a string with more of the body after it documents it
+			if end+2 < tok.close && doc.tokens[end+1].typ == glisp.TokenString {
+				def.doc = doc.tokens[end+1].text
+			}
+		}
+		doc.defs = append(doc.defs, def)
+	}
+}
+
+func (doc *document) findIncludes() {
+	for i, tok := range doc.tokens {
+		if tok.typ != glisp.TokenLParen || i+1 >= len(doc.tokens) {
+			continue
+		}
+		form := doc.tokens[i+1]
+		if form.typ != glisp.TokenSymbol || (form.text != "include" && form.text != "import") {
+			continue
+		}
+		end := tok.close
+		if end < 0 {
+			end = len(doc.tokens)
+		}
+		for j := i + 2; j < end; j++ {
+			if doc.tokens[j].typ == glisp.TokenString {
+				file := doc.tokens[j].text
+				doc.includes = append(doc.includes, include{
+					file: file,
+					path: doc.resolve(file),
+					span: doc.span(doc.tokens[j].pos, doc.end(j)),
+				})
+			}
+		}
+	}
+}
+
+// resolve finds an included file the way glisp does, against the working
+// directory, falling back to the document's own directory
+func (doc *document) resolve(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	abs, err := filepath.Abs(file)
+	if err == nil {
+		if _, err := os.Stat(abs); err == nil {
+			return abs
+		}
+	}
+	if doc.path != "" {
+		beside := filepath.Join(filepath.Dir(doc.path), file)
+		if _, err := os.Stat(beside); err == nil {
+			return beside
+		}
+	}
+	return abs
+}
+
+// compile parses the document and generates code for it in env, reporting
+// what fails and calls to builtins with the wrong number of arguments.
+// Nothing is run, but macros are as they're expanded.
+func (doc *document) compile(env *glisp.Glisp) {
+	env.SetOutput(io.Discard)
+	lexer := glisp.NewLexerFromFile(strings.NewReader(doc.text), doc.path)
+	exprs, err := glisp.ParseTokens(env, lexer)
+	if err != nil {
+		doc.report(lexer.TokenPos(), lexer.Pos(), err.Error())
+		return
+	}
+
+	// builtins the document redefines are its own to call as it likes
+	shadowed := make(map[string]bool)
+	for _, def := range doc.defs {
+		shadowed[def.name] = true
+	}
+
+	for _, expr := range exprs {
+		expr = doc.includePaths(env, expr)
+		gen := glisp.NewGenerator(env)
+		if err := gen.GenerateBegin([]glisp.Sexp{expr}); err != nil {
+			doc.generateError(expr, err)
+		}
+		doc.checkCalls(expr, shadowed)
+	}
+}
+
+// includePaths gives a top level include or import the paths resolve
+// finds, so the files it names are found wherever the server was started
+func (doc *document) includePaths(env *glisp.Glisp, expr glisp.Sexp) glisp.Sexp {
+	if !glisp.IsList(expr) || expr == glisp.SexpNull {
+		return expr
+	}
+	items, _ := glisp.ListToArray(expr)
+	head, _ := items[0].(glisp.SexpSymbol)
+	if head.Name() != "include" && head.Name() != "import" {
+		return expr
+	}
+
+	resolved := []glisp.Sexp{head}
+	for _, item := range items[1:] {
+		if file, ok := item.(glisp.SexpStr); ok {
+			item = glisp.SexpStr(doc.resolve(string(file)))
+		}
+		resolved = append(resolved, item)
+	}
+	return glisp.MakeList(resolved)
+}
+
+// generateError reports err at the innermost list in the document that
+// failed to compile
+func (doc *document) generateError(expr glisp.Sexp, err error) {
+	pos := glisp.PositionOf(expr)
+	message := err.Error()
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		gerr, ok := e.(*glisp.GenerateError)
+		if !ok {
+			continue
+		}
+		// lists from included files or made by macros are reported where
+		// this document's code led to them
+		if gerr.Pos != nil && gerr.Pos.File == doc.path {
+			pos = gerr.Pos
+		}
+		message = gerr.Err.Error()
+	}
+	if pos == nil {
+		pos = &glisp.SourcePos{File: doc.path, Line: 1, Col: 1}
+	}
+	doc.report(*pos, doc.formEnd(*pos), strings.TrimSpace(message))
+}
+
+// checkCalls reports calls to builtins in expr with the wrong number of
+// arguments. Names in shadowed are bound to something else.
+func (doc *document) checkCalls(expr glisp.Sexp, shadowed map[string]bool) {
+	if arr, ok := expr.(glisp.SexpArray); ok {
+		for _, item := range arr {
+			doc.checkCalls(item, shadowed)
+		}
+		return
+	}
+	if _, ok := expr.(glisp.SexpPair); !ok || !glisp.IsList(expr) {
+		return
+	}
+	items, _ := glisp.ListToArray(expr)
+	head, _ := items[0].(glisp.SexpSymbol)
+	args := items[1:]
+
+	var body []glisp.Sexp
+	switch head.Name() {
+	case "quote", "syntax-quote", "defmac", "macexpand":
+		// not code, or code that makes code
+		return
+	case "fn", "defn":
+		if head.Name() == "defn" && len(args) > 0 {
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			params, _ := args[0].(glisp.SexpArray)
+			shadowed = bind(shadowed, params)
+			body = args[1:]
+		}
+	case "let", "let*", "loop":
+		if len(args) > 0 {
+			bindings, _ := args[0].(glisp.SexpArray)
+			for i := 0; i < len(bindings); i += 2 {
+				shadowed = bind(shadowed, bindings[i:i+1])
+				if i+1 < len(bindings) {
+					body = append(body, bindings[i+1])
+				}
+			}
+			body = append(body, args[1:]...)
+		}
+	case "dotimes", "doseq":
+		if len(args) > 0 {
+			binding, _ := args[0].(glisp.SexpArray)
+			if len(binding) > 0 {
+				shadowed = bind(shadowed, binding[:1])
+				body = append(body, binding[1:]...)
+			}
+			body = append(body, args[1:]...)
+		}
+	case "catch":
+		if len(args) > 0 {
+			shadowed = bind(shadowed, args[:1])
+			body = args[1:]
+		}
+	default:
+		doc.checkArity(expr, head.Name(), len(args), shadowed)
+		body = items
+	}
+
+	for _, item := range body {
+		doc.checkCalls(item, shadowed)
+	}
+}
+
+// bind adds the symbols among names to shadowed, without changing it for
+// the code outside of where they're bound
+func bind(shadowed map[string]bool, names []glisp.Sexp) map[string]bool {
+	inner := make(map[string]bool, len(shadowed)+len(names))
+	for name := range shadowed {
+		inner[name] = true
+	}
+	for _, name := range names {
+		if sym, ok := name.(glisp.SexpSymbol); ok {
+			inner[sym.Name()] = true
+		}
+	}
+	return inner
+}
+
+func (doc *document) checkArity(call glisp.Sexp, name string, nargs int, shadowed map[string]bool) {
+	if _, builtin := glisp.BuiltinFunctions[name]; !builtin || shadowed[name] {
+		return
+	}
+	usage, ok := glisp.LookupDoc(name)
+	if !ok {
+		return
+	}
+	least, most := usage.Arity()
+	if nargs >= least && (most < 0 || nargs <= most) {
+		return
+	}
+
+	var takes string
+	switch {
+	case least == most:
+		takes = arguments(least)
+	case most < 0:
+		takes = "at least " + arguments(least)
+	default:
+		takes = fmt.Sprintf("%d to %d arguments", least, most)
+	}
+	pos := glisp.PositionOf(call)
+	if pos == nil {
+		return
+	}
+	doc.report(*pos, doc.formEnd(*pos), fmt.Sprintf("%s takes %s, not %d, as in %s",
+		name, takes, nargs, usage.Usage))
+}
+
+func arguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
+
+func (doc *document) report(start, end glisp.SourcePos, message string) {
+	doc.diagnostics = append(doc.diagnostics, diagnostic{
+		Range:    doc.span(start, end),
+		Severity: severityError,
+		Source:   "glisp",
+		Message:  message,
+	})
+}
+
+// end is just past token i
+func (doc *document) end(i int) glisp.SourcePos {
+	if i < 0 || i >= len(doc.tokens) {
+		if len(doc.tokens) == 0 {
+			return glisp.SourcePos{File: doc.path, Line: 1, Col: 1}
+		}
+		i = len(doc.tokens) - 1
+	}
+	tok := doc.tokens[i]
+	length := utf8.RuneCountInString(tok.text)
+	switch {
+	case opening(tok.typ) || closing(tok.typ):
+		length = 1
+	case tok.typ == glisp.TokenString:
+		// its quotes, escapes inside it are lost
+		length += 2
+	}
+	return glisp.SourcePos{File: tok.pos.File, Line: tok.pos.Line, Col: tok.pos.Col + length}
+}
+
+// formEnd is the end of the list starting at pos
+func (doc *document) formEnd(pos glisp.SourcePos) glisp.SourcePos {
+	for i, tok := range doc.tokens {
+		if tok.pos.Line == pos.Line && tok.pos.Col == pos.Col {
+			if tok.close >= 0 {
+				return doc.end(tok.close)
+			}
+			return doc.end(i)
+		}
+	}
+	return pos
+}
+
+// position converts a lexer position, a line and a column counting runes
+// from 1, to the protocol's
+func (doc *document) position(pos glisp.SourcePos) position {
+	line := pos.Line - 1
+	if line < 0 || line >= len(doc.lines) {
+		return position{Line: max(line, 0)}
+	}
+	units := 0
+	col := 1
+	for _, r := range doc.lines[line] {
+		if col >= pos.Col {
+			break
+		}
+		units += utf16.RuneLen(r)
+		col++
+	}
+	return position{Line: line, Character: units}
+}
+
+func (doc *document) span(start, end glisp.SourcePos) span {
+	return span{doc.position(start), doc.position(end)}
+}
+
+// prefix is the start of the symbol being typed at p
+func (doc *document) prefix(p position) string {
+	if p.Line < 0 || p.Line >= len(doc.lines) {
+		return ""
+	}
+	var before []rune
+	units := 0
+	for _, r := range doc.lines[p.Line] {
+		if units >= p.Character {
+			break
+		}
+		before = append(before, r)
+		units += utf16.RuneLen(r)
+	}
+	start := len(before)
+	for start > 0 && !strings.ContainsRune(" \t\r()[]{}'`~\"", before[start-1]) {
+		start--
+	}
+	return string(before[start:])
+}
+
+// symbolAt is the symbol token at p
+func (doc *document) symbolAt(p position) (token, span, bool) {
+	for i, tok := range doc.tokens {
+		if tok.typ != glisp.TokenSymbol {
+			continue
+		}
+		s := doc.span(tok.pos, doc.end(i))
+		if s.contains(p) {
+			return tok, s, true
+		}
+	}
+	return token{}, span{}, false
+}
+
+// includeAt is the included file named at p
+func (doc *document) includeAt(p position) (include, bool) {
+	for _, inc := range doc.includes {
+		if inc.span.contains(p) {
+			return inc, true
+		}
+	}
+	return include{}, false
+}
+
+// definition finds name among the document's definitions, top level ones
+// first
+func (doc *document) definition(name string) (definition, bool) {
+	var found *definition
+	for i, def := range doc.defs {
+		if def.name != name {
+			continue
+		}
+		if def.depth == 0 {
+			return def, true
+		}
+		if found == nil {
+			found = &doc.defs[i]
+		}
+	}
+	if found == nil {
+		return definition{}, false
+	}
+	return *found, true
+}
+
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
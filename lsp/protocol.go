@@ -0,0 +1,207 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+)
+
+// The language server protocol is JSON-RPC 2.0 with each message preceded
+// by a Content-Length header. Only the parts of it the server uses are
+// here, positions count UTF-16 code units as the protocol's default does.
+
+// message is a request, a notification (no ID) or a response (no Method)
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  any              `json:"result"`
+	Error   *responseError   `json:"error,omitempty"`
+}
+
+type notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC error codes
+const (
+	codeInvalidParams  = -32602
+	codeMethodNotFound = -32601
+	codeInvalidRequest = -32600
+)
+
+func readMessage(r *bufio.Reader) (*message, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	var msg message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	if msg.JSONRPC != "2.0" {
+		return nil, errors.New("not a JSON-RPC 2.0 message")
+	}
+	return &msg, nil
+}
+
+// readBody reads a message's headers and returns what follows them
+func readBody(r *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Length %q", header.Get("Content-Length"))
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeMessage(w io.Writer, msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type span struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+// contains is true when pos is in s, its end included so the cursor just
+// past a symbol is still on it
+func (s span) contains(pos position) bool {
+	if pos.Line < s.Start.Line || pos.Line > s.End.Line {
+		return false
+	}
+	if pos.Line == s.Start.Line && pos.Character < s.Start.Character {
+		return false
+	}
+	if pos.Line == s.End.Line && pos.Character > s.End.Character {
+		return false
+	}
+	return true
+}
+
+type location struct {
+	URI   string `json:"uri"`
+	Range span   `json:"range"`
+}
+
+const severityError = 1
+
+type diagnostic struct {
+	Range    span   `json:"range"`
+	Severity int    `json:"severity"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+type publishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Version     int          `json:"version"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+type textDocumentItem struct {
+	URI     string `json:"uri"`
+	Version int    `json:"version"`
+	Text    string `json:"text"`
+}
+
+type textDocumentIdentifier struct {
+	URI     string `json:"uri"`
+	Version int    `json:"version"`
+}
+
+type didOpenParams struct {
+	TextDocument textDocumentItem `json:"textDocument"`
+}
+
+type didChangeParams struct {
+	TextDocument   textDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type didCloseParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+}
+
+type textDocumentPositionParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+	Position     position               `json:"position"`
+}
+
+type markupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type hover struct {
+	Contents markupContent `json:"contents"`
+	Range    span          `json:"range"`
+}
+
+// symbol kinds
+const (
+	symbolFunction = 12
+	symbolVariable = 13
+)
+
+type documentSymbol struct {
+	Name           string `json:"name"`
+	Detail         string `json:"detail,omitempty"`
+	Kind           int    `json:"kind"`
+	Range          span   `json:"range"`
+	SelectionRange span   `json:"selectionRange"`
+}
+
+// completion item kinds
+const (
+	completionFunction = 3
+	completionVariable = 6
+	completionKeyword  = 14
+)
+
+type completionItem struct {
+	Label         string         `json:"label"`
+	Kind          int            `json:"kind"`
+	Detail        string         `json:"detail,omitempty"`
+	Documentation *markupContent `json:"documentation,omitempty"`
+}
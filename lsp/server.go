@@ -0,0 +1,372 @@
+// Package lsp is a language server for glisp sources, talking the
+// language server protocol over a pair of streams, stdin and stdout when
+// run as glisp lsp.
+//
+// Documents are checked as they change: brackets that don't balance,
+// what the parser and the generator reject (bad let bindings, def without
+// a name and the like) and calls to builtins with the wrong number of
+// arguments. It finds where def, defn and defmac define a name, following
+// include and import, shows the docs of builtins and of functions with a
+// docstring, lists a document's definitions and completes names.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chrhlnd/glisp"
+)
+
+// includeDepth is how far includes of includes are followed
+const includeDepth = 8
+
+// Server answers one editor
+type Server struct {
+	newEnv   func() *glisp.Glisp
+	names    []string             // the globals an env starts with
+	docs     map[string]*document // the open documents by uri
+	out      io.Writer
+	shutdown bool
+}
+
+// NewServer makes a server that compiles documents in envs from newEnv,
+// one per check. Macros run as they're expanded, so they should be
+// sandboxed; nil gives a sandbox with the builtins that can include files
+// from anywhere.
+func NewServer(newEnv func() *glisp.Glisp) *Server {
+	if newEnv == nil {
+		newEnv = sandboxedEnv
+	}
+	s := &Server{
+		newEnv: newEnv,
+		docs:   make(map[string]*document),
+	}
+	for _, name := range newEnv().GlobalNames() {
+		if !strings.HasPrefix(name, "__") {
+			s.names = append(s.names, name)
+		}
+	}
+	return s
+}
+
+func sandboxedEnv() *glisp.Glisp {
+	env, err := glisp.NewSandboxedGlisp(glisp.SandboxOptions{
+		SourceDirs: []string{string(filepath.Separator)},
+	})
+	if err != nil {
+		return glisp.NewGlisp()
+	}
+	return env
+}
+
+// Serve reads requests from in and answers them on out until the editor
+// says exit, or in ends
+func (s *Server) Serve(in io.Reader, out io.Writer) error {
+	s.out = out
+	r := bufio.NewReader(in)
+	for {
+		msg, err := readMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.ID == nil {
+			if msg.Method == "exit" {
+				if !s.shutdown {
+					return errors.New("exit without shutdown")
+				}
+				return nil
+			}
+			s.notified(msg)
+			continue
+		}
+
+		result, failure := s.call(msg)
+		err = writeMessage(out, response{JSONRPC: "2.0", ID: msg.ID, Result: result, Error: failure})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) call(msg *message) (any, *responseError) {
+	if s.shutdown {
+		return nil, &responseError{codeInvalidRequest, "the server is shutting down"}
+	}
+
+	switch msg.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       1, // the whole document on every change
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]any{"triggerCharacters": []string{"("}},
+			},
+			"serverInfo": map[string]string{"name": "glisp", "version": glisp.Version()},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/definition", "textDocument/hover",
+		"textDocument/documentSymbol", "textDocument/completion":
+		return s.documentCall(msg)
+	}
+	return nil, &responseError{codeMethodNotFound, fmt.Sprintf("no method %s", msg.Method)}
+}
+
+// documentCall answers the requests about a place in an open document
+func (s *Server) documentCall(msg *message) (any, *responseError) {
+	var params textDocumentPositionParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return nil, &responseError{codeInvalidParams, err.Error()}
+	}
+	doc := s.docs[params.TextDocument.URI]
+	if doc == nil {
+		return nil, nil
+	}
+
+	switch msg.Method {
+	case "textDocument/definition":
+		return s.definition(doc, params.Position), nil
+	case "textDocument/hover":
+		return s.hover(doc, params.Position), nil
+	case "textDocument/documentSymbol":
+		return symbols(doc), nil
+	default:
+		return s.complete(doc, params.Position), nil
+	}
+}
+
+func (s *Server) notified(msg *message) {
+	switch msg.Method {
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if json.Unmarshal(msg.Params, &params) == nil {
+			item := params.TextDocument
+			s.check(item.URI, item.Version, item.Text)
+		}
+	case "textDocument/didChange":
+		var params didChangeParams
+		if json.Unmarshal(msg.Params, &params) == nil && len(params.ContentChanges) > 0 {
+			// sync is full so the last change is the whole document
+			text := params.ContentChanges[len(params.ContentChanges)-1].Text
+			s.check(params.TextDocument.URI, params.TextDocument.Version, text)
+		}
+	case "textDocument/didClose":
+		var params didCloseParams
+		if json.Unmarshal(msg.Params, &params) == nil {
+			delete(s.docs, params.TextDocument.URI)
+			s.publish(&document{uri: params.TextDocument.URI})
+		}
+	}
+}
+
+// check analyzes and compiles an open document and publishes what's wrong
+// with it
+func (s *Server) check(uri string, version int, text string) {
+	doc := analyze(uri, text)
+	doc.version = version
+	if len(doc.diagnostics) == 0 {
+		doc.compile(s.newEnv())
+	}
+	s.docs[uri] = doc
+	s.publish(doc)
+}
+
+func (s *Server) publish(doc *document) {
+	diagnostics := doc.diagnostics
+	if diagnostics == nil {
+		diagnostics = []diagnostic{}
+	}
+	writeMessage(s.out, notification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params:  publishDiagnosticsParams{doc.uri, doc.version, diagnostics},
+	})
+}
+
+// open is the document at path, the editor's copy if it has it open
+func (s *Server) open(path string) *document {
+	for _, doc := range s.docs {
+		if doc.path == path {
+			return doc
+		}
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return analyze(pathURI(path), string(text))
+}
+
+// reachable are doc and the documents it includes, and what they include,
+// nearest first, then the other open documents
+func (s *Server) reachable(doc *document) []*document {
+	seen := map[string]bool{doc.uri: true}
+	found := []*document{doc}
+	for next, depth := 0, 0; depth < includeDepth && next < len(found); depth++ {
+		level := found[next:]
+		next = len(found)
+		for _, d := range level {
+			for _, inc := range d.includes {
+				if included := s.open(inc.path); included != nil && !seen[included.uri] {
+					seen[included.uri] = true
+					found = append(found, included)
+				}
+			}
+		}
+	}
+
+	var others []string
+	for uri := range s.docs {
+		if !seen[uri] {
+			others = append(others, uri)
+		}
+	}
+	sort.Strings(others)
+	for _, uri := range others {
+		found = append(found, s.docs[uri])
+	}
+	return found
+}
+
+// lookup finds where name is defined for code in doc
+func (s *Server) lookup(doc *document, name string) (definition, bool) {
+	for _, d := range s.reachable(doc) {
+		if def, ok := d.definition(name); ok {
+			return def, true
+		}
+	}
+	return definition{}, false
+}
+
+func (s *Server) definition(doc *document, p position) []location {
+	if inc, ok := doc.includeAt(p); ok {
+		if _, err := os.Stat(inc.path); err != nil {
+			return nil
+		}
+		return []location{{pathURI(inc.path), span{}}}
+	}
+
+	tok, _, ok := doc.symbolAt(p)
+	if !ok {
+		return nil
+	}
+	def, ok := s.lookup(doc, tok.text)
+	if !ok {
+		return nil
+	}
+	return []location{{def.uri, def.span}}
+}
+
+func (s *Server) hover(doc *document, p position) *hover {
+	tok, at, ok := doc.symbolAt(p)
+	if !ok {
+		return nil
+	}
+
+	var text string
+	if def, ok := s.lookup(doc, tok.text); ok {
+		usage := def.usage
+		if usage == "" {
+			usage = "(" + def.kind + " " + def.name + " ...)"
+		}
+		text = "```glisp\n" + usage + "\n```"
+		if def.doc != "" {
+			text += "\n\n" + def.doc
+		}
+		where := filepath.Base(uriPath(def.uri))
+		if def.uri == doc.uri {
+			where = "this file"
+		}
+		text += fmt.Sprintf("\n\n%s in %s, line %d", def.kind, where, def.line)
+	} else if usage, ok := glisp.LookupDoc(tok.text); ok {
+		text = "```glisp\n" + usage.Usage + "\n```\n\n" + usage.Text
+	} else {
+		return nil
+	}
+	return &hover{markupContent{"markdown", text}, at}
+}
+
+// symbols are the document's top level definitions
+func symbols(doc *document) []documentSymbol {
+	found := []documentSymbol{}
+	for _, def := range doc.defs {
+		if def.depth != 0 {
+			continue
+		}
+		sym := documentSymbol{
+			Name:           def.name,
+			Detail:         def.usage,
+			Kind:           symbolFunction,
+			Range:          def.whole,
+			SelectionRange: def.span,
+		}
+		switch def.kind {
+		case "def":
+			sym.Kind = symbolVariable
+		case "defmac":
+			sym.Detail = "macro " + def.usage
+		}
+		found = append(found, sym)
+	}
+	return found
+}
+
+func (s *Server) complete(doc *document, p position) []completionItem {
+	prefix := doc.prefix(p)
+	items := []completionItem{}
+	seen := make(map[string]bool)
+
+	for _, d := range s.reachable(doc) {
+		for _, def := range d.defs {
+			if seen[def.name] || !strings.HasPrefix(def.name, prefix) {
+				continue
+			}
+			seen[def.name] = true
+			item := completionItem{Label: def.name, Kind: completionFunction, Detail: def.usage}
+			switch def.kind {
+			case "def":
+				item.Kind = completionVariable
+			case "defmac":
+				item.Kind = completionKeyword
+			}
+			if def.doc != "" {
+				item.Documentation = &markupContent{"markdown", def.doc}
+			}
+			items = append(items, item)
+		}
+	}
+
+	special := make(map[string]bool)
+	for _, name := range glisp.SpecialForms {
+		special[name] = true
+	}
+	for _, name := range s.names {
+		if seen[name] || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		item := completionItem{Label: name, Kind: completionFunction}
+		if special[name] {
+			item.Kind = completionKeyword
+		}
+		if usage, ok := glisp.LookupDoc(name); ok {
+			item.Detail = usage.Usage
+			item.Documentation = &markupContent{"markdown", usage.Text}
+		}
+		items = append(items, item)
+	}
+	return items
+}
@@ -0,0 +1,251 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// client is the editor's side of a server running over pipes
+type client struct {
+	t      *testing.T
+	in     io.WriteCloser
+	out    chan []byte // the messages from the server, read as they come
+	nextID int
+	done   chan error
+
+	// the diagnostics last published for each document
+	diagnostics map[string][]diagnostic
+}
+
+func start(t *testing.T) *client {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &client{
+		t:           t,
+		in:          inW,
+		out:         make(chan []byte, 64),
+		done:        make(chan error, 1),
+		diagnostics: make(map[string][]diagnostic),
+	}
+	go func() {
+		c.done <- NewServer(nil).Serve(inR, outW)
+		outW.Close()
+	}()
+	go func() {
+		r := bufio.NewReader(outR)
+		for {
+			body, err := readBody(r)
+			if err != nil {
+				close(c.out)
+				return
+			}
+			c.out <- body
+		}
+	}()
+	t.Cleanup(func() { inW.Close() })
+	return c
+}
+
+func (c *client) notify(method string, params any) {
+	c.t.Helper()
+	if err := writeMessage(c.in, notification{"2.0", method, params}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// call sends a request and reads up to its response, keeping the
+// diagnostics published meanwhile. The result is decoded into result.
+func (c *client) call(method string, params any, result any) {
+	c.t.Helper()
+	c.nextID++
+	id := json.RawMessage(strings.Repeat("7", c.nextID))
+	req := struct {
+		JSONRPC string           `json:"jsonrpc"`
+		ID      *json.RawMessage `json:"id"`
+		Method  string           `json:"method"`
+		Params  any              `json:"params"`
+	}{"2.0", &id, method, params}
+	if err := writeMessage(c.in, req); err != nil {
+		c.t.Fatal(err)
+	}
+
+	for {
+		body, ok := <-c.out
+		if !ok {
+			c.t.Fatalf("the server stopped before answering %s", method)
+		}
+		var msg struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result json.RawMessage `json:"result"`
+			Error  *responseError  `json:"error"`
+		}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			c.t.Fatal(err)
+		}
+		if msg.Method == "textDocument/publishDiagnostics" {
+			var published publishDiagnosticsParams
+			json.Unmarshal(msg.Params, &published)
+			c.diagnostics[published.URI] = published.Diagnostics
+			continue
+		}
+		if msg.Error != nil {
+			c.t.Fatalf("%s failed: %s", method, msg.Error.Message)
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg.Result, result); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return
+	}
+}
+
+func (c *client) open(uri, text string) {
+	c.t.Helper()
+	c.notify("textDocument/didOpen", didOpenParams{textDocumentItem{uri, 1, text}})
+}
+
+func at(uri string, line, char int) textDocumentPositionParams {
+	return textDocumentPositionParams{textDocumentIdentifier{URI: uri}, position{line, char}}
+}
+
+func TestDiagnostics(t *testing.T) {
+	c := start(t)
+	c.call("initialize", map[string]any{}, nil)
+
+	checked := pathURI("/src/checked.glisp")
+	c.open(checked, `(defn add [a b] (+ a b))
+(let [x] x)
+(cons 1 2 3)
+(defn shadowing [cons] (cons 1 2 3))
+(def total (add 1 (hget {} 'k 0 1)))
+'(cons 1)
+`)
+	unbalanced := pathURI("/src/unbalanced.glisp")
+	c.open(unbalanced, "(defn f [x]\n  (+ x 1]\n")
+	// the diagnostics are published before this is answered
+	c.call("textDocument/documentSymbol", at(checked, 0, 0), nil)
+
+	tests := []struct {
+		uri     string
+		line    int
+		message string
+	}{
+		{checked, 1, "uneven let binding list"},
+		{checked, 2, "cons takes 2 arguments, not 3, as in (cons a b)"},
+		{checked, 4, "hget takes 2 to 3 arguments, not 4, as in (hget h key [default])"},
+		{unbalanced, 1, "] closes the ( at 2:3"},
+		{unbalanced, 0, "( is never closed"},
+	}
+	for _, test := range tests {
+		found := false
+		for _, diag := range c.diagnostics[test.uri] {
+			if diag.Range.Start.Line == test.line && diag.Message == test.message {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no %q on line %d, got %+v", test.message, test.line, c.diagnostics[test.uri])
+		}
+	}
+	if len(c.diagnostics[checked]) != 3 || len(c.diagnostics[unbalanced]) != 2 {
+		t.Errorf("extra diagnostics %+v", c.diagnostics)
+	}
+
+	// fixing it clears them
+	c.notify("textDocument/didChange", didChangeParams{
+		TextDocument: textDocumentIdentifier{unbalanced, 2},
+		ContentChanges: []struct {
+			Text string `json:"text"`
+		}{{"(defn f [x]\n  (+ x 1))\n"}},
+	})
+	c.call("textDocument/documentSymbol", at(unbalanced, 0, 0), nil)
+	if len(c.diagnostics[unbalanced]) != 0 {
+		t.Errorf("fixed document still has %+v", c.diagnostics[unbalanced])
+	}
+
+	c.call("shutdown", nil, nil)
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNavigation(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib.glisp")
+	err := os.WriteFile(lib, []byte(`(def scale 3)
+(defn sq [x] "squares x" (* x x))
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := start(t)
+	c.call("initialize", map[string]any{}, nil)
+	main := pathURI(filepath.Join(dir, "main.glisp"))
+	c.open(main, `(include "lib.glisp")
+(defmac twice [x] `+"`"+`(* 2 ~x))
+(defn area [w h] "w times h" (* w h))
+(println (sq scale) (area 2 3) (s))
+`)
+
+	var locs []location
+	c.call("textDocument/definition", at(main, 3, 10), &locs)
+	if len(locs) != 1 || locs[0].URI != pathURI(lib) || locs[0].Range.Start != (position{1, 6}) {
+		t.Errorf("sq is defined at %+v", locs)
+	}
+	c.call("textDocument/definition", at(main, 3, 22), &locs)
+	if len(locs) != 1 || locs[0].URI != main || locs[0].Range.Start != (position{2, 6}) {
+		t.Errorf("area is defined at %+v", locs)
+	}
+	c.call("textDocument/definition", at(main, 0, 12), &locs)
+	if len(locs) != 1 || locs[0].URI != pathURI(lib) {
+		t.Errorf("the include goes to %+v", locs)
+	}
+
+	var h hover
+	c.call("textDocument/hover", at(main, 3, 11), &h)
+	if !strings.Contains(h.Contents.Value, "(sq x)") || !strings.Contains(h.Contents.Value, "squares x") {
+		t.Errorf("hover over sq gave %q", h.Contents.Value)
+	}
+	c.call("textDocument/hover", at(main, 3, 2), &h)
+	if !strings.Contains(h.Contents.Value, "(println x ...)") {
+		t.Errorf("hover over println gave %q", h.Contents.Value)
+	}
+
+	var syms []documentSymbol
+	c.call("textDocument/documentSymbol", at(main, 0, 0), &syms)
+	var names []string
+	for _, sym := range syms {
+		names = append(names, sym.Name+" "+sym.Detail)
+	}
+	if strings.Join(names, ", ") != "twice macro (twice x), area (area w h)" {
+		t.Errorf("symbols are %v", names)
+	}
+
+	var items []completionItem
+	c.call("textDocument/completion", at(main, 3, 33), &items)
+	labels := make(map[string]bool)
+	for _, item := range items {
+		if !strings.HasPrefix(item.Label, "s") {
+			t.Errorf("%s doesn't start with s", item.Label)
+		}
+		labels[item.Label] = true
+	}
+	for _, want := range []string{"sq", "scale", "str", "set!", "syntax-quote"} {
+		if !labels[want] {
+			t.Errorf("no %s among %v", want, items)
+		}
+	}
+
+	if len(c.diagnostics[main]) != 0 {
+		t.Errorf("main has %+v", c.diagnostics[main])
+	}
+}
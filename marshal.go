@@ -0,0 +1,112 @@
+package glisp
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FromGo converts a Go value to a Sexp. Structs become hashes typed with
+// the struct name and keyed by field name, or by the `glisp:"name"` tag.
+// The struct stays attached to its hash as GoStruct, when value is a
+// pointer that is the caller's struct, so hset! on the hash writes through.
+// Values with no Sexp form, channels and funcs, or that contain themselves
+// are errors.
+func FromGo(value interface{}) (Sexp, error) {
+	val := reflect.ValueOf(value)
+	if val.Kind() == reflect.Struct {
+		ptr := reflect.New(val.Type())
+		ptr.Elem().Set(val)
+		val = ptr.Elem()
+	}
+	return valueToSexp(val)
+}
+
+// ToGo fills the value target points at from expr
+func ToGo(expr Sexp, target interface{}) error {
+	ptr := reflect.ValueOf(target)
+	if ptr.Kind() != reflect.Pointer || ptr.IsNil() {
+		return fmt.Errorf("ToGo target must be a non-nil pointer, got %T", target)
+	}
+	val, err := sexpToValue(expr, ptr.Elem().Type())
+	if err != nil {
+		return err
+	}
+	ptr.Elem().Set(val)
+	return nil
+}
+
+// fieldName is the hash key a struct field is stored under, false for
+// fields that aren't marshalled
+func fieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	tag := field.Tag.Get("glisp")
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return field.Name, true
+}
+
+// structField finds the field a hash key refers to, preferring an exact
+// match to one that only differs in case
+func structField(t reflect.Type, key string) (int, bool) {
+	folded := -1
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := fieldName(t.Field(i))
+		if !ok {
+			continue
+		}
+		if name == key {
+			return i, true
+		}
+		if folded < 0 && strings.EqualFold(name, key) {
+			folded = i
+		}
+	}
+	return folded, folded >= 0
+}
+
+// goStruct is the struct backing a typed hash, if there is one
+func (hash *SexpHash) goStruct() (reflect.Value, bool) {
+	if hash.GoStruct == nil || *hash.GoStruct == nil {
+		return reflect.Value{}, false
+	}
+	ptr := reflect.ValueOf(*hash.GoStruct)
+	if ptr.Kind() != reflect.Pointer || ptr.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	return ptr.Elem(), true
+}
+
+// writeThrough mirrors a change to a typed hash onto its Go struct, a
+// SexpEnd val zeroes the field
+func (hash *SexpHash) writeThrough(key Sexp, val Sexp) error {
+	st, ok := hash.goStruct()
+	if !ok {
+		return nil
+	}
+	name, ok := keyName(key)
+	if !ok {
+		return nil
+	}
+	i, ok := structField(st.Type(), name)
+	if !ok {
+		return nil
+	}
+	field := st.Field(i)
+	if val == SexpEnd {
+		field.SetZero()
+		return nil
+	}
+	v, err := sexpToValue(val, field.Type())
+	if err != nil {
+		return fmt.Errorf("%s.%s: %w", *hash.TypeName, st.Type().Field(i).Name, err)
+	}
+	field.Set(v)
+	return nil
+}
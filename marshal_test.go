@@ -0,0 +1,176 @@
+package glisp_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chrhlnd/glisp"
+)
+
+type Limits struct {
+	Timeout time.Duration
+	Rates   map[string]float64
+}
+
+type Service struct {
+	Name    string   `glisp:"name"`
+	Port    int      `glisp:"port,omitempty"`
+	Hosts   []string `glisp:"hosts"`
+	Key     []byte
+	Enabled bool
+	Limits  Limits
+	Backup  *Service
+	Ignored string `glisp:"-"`
+	private int
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	in := Service{
+		Name:    "api",
+		Port:    8080,
+		Hosts:   []string{"a", "b"},
+		Key:     []byte{1, 2},
+		Enabled: true,
+		Limits:  Limits{2 * time.Second, map[string]float64{"read": 1.5}},
+		Backup:  &Service{Name: "spare", Hosts: []string{}},
+		Ignored: "not marshalled",
+	}
+	expr, err := glisp.FromGo(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, ok := expr.(glisp.SexpHash)
+	if !ok || *hash.TypeName != "Service" {
+		t.Fatalf("got %s", expr.SexpString())
+	}
+	for key, want := range map[string]string{
+		"name":    `"api"`,
+		"port":    "8080",
+		"hosts":   `["a" "b"]`,
+		"Key":     "<1,2>",
+		"Enabled": "true",
+		"Ignored": "()",
+	} {
+		got, _ := hash.HashGetDefault(glisp.SexpStr(key), glisp.SexpNull)
+		if got.SexpString() != want {
+			t.Errorf("%s is %s, expected %s", key, got.SexpString(), want)
+		}
+	}
+
+	var out Service
+	if err := glisp.ToGo(expr, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Ignored = ""
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip gave\n%+v\nexpected\n%+v", out, in)
+	}
+
+	// a struct that holds itself by type, and the same pointer twice
+	shared := &Node{Val: 3}
+	list := []*Node{{1, &Node{2, shared}}, shared}
+	expr, err = glisp.FromGo(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back []*Node
+	if err := glisp.ToGo(expr, &back); err != nil {
+		t.Fatal(err)
+	}
+	if len(back) != 2 || back[0].Next.Next.Val != 3 || back[1].Val != 3 {
+		t.Errorf("the list came back as %s", expr.SexpString())
+	}
+
+	// plain values
+	var nums map[string][]int
+	if err := glisp.ToGo(glisp.SexpNull, &nums); err != nil || nums != nil {
+		t.Errorf("() to a map gave %v, %v", nums, err)
+	}
+	expr, err = glisp.FromGo(map[string][]int{"x": {1}})
+	if err != nil || glisp.ToGo(expr, &nums) != nil || nums["x"][0] != 1 {
+		t.Errorf("a map came back as %v, %v", nums, err)
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	loop := &Node{Val: 1}
+	loop.Next = &Node{2, loop}
+	values := []interface{}{loop, make(chan int), func() {}}
+	for _, value := range values {
+		if expr, err := glisp.FromGo(value); err == nil {
+			t.Errorf("%T gave %v", value, expr)
+		}
+	}
+	if _, err := glisp.FromGo(loop); !errors.Is(err, glisp.ErrCycle) {
+		t.Errorf("a loop gave %v", err)
+	}
+
+	env := glisp.NewGlisp()
+	expr, err := env.EvalString("(def h {'Val 1}) (hset! h 'Next h) h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var node Node
+	if err := glisp.ToGo(expr, &node); !errors.Is(err, glisp.ErrCycle) {
+		t.Errorf("a hash holding itself gave %v", err)
+	}
+
+	var service Service
+	if err := glisp.ToGo(expr, service); err == nil {
+		t.Error("ToGo worked without a pointer")
+	}
+	expr, _ = env.EvalString(`{'port "80"}`)
+	if err := glisp.ToGo(expr, &service); err == nil {
+		t.Error("a string went into an int")
+	}
+}
+
+func TestMarshalWriteThrough(t *testing.T) {
+	service := &Service{Name: "api", Port: 80, Hosts: []string{"a"}}
+	expr, err := glisp.FromGo(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := glisp.NewGlisp()
+	env.AddGlobal("service", expr)
+
+	src := `(hset! service "name" "web")
+		(hset! service 'port 443)
+		(hset! service "hosts" ["b" "c"])
+		(hset! service "Limits" {'Timeout 1500})
+		(hset! service "extra" 1)
+		(hdel! service "Key")
+		(hdel! service 'hosts)`
+	service.Key = []byte{1}
+	if _, err := env.EvalString(src); err != nil {
+		t.Fatal(err)
+	}
+	want := Service{Name: "web", Port: 443, Limits: Limits{Timeout: 1500 * time.Millisecond}}
+	if !reflect.DeepEqual(*service, want) {
+		t.Errorf("the struct is\n%+v\nexpected\n%+v", *service, want)
+	}
+
+	// a bad value leaves the struct and the hash as they were
+	env.Clear()
+	if _, err := env.EvalString(`(hset! service 'port "eighty")`); err == nil {
+		t.Error("a string went into the port")
+	}
+	env.Clear()
+	port, err := env.EvalString(`(hget service 'port)`)
+	if service.Port != 443 || err != nil || port != glisp.SexpInt(443) {
+		t.Errorf("after a bad hset! the port is %d and %v", service.Port, port)
+	}
+
+	// a struct passed by value is copied, the caller's doesn't change
+	copied := Service{Name: "api"}
+	expr, _ = glisp.FromGo(copied)
+	hash := expr.(glisp.SexpHash)
+	if err := hash.HashSet(glisp.SexpStr("name"), glisp.SexpStr("web")); err != nil {
+		t.Fatal(err)
+	}
+	if copied.Name != "api" {
+		t.Errorf("the copy wrote through to %q", copied.Name)
+	}
+}
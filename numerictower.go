@@ -17,6 +17,7 @@ const (
 )
 
 var WrongType error = errors.New("operands have invalid type")
+var DivideByZero error = errors.New("integer divide by zero")
 
 func IntegerDo(op IntegerOp, a, b Sexp) (Sexp, error) {
 	var ia SexpInt
@@ -48,6 +49,9 @@ func IntegerDo(op IntegerOp, a, b Sexp) (Sexp, error) {
 	case ShiftRightLog:
 		return SexpInt(uint(ia) >> uint(ib)), nil
 	case Modulo:
+		if ib == 0 {
+			return SexpNull, DivideByZero
+		}
 		return ia % ib, nil
 	case BitAnd:
 		return ia & ib, nil
@@ -120,8 +124,14 @@ func NumericMatchInt(op NumericOp, a SexpInt, b Sexp) (Sexp, error) {
 	case SexpFloat:
 		return NumericFloatDo(op, SexpFloat(a), tb), nil
 	case SexpInt:
+		if op == Div && tb == 0 {
+			return SexpNull, DivideByZero
+		}
 		return NumericIntDo(op, a, tb), nil
 	case SexpChar:
+		if op == Div && tb == 0 {
+			return SexpNull, DivideByZero
+		}
 		return NumericIntDo(op, a, SexpInt(tb)), nil
 	}
 	return SexpNull, WrongType
@@ -133,8 +143,14 @@ func NumericMatchChar(op NumericOp, a SexpChar, b Sexp) (Sexp, error) {
 	case SexpFloat:
 		res = NumericFloatDo(op, SexpFloat(a), tb)
 	case SexpInt:
+		if op == Div && tb == 0 {
+			return SexpNull, DivideByZero
+		}
 		res = NumericIntDo(op, SexpInt(a), tb)
 	case SexpChar:
+		if op == Div && tb == 0 {
+			return SexpNull, DivideByZero
+		}
 		res = NumericIntDo(op, SexpInt(a), SexpInt(tb))
 	default:
 		return SexpNull, WrongType
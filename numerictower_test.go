@@ -0,0 +1,23 @@
+package glisp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDivideByZero(t *testing.T) {
+	env := NewGlisp()
+	for _, src := range []string{"(/ 1 0)", "(/ 10 2 0)", "(mod 1 0)", "(/ #a 0)"} {
+		_, err := env.EvalString(src)
+		if !errors.Is(err, DivideByZero) {
+			t.Errorf("%s gave %v", src, err)
+		}
+		env.Clear()
+	}
+
+	// floats divide to infinity as Go's do
+	expr, err := env.EvalString("(/ 1.0 0)")
+	if err != nil || expr.SexpString() != "+Inf" {
+		t.Errorf("(/ 1.0 0) gave %v, %v", expr, err)
+	}
+}
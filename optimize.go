@@ -0,0 +1,338 @@
+package glisp
+
+// The optimizer is a peephole pass over the instructions of a function,
+// run once the generator is done with them. It folds pure builtins called
+// on constants, drops values pushed only to be popped, threads jumps and
+// removes code nothing can reach.
+
+// SetOptLevel picks how much the generator optimizes, 0 turns the
+// optimizer off so the instructions follow the source one to one, which
+// is easier to step through. 1, the default, runs the peephole pass. A
+// folded builtin isn't called at runtime, so hooks don't see it.
+func (env *Glisp) SetOptLevel(level int) {
+	env.optLevel = level
+}
+
+const DefaultOptLevel = 1
+
+// pureBuiltins only compute their result from their arguments, so with
+// constant arguments they can run at compile time
+var pureBuiltins = map[string]bool{
+	"<": true, ">": true, "<=": true, ">=": true, "=": true, "not=": true,
+	"sll": true, "sra": true, "srl": true, "mod": true,
+	"+": true, "-": true, "*": true, "/": true,
+	"bit-and": true, "bit-or": true, "bit-xor": true, "bit-not": true,
+	"not": true,
+}
+
+type optInstr struct {
+	instr  Instruction
+	pos    *SourcePos
+	target int // where it jumps to, -1 if it doesn't
+}
+
+// optimize runs over what's been generated, before it goes into a function
+func (gen *Generator) optimize() {
+	if gen.env.optLevel <= 0 {
+		return
+	}
+	gen.instructions, gen.positions = optimize(gen.env, gen.instructions, gen.positions)
+}
+
+func optimize(env *Glisp, instrs []Instruction, positions []*SourcePos) ([]Instruction, []*SourcePos) {
+	code := make([]optInstr, len(instrs))
+	for i, instr := range instrs {
+		code[i] = optInstr{instr: instr, target: jumpTarget(instr, i)}
+		if i < len(positions) {
+			code[i].pos = positions[i]
+		}
+		if code[i].target < -1 || code[i].target > len(instrs) {
+			// nothing else to go on, leave it alone
+			return instrs, positions
+		}
+	}
+
+	passes := []func(*Glisp, []optInstr, []bool) bool{
+		foldConstants,
+		foldBranches,
+		dropPushPop,
+		threadJumps,
+		dropUnreachable,
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, pass := range passes {
+			drop := make([]bool, len(code))
+			if pass(env, code, drop) {
+				code = compact(code, drop)
+				changed = true
+			}
+		}
+	}
+
+	instrs = make([]Instruction, len(code))
+	positions = make([]*SourcePos, len(code))
+	for i, c := range code {
+		instrs[i] = retarget(c.instr, i, c.target)
+		positions[i] = c.pos
+	}
+	return instrs, positions
+}
+
+func jumpTarget(instr Instruction, i int) int {
+	switch j := instr.(type) {
+	case JumpInstr:
+		return i + j.location
+	case BranchInstr:
+		return i + j.location
+	case GotoInstr:
+		return j.location
+	case TryInstr:
+		return i + j.location
+	}
+	return -1
+}
+
+func retarget(instr Instruction, i int, target int) Instruction {
+	switch j := instr.(type) {
+	case JumpInstr:
+		return JumpInstr{target - i}
+	case BranchInstr:
+		return BranchInstr{j.direction, target - i}
+	case GotoInstr:
+		return GotoInstr{target}
+	case TryInstr:
+		return TryInstr{target - i}
+	}
+	return instr
+}
+
+// compact takes out the dropped instructions, a jump to one of them goes
+// to whatever comes after it instead
+func compact(code []optInstr, drop []bool) []optInstr {
+	index := make([]int, len(code)+1)
+	n := 0
+	for i := range code {
+		index[i] = n
+		if !drop[i] {
+			n++
+		}
+	}
+	index[len(code)] = n
+
+	out := make([]optInstr, 0, n)
+	for i, c := range code {
+		if drop[i] {
+			continue
+		}
+		if c.target >= 0 {
+			c.target = index[c.target]
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func jumpedTo(code []optInstr) []bool {
+	targets := make([]bool, len(code)+1)
+	for _, c := range code {
+		if c.target >= 0 {
+			targets[c.target] = true
+		}
+	}
+	return targets
+}
+
+func isConstant(expr Sexp) bool {
+	switch expr.(type) {
+	case SexpInt, SexpFloat, SexpBool, SexpChar, SexpStr:
+		return true
+	}
+	return false
+}
+
+// foldConstants replaces pushing constants and calling a pure builtin on
+// them with pushing the result. Calls that fail are left to fail at
+// runtime.
+func foldConstants(env *Glisp, code []optInstr, drop []bool) bool {
+	targets := jumpedTo(code)
+	changed := false
+
+	for i, c := range code {
+		var sym SexpSymbol
+		var nargs int
+		switch call := c.instr.(type) {
+		case CallInstr:
+			sym, nargs = call.sym, call.nargs
+		case TailCallInstr:
+			// a builtin carries on with the next instruction either way
+			sym, nargs = call.sym, call.nargs
+		default:
+			continue
+		}
+		f, ok := env.builtins[sym.number]
+		if !ok || !pureBuiltins[sym.name] || nargs > i {
+			continue
+		}
+
+		start := i - nargs
+		args := make([]Sexp, 0, nargs)
+		for j := start; j < i; j++ {
+			push, ok := code[j].instr.(PushInstr)
+			if !ok || drop[j] || !isConstant(push.expr) || (j > start && targets[j]) {
+				break
+			}
+			args = append(args, push.expr)
+		}
+		if len(args) != nargs || (nargs > 0 && targets[i]) {
+			continue
+		}
+
+		res, err := f.userfun(env, sym.name, args)
+		if err != nil || !isConstant(res) {
+			continue
+		}
+		for j := start + 1; j <= i; j++ {
+			drop[j] = true
+		}
+		code[start] = optInstr{instr: PushInstr{res}, pos: c.pos, target: -1}
+		changed = true
+	}
+	return changed
+}
+
+// foldBranches turns a branch on a constant into a jump or nothing
+func foldBranches(env *Glisp, code []optInstr, drop []bool) bool {
+	targets := jumpedTo(code)
+	changed := false
+
+	for i := 0; i+1 < len(code); i++ {
+		push, ok := code[i].instr.(PushInstr)
+		br, isbr := code[i+1].instr.(BranchInstr)
+		if !ok || !isbr || targets[i+1] {
+			continue
+		}
+		if IsTruthy(push.expr) == br.direction {
+			code[i] = optInstr{instr: JumpInstr{}, pos: code[i+1].pos, target: code[i+1].target}
+			drop[i+1] = true
+		} else {
+			drop[i] = true
+			drop[i+1] = true
+		}
+		changed = true
+		i++
+	}
+	return changed
+}
+
+// dropPushPop drops a value pushed and popped straight away
+func dropPushPop(env *Glisp, code []optInstr, drop []bool) bool {
+	targets := jumpedTo(code)
+	changed := false
+
+	for i := 0; i+1 < len(code); i++ {
+		switch code[i].instr.(type) {
+		case PushInstr, DupInstr:
+		default:
+			continue
+		}
+		if _, ok := code[i+1].instr.(PopInstr); !ok || targets[i+1] {
+			continue
+		}
+		drop[i] = true
+		drop[i+1] = true
+		changed = true
+		i++
+	}
+	return changed
+}
+
+// threadJumps points jumps that land on another jump at where that one
+// goes, a jump to a return becomes the return and a jump to the next
+// instruction goes
+func threadJumps(env *Glisp, code []optInstr, drop []bool) bool {
+	changed := false
+
+	for i := range code {
+		c := &code[i]
+		switch c.instr.(type) {
+		case JumpInstr, BranchInstr, GotoInstr:
+		default:
+			continue
+		}
+
+		if target := finalTarget(code, c.target); target != c.target {
+			c.target = target
+			changed = true
+		}
+
+		switch c.instr.(type) {
+		case JumpInstr, GotoInstr:
+			if c.target == i+1 {
+				drop[i] = true
+				changed = true
+			} else if c.target < len(code) {
+				if ret, ok := code[c.target].instr.(ReturnInstr); ok {
+					*c = optInstr{instr: ret, pos: c.pos, target: -1}
+					changed = true
+				}
+			}
+		}
+	}
+	return changed
+}
+
+// finalTarget follows a chain of jumps from target. Jumps going round in
+// a circle are left as they are.
+func finalTarget(code []optInstr, target int) int {
+	seen := make(map[int]bool)
+	t := target
+	for t < len(code) {
+		switch code[t].instr.(type) {
+		case JumpInstr, GotoInstr:
+		default:
+			return t
+		}
+		if seen[t] {
+			return target
+		}
+		seen[t] = true
+		t = code[t].target
+	}
+	return t
+}
+
+// dropUnreachable drops whatever can't be reached from the start, or
+// from a catch
+func dropUnreachable(env *Glisp, code []optInstr, drop []bool) bool {
+	reached := make([]bool, len(code))
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= len(code) || reached[i] {
+			continue
+		}
+		reached[i] = true
+
+		c := code[i]
+		switch c.instr.(type) {
+		case JumpInstr, GotoInstr:
+			work = append(work, c.target)
+		case ReturnInstr, ThrowInstr:
+		case BranchInstr, TryInstr:
+			work = append(work, c.target, i+1)
+		default:
+			work = append(work, i+1)
+		}
+	}
+
+	changed := false
+	for i := range code {
+		if !reached[i] {
+			drop[i] = true
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,26 @@
+package glisp_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/chrhlnd/glisp"
+)
+
+// The optimizer mustn't change what any of the test scripts do, including
+// the ones that fail.
+func TestOptimizerSemantics(t *testing.T) {
+	files, err := filepath.Glob("tests/*.glisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(removeTestOutputs)
+
+	for _, file := range files {
+		unoptimized := runScript(t, file, 0)
+		optimized := runScript(t, file, glisp.DefaultOptLevel)
+		if unoptimized != optimized {
+			t.Errorf("%s: -O0 gave %+v, optimized %+v", file, unoptimized, optimized)
+		}
+	}
+}
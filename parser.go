@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 type Parser struct {
@@ -52,12 +53,18 @@ func ParseList(parser *Parser) (Sexp, error) {
 		if err != nil {
 			return SexpNull, err
 		}
+		if expr == SexpEnd {
+			return SexpEnd, UnexpectedEnd
+		}
 
 		// eat up the end paren
 		tok, err = lexer.GetNextToken()
 		if err != nil {
 			return SexpNull, err
 		}
+		if tok.typ == TokenEnd {
+			return SexpEnd, UnexpectedEnd
+		}
 		// make sure it was actually an end paren
 		if tok.typ != TokenRParen {
 			return SexpNull, errors.New("extra value in dotted pair")
@@ -137,6 +144,24 @@ func ParseHash(parser *Parser) (Sexp, error) {
 	return list, nil
 }
 
+// at marks a parsed list with where it started in the source
+func at(expr Sexp, pos SourcePos) Sexp {
+	if list, ok := expr.(SexpPair); ok {
+		list.pos = &pos
+		return list
+	}
+	return expr
+}
+
+// parseQuoted is the expression after a ' ` ~ or ~@, there has to be one
+func parseQuoted(parser *Parser) (Sexp, error) {
+	expr, err := ParseExpression(parser)
+	if err == nil && expr == SexpEnd {
+		return SexpEnd, UnexpectedEnd
+	}
+	return expr, err
+}
+
 func ParseExpression(parser *Parser) (Sexp, error) {
 	lexer := parser.lexer
 	env := parser.env
@@ -144,40 +169,43 @@ func ParseExpression(parser *Parser) (Sexp, error) {
 	if err != nil {
 		return SexpEnd, err
 	}
+	pos := lexer.TokenPos()
 
 	switch tok.typ {
 	case TokenNil:
 		return SexpNull, nil
 	case TokenLParen:
-		return ParseList(parser)
+		expr, err := ParseList(parser)
+		return at(expr, pos), err
 	case TokenLSquare:
 		return ParseArray(parser)
 	case TokenLCurly:
-		return ParseHash(parser)
+		expr, err := ParseHash(parser)
+		return at(expr, pos), err
 	case TokenQuote:
-		expr, err := ParseExpression(parser)
+		expr, err := parseQuoted(parser)
 		if err != nil {
 			return SexpNull, err
 		}
-		return MakeList([]Sexp{env.MakeSymbol("quote"), expr}), nil
+		return at(MakeList([]Sexp{env.MakeSymbol("quote"), expr}), pos), nil
 	case TokenBacktick:
-		expr, err := ParseExpression(parser)
+		expr, err := parseQuoted(parser)
 		if err != nil {
 			return SexpNull, err
 		}
-		return MakeList([]Sexp{env.MakeSymbol("syntax-quote"), expr}), nil
+		return at(MakeList([]Sexp{env.MakeSymbol("syntax-quote"), expr}), pos), nil
 	case TokenTilde:
-		expr, err := ParseExpression(parser)
+		expr, err := parseQuoted(parser)
 		if err != nil {
 			return SexpNull, err
 		}
-		return MakeList([]Sexp{env.MakeSymbol("unquote"), expr}), nil
+		return at(MakeList([]Sexp{env.MakeSymbol("unquote"), expr}), pos), nil
 	case TokenTildeAt:
-		expr, err := ParseExpression(parser)
+		expr, err := parseQuoted(parser)
 		if err != nil {
 			return SexpNull, err
 		}
-		return MakeList([]Sexp{env.MakeSymbol("unquote-splicing"), expr}), nil
+		return at(MakeList([]Sexp{env.MakeSymbol("unquote-splicing"), expr}), pos), nil
 	case TokenSymbol:
 		return env.MakeSymbol(tok.str), nil
 	case TokenBool:
@@ -238,3 +266,19 @@ func ParseTokens(env *Glisp, lexer *Lexer) ([]Sexp, error) {
 	}
 	return expressions, nil
 }
+
+// ParseComplete tells whether src is made of whole expressions, a repl
+// reads another line while it isn't. An error means src is wrong in a way
+// more input won't fix. Nothing is added to an environment.
+func ParseComplete(src string) (bool, error) {
+	lexer := NewLexerFromStream(strings.NewReader(src))
+	scratch := &Glisp{symbols: newSymbolTable()}
+	_, err := ParseTokens(scratch, lexer)
+	if errors.Is(err, UnexpectedEnd) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error at %s: %w", lexer.Pos(), err)
+	}
+	return true, nil
+}
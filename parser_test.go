@@ -0,0 +1,102 @@
+package glisp
+
+import (
+	"strings"
+	"testing"
+)
+
+func parse(env *Glisp, src string) ([]Sexp, error) {
+	return ParseTokens(env, NewLexerFromFile(strings.NewReader(src), "test.glisp"))
+}
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"(+ 1 2)", "(+ 1 2)"},
+		{"()", "()"},
+		{"(a . b)", "(a . b)"},
+		{"(a (b c) [d e])", "(a (b c) [d e])"},
+		{"{a 1}", "(hash a 1)"},
+		{"'a", "(quote a)"},
+		{"`(a ~b ~@c)", "(syntax-quote (a (unquote b) (unquote-splicing c)))"},
+		{"0x10 0o10 0b10 1.5 #a \"s\" true nil", "16 8 2 1.5 #a \"s\" true ()"},
+	}
+
+	env := NewGlisp()
+	for _, test := range tests {
+		exprs, err := parse(env, test.src)
+		if err != nil {
+			t.Errorf("parsing %q: %v", test.src, err)
+			continue
+		}
+		strs := make([]string, len(exprs))
+		for i, expr := range exprs {
+			strs[i] = expr.SexpString()
+		}
+		if got := strings.Join(strs, " "); got != test.want {
+			t.Errorf("parsing %q gave %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	env := NewGlisp()
+	for _, src := range []string{"(a b", "[a", "{a", "(a . b c)", ")"} {
+		if _, err := parse(env, src); err == nil {
+			t.Errorf("parsing %q should fail", src)
+		}
+	}
+}
+
+func TestParseComplete(t *testing.T) {
+	tests := []struct {
+		src      string
+		complete bool
+		fails    bool
+	}{
+		{"(+ 1 2)", true, false},
+		{"(+ 1\n", false, false},
+		{"{a (b", false, false},
+		{"[1 2", false, false},
+		{"(str \"a)\"", false, false},
+		{"(str \"a", false, false},
+		{"(a ; )\n", false, false},
+		{"(list #( #))", true, false},
+		{"'", false, false},
+		{"(a .", false, false},
+		{"a)", false, true},
+		{"(a . b c)", false, true},
+	}
+
+	for _, test := range tests {
+		complete, err := ParseComplete(test.src)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q should be a syntax error", test.src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+		} else if complete != test.complete {
+			t.Errorf("%q complete is %v, want %v", test.src, complete, test.complete)
+		}
+	}
+}
+
+func TestParserPositions(t *testing.T) {
+	exprs, err := parse(NewGlisp(), "1\n  (a\n (b))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := exprs[1].(SexpPair)
+	if outer.pos == nil || *outer.pos != (SourcePos{"test.glisp", 2, 3}) {
+		t.Errorf("outer list at %v, want test.glisp:2:3", outer.pos)
+	}
+	inner := outer.tail.(SexpPair).head.(SexpPair)
+	if inner.pos == nil || *inner.pos != (SourcePos{"test.glisp", 3, 2}) {
+		t.Errorf("inner list at %v, want test.glisp:3:2", inner.pos)
+	}
+}
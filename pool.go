@@ -0,0 +1,83 @@
+package glisp
+
+import (
+	"sync"
+)
+
+// EnvPool runs one compiled program from many goroutines at once. The
+// envs it hands out share the symbols, builtins, globals and macros of
+// the env the pool was made from, but have their own stacks, and whatever
+// they define or set! only they see until they go back to the pool.
+//
+// Values are shared, not copied: a hash or array one env gets from a
+// global and changes in place is changed for every env.
+type EnvPool struct {
+	base    *Glisp
+	macros  *registry // base's macros and the ones program defined
+	program SexpFunction
+	pool    sync.Pool
+}
+
+// NewEnvPool compiles program against env. Set env up first, imports,
+// functions and any definitions the program needs; env shouldn't change
+// once the pool is in use.
+func NewEnvPool(env *Glisp, program string) (*EnvPool, error) {
+	// a defmac in program goes in the pool's registry, not env's
+	compiler := env.duplicate(env.globals.overlay(), env.registry.overlay())
+	err := compiler.LoadString(program)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &EnvPool{base: env, macros: compiler.registry, program: compiler.mainfunc}
+	// loading into one of the pool's envs appends to main, make that copy
+	fun := p.program.fun
+	p.program.fun = fun[:len(fun):len(fun)]
+	positions := p.program.info.positions
+	p.program.info = &funcInfo{positions: positions[:len(positions):len(positions)]}
+
+	p.pool.New = func() interface{} {
+		env := p.base.duplicate(p.base.globals.overlay(), p.macros.overlay())
+		env.reset(p.program)
+		return env
+	}
+	return p, nil
+}
+
+// Get hands out an env ready to Run the program
+func (p *EnvPool) Get() *Glisp {
+	return p.pool.Get().(*Glisp)
+}
+
+// Put resets env and takes it back, it mustn't be used afterwards
+func (p *EnvPool) Put(env *Glisp) {
+	if env.profiler != nil {
+		env.profiler.Stop()
+	}
+	if env.debugger != nil {
+		env.debugger.Detach()
+	}
+	env.globals.reset()
+	env.registry.reset()
+	env.before = p.base.before
+	env.after = p.base.after
+	env.tracers = p.base.tracers
+	env.ctx = p.base.ctx
+	env.stopping.Store(false)
+	env.stopReason = nil
+	env.budget = p.base.budget
+	env.timeout = p.base.timeout
+	env.sandbox = p.base.sandbox
+	env.importCache = p.base.importCache
+	env.optLevel = p.base.optLevel
+	env.out = p.base.out
+	env.reset(p.program)
+	p.pool.Put(env)
+}
+
+// Run runs the program in an env from the pool
+func (p *EnvPool) Run() (Sexp, error) {
+	env := p.Get()
+	defer p.Put(env)
+	return env.Run()
+}
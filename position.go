@@ -0,0 +1,53 @@
+package glisp
+
+import (
+	"fmt"
+)
+
+// SourcePos is where in the source an expression was read from, File is
+// empty for code that didn't come out of a file (strings, the repl)
+type SourcePos struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (pos SourcePos) String() string {
+	if pos.File == "" {
+		return fmt.Sprintf("%d:%d", pos.Line, pos.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Col)
+}
+
+// PositionError is a runtime error tagged with the source of the
+// instruction that raised it
+type PositionError struct {
+	Pos SourcePos
+	Err error
+}
+
+func (p *PositionError) Error() string {
+	return fmt.Sprintf("%s: %v", p.Pos, p.Err)
+}
+
+func (p *PositionError) Unwrap() error {
+	return p.Err
+}
+
+// Position returns the source of the instruction at pc, or nil if the
+// function has none (builtins, generated code)
+func (sf SexpFunction) Position(pc int) *SourcePos {
+	if sf.info == nil || pc < 0 || pc >= len(sf.info.positions) {
+		return nil
+	}
+	return sf.info.positions[pc]
+}
+
+// PositionOf is where a parsed list started, nil for anything else. Macros
+// can use it to say where the code they were given came from.
+func PositionOf(expr Sexp) *SourcePos {
+	if list, ok := expr.(SexpPair); ok {
+		return list.pos
+	}
+	return nil
+}
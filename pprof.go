@@ -0,0 +1,168 @@
+package glisp
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+)
+
+// WritePprof writes a gzipped profile.proto, for go tool pprof and anything
+// else that reads them. Its stacks are glisp functions and lines, with the
+// instructions and nanoseconds spent in each.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	var prof protoBuf
+	strs := newStringTable()
+
+	valueType := func(typ, unit string) []byte {
+		var vt protoBuf
+		vt.int64(1, int64(strs.index(typ)))
+		vt.int64(2, int64(strs.index(unit)))
+		return vt
+	}
+	prof.bytes(1, valueType("instructions", "count"))
+	prof.bytes(1, valueType("cpu", "nanoseconds"))
+
+	funcIDs := make(map[profLoc]uint64)
+	locIDs := make(map[profLoc]uint64)
+	var funcs, locs []profLoc
+
+	locID := func(loc profLoc) uint64 {
+		id, ok := locIDs[loc]
+		if !ok {
+			fn := profLoc{function: loc.function, file: loc.file}
+			if _, ok := funcIDs[fn]; !ok {
+				funcs = append(funcs, fn)
+				funcIDs[fn] = uint64(len(funcs))
+			}
+			locs = append(locs, loc)
+			id = uint64(len(locs))
+			locIDs[loc] = id
+		}
+		return id
+	}
+
+	var samples [][]byte
+	p.walk(func(path []*profNode) {
+		n := path[len(path)-1]
+		if n.instrs == 0 && n.nanos == 0 {
+			return
+		}
+		// the innermost location goes first
+		ids := make([]uint64, len(path))
+		for i, c := range path {
+			ids[len(path)-1-i] = locID(c.loc)
+		}
+		var sample protoBuf
+		sample.packed(1, ids)
+		sample.packed(2, []uint64{uint64(n.instrs), uint64(n.nanos)})
+		samples = append(samples, sample)
+	})
+	// the walk goes through maps, keep the output the same from run to run
+	sort.Slice(samples, func(i, j int) bool { return string(samples[i]) < string(samples[j]) })
+	for _, sample := range samples {
+		prof.bytes(2, sample)
+	}
+
+	for i, loc := range locs {
+		var line protoBuf
+		line.uint64(1, funcIDs[profLoc{function: loc.function, file: loc.file}])
+		line.int64(2, int64(loc.line))
+
+		var l protoBuf
+		l.uint64(1, uint64(i+1))
+		l.bytes(4, line)
+		prof.bytes(4, l)
+	}
+	for i, fn := range funcs {
+		var f protoBuf
+		f.uint64(1, uint64(i+1))
+		f.int64(2, int64(strs.index(fn.function)))
+		f.int64(3, int64(strs.index(fn.function)))
+		f.int64(4, int64(strs.index(fn.file)))
+		prof.bytes(5, f)
+	}
+
+	// the string table has to come after everything that adds to it
+	for _, s := range strs.strs {
+		prof.string(6, s)
+	}
+	prof.int64(9, p.start.UnixNano())
+	prof.int64(10, int64(p.elapsed))
+	prof.bytes(11, valueType("cpu", "nanoseconds"))
+	if p.interval != 0 {
+		prof.int64(12, int64(p.interval))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(prof); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+type stringTable struct {
+	strs    []string
+	indices map[string]int
+}
+
+// profile.proto wants "" at index 0
+func newStringTable() *stringTable {
+	return &stringTable{strs: []string{""}, indices: map[string]int{"": 0}}
+}
+
+func (st *stringTable) index(s string) int {
+	i, ok := st.indices[s]
+	if !ok {
+		i = len(st.strs)
+		st.strs = append(st.strs, s)
+		st.indices[s] = i
+	}
+	return i
+}
+
+// protoBuf is just enough of the protobuf wire format to write a profile
+type protoBuf []byte
+
+func (b *protoBuf) varint(x uint64) {
+	for x >= 0x80 {
+		*b = append(*b, byte(x)|0x80)
+		x >>= 7
+	}
+	*b = append(*b, byte(x))
+}
+
+func (b *protoBuf) key(field int, wiretype int) {
+	b.varint(uint64(field)<<3 | uint64(wiretype))
+}
+
+// zero values are left out, same as protobuf does
+func (b *protoBuf) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(x)
+}
+
+func (b *protoBuf) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuf) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+// strings in the string table keep their place even when empty
+func (b *protoBuf) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *protoBuf) packed(field int, xs []uint64) {
+	var data protoBuf
+	for _, x := range xs {
+		data.varint(x)
+	}
+	b.bytes(field, data)
+}
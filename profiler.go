@@ -0,0 +1,353 @@
+package glisp
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Profiler records where an env spends its time and instructions, by glisp
+// function and source line. Like the debugger it's checked before every
+// instruction. Instruction counts are always exact. Time is either read
+// around every instruction, or with NewSamplingProfiler charged an
+// interval at a time to whatever is running when the interval is up,
+// which costs much less. A late tick charges all the time since the last
+// one, so no time goes missing.
+type Profiler struct {
+	env      *Glisp
+	root     *profNode
+	interval time.Duration // 0 when timing every instruction
+	pending  atomic.Int64  // nanoseconds due to whatever runs next
+	done     chan struct{}
+	start    time.Time
+	elapsed  time.Duration
+
+	files map[*funcInfo]string // the file each function is in
+
+	// where the last instruction ran, the time since then is its
+	callers  *profNode
+	depth    int
+	top      Address
+	leaf     *profNode
+	leafFunc *funcInfo
+	last     time.Time
+}
+
+// profLoc is a line in a function, line is 0 when it isn't known
+type profLoc struct {
+	function string
+	file     string
+	line     int
+}
+
+// profNode is a location in the call tree, what's recorded against it is
+// for the instructions run there, not in what it called
+type profNode struct {
+	loc      profLoc
+	children map[profLoc]*profNode
+	calls    int64
+	instrs   int64
+	nanos    int64
+}
+
+func (n *profNode) child(loc profLoc) *profNode {
+	c, ok := n.children[loc]
+	if !ok {
+		c = &profNode{loc: loc}
+		if n.children == nil {
+			n.children = make(map[profLoc]*profNode)
+		}
+		n.children[loc] = c
+	}
+	return c
+}
+
+// NewProfiler starts profiling env, timing every instruction
+func NewProfiler(env *Glisp) *Profiler {
+	p := &Profiler{
+		env:   env,
+		root:  &profNode{},
+		files: make(map[*funcInfo]string),
+		depth: -1,
+		start: time.Now(),
+	}
+	p.last = p.start
+	env.profiler = p
+	return p
+}
+
+// NewSamplingProfiler starts profiling env, charging time every interval
+func NewSamplingProfiler(env *Glisp, interval time.Duration) *Profiler {
+	p := NewProfiler(env)
+	p.interval = interval
+	p.done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := p.start
+		for {
+			select {
+			case now := <-ticker.C:
+				p.pending.Add(int64(now.Sub(last)))
+				last = now
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Stop detaches the profiler, what it recorded can still be written out
+func (p *Profiler) Stop() {
+	if p.env.profiler != p {
+		return
+	}
+	p.env.profiler = nil
+	now := time.Now()
+	if p.interval == 0 && p.leaf != nil {
+		p.leaf.nanos += int64(now.Sub(p.last))
+	}
+	if p.done != nil {
+		close(p.done)
+	}
+	p.elapsed = now.Sub(p.start)
+}
+
+func (p *Profiler) funcFile(sf SexpFunction) string {
+	if sf.info == nil {
+		return ""
+	}
+	file, ok := p.files[sf.info]
+	if !ok {
+		for _, pos := range sf.info.positions {
+			if pos != nil {
+				file = pos.File
+				break
+			}
+		}
+		p.files[sf.info] = file
+	}
+	return file
+}
+
+func (p *Profiler) location(sf SexpFunction, pc int) profLoc {
+	loc := profLoc{function: sf.name, file: p.funcFile(sf)}
+	if pos := sf.Position(pc); pos != nil {
+		loc.line = pos.Line
+	}
+	return loc
+}
+
+// step runs before each instruction
+func (p *Profiler) step() {
+	env := p.env
+
+	if p.interval == 0 {
+		now := time.Now()
+		if p.leaf != nil {
+			p.leaf.nanos += int64(now.Sub(p.last))
+		}
+		p.last = now
+	}
+
+	// the callers only change with the address stack
+	depth := env.callDepth()
+	var top Address
+	if depth > 0 {
+		top = env.addrstack.elements[env.addrstack.tos].(Address)
+	}
+	if depth != p.depth || top.position != p.top.position || top.function.info != p.top.function.info {
+		p.callers = p.root
+		for i := 0; i <= env.addrstack.tos; i++ {
+			addr := env.addrstack.elements[i].(Address)
+			// the return address, the call is just before it
+			p.callers = p.callers.child(p.location(addr.function, addr.position-1))
+		}
+		p.depth, p.top = depth, top
+		p.leaf = nil
+	}
+
+	// an instruction without a position stays on the line before it
+	if env.curfunc.Position(env.pc) != nil || p.leaf == nil || p.leafFunc != env.curfunc.info {
+		p.leaf = p.callers.child(p.location(env.curfunc, env.pc))
+		p.leafFunc = env.curfunc.info
+	}
+	if env.pc == 0 {
+		p.leaf.calls++
+	}
+	p.leaf.instrs++
+	if p.interval != 0 && p.pending.Load() != 0 {
+		p.leaf.nanos += p.pending.Swap(0)
+	}
+}
+
+// FunctionProfile is what a function cost. The totals include what it
+// called, the self figures only its own instructions. Time spent in
+// builtins goes to the glisp code calling them.
+type FunctionProfile struct {
+	Name             string
+	File             string
+	Calls            int64
+	Instructions     int64
+	SelfInstructions int64
+	Time             time.Duration
+	SelfTime         time.Duration
+}
+
+// LineProfile is what a line of a function cost, the same way
+type LineProfile struct {
+	Function         string
+	File             string
+	Line             int
+	Instructions     int64
+	SelfInstructions int64
+	Time             time.Duration
+	SelfTime         time.Duration
+}
+
+// walk calls fn for every node below the root with the path to it, root
+// excluded
+func (p *Profiler) walk(fn func(path []*profNode)) {
+	var visit func(n *profNode, path []*profNode)
+	visit = func(n *profNode, path []*profNode) {
+		for _, c := range n.children {
+			path := append(path, c)
+			fn(path)
+			visit(c, path)
+		}
+	}
+	visit(p.root, nil)
+}
+
+// Functions is what each function cost, the most time first
+func (p *Profiler) Functions() []FunctionProfile {
+	byName := make(map[profLoc]*FunctionProfile)
+	get := func(loc profLoc) *FunctionProfile {
+		key := profLoc{function: loc.function, file: loc.file}
+		f, ok := byName[key]
+		if !ok {
+			f = &FunctionProfile{Name: loc.function, File: loc.file}
+			byName[key] = f
+		}
+		return f
+	}
+
+	p.walk(func(path []*profNode) {
+		n := path[len(path)-1]
+		f := get(n.loc)
+		f.Calls += n.calls
+		f.SelfInstructions += n.instrs
+		f.SelfTime += time.Duration(n.nanos)
+
+		// a recursive function is only charged once
+		seen := make(map[profLoc]bool)
+		for _, c := range path {
+			key := profLoc{function: c.loc.function, file: c.loc.file}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			f := get(key)
+			f.Instructions += n.instrs
+			f.Time += time.Duration(n.nanos)
+		}
+	})
+
+	funcs := make([]FunctionProfile, 0, len(byName))
+	for _, f := range byName {
+		funcs = append(funcs, *f)
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		if funcs[i].Time != funcs[j].Time {
+			return funcs[i].Time > funcs[j].Time
+		}
+		if funcs[i].Instructions != funcs[j].Instructions {
+			return funcs[i].Instructions > funcs[j].Instructions
+		}
+		return funcs[i].Name < funcs[j].Name
+	})
+	return funcs
+}
+
+// Lines is what each line cost, the most time first
+func (p *Profiler) Lines() []LineProfile {
+	byLine := make(map[profLoc]*LineProfile)
+	get := func(loc profLoc) *LineProfile {
+		l, ok := byLine[loc]
+		if !ok {
+			l = &LineProfile{Function: loc.function, File: loc.file, Line: loc.line}
+			byLine[loc] = l
+		}
+		return l
+	}
+
+	p.walk(func(path []*profNode) {
+		n := path[len(path)-1]
+		l := get(n.loc)
+		l.SelfInstructions += n.instrs
+		l.SelfTime += time.Duration(n.nanos)
+
+		seen := make(map[profLoc]bool)
+		for _, c := range path {
+			if seen[c.loc] {
+				continue
+			}
+			seen[c.loc] = true
+			l := get(c.loc)
+			l.Instructions += n.instrs
+			l.Time += time.Duration(n.nanos)
+		}
+	})
+
+	lines := make([]LineProfile, 0, len(byLine))
+	for _, l := range byLine {
+		lines = append(lines, *l)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Time != lines[j].Time {
+			return lines[i].Time > lines[j].Time
+		}
+		if lines[i].Instructions != lines[j].Instructions {
+			return lines[i].Instructions > lines[j].Instructions
+		}
+		if lines[i].Function != lines[j].Function {
+			return lines[i].Function < lines[j].Function
+		}
+		return lines[i].Line < lines[j].Line
+	})
+	return lines
+}
+
+// WriteFolded writes the call stacks one per line, outermost function
+// first, with the nanoseconds spent in them. That's what flamegraph.pl
+// and most other flame graph tools read.
+func (p *Profiler) WriteFolded(w io.Writer) error {
+	stacks := make(map[string]int64)
+	p.walk(func(path []*profNode) {
+		n := path[len(path)-1]
+		if n.nanos == 0 {
+			return
+		}
+		names := make([]string, len(path))
+		for i, c := range path {
+			names[i] = c.loc.function
+		}
+		stacks[strings.Join(names, ";")] += n.nanos
+	})
+
+	keys := make([]string, 0, len(stacks))
+	for stack := range stacks {
+		keys = append(keys, stack)
+	}
+	sort.Strings(keys)
+	for _, stack := range keys {
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, stacks[stack]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
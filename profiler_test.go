@@ -0,0 +1,224 @@
+package glisp_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/chrhlnd/glisp"
+)
+
+const profilee = `(defn fib [n]
+  (cond (< n 2) n
+        (+ (fib (- n 1)) (fib (- n 2)))))
+(fib 10)`
+
+func profile(t *testing.T) *glisp.Profiler {
+	t.Helper()
+	env := glisp.NewGlisp()
+	p := glisp.NewProfiler(env)
+	expr, err := env.EvalString(profilee)
+	p.Stop()
+	if err != nil || expr != glisp.SexpInt(55) {
+		t.Fatalf("the profilee gave %v, %v", expr, err)
+	}
+	return p
+}
+
+func TestProfilerCounts(t *testing.T) {
+	p := profile(t)
+	funcs := make(map[string]glisp.FunctionProfile)
+	var self int64
+	for _, f := range p.Functions() {
+		funcs[f.Name] = f
+		self += f.SelfInstructions
+	}
+	fib, main := funcs["fib"], funcs["__main"]
+	if fib.Calls != 177 || main.Calls != 1 {
+		t.Errorf("fib was called %d times, main %d", fib.Calls, main.Calls)
+	}
+	// a recursive function is only charged once for what it calls
+	if fib.Instructions != fib.SelfInstructions || fib.Instructions == 0 {
+		t.Errorf("fib ran %d instructions, %d itself", fib.Instructions, fib.SelfInstructions)
+	}
+	if main.Instructions != self || main.Instructions != main.SelfInstructions+fib.Instructions {
+		t.Errorf("main ran %d instructions, every function %d", main.Instructions, self)
+	}
+
+	// the counts are exact, the same as the budget counts
+	env := glisp.NewGlisp()
+	env.SetInstructionBudget(int(self))
+	if _, err := env.EvalString(profilee); err != nil {
+		t.Errorf("a budget of %d: %v", self, err)
+	}
+	env.SetInstructionBudget(int(self) - 1)
+	if _, err := env.EvalString(profilee); err == nil {
+		t.Errorf("a budget of %d was enough", self-1)
+	}
+
+	var lines int64
+	for _, l := range p.Lines() {
+		if l.Function == "fib" && (l.Line < 1 || l.Line > 3) {
+			t.Errorf("fib has a line %d", l.Line)
+		}
+		lines += l.SelfInstructions
+	}
+	if lines != self {
+		t.Errorf("the lines ran %d instructions, the functions %d", lines, self)
+	}
+}
+
+func TestProfilerFolded(t *testing.T) {
+	p := profile(t)
+	var buf bytes.Buffer
+	if err := p.WriteFolded(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	stacks := make(map[string]bool)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		stack, nanos, ok := strings.Cut(scanner.Text(), " ")
+		n, err := strconv.ParseInt(nanos, 10, 64)
+		if !ok || err != nil || n <= 0 || !strings.HasPrefix(stack, "__main") {
+			t.Fatalf("bad line %q", scanner.Text())
+		}
+		stacks[stack] = true
+		total += n
+	}
+	if !stacks["__main;fib;fib"] {
+		t.Errorf("no recursion in %v", stacks)
+	}
+	for _, f := range p.Functions() {
+		if f.Name == "__main" && int64(f.Time) != total {
+			t.Errorf("main took %d ns, the stacks %d", f.Time, total)
+		}
+	}
+}
+
+// protoFields splits a protobuf message into its varint and length
+// delimited fields, the only wire types a profile uses
+func protoFields(t *testing.T, msg []byte) (map[int][]uint64, map[int][][]byte) {
+	t.Helper()
+	varints := make(map[int][]uint64)
+	delimited := make(map[int][][]byte)
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			t.Fatal("bad key")
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			x, n := binary.Uvarint(msg)
+			if n <= 0 {
+				t.Fatal("bad varint")
+			}
+			varints[field] = append(varints[field], x)
+			msg = msg[n:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				t.Fatal("bad length")
+			}
+			delimited[field] = append(delimited[field], msg[n:n+int(size)])
+			msg = msg[n+int(size):]
+		default:
+			t.Fatalf("wire type %d", key&7)
+		}
+	}
+	return varints, delimited
+}
+
+func packed(t *testing.T, data []byte) []uint64 {
+	var xs []uint64
+	for len(data) > 0 {
+		x, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("bad packed varint")
+		}
+		xs = append(xs, x)
+		data = data[n:]
+	}
+	return xs
+}
+
+func TestProfilerPprof(t *testing.T) {
+	p := profile(t)
+	var buf bytes.Buffer
+	if err := p.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, prof := protoFields(t, msg)
+	strs := make([]string, len(prof[6]))
+	for i, s := range prof[6] {
+		strs[i] = string(s)
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("the string table is %q", strs)
+	}
+
+	var types []string
+	for _, vt := range prof[1] {
+		v, _ := protoFields(t, vt)
+		types = append(types, strs[v[1][0]]+"/"+strs[v[2][0]])
+	}
+	if strings.Join(types, " ") != "instructions/count cpu/nanoseconds" {
+		t.Errorf("the sample types are %v", types)
+	}
+
+	// function id to name, location id to its function's name
+	names := make(map[uint64]string)
+	for _, fn := range prof[5] {
+		v, _ := protoFields(t, fn)
+		names[v[1][0]] = strs[v[2][0]]
+	}
+	locs := make(map[uint64]string)
+	for _, loc := range prof[4] {
+		v, d := protoFields(t, loc)
+		line, _ := protoFields(t, d[4][0])
+		locs[v[1][0]] = names[line[1][0]]
+	}
+
+	var instrs, nanos int64
+	deepest := 0
+	for _, sample := range prof[2] {
+		_, d := protoFields(t, sample)
+		ids, values := packed(t, d[1][0]), packed(t, d[2][0])
+		if len(values) != 2 {
+			t.Fatalf("a sample has %d values", len(values))
+		}
+		instrs += int64(values[0])
+		nanos += int64(values[1])
+		// innermost first, so main is last
+		if locs[ids[len(ids)-1]] != "__main" {
+			t.Errorf("a stack starts in %s", locs[ids[len(ids)-1]])
+		}
+		deepest = max(deepest, len(ids))
+	}
+	// (fib 10) calls itself nine deep
+	if deepest != 11 {
+		t.Errorf("the deepest stack is %d", deepest)
+	}
+	for _, f := range p.Functions() {
+		if f.Name == "__main" && (f.Instructions != instrs || int64(f.Time) != nanos) {
+			t.Errorf("main ran %d instructions in %d ns, the samples %d in %d",
+				f.Instructions, f.Time, instrs, nanos)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package glisp
+
+import (
+	"strconv"
+	"sync"
+)
+
+// symbolTable interns symbol names. Environments cloned or duplicated
+// from each other share one, and may run on different goroutines.
+type symbolTable struct {
+	lock    sync.RWMutex
+	numbers map[string]int
+	next    int
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{numbers: make(map[string]int), next: 1}
+}
+
+func (t *symbolTable) intern(name string) int {
+	t.lock.RLock()
+	num, ok := t.numbers[name]
+	t.lock.RUnlock()
+	if ok {
+		return num
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if num, ok := t.numbers[name]; ok {
+		return num
+	}
+	return t.add(name)
+}
+
+// gensym makes a symbol named prefix and a number nothing else has used
+func (t *symbolTable) gensym(prefix string) SexpSymbol {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for {
+		name := prefix + strconv.Itoa(t.next)
+		if _, ok := t.numbers[name]; ok {
+			// someone wrote the name themselves, it's theirs
+			t.next++
+			continue
+		}
+		return SexpSymbol{name, t.add(name)}
+	}
+}
+
+// all is every symbol interned so far
+func (t *symbolTable) all() []SexpSymbol {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	syms := make([]SexpSymbol, 0, len(t.numbers))
+	for name, num := range t.numbers {
+		syms = append(syms, SexpSymbol{name, num})
+	}
+	return syms
+}
+
+// add needs the write lock held
+func (t *symbolTable) add(name string) int {
+	num := t.next
+	t.numbers[name] = num
+	t.next++
+	return num
+}
+
+// registry is the compile time state environments share with their
+// clones and duplicates
+type registry struct {
+	lock    sync.RWMutex
+	macros  map[SexpSymbol]SexpFunction
+	imports map[string]struct{}
+	base    *registry // shadowed like GlobalScope.base
+}
+
+func newRegistry() *registry {
+	return &registry{
+		macros:  make(map[SexpSymbol]SexpFunction),
+		imports: make(map[string]struct{}),
+	}
+}
+
+func (r *registry) overlay() *registry {
+	o := newRegistry()
+	o.base = r
+	return o
+}
+
+func (r *registry) macro(sym SexpSymbol) (SexpFunction, bool) {
+	r.lock.RLock()
+	macro, ok := r.macros[sym]
+	r.lock.RUnlock()
+	if !ok && r.base != nil {
+		return r.base.macro(sym)
+	}
+	return macro, ok
+}
+
+func (r *registry) setMacro(sym SexpSymbol, macro SexpFunction) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.macros[sym] = macro
+}
+
+// markImported records name as imported, false if it already was
+func (r *registry) markImported(name string) bool {
+	if r.base != nil && r.base.imported(name) {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.imports[name]; ok {
+		return false
+	}
+	r.imports[name] = struct{}{}
+	return true
+}
+
+// unmarkImported takes back markImported, for an import that failed
+func (r *registry) unmarkImported(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.imports, name)
+}
+
+func (r *registry) imported(name string) bool {
+	r.lock.RLock()
+	_, ok := r.imports[name]
+	r.lock.RUnlock()
+	if !ok && r.base != nil {
+		return r.base.imported(name)
+	}
+	return ok
+}
+
+// commit moves what's been registered in an overlay down into its base
+func (r *registry) commit() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for sym, macro := range r.macros {
+		r.base.setMacro(sym, macro)
+	}
+	for name := range r.imports {
+		r.base.markImported(name)
+	}
+	clear(r.macros)
+	clear(r.imports)
+}
+
+// scriptMacros are the macros written in glisp, the ones that can go
+// into a compiled image. inherited includes what an overlay shadows.
+func (r *registry) scriptMacros(inherited bool) map[SexpSymbol]SexpFunction {
+	macros := make(map[SexpSymbol]SexpFunction)
+	if inherited && r.base != nil {
+		macros = r.base.scriptMacros(true)
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for sym, macro := range r.macros {
+		if macro.user {
+			delete(macros, sym)
+			continue
+		}
+		macros[sym] = macro
+	}
+	return macros
+}
+
+func (r *registry) importNames(inherited bool) []string {
+	var names []string
+	if inherited && r.base != nil {
+		names = r.base.importNames(true)
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for name := range r.imports {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (r *registry) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	clear(r.macros)
+	clear(r.imports)
+}
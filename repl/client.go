@@ -0,0 +1,168 @@
+package repl
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Client talks to a repl Server. It's safe to use from several goroutines,
+// an Interrupt can be sent while an Eval waits.
+type Client struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[string]chan *Response
+	nextID  int
+	err     error         // why the connection ended
+	done    chan struct{} // closed when it has
+}
+
+// Dial connects to a server listening on network and address
+func Dial(network, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient talks to a server over conn
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:    conn,
+		pending: make(map[string]chan *Response),
+		done:    make(chan struct{}),
+	}
+	go c.read()
+	return c
+}
+
+func (c *Client) read() {
+	var err error
+	for {
+		var resp Response
+		if err = readFrame(c.conn, &resp); err != nil {
+			break
+		}
+		c.lock.Lock()
+		reply, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.lock.Unlock()
+		if ok {
+			reply <- &resp
+		}
+	}
+
+	c.lock.Lock()
+	c.err = err
+	c.lock.Unlock()
+	close(c.done)
+}
+
+// Close ends the connection, and with it the sessions it cloned
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Send sends req and waits for its response. req is given an id if it
+// doesn't have one.
+func (c *Client) Send(req *Request) (*Response, error) {
+	reply := make(chan *Response, 1)
+	c.lock.Lock()
+	if req.ID == "" {
+		c.nextID++
+		req.ID = strconv.Itoa(c.nextID)
+	}
+	if _, ok := c.pending[req.ID]; ok {
+		c.lock.Unlock()
+		return nil, errors.New("request id " + req.ID + " is already waiting")
+	}
+	c.pending[req.ID] = reply
+	c.lock.Unlock()
+
+	c.writeLock.Lock()
+	err := writeFrame(c.conn, req)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.lock.Lock()
+		delete(c.pending, req.ID)
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	select {
+	case resp := <-reply:
+		return resp, nil
+	case <-c.done:
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return nil, c.err
+	}
+}
+
+// call sends req, turning a failed response into an error
+func (c *Client) call(req *Request) (*Response, error) {
+	resp, err := c.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != "" {
+		return resp, errors.New(resp.Err)
+	}
+	return resp, nil
+}
+
+// Describe asks what ops and versions the server has
+func (c *Client) Describe() (*Response, error) {
+	return c.call(&Request{Op: "describe"})
+}
+
+// Clone starts a session, returning its id
+func (c *Client) Clone() (string, error) {
+	resp, err := c.call(&Request{Op: "clone"})
+	if err != nil {
+		return "", err
+	}
+	return resp.NewSession, nil
+}
+
+// CloseSession ends a session
+func (c *Client) CloseSession(session string) error {
+	_, err := c.call(&Request{Op: "close", Session: session})
+	return err
+}
+
+// Eval runs code in session. Its value, output and any failure are in the
+// response, the error is for requests that didn't get that far.
+func (c *Client) Eval(session, code string) (*Response, error) {
+	return c.Send(&Request{Op: "eval", Session: session, Code: code})
+}
+
+// LoadFile runs code in session as though it were file. With no code
+// the server reads file itself.
+func (c *Client) LoadFile(session, file, code string) (*Response, error) {
+	return c.Send(&Request{Op: "load-file", Session: session, File: file, Code: code})
+}
+
+// Complete lists the globals starting with prefix, session can be empty
+// for the host's
+func (c *Client) Complete(session, prefix string) ([]string, error) {
+	resp, err := c.call(&Request{Op: "complete", Session: session, Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Completions, nil
+}
+
+// Interrupt stops the evaluation with request id in session, or whatever
+// it's running when id is empty. It's false when there was nothing to stop.
+func (c *Client) Interrupt(session, id string) (bool, error) {
+	resp, err := c.call(&Request{Op: "interrupt", Session: session, InterruptID: id})
+	if err != nil {
+		return false, err
+	}
+	return !resp.Has("session-idle"), nil
+}
@@ -0,0 +1,315 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chrhlnd/glisp"
+)
+
+// Command is a repl meta-command, typed as :name and its arguments
+type Command struct {
+	Name  string // without the colon
+	Usage string // what it takes, shown by :help
+	Help  string
+	Run   func(env *glisp.Glisp, args string) error
+}
+
+var commands = make(map[string]Command)
+
+// AddCommand adds a meta-command to the repl, replacing any with the same
+// name. Apps embedding the repl add their own with it.
+func AddCommand(cmd Command) {
+	commands[cmd.Name] = cmd
+}
+
+// errQuit is returned by :quit to end the repl
+var errQuit = errors.New("quit")
+
+// loaded are the files :load has sourced, in order, for :reload
+var loaded []string
+
+// start is what the env had defined when the repl started, :reset goes
+// back to it
+var start *glisp.Checkpoint
+
+func init() {
+	for _, cmd := range []Command{
+		{"help", "", "list the commands", helpCommand},
+		{"quit", "", "leave the repl", func(*glisp.Glisp, string) error { return errQuit }},
+		{"load", "file", "run a file, remembering it for :reload", loadCommand},
+		{"reload", "", "run the files loaded so far again", reloadCommand},
+		{"doc", "name", "show how to call a function or special form and what it does", docCommand},
+		{"type", "expr", "show the type of what expr evaluates to", typeCommand},
+		{"time", "expr", "evaluate expr and show how long it took", timeCommand},
+		{"disasm", "fn", "show a function's instructions, their jumps and source lines", disasmCommand},
+		{"env", "", "list the globals defined in glisp", envCommand},
+		{"reset", "", "forget what's been defined since the repl started", resetCommand},
+		{"dump", "[fn]", "dump the vm's state, or a function's instructions", dumpCommand},
+	} {
+		AddCommand(cmd)
+	}
+
+	debugCommands := []struct{ name, usage, help string }{
+		{"break", "[fn | line | file:line ...]", "set breakpoints, or list them"},
+		{"delete", "id ...", "remove breakpoints"},
+		{"watch", "[expr]", "show expr whenever the debugger stops, or show the watches"},
+		{"step", "[expr]", "step into the next call, starting expr when not stopped"},
+		{"next", "[expr]", "step over the next call, starting expr when not stopped"},
+		{"out", "", "run until the current function returns"},
+		{"continue", "", "run until the next breakpoint"},
+		{"locals", "[all]", "show the locals where the debugger stopped, all shows the ones macros make too"},
+		{"bt", "", "show the call stack where the debugger stopped"},
+	}
+	for _, dc := range debugCommands {
+		name := ":" + dc.name
+		AddCommand(Command{dc.name, dc.usage, dc.help, func(env *glisp.Glisp, args string) error {
+			expr, _ := processDebugCommand(env, name, strings.Fields(args))
+			if expr == "" {
+				return nil
+			}
+			return evalPrint(env, expr)
+		}})
+	}
+}
+
+// runCommand runs a line starting with a colon
+func runCommand(env *glisp.Glisp, line string) error {
+	name, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	cmd, ok := commands[strings.TrimPrefix(name, ":")]
+	if !ok {
+		return fmt.Errorf("unknown command %s, :help lists them", name)
+	}
+	return cmd.Run(env, strings.TrimSpace(args))
+}
+
+// evalPrint evaluates line and prints what it gave. Failures are printed
+// with their stack trace, only an exit is returned.
+func evalPrint(env *glisp.Glisp, line string) error {
+	expr, err := env.EvalString(line)
+	var exit *glisp.ExitError
+	if errors.As(err, &exit) {
+		return exit
+	}
+	if err != nil {
+		fmt.Print(env.GetStackTrace(err))
+		env.Clear()
+		return nil
+	}
+	if expr != glisp.SexpNull {
+		fmt.Println(expr.SexpString())
+	}
+	return nil
+}
+
+// evalArg evaluates a command's argument, the failure is left to print
+func evalArg(env *glisp.Glisp, args string) (glisp.Sexp, error) {
+	if args == "" {
+		return glisp.SexpNull, errors.New("an expression is needed")
+	}
+	expr, err := env.EvalString(args)
+	if err != nil {
+		var exit *glisp.ExitError
+		if !errors.As(err, &exit) {
+			err = errors.New(strings.TrimRight(env.GetStackTrace(err), "\n"))
+			env.Clear()
+		}
+	}
+	return expr, err
+}
+
+func helpCommand(env *glisp.Glisp, args string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	usages := make([]string, len(names))
+	width := 0
+	for i, name := range names {
+		usages[i] = strings.TrimSpace(":" + name + " " + commands[name].Usage)
+		width = max(width, len(usages[i]))
+	}
+	for i, name := range names {
+		fmt.Printf("%-*s  %s\n", width, usages[i], commands[name].Help)
+	}
+	return nil
+}
+
+// sourceFile runs file in env
+func sourceFile(env *glisp.Glisp, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = env.SourceFile(f)
+	var exit *glisp.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		err = errors.New(strings.TrimRight(env.GetStackTrace(err), "\n"))
+		env.Clear()
+	}
+	return err
+}
+
+func loadCommand(env *glisp.Glisp, args string) error {
+	file := strings.Trim(args, `"`)
+	if file == "" {
+		return errors.New(":load needs a file")
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	if err := sourceFile(env, file); err != nil {
+		return err
+	}
+	for _, f := range loaded {
+		if f == file {
+			return nil
+		}
+	}
+	loaded = append(loaded, file)
+	return nil
+}
+
+func reloadCommand(env *glisp.Glisp, args string) error {
+	if len(loaded) == 0 {
+		fmt.Println("nothing loaded yet")
+	}
+	for _, file := range loaded {
+		if err := sourceFile(env, file); err != nil {
+			return err
+		}
+		fmt.Printf("reloaded %s\n", file)
+	}
+	return nil
+}
+
+func docCommand(env *glisp.Glisp, args string) error {
+	if args == "" {
+		return errors.New(":doc needs a name")
+	}
+
+	obj, found := env.FindObject(args)
+	if fun, ok := obj.(glisp.SexpFunction); found && ok && !fun.Builtin() {
+		fmt.Println(fun.Signature())
+		if doc := fun.Doc(); doc != "" {
+			fmt.Println("  " + doc)
+		}
+		return nil
+	}
+	if doc, ok := glisp.LookupDoc(args); ok {
+		fmt.Println(doc.Usage)
+		fmt.Println("  " + doc.Text)
+		return nil
+	}
+	if found {
+		fmt.Printf("%s is a %s, with no documentation\n", args, glisp.TypeName(obj))
+		return nil
+	}
+	return fmt.Errorf("nothing called %s", args)
+}
+
+func typeCommand(env *glisp.Glisp, args string) error {
+	expr, err := evalArg(env, args)
+	if err != nil {
+		return err
+	}
+	fmt.Println(glisp.TypeName(expr))
+	return nil
+}
+
+func timeCommand(env *glisp.Glisp, args string) error {
+	begin := time.Now()
+	expr, err := evalArg(env, args)
+	elapsed := time.Since(begin)
+	if err != nil {
+		return err
+	}
+	if expr != glisp.SexpNull {
+		fmt.Println(expr.SexpString())
+	}
+	fmt.Printf("elapsed %v\n", elapsed)
+	return nil
+}
+
+func disasmCommand(env *glisp.Glisp, args string) error {
+	if args == "" {
+		return errors.New(":disasm needs a function name")
+	}
+	obj, found := env.FindObject(args)
+	if !found {
+		return fmt.Errorf("nothing called %s", args)
+	}
+	fun, ok := obj.(glisp.SexpFunction)
+	if !ok {
+		return fmt.Errorf("%s is a %s, not a function", args, glisp.TypeName(obj))
+	}
+	return glisp.Disassemble(os.Stdout, fun)
+}
+
+func envCommand(env *glisp.Glisp, args string) error {
+	for _, name := range env.GlobalNames() {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		obj, found := env.FindObject(name)
+		if !found {
+			// a special form or macro
+			continue
+		}
+		if fun, ok := obj.(glisp.SexpFunction); ok {
+			if !fun.Builtin() {
+				fmt.Println(fun.Signature())
+			}
+			continue
+		}
+		value := obj.SexpString()
+		if len(value) > 60 {
+			value = value[:57] + "..."
+		}
+		fmt.Printf("%s = %s\n", name, value)
+	}
+	return nil
+}
+
+func resetCommand(env *glisp.Glisp, args string) error {
+	env.Restore(start)
+	loaded = nil
+	fmt.Println("reset")
+	return nil
+}
+
+func dumpCommand(env *glisp.Glisp, args string) error {
+	if args == "" {
+		env.DumpEnvironment()
+		return nil
+	}
+	return env.DumpFunctionByName(args)
+}
+
+// commandCompleter completes command names after a colon starting the
+// line, and symbols everywhere else
+func commandCompleter(symbols Completer) Completer {
+	return func(line string, pos int) (int, []string) {
+		word := string([]rune(line)[:pos])
+		if !strings.HasPrefix(word, ":") || strings.ContainsAny(word, " \t") {
+			return symbols(line, pos)
+		}
+		var candidates []string
+		for name := range commands {
+			if strings.HasPrefix(":"+name, word) {
+				candidates = append(candidates, ":"+name)
+			}
+		}
+		sort.Strings(candidates)
+		return 0, candidates
+	}
+}
@@ -0,0 +1,34 @@
+package repl
+
+import (
+	"strings"
+
+	"github.com/chrhlnd/glisp"
+)
+
+// SymbolCompleter completes the symbol before the cursor with the names
+// env has bound globally, its builtins and macros and the special forms.
+// Names starting with __ are left out unless that's what's been typed.
+func SymbolCompleter(env *glisp.Glisp) Completer {
+	return func(line string, pos int) (int, []string) {
+		runes := []rune(line)
+		start := pos
+		for start > 0 && !isDelimiter(runes[start-1]) {
+			start--
+		}
+		prefix := string(runes[start:pos])
+		hidden := !strings.HasPrefix(prefix, "__")
+
+		var candidates []string
+		for _, name := range env.GlobalNames() {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if hidden && strings.HasPrefix(name, "__") {
+				continue
+			}
+			candidates = append(candidates, name)
+		}
+		return start, candidates
+	}
+}
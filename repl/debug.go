@@ -0,0 +1,194 @@
+package repl
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/chrhlnd/glisp"
+)
+
+// getDebugger is the env's debugger, attached the first time a debug
+// command is used, until then the vm doesn't pay for it. From then on
+// code is compiled unoptimized, so it steps and stops the way it's written.
+func getDebugger(env *glisp.Glisp) *glisp.Debugger {
+	d := env.Debugger()
+	if d == nil {
+		d = glisp.NewDebugger(env, debugPrompt)
+		env.SetOptLevel(0)
+	}
+	return d
+}
+
+// SetBreakpoint takes a function name, a line or file:line
+func SetBreakpoint(env *glisp.Glisp, spec string) {
+	setBreakpoint(getDebugger(env), spec)
+}
+
+func setBreakpoint(d *glisp.Debugger, spec string) {
+	var bp *glisp.Breakpoint
+	if i := strings.LastIndex(spec, ":"); i > 0 {
+		line, err := strconv.Atoi(spec[i+1:])
+		if err != nil {
+			fmt.Printf("bad line in %q\n", spec)
+			return
+		}
+		bp = d.BreakLine(spec[:i], line)
+	} else if line, err := strconv.Atoi(spec); err == nil {
+		bp = d.BreakLine("", line)
+	} else {
+		bp = d.BreakFunction(spec)
+	}
+	fmt.Printf("breakpoint %s\n", bp)
+}
+
+// processDebugCommand runs one of the : commands. Outside of the debugger
+// :step and :next take an expression to step through, that's returned to
+// be evaluated. resume is true when a stopped env should carry on.
+func processDebugCommand(env *glisp.Glisp, cmd string, args []string) (expr string, resume bool) {
+	return debugCommand(getDebugger(env), cmd, args)
+}
+
+func debugCommand(d *glisp.Debugger, cmd string, args []string) (expr string, resume bool) {
+	switch cmd {
+	case ":break":
+		if len(args) == 0 {
+			for _, bp := range d.Breakpoints() {
+				fmt.Println(bp)
+			}
+		}
+		for _, spec := range args {
+			setBreakpoint(d, spec)
+		}
+	case ":delete":
+		for _, arg := range args {
+			id, err := strconv.Atoi(arg)
+			if err != nil || !d.RemoveBreakpoint(id) {
+				fmt.Printf("no breakpoint %s\n", arg)
+			}
+		}
+	case ":watch":
+		if len(args) == 0 {
+			printWatches(d)
+		} else {
+			d.Watch(strings.Join(args, " "))
+		}
+	case ":step", ":next", ":out", ":continue":
+		switch cmd {
+		case ":step":
+			d.Step()
+		case ":next":
+			d.Next()
+		case ":out":
+			d.Out()
+		case ":continue":
+			d.Continue()
+		}
+		if d.Stopped() {
+			return "", true
+		}
+		if len(args) == 0 || cmd == ":continue" || cmd == ":out" {
+			d.Continue()
+			fmt.Println("not stopped, :step and :next take an expression to start with")
+			return "", false
+		}
+		return strings.Join(args, " "), false
+	case ":locals":
+		if !d.Stopped() {
+			fmt.Println("not stopped")
+			break
+		}
+		d.Verbose = len(args) > 0 && args[0] == "all"
+		for _, local := range d.Locals() {
+			fmt.Printf("%s = %s\n", local.Name, local.Value.SexpString())
+		}
+	case ":bt":
+		if !d.Stopped() {
+			fmt.Println("not stopped")
+			break
+		}
+		for i, frame := range d.Backtrace() {
+			if frame.Pos != nil {
+				fmt.Printf("#%d %s at %s\n", i, frame.Function, frame.Pos)
+			} else {
+				fmt.Printf("#%d %s\n", i, frame.Function)
+			}
+		}
+	default:
+		fmt.Printf("unknown command %s\n", cmd)
+	}
+	return "", false
+}
+
+func printWatches(d *glisp.Debugger) {
+	for _, w := range d.WatchValues() {
+		if w.Err != nil {
+			fmt.Printf("%s: %v\n", w.Expr, w.Err)
+		} else {
+			fmt.Printf("%s = %s\n", w.Expr, w.Value.SexpString())
+		}
+	}
+}
+
+// sourceLine is the text of a line of file, empty if it can't be read
+func sourceLine(file string, line int) string {
+	if file == "" {
+		return ""
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(string(src), "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return lines[line-1]
+}
+
+// debugPrompt reads commands while the env is stopped, expressions are
+// evaluated where it stopped
+func debugPrompt(d *glisp.Debugger, stop glisp.DebugStop) {
+	where := stop.Function
+	if stop.Pos != nil {
+		where += " at " + stop.Pos.String()
+	}
+	if stop.Breakpoint != nil {
+		fmt.Printf("breakpoint %d, %s\n", stop.Breakpoint.ID, where)
+	} else {
+		fmt.Printf("stopped in %s\n", where)
+	}
+	if stop.Pos != nil {
+		if text := sourceLine(stop.Pos.File, stop.Pos.Line); text != "" {
+			fmt.Printf("%d\t%s\n", stop.Pos.Line, text)
+		}
+	}
+	printWatches(d)
+
+	for {
+		line, err := getExpression("debug>")
+		if err == ErrInterrupted {
+			continue
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+
+		parts := strings.Split(line, " ")
+		if strings.HasPrefix(parts[0], ":") {
+			if _, resume := debugCommand(d, parts[0], parts[1:]); resume {
+				return
+			}
+			continue
+		}
+
+		expr, err := d.Eval(line)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println(expr.SexpString())
+	}
+}
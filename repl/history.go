@@ -0,0 +1,112 @@
+package repl
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HistorySize is how many lines are kept, older ones are dropped
+const HistorySize = 1000
+
+// history is the lines entered so far, oldest first. When it has a file
+// each line is appended to it as it's added.
+type history struct {
+	lines []string
+	file  string
+}
+
+// DefaultHistoryFile is ~/.glisp_history, empty if there's no home directory
+func DefaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".glisp_history")
+}
+
+// load reads the last HistorySize lines of file, which doesn't have to
+// exist yet, and keeps adding to it. The file is trimmed if it's grown
+// well past HistorySize.
+func (h *history) load(file string) error {
+	h.file = file
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	grown := len(lines) > 2*HistorySize
+	if len(lines) > HistorySize {
+		lines = lines[len(lines)-HistorySize:]
+	}
+	h.lines = append(lines, h.lines...)
+
+	if grown {
+		return h.save()
+	}
+	return nil
+}
+
+func (h *history) save() error {
+	var buf strings.Builder
+	for _, line := range h.lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return os.WriteFile(h.file, []byte(buf.String()), 0600)
+}
+
+// add records line unless it's blank or the same as the last one
+func (h *history) add(line string) error {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" || strings.Contains(line, "\n") {
+		return nil
+	}
+	if len(h.lines) > 0 && h.lines[len(h.lines)-1] == line {
+		return nil
+	}
+	h.lines = append(h.lines, line)
+	if len(h.lines) > HistorySize {
+		h.lines = h.lines[len(h.lines)-HistorySize:]
+	}
+
+	if h.file == "" {
+		return nil
+	}
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(line + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// search looks back from before index for a line containing query,
+// returning its index or -1
+func (h *history) search(query string, before int) int {
+	if before > len(h.lines) {
+		before = len(h.lines)
+	}
+	for i := before - 1; i >= 0; i-- {
+		if strings.Contains(h.lines[i], query) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,513 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrInterrupted is returned by ReadLine when ctrl-c abandons the line
+var ErrInterrupted = errors.New("interrupted")
+
+// Completer gives the completions of the word before pos in line, and
+// where that word starts. Positions count runes.
+type Completer func(line string, pos int) (start int, candidates []string)
+
+// LineEditor reads lines from a terminal with emacs style editing keys,
+// history and tab completion. When its input isn't a terminal it reads
+// plain lines.
+type LineEditor struct {
+	Completer Completer
+
+	in      *os.File
+	out     io.Writer
+	reader  *bufio.Reader
+	history history
+
+	// the line being edited
+	prompt string
+	buf    []rune
+	pos    int
+	offset int // the first rune shown when the line is wider than the screen
+	width  int
+	tabbed bool // the last key was a tab that didn't complete anything
+}
+
+func NewLineEditor(in *os.File, out io.Writer) *LineEditor {
+	return &LineEditor{in: in, out: out, reader: bufio.NewReader(in)}
+}
+
+// LoadHistory reads the history saved in file and appends what's entered
+// from now on to it
+func (e *LineEditor) LoadHistory(file string) error {
+	return e.history.load(file)
+}
+
+// AddHistory records a line, up and down and ctrl-r find it again
+func (e *LineEditor) AddHistory(line string) error {
+	return e.history.add(line)
+}
+
+// ReadLine prints prompt and returns the line typed after it, without its
+// newline. ctrl-d on an empty line gives io.EOF.
+func (e *LineEditor) ReadLine(prompt string) (string, error) {
+	fd := e.in.Fd()
+	if !isTerminal(fd) {
+		fmt.Fprint(e.out, prompt)
+		return e.readPlain()
+	}
+	state, err := makeRaw(fd)
+	if err != nil {
+		fmt.Fprint(e.out, prompt)
+		return e.readPlain()
+	}
+	defer restore(fd, state)
+
+	e.width = terminalWidth(fd)
+	return e.edit(prompt)
+}
+
+func (e *LineEditor) readPlain() (string, error) {
+	line, err := e.reader.ReadString('\n')
+	if err == io.EOF {
+		if line != "" {
+			err = nil
+		} else {
+			fmt.Fprint(e.out, "\n")
+		}
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlG     = 7
+	keyCtrlH     = 8
+	keyTab       = 9
+	keyCtrlJ     = 10
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlR     = 18
+	keyCtrlT     = 20
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEsc       = 27
+	keyBackspace = 127
+)
+
+// keys sent as escape sequences are given runes no character uses
+const (
+	keyUnknown rune = -iota - 1
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+	keyWordLeft
+	keyWordRight
+	keyDeleteWord
+)
+
+func (e *LineEditor) readKey() (rune, error) {
+	r, _, err := e.reader.ReadRune()
+	if err != nil || r != keyEsc {
+		return r, err
+	}
+
+	r, _, err = e.reader.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	switch r {
+	case '[', 'O':
+		// parameters up to a final byte, like [3~ or [1;5C
+		var params []rune
+		for {
+			c, _, err := e.reader.ReadRune()
+			if err != nil {
+				return 0, err
+			}
+			if c >= 0x40 && c <= 0x7e {
+				return escapeKey(string(params), c), nil
+			}
+			params = append(params, c)
+		}
+	case 'b':
+		return keyWordLeft, nil
+	case 'f':
+		return keyWordRight, nil
+	case keyBackspace, keyCtrlH:
+		return keyDeleteWord, nil
+	}
+	return keyUnknown, nil
+}
+
+func escapeKey(params string, final rune) rune {
+	// ctrl and alt arrows move by words
+	modified := strings.HasSuffix(params, ";5") || strings.HasSuffix(params, ";3")
+	switch final {
+	case 'A':
+		return keyUp
+	case 'B':
+		return keyDown
+	case 'C':
+		if modified {
+			return keyWordRight
+		}
+		return keyRight
+	case 'D':
+		if modified {
+			return keyWordLeft
+		}
+		return keyLeft
+	case 'H':
+		return keyHome
+	case 'F':
+		return keyEnd
+	case '~':
+		switch params {
+		case "1", "7":
+			return keyHome
+		case "4", "8":
+			return keyEnd
+		case "3":
+			return keyDelete
+		}
+	}
+	return keyUnknown
+}
+
+func (e *LineEditor) edit(prompt string) (string, error) {
+	e.prompt = prompt
+	e.buf = nil
+	e.pos = 0
+	e.offset = 0
+	e.tabbed = false
+
+	// which history line is shown, len(lines) is the new one, kept in
+	// current while going through the others
+	hist := len(e.history.lines)
+	var current []rune
+	var pending rune
+
+	e.refresh()
+	for {
+		k := pending
+		pending = 0
+		if k == 0 {
+			var err error
+			k, err = e.readKey()
+			if err != nil {
+				fmt.Fprint(e.out, "\n")
+				if err == io.EOF && len(e.buf) > 0 {
+					return string(e.buf), nil
+				}
+				return "", err
+			}
+		}
+		if k != keyTab {
+			e.tabbed = false
+		}
+
+		switch k {
+		case keyEnter, keyCtrlJ:
+			e.pos = len(e.buf)
+			e.refresh()
+			fmt.Fprint(e.out, "\n")
+			return string(e.buf), nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\n")
+			return "", ErrInterrupted
+		case keyCtrlD:
+			if len(e.buf) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			e.delete(e.pos, e.pos+1)
+		case keyBackspace, keyCtrlH:
+			if e.pos > 0 {
+				e.delete(e.pos-1, e.pos)
+			}
+		case keyDelete:
+			e.delete(e.pos, e.pos+1)
+		case keyLeft, keyCtrlB:
+			if e.pos > 0 {
+				e.pos--
+			}
+		case keyRight, keyCtrlF:
+			if e.pos < len(e.buf) {
+				e.pos++
+			}
+		case keyHome, keyCtrlA:
+			e.pos = 0
+		case keyEnd, keyCtrlE:
+			e.pos = len(e.buf)
+		case keyWordLeft:
+			e.pos = e.wordStart(e.pos)
+		case keyWordRight:
+			e.pos = e.wordEnd(e.pos)
+		case keyCtrlK:
+			e.delete(e.pos, len(e.buf))
+		case keyCtrlU:
+			e.delete(0, e.pos)
+		case keyCtrlW, keyDeleteWord:
+			e.delete(e.wordStart(e.pos), e.pos)
+		case keyCtrlT:
+			if e.pos > 0 && len(e.buf) > 1 {
+				if e.pos == len(e.buf) {
+					e.pos--
+				}
+				e.buf[e.pos-1], e.buf[e.pos] = e.buf[e.pos], e.buf[e.pos-1]
+				e.pos++
+			}
+		case keyCtrlL:
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case keyUp, keyCtrlP:
+			if hist > 0 {
+				if hist == len(e.history.lines) {
+					current = append([]rune(nil), e.buf...)
+				}
+				hist--
+				e.setLine([]rune(e.history.lines[hist]))
+			}
+		case keyDown, keyCtrlN:
+			if hist < len(e.history.lines) {
+				hist++
+				if hist == len(e.history.lines) {
+					e.setLine(current)
+				} else {
+					e.setLine([]rune(e.history.lines[hist]))
+				}
+			}
+		case keyTab:
+			e.complete()
+		case keyCtrlR:
+			found, next, err := e.reverseSearch()
+			if err != nil {
+				fmt.Fprint(e.out, "\n")
+				return "", err
+			}
+			if found >= 0 {
+				hist = found
+			}
+			pending = next
+		default:
+			if k >= ' ' {
+				e.insert(k)
+			}
+		}
+		e.refresh()
+	}
+}
+
+func (e *LineEditor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.pos+1:], e.buf[e.pos:])
+	e.buf[e.pos] = r
+	e.pos++
+}
+
+// delete removes the runes from start up to end, leaving the cursor at start
+func (e *LineEditor) delete(start, end int) {
+	if end > len(e.buf) {
+		end = len(e.buf)
+	}
+	if start >= end {
+		return
+	}
+	e.buf = append(e.buf[:start], e.buf[end:]...)
+	e.pos = start
+}
+
+func (e *LineEditor) setLine(line []rune) {
+	e.buf = append([]rune(nil), line...)
+	e.pos = len(e.buf)
+}
+
+// isDelimiter is true for the runes that end a symbol
+func isDelimiter(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("()[]{}'`~@\",;", r)
+}
+
+func (e *LineEditor) wordStart(pos int) int {
+	for pos > 0 && isDelimiter(e.buf[pos-1]) {
+		pos--
+	}
+	for pos > 0 && !isDelimiter(e.buf[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+func (e *LineEditor) wordEnd(pos int) int {
+	for pos < len(e.buf) && isDelimiter(e.buf[pos]) {
+		pos++
+	}
+	for pos < len(e.buf) && !isDelimiter(e.buf[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// refresh redraws the line. One that doesn't fit is scrolled sideways to
+// keep the cursor on screen.
+func (e *LineEditor) refresh() {
+	room := e.width - utf8.RuneCountInString(e.prompt) - 1
+	if room < 10 {
+		room = len(e.buf) + 1
+	}
+	if e.pos < e.offset {
+		e.offset = e.pos
+	}
+	if e.pos > e.offset+room {
+		e.offset = e.pos - room
+	}
+	end := min(len(e.buf), e.offset+room)
+
+	var b strings.Builder
+	b.WriteString("\r")
+	b.WriteString(e.prompt)
+	b.WriteString(string(e.buf[e.offset:end]))
+	b.WriteString("\x1b[K")
+	if back := end - e.pos; back > 0 {
+		fmt.Fprintf(&b, "\x1b[%dD", back)
+	}
+	io.WriteString(e.out, b.String())
+}
+
+// complete fills in as much of the word before the cursor as all the
+// candidates share. When that's nothing a second tab lists them.
+func (e *LineEditor) complete() {
+	if e.Completer == nil {
+		return
+	}
+	start, candidates := e.Completer(string(e.buf), e.pos)
+	if len(candidates) == 0 {
+		fmt.Fprint(e.out, "\a")
+		return
+	}
+
+	prefix := []rune(commonPrefix(candidates))
+	if len(prefix) > e.pos-start {
+		rest := append(prefix, e.buf[e.pos:]...)
+		e.buf = append(e.buf[:start], rest...)
+		e.pos = start + len(prefix)
+		return
+	}
+	if len(candidates) == 1 {
+		return
+	}
+
+	if e.tabbed {
+		e.listCandidates(candidates)
+	} else {
+		fmt.Fprint(e.out, "\a")
+	}
+	e.tabbed = true
+}
+
+func commonPrefix(strs []string) string {
+	prefix := strs[0]
+	for _, s := range strs[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return prefix
+}
+
+// listCandidates prints the candidates in columns under the line, which
+// is redrawn after them
+func (e *LineEditor) listCandidates(candidates []string) {
+	colwidth := 0
+	for _, c := range candidates {
+		colwidth = max(colwidth, utf8.RuneCountInString(c)+2)
+	}
+	cols := max(1, e.width/colwidth)
+
+	var b strings.Builder
+	b.WriteString("\n")
+	for i, c := range candidates {
+		b.WriteString(c)
+		if (i+1)%cols == 0 || i == len(candidates)-1 {
+			b.WriteString("\n")
+		} else {
+			b.WriteString(strings.Repeat(" ", colwidth-utf8.RuneCountInString(c)))
+		}
+	}
+	io.WriteString(e.out, b.String())
+}
+
+// reverseSearch is ctrl-r, it finds the latest history line containing
+// what's typed and ctrl-r again looks further back. Any other key takes
+// the match as the line and is returned to be handled as usual, ctrl-g
+// leaves the line as it was. found is the index of the match or -1.
+func (e *LineEditor) reverseSearch() (found int, next rune, err error) {
+	lines := e.history.lines
+	var query []rune
+	found = -1
+	match := ""
+
+	search := func(before int) {
+		if i := e.history.search(string(query), before); i >= 0 {
+			found, match = i, lines[i]
+		} else if len(query) > 0 {
+			found, match = -1, ""
+		}
+	}
+
+	for {
+		label := "reverse-i-search"
+		if found < 0 && len(query) > 0 {
+			label = "failing " + label
+		}
+		fmt.Fprintf(e.out, "\r(%s)`%s': %s\x1b[K", label, string(query), match)
+
+		k, err := e.readKey()
+		if err != nil {
+			return -1, 0, err
+		}
+		switch {
+		case k == keyCtrlR:
+			if found >= 0 {
+				search(found)
+			}
+		case k == keyBackspace || k == keyCtrlH:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+			}
+			search(len(lines))
+		case k == keyCtrlG || k == keyCtrlC:
+			return -1, 0, nil
+		case k >= ' ':
+			query = append(query, k)
+			// the longer query may still match what's shown
+			if found >= 0 {
+				search(found + 1)
+			} else {
+				search(len(lines))
+			}
+		default:
+			if match != "" {
+				e.setLine([]rune(match))
+			}
+			return found, k, nil
+		}
+	}
+}
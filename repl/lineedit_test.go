@@ -0,0 +1,181 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	up       = "\x1b[A"
+	down     = "\x1b[B"
+	left     = "\x1b[D"
+	wordLeft = "\x1b[1;5D"
+	del      = "\x1b[3~"
+	ctrlA    = "\x01"
+	ctrlC    = "\x03"
+	ctrlD    = "\x04"
+	ctrlE    = "\x05"
+	ctrlG    = "\x07"
+	ctrlK    = "\x0b"
+	ctrlR    = "\x12"
+	ctrlT    = "\x14"
+	ctrlU    = "\x15"
+	ctrlW    = "\x17"
+	bs       = "\x7f"
+)
+
+// typeKeys has e read a line from keys as a terminal would send them,
+// returning the line and what was drawn
+func typeKeys(e *LineEditor, keys string) (string, string, error) {
+	var screen strings.Builder
+	e.reader = bufio.NewReader(strings.NewReader(keys))
+	e.out = &screen
+	e.width = 80
+	line, err := e.edit("> ")
+	return line, screen.String(), err
+}
+
+func TestLineEditing(t *testing.T) {
+	tests := []struct {
+		keys, line string
+	}{
+		{"(+ 1 2)\r", "(+ 1 2)"},
+		{"ac" + left + "b\r", "abc"},
+		{"bc" + ctrlA + "a" + ctrlE + "d\r", "abcd"},
+		{"abcd" + left + left + ctrlK + "\r", "ab"},
+		{"abcd" + left + ctrlU + "\r", "d"},
+		{"(foo bar" + ctrlW + "baz\r", "(foo baz"},
+		{"(foo bar" + wordLeft + "x\r", "(foo xbar"},
+		{"abc" + bs + "\r", "ab"},
+		{"abc" + ctrlA + del + "\r", "bc"},
+		{"abc" + ctrlA + ctrlD + "\r", "bc"},
+		{"ab" + ctrlT + "\r", "ba"},
+		{"héllo" + left + left + left + bs + "e\r", "hello"},
+		// input that ends mid-line gives the line
+		{"partial", "partial"},
+	}
+	for _, test := range tests {
+		line, _, err := typeKeys(&LineEditor{}, test.keys)
+		if err != nil || line != test.line {
+			t.Errorf("%q gave %q, %v, want %q", test.keys, line, err, test.line)
+		}
+	}
+
+	if _, _, err := typeKeys(&LineEditor{}, "abc"+ctrlC); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("ctrl-c gave %v", err)
+	}
+	if _, _, err := typeKeys(&LineEditor{}, ctrlD); err != io.EOF {
+		t.Errorf("ctrl-d on an empty line gave %v", err)
+	}
+}
+
+func TestLineHistory(t *testing.T) {
+	e := &LineEditor{}
+	for _, line := range []string{"(def a 1)", "(+ a 2)", "(+ a 2)", "  ", "(def b 3)"} {
+		if err := e.AddHistory(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(e.history.lines, "|"); got != "(def a 1)|(+ a 2)|(def b 3)" {
+		t.Fatalf("the history is %s", got)
+	}
+
+	tests := []struct {
+		keys, line string
+	}{
+		{up + "\r", "(def b 3)"},
+		{up + up + up + up + "\r", "(def a 1)"},
+		// going back down comes back to what was being typed
+		{"(car" + up + up + down + down + "\r", "(car"},
+		{up + bs + " 4)\r", "(def b 3 4)"},
+		{ctrlR + "def\r", "(def b 3)"},
+		{ctrlR + "def" + ctrlR + "\r", "(def a 1)"},
+		{ctrlR + "a 2" + left + "x\r", "(+ a 2x)"},
+		// ctrl-g leaves the line alone
+		{"kept" + ctrlR + "def" + ctrlG + "\r", "kept"},
+	}
+	for _, test := range tests {
+		line, _, err := typeKeys(e, test.keys)
+		if err != nil || line != test.line {
+			t.Errorf("%q gave %q, %v, want %q", test.keys, line, err, test.line)
+		}
+	}
+
+	_, screen, _ := typeKeys(e, ctrlR+"zzz"+ctrlG+"\r")
+	if !strings.Contains(screen, "(failing reverse-i-search)`zzz'") {
+		t.Errorf("a search that found nothing drew %q", screen)
+	}
+}
+
+func TestLineCompletion(t *testing.T) {
+	e := &LineEditor{Completer: func(line string, pos int) (int, []string) {
+		start := strings.LastIndexAny(line[:pos], "( ") + 1
+		var found []string
+		for _, name := range []string{"make-chan", "make-data", "map"} {
+			if strings.HasPrefix(name, line[start:pos]) {
+				found = append(found, name)
+			}
+		}
+		return start, found
+	}}
+
+	line, _, _ := typeKeys(e, "(make\t\r")
+	if line != "(make-" {
+		t.Errorf("completing make gave %q", line)
+	}
+	line, _, _ = typeKeys(e, "(make-c\t ch)\r")
+	if line != "(make-chan ch)" {
+		t.Errorf("completing make-c gave %q", line)
+	}
+	// one tab rings, a second lists them
+	line, screen, _ := typeKeys(e, "(ma\t\t\r")
+	if line != "(ma" || !strings.Contains(screen, "\a") ||
+		!strings.Contains(screen, "make-chan  make-data  map") {
+		t.Errorf("two tabs on ma gave %q and drew %q", line, screen)
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history")
+	if err := os.WriteFile(file, []byte("(old 1)\n(old 2)\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &LineEditor{}
+	if err := e.LoadHistory(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddHistory("(new 3)"); err != nil {
+		t.Fatal(err)
+	}
+	line, _, _ := typeKeys(e, up+up+"\r")
+	if line != "(old 2)" {
+		t.Errorf("up twice gave %q", line)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil || string(data) != "(old 1)\n(old 2)\n(new 3)\n" {
+		t.Errorf("the file has %q, %v", data, err)
+	}
+
+	// a file that's grown well past HistorySize is cut back on loading
+	var long strings.Builder
+	for i := 0; i < 2*HistorySize+1; i++ {
+		long.WriteString("(line)\n")
+	}
+	if err := os.WriteFile(file, []byte(long.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e = &LineEditor{}
+	if err := e.LoadHistory(file); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(file)
+	if len(e.history.lines) != HistorySize || strings.Count(string(data), "\n") != HistorySize {
+		t.Errorf("kept %d lines, the file %d", len(e.history.lines), strings.Count(string(data), "\n"))
+	}
+}
@@ -0,0 +1,93 @@
+package repl
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The repl server speaks framed JSON: every message is a 4 byte big endian
+// length followed by that many bytes of a JSON object. Clients send
+// Requests and get one Response back for each, carrying the request's id.
+// Responses to different requests can come back in any order, an interrupt
+// is answered while the eval it stops is still running.
+//
+//	describe              the ops and versions the server has
+//	clone                 a new session, in new-session
+//	close      session    ends a session
+//	eval       session    runs code, giving its value, out and err
+//	load-file  session    runs code as file, or file read on the server
+//	complete   [session]  the globals starting with prefix
+//	interrupt  session    stops interrupt-id, or whatever the session runs
+//
+// Evaluation failures come back with "error" in the status and the stack
+// trace in err, a stopped one with "interrupted". A request the server
+// can't handle gets "unknown-op", "unknown-session" or "bad-request" and
+// its reason in err. Every response has "done" in its status.
+
+// MaxFrame is the largest message either side will read
+const MaxFrame = 16 << 20
+
+// Request is a message from a client
+type Request struct {
+	ID          string `json:"id"`
+	Op          string `json:"op"`
+	Session     string `json:"session,omitempty"`
+	Code        string `json:"code,omitempty"`
+	File        string `json:"file,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`
+	InterruptID string `json:"interrupt-id,omitempty"`
+}
+
+// Response answers the Request with the same ID
+type Response struct {
+	ID          string            `json:"id"`
+	Session     string            `json:"session,omitempty"`
+	Status      []string          `json:"status"`
+	Value       string            `json:"value,omitempty"`
+	Out         string            `json:"out,omitempty"`
+	Err         string            `json:"err,omitempty"`
+	NewSession  string            `json:"new-session,omitempty"`
+	Completions []string          `json:"completions,omitempty"`
+	Ops         []string          `json:"ops,omitempty"`
+	Versions    map[string]string `json:"versions,omitempty"`
+}
+
+// Has is true when status is among the response's
+func (r *Response) Has(status string) bool {
+	for _, s := range r.Status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFrame(w io.Writer, msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+	_, err = w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader, msg any) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrame {
+		return fmt.Errorf("frame of %d bytes is over the %d limit", size, MaxFrame)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, msg)
+}
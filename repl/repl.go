@@ -0,0 +1,99 @@
+// Package repl is glisp's interactive read-eval-print loop, with the step
+// debugger's : commands.
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/chrhlnd/glisp"
+	"github.com/chrhlnd/glisp/extensions"
+)
+
+// HistoryFile is where the repl keeps its history, set it to "" before Run
+// to keep it in memory only
+var HistoryFile = DefaultHistoryFile()
+
+// editor reads the repl's and the debugger's input
+var editor = NewLineEditor(os.Stdin, os.Stdout)
+
+// getExpression reads lines until they make whole expressions. A syntax
+// error is reported as soon as there is one and the lines are dropped.
+func getExpression(prompt string) (string, error) {
+	line, err := editor.ReadLine(prompt + " ")
+	if err != nil {
+		return "", err
+	}
+	editor.AddHistory(line)
+	for {
+		complete, err := glisp.ParseComplete(line)
+		if err != nil {
+			fmt.Println(err)
+			return getExpression(prompt)
+		}
+		if complete {
+			return line, nil
+		}
+		nextline, err := editor.ReadLine(prompt + "> ")
+		if err != nil {
+			return "", err
+		}
+		editor.AddHistory(nextline)
+		line += "\n" + nextline
+	}
+}
+
+// Run reads and evaluates expressions from stdin until :quit or the end
+// of input. Lines starting with a colon are meta-commands, :help lists
+// them. An (exit n) comes back as its *glisp.ExitError.
+func Run(env *glisp.Glisp) error {
+	fmt.Printf("glisp version %s\n", glisp.Version())
+	fmt.Printf("glispext version %s\n", glispext.Version())
+
+	editor.Completer = commandCompleter(SymbolCompleter(env))
+	if HistoryFile != "" {
+		if err := editor.LoadHistory(HistoryFile); err != nil {
+			fmt.Println(err)
+		}
+	}
+	start = env.Checkpoint()
+
+	for {
+		line, err := getExpression(">")
+		if err == io.EOF {
+			return nil
+		}
+		if err == ErrInterrupted {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			continue
+		case trimmed == "quit":
+			return nil
+		case strings.HasPrefix(trimmed, ":"):
+			err = runCommand(env, trimmed)
+		default:
+			err = evalPrint(env, line)
+		}
+
+		var exit *glisp.ExitError
+		if errors.As(err, &exit) {
+			return exit
+		}
+		if err == errQuit {
+			return nil
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package repl
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chrhlnd/glisp"
+)
+
+// ErrServerClosed is returned by Serve once Close has been called
+var ErrServerClosed = errors.New("repl server closed")
+
+// ServerOps are the ops a Server answers, for describe
+var ServerOps = []string{"clone", "close", "complete", "describe", "eval", "interrupt", "load-file"}
+
+// Server lets editors and tools attach to a running program's env over a
+// socket, see protocol.go for what they send.
+//
+// Each session evaluates in its own Clone of the host env, so it shares
+// the host's globals and what it defines is seen by the host. Everything
+// a session runs goes through the host's QueueRun and so happens on the
+// host's goroutine, between its own evaluations: whenever it calls
+// CallQueued, which wait does while it blocks. A host with nothing else to
+// do calls RunQueued.
+type Server struct {
+	env *glisp.Glisp
+
+	ctx  context.Context // cancelled by Close, stops every evaluation
+	stop context.CancelFunc
+
+	lock      sync.Mutex
+	sessions  map[string]*session
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// session is a client's env, it lasts until it's closed or the connection
+// that cloned it goes
+type session struct {
+	id    string
+	conn  net.Conn
+	env   *glisp.Glisp
+	out   syncBuffer
+	ctx   context.Context
+	close context.CancelFunc
+
+	lock    sync.Mutex
+	running map[string]context.CancelFunc // evaluations by request id
+}
+
+// syncBuffer collects a session's output, coroutines it starts may print
+// while it's being read
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+// take returns what's been written and empties the buffer
+func (b *syncBuffer) take() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	out := b.buf.String()
+	b.buf.Reset()
+	return out
+}
+
+// NewServer makes a server for env, Serve starts it answering
+func NewServer(env *glisp.Glisp) *Server {
+	ctx, stop := context.WithCancel(context.Background())
+	return &Server{
+		env:       env,
+		ctx:       ctx,
+		stop:      stop,
+		sessions:  make(map[string]*session),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on network ("tcp" or "unix") and address, as
+// net.Listen does, and serves the connections
+func (s *Server) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve answers the connections made to l until Close, l is closed with
+// the server
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.ctx.Err() != nil {
+		s.lock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.lock.Lock()
+		if s.ctx.Err() != nil {
+			s.lock.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, drops the connections and interrupts what
+// the sessions are running. It waits for the connections to finish, which
+// needs the host to run what's interrupted.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.stop()
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// RunQueued runs the sessions' evaluations on the calling goroutine until
+// ctx is done, for a host that doesn't otherwise wait on its env. env
+// mustn't be running anything else meanwhile.
+func (s *Server) RunQueued(ctx context.Context) error {
+	cond := s.env.GetQueuedWaitCond()
+	for {
+		// reset before looking, so anything queued after the last look
+		// signals again
+		cond.Reset()
+		for s.env.CallQueued() {
+		}
+
+		select {
+		case <-cond.Channel():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+
+	// cancelled when the connection goes, taking its sessions with it
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	var writeLock sync.Mutex
+	var requests sync.WaitGroup
+	reply := func(resp *Response) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		writeFrame(conn, resp)
+	}
+
+	for {
+		var req Request
+		err := readFrame(conn, &req)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			reply(&Response{Status: []string{"bad-request", "done"}, Err: err.Error()})
+			continue
+		}
+		if err != nil {
+			break
+		}
+
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			reply(s.handle(ctx, conn, &req))
+		}()
+	}
+
+	cancel()
+	requests.Wait()
+
+	s.lock.Lock()
+	delete(s.conns, conn)
+	for id, sess := range s.sessions {
+		if sess.conn == conn {
+			delete(s.sessions, id)
+		}
+	}
+	s.lock.Unlock()
+	conn.Close()
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn, req *Request) *Response {
+	resp := &Response{ID: req.ID, Session: req.Session}
+
+	switch req.Op {
+	case "describe":
+		resp.Ops = ServerOps
+		resp.Versions = map[string]string{"glisp": glisp.Version(), "protocol": "1"}
+	case "clone":
+		sess, err := s.clone(ctx, conn)
+		if err != nil {
+			return failed(resp, "interrupted", err)
+		}
+		resp.NewSession = sess.id
+	case "close":
+		s.lock.Lock()
+		sess, ok := s.sessions[req.Session]
+		delete(s.sessions, req.Session)
+		s.lock.Unlock()
+		if !ok {
+			return failed(resp, "unknown-session", fmt.Errorf("no session %q", req.Session))
+		}
+		sess.close()
+	case "complete":
+		env := s.env
+		if req.Session != "" {
+			sess, ok := s.session(req.Session)
+			if !ok {
+				return failed(resp, "unknown-session", fmt.Errorf("no session %q", req.Session))
+			}
+			env = sess.env
+		}
+		resp.Completions = complete(env, req.Prefix)
+	case "eval", "load-file":
+		sess, ok := s.session(req.Session)
+		if !ok {
+			return failed(resp, "unknown-session", fmt.Errorf("no session %q", req.Session))
+		}
+		return s.eval(sess, req, resp)
+	case "interrupt":
+		sess, ok := s.session(req.Session)
+		if !ok {
+			return failed(resp, "unknown-session", fmt.Errorf("no session %q", req.Session))
+		}
+		if !sess.interrupt(req.InterruptID) {
+			resp.Status = append(resp.Status, "session-idle")
+		}
+	default:
+		return failed(resp, "unknown-op", fmt.Errorf("unknown op %q", req.Op))
+	}
+
+	resp.Status = append(resp.Status, "done")
+	return resp
+}
+
+// failed finishes resp with status and err
+func failed(resp *Response, status string, err error) *Response {
+	resp.Status = append(resp.Status, status, "done")
+	resp.Err = err.Error()
+	return resp
+}
+
+func (s *Server) session(id string) (*session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sess, ok := s.sessions[id]
+	return sess, ok
+}
+
+// clone makes a session for conn, lasting until ctx is done. The host env
+// is cloned on its goroutine since Clone copies its stacks.
+func (s *Server) clone(ctx context.Context, conn net.Conn) (*session, error) {
+	var env *glisp.Glisp
+	if !s.onHost(ctx, func() { env = s.env.Clone() }) {
+		return nil, ErrServerClosed
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	sess := &session{
+		id:      hex.EncodeToString(id),
+		conn:    conn,
+		env:     env,
+		running: make(map[string]context.CancelFunc),
+	}
+	sess.ctx, sess.close = context.WithCancel(ctx)
+	env.SetOutput(&sess.out)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sess.ctx.Err() != nil {
+		return nil, ErrServerClosed
+	}
+	s.sessions[sess.id] = sess
+	return sess, nil
+}
+
+// onHost runs fn on the host's goroutine and waits for it. If ctx is done
+// before the host gets to fn it's dropped and false is returned.
+func (s *Server) onHost(ctx context.Context, fn func()) bool {
+	var claimed atomic.Bool
+	done := make(chan struct{})
+	s.env.QueueRun(func() {
+		defer close(done)
+		if claimed.CompareAndSwap(false, true) {
+			fn()
+		}
+	})
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		if claimed.CompareAndSwap(false, true) {
+			return false
+		}
+		// it's running, ctx stops it soon enough
+		<-done
+		return true
+	}
+}
+
+func (s *Server) eval(sess *session, req *Request, resp *Response) *Response {
+	var src io.Reader
+	var file string
+	switch {
+	case req.Op == "eval" && req.Code != "":
+		src, file = strings.NewReader(req.Code), "eval"
+	case req.Op == "load-file" && req.Code != "":
+		src, file = strings.NewReader(req.Code), req.File
+		if file == "" {
+			file = "load-file"
+		}
+	case req.Op == "load-file" && req.File != "":
+		path, err := sess.env.SandboxSource(req.File)
+		if err != nil {
+			return failed(resp, "error", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return failed(resp, "error", err)
+		}
+		defer f.Close()
+		src, file = f, path
+	default:
+		return failed(resp, "bad-request", fmt.Errorf("%s needs code", req.Op))
+	}
+
+	ctx, cancel := context.WithCancel(sess.ctx)
+	defer cancel()
+	sess.lock.Lock()
+	sess.running[req.ID] = cancel
+	sess.lock.Unlock()
+	defer func() {
+		sess.lock.Lock()
+		delete(sess.running, req.ID)
+		sess.lock.Unlock()
+	}()
+
+	var value glisp.Sexp
+	var err error
+	ran := s.onHost(ctx, func() {
+		value, err = sess.run(ctx, src, file)
+	})
+	resp.Out = sess.out.take()
+
+	switch {
+	case !ran || errors.Is(err, glisp.ErrCancelled):
+		resp.Status = append(resp.Status, "interrupted")
+	case err != nil:
+		resp.Status = append(resp.Status, "error")
+		resp.Err = strings.TrimRight(err.Error(), "\n")
+	default:
+		resp.Value = value.SexpString()
+	}
+	resp.Status = append(resp.Status, "done")
+	return resp
+}
+
+// run evaluates src in the session's env, on the host's goroutine. A
+// failure is returned with its stack trace.
+func (sess *session) run(ctx context.Context, src io.Reader, file string) (glisp.Sexp, error) {
+	env := sess.env
+	exprs, err := env.ParseNamedStream(src, file)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	if err = env.LoadExpressions(exprs); err != nil {
+		env.Clear()
+		return glisp.SexpNull, err
+	}
+
+	value, err := env.RunContext(ctx)
+	if err != nil && !errors.Is(err, glisp.ErrCancelled) {
+		err = errors.New(env.GetStackTrace(err))
+		env.Clear()
+	}
+	return value, err
+}
+
+// interrupt stops the evaluation with request id, or all of them when id
+// is empty. It's false when there was nothing to stop.
+func (sess *session) interrupt(id string) bool {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if id != "" {
+		cancel, ok := sess.running[id]
+		if ok {
+			cancel()
+		}
+		return ok
+	}
+	for _, cancel := range sess.running {
+		cancel()
+	}
+	return len(sess.running) > 0
+}
+
+// complete lists env's globals starting with prefix, leaving out the
+// internal ones
+func complete(env *glisp.Glisp, prefix string) []string {
+	var names []string
+	for _, name := range env.GlobalNames() {
+		if strings.HasPrefix(name, prefix) && !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,192 @@
+package repl
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chrhlnd/glisp"
+)
+
+// serve starts a server for env on l, with a host goroutine running what
+// it queues unless host is false
+func serve(t *testing.T, env *glisp.Glisp, l net.Listener, host bool) *Client {
+	srv := NewServer(env)
+	go srv.Serve(l)
+
+	ctx, stop := context.WithCancel(context.Background())
+	if host {
+		go srv.RunQueued(ctx)
+	}
+
+	client, err := Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		srv.Close()
+		stop()
+	})
+	return client
+}
+
+func loopback(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestServerEval(t *testing.T) {
+	env := glisp.NewGlisp()
+	if _, err := env.EvalString("(def shared 10)"); err != nil {
+		t.Fatal(err)
+	}
+	client := serve(t, env, loopback(t), true)
+
+	desc, err := client.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(desc.Ops, ServerOps) || desc.Versions["glisp"] != glisp.Version() {
+		t.Errorf("describe gave %+v", desc)
+	}
+
+	session, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code, value, out, status string
+	}{
+		{"(+ shared 1)", "11", "", "done"},
+		{`(println "hi" 1) (def remote 7) remote`, "7", "hi 1\n", "done"},
+		{"(nothing-called-this)", "", "", "error"},
+		{"(+ 1", "", "", "error"},
+		// failures leave the session usable
+		{"(* remote 2)", "14", "", "done"},
+	}
+	for _, test := range tests {
+		resp, err := client.Eval(session, test.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Value != test.value || resp.Out != test.out || !resp.Has(test.status) || !resp.Has("done") {
+			t.Errorf("%s gave %+v", test.code, resp)
+		}
+		if test.status == "error" && resp.Err == "" {
+			t.Errorf("%s failed without saying why", test.code)
+		}
+	}
+
+	// the session defines in the host's globals
+	if obj, _ := env.FindObject("remote"); obj != glisp.SexpInt(7) {
+		t.Errorf("host sees remote as %v", obj)
+	}
+
+	resp, err := client.LoadFile(session, "lib.glisp", "(defn triple [x] (* 3 x)) (triple 5)")
+	if err != nil || resp.Value != "15" {
+		t.Errorf("load-file gave %+v, %v", resp, err)
+	}
+
+	names, err := client.Complete(session, "tri")
+	if err != nil || !reflect.DeepEqual(names, []string{"triple"}) {
+		t.Errorf("complete gave %v, %v", names, err)
+	}
+
+	if err := client.CloseSession(session); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Eval(session, "1")
+	if err != nil || !resp.Has("unknown-session") {
+		t.Errorf("eval in a closed session gave %+v, %v", resp, err)
+	}
+	resp, err = client.Send(&Request{Op: "frobnicate"})
+	if err != nil || !resp.Has("unknown-op") {
+		t.Errorf("an unknown op gave %+v, %v", resp, err)
+	}
+}
+
+func TestServerInterrupt(t *testing.T) {
+	client := serve(t, glisp.NewGlisp(), loopback(t), true)
+	session, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *Response)
+	go func() {
+		resp, err := client.Send(&Request{ID: "spin", Op: "eval", Session: session, Code: "(while true 1)"})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stopped, err := client.Interrupt(session, "spin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stopped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the eval never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if resp := <-done; resp == nil || !resp.Has("interrupted") {
+		t.Errorf("the interrupted eval gave %+v", resp)
+	}
+	if stopped, _ := client.Interrupt(session, ""); stopped {
+		t.Error("an idle session had something to interrupt")
+	}
+	resp, err := client.Eval(session, "(+ 2 2)")
+	if err != nil || resp.Value != "4" {
+		t.Errorf("eval after an interrupt gave %+v, %v", resp, err)
+	}
+}
+
+// A host blocked in wait runs the sessions' evaluations, one of which
+// wakes it up.
+func TestServerUnixHostWaiting(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "repl.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := glisp.NewGlisp()
+	if _, err := env.EvalString("(def woken (event))"); err != nil {
+		t.Fatal(err)
+	}
+	client := serve(t, env, l, false)
+
+	result := make(chan glisp.Sexp, 1)
+	go func() {
+		expr, err := env.EvalString("(+ 1 (wait woken 0))")
+		if err != nil {
+			t.Error(err)
+		}
+		result <- expr
+	}()
+
+	session, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Eval(session, "(event woken 41) 'sent")
+	if err != nil || resp.Value != "sent" {
+		t.Errorf("eval gave %+v, %v", resp, err)
+	}
+	if expr := <-result; expr != glisp.SexpInt(42) {
+		t.Errorf("host got %v", expr)
+	}
+}
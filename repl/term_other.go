@@ -0,0 +1,25 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package repl
+
+import "errors"
+
+// terminalState is what makeRaw changed, to put back afterwards
+type terminalState struct{}
+
+// without termios input is read a line at a time, with no editing
+func isTerminal(fd uintptr) bool {
+	return false
+}
+
+func makeRaw(fd uintptr) (*terminalState, error) {
+	return nil, errors.New("line editing isn't supported on this platform")
+}
+
+func restore(fd uintptr, state *terminalState) error {
+	return nil
+}
+
+func terminalWidth(fd uintptr) int {
+	return 80
+}
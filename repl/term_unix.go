@@ -0,0 +1,63 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package repl
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// terminalState is what makeRaw changed, to put back afterwards
+type terminalState struct {
+	termios syscall.Termios
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func isTerminal(fd uintptr) bool {
+	var termios syscall.Termios
+	return ioctl(fd, ioctlGetTermios, unsafe.Pointer(&termios)) == nil
+}
+
+// makeRaw turns off echo and line buffering so keys arrive as they're
+// pressed, output processing is left on so \n still starts a new line
+func makeRaw(fd uintptr) (*terminalState, error) {
+	var old terminalState
+	if err := ioctl(fd, ioctlGetTermios, unsafe.Pointer(&old.termios)); err != nil {
+		return nil, err
+	}
+
+	raw := old.termios
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, ioctlSetTermios, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
+
+func restore(fd uintptr, state *terminalState) error {
+	return ioctl(fd, ioctlSetTermios, unsafe.Pointer(&state.termios))
+}
+
+// terminalWidth is how many columns the terminal has, 80 if it can't tell
+func terminalWidth(fd uintptr) int {
+	var size struct {
+		rows, cols, x, y uint16
+	}
+	if ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&size)) != nil || size.cols == 0 {
+		return 80
+	}
+	return int(size.cols)
+}
@@ -0,0 +1,252 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/metrics"
+	"strings"
+)
+
+// ErrSandbox is wrapped by every error from something a sandboxed env
+// isn't allowed to do
+var ErrSandbox = errors.New("not allowed in sandbox")
+
+var ErrCallDepthLimit = errors.New("call depth limit exceeded")
+var ErrDataStackLimit = errors.New("data stack limit exceeded")
+var ErrHeapLimit = errors.New("heap limit exceeded")
+
+const SandboxCallDepth = 10000
+const SandboxDataStack = 100000
+
+// how many instructions between heap checks, reading the runtime metrics
+// on every step would be too slow
+const heapCheckInterval = 4096
+
+// how many dangling links resolve follows before giving up on a loop
+const maxLinks = 255
+
+// SandboxOptions is the capability set of an env made by NewSandboxedGlisp,
+// the zero value allows nothing outside of the vm.
+type SandboxOptions struct {
+	// FsRoot jails the fs-* functions, relative paths resolve against it
+	// and nothing outside of it can be reached. Empty denies the filesystem.
+	FsRoot string
+
+	// Commands os-exec and os-spawn may run, matched exactly against the
+	// command as the script gives it. Children get an empty environment.
+	Commands []string
+
+	// SourceDirs are the directories source-file, include and import may
+	// load from.
+	SourceDirs []string
+
+	// MaxCallDepth and MaxDataStack cap the vm stacks, 0 means the
+	// Sandbox* defaults and -1 no limit.
+	MaxCallDepth int
+	MaxDataStack int
+
+	// MaxHeap stops a run once the heap grows past it (in bytes), 0 is no
+	// limit. Go can't account memory per env, so this is the whole
+	// process heap; it's a backstop for runaway scripts.
+	MaxHeap uint64
+}
+
+type sandbox struct {
+	root       string
+	commands   map[string]struct{}
+	sourceDirs []string
+	maxCalls   int
+	maxData    int
+	maxHeap    uint64
+}
+
+func NewSandboxedGlisp(opts SandboxOptions) (*Glisp, error) {
+	sb := &sandbox{
+		commands: make(map[string]struct{}),
+		maxCalls: limit(opts.MaxCallDepth, SandboxCallDepth),
+		maxData:  limit(opts.MaxDataStack, SandboxDataStack),
+		maxHeap:  opts.MaxHeap,
+	}
+
+	if opts.FsRoot != "" {
+		root, err := realDir(opts.FsRoot)
+		if err != nil {
+			return nil, err
+		}
+		sb.root = root
+	}
+	for _, cmd := range opts.Commands {
+		sb.commands[cmd] = struct{}{}
+	}
+	for _, dir := range opts.SourceDirs {
+		real, err := realDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		sb.sourceDirs = append(sb.sourceDirs, real)
+	}
+
+	env := NewGlisp()
+	env.sandbox = sb
+	return env, nil
+}
+
+func limit(opt int, def int) int {
+	if opt == 0 {
+		return def
+	}
+	if opt < 0 {
+		return 0
+	}
+	return opt
+}
+
+// realDir is the absolute path of an existing directory with links resolved
+func realDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return real, nil
+}
+
+// resolve follows links as far as the path exists, so a link inside the
+// jail can't lead out of it. A link to something that isn't there yet is
+// followed too, it's where writing through it would create the file.
+func resolve(path string) (string, error) {
+	path = filepath.Clean(path)
+	rest := ""
+	for links := 0; ; {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if links++; links > maxLinks {
+				return "", fmt.Errorf("%s: too many links", path)
+			}
+			target, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			path = filepath.Clean(target)
+			continue
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+func within(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (env *Glisp) Sandboxed() bool {
+	return env.sandbox != nil
+}
+
+// SandboxPath maps a path from a script to the one to hand the os. Outside
+// a sandbox it's returned as is.
+func (env *Glisp) SandboxPath(path string) (string, error) {
+	sb := env.sandbox
+	if sb == nil {
+		return path, nil
+	}
+	if sb.root == "" {
+		return "", fmt.Errorf("%w: filesystem access", ErrSandbox)
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(sb.root, path)
+	}
+	real, err := resolve(path)
+	if err != nil {
+		return "", err
+	}
+	if !within(sb.root, real) {
+		return "", fmt.Errorf("%w: %s is outside of %s", ErrSandbox, path, sb.root)
+	}
+	return real, nil
+}
+
+// SandboxCommand checks a command against the allowlist
+func (env *Glisp) SandboxCommand(cmd string) error {
+	sb := env.sandbox
+	if sb == nil {
+		return nil
+	}
+	if _, ok := sb.commands[cmd]; !ok {
+		return fmt.Errorf("%w: running %s", ErrSandbox, cmd)
+	}
+	return nil
+}
+
+// SandboxSource checks a file about to be loaded as code is in one of
+// the source dirs
+func (env *Glisp) SandboxSource(file string) (string, error) {
+	sb := env.sandbox
+	if sb == nil {
+		return file, nil
+	}
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	real, err := resolve(abs)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range sb.sourceDirs {
+		if within(dir, real) {
+			return real, nil
+		}
+	}
+	return "", fmt.Errorf("%w: loading %s", ErrSandbox, file)
+}
+
+// check runs before every instruction of a sandboxed env, going over a
+// limit stops the run like a cancel does
+func (sb *sandbox) check(env *Glisp) error {
+	if sb.maxCalls > 0 && env.addrstack.tos >= sb.maxCalls {
+		return &CancelError{ErrCallDepthLimit}
+	}
+	if sb.maxData > 0 && env.datastack.tos >= sb.maxData {
+		return &CancelError{ErrDataStackLimit}
+	}
+	if sb.maxHeap > 0 && env.steps%heapCheckInterval == 0 {
+		heap := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		metrics.Read(heap)
+		if heap[0].Value.Uint64() > sb.maxHeap {
+			return &CancelError{ErrHeapLimit}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package glisp_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chrhlnd/glisp"
+	glispext "github.com/chrhlnd/glisp/extensions"
+)
+
+// writeFile puts text in dir/name, returning its path
+func writeFile(t *testing.T, dir, name, text string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSandboxImport(t *testing.T) {
+	lib := t.TempDir()
+	secret := writeFile(t, t.TempDir(), "secret.glisp", "(def secret 1)")
+	env, err := glisp.NewSandboxedGlisp(glisp.SandboxOptions{SourceDirs: []string{lib}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a denied import stays denied, not done
+	for i := 0; i < 2; i++ {
+		_, err := env.EvalString(`(import "` + secret + `")`)
+		if !errors.Is(err, glisp.ErrSandbox) {
+			t.Errorf("import %d of a file outside the source dirs gave %v", i, err)
+		}
+		env.Clear()
+	}
+
+	// as is one that isn't there yet, until it is
+	missing := filepath.Join(lib, "later.glisp")
+	if _, err := env.EvalString(`(import "` + missing + `")`); err == nil {
+		t.Error("importing a missing file worked")
+	}
+	env.Clear()
+	writeFile(t, lib, "later.glisp", "(def later 2)")
+	expr, err := env.EvalString(`(import "` + missing + `") later`)
+	if err != nil || expr != glisp.SexpInt(2) {
+		t.Errorf("import once the file exists gave %v, %v", expr, err)
+	}
+}
+
+// sandboxed is a sandbox with the fs and os builtins
+func sandboxed(t *testing.T, opts glisp.SandboxOptions) *glisp.Glisp {
+	t.Helper()
+	env, err := glisp.NewSandboxedGlisp(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.ImportEval()
+	glispext.ImportFileSys(env)
+	glispext.ImportOs(env)
+	return env
+}
+
+func TestSandboxPaths(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	writeFile(t, root, "inside.txt", "in")
+	secret := writeFile(t, outside, "secret.txt", "out")
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"out-link":     outside,
+		"sub/up-link":  filepath.Join(root, ".."),
+		"in-link":      filepath.Join(root, "inside.txt"),
+		"secret-link":  secret,
+		"dangling-out": filepath.Join(outside, "nothing-yet"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skip("no symlinks here:", err)
+		}
+	}
+	env := sandboxed(t, glisp.SandboxOptions{FsRoot: root})
+
+	allowed := []string{"inside.txt", "./inside.txt", "sub/../inside.txt", "in-link",
+		filepath.Join(root, "inside.txt")}
+	for _, path := range allowed {
+		got, err := env.SandboxPath(path)
+		if err != nil || filepath.Base(got) != "inside.txt" {
+			t.Errorf("%s gave %s, %v", path, got, err)
+		}
+	}
+
+	denied := []string{"..", "../secret.txt", "sub/../../secret.txt", secret, "/",
+		"out-link/secret.txt", "sub/up-link", "secret-link", "dangling-out",
+		"out-link/not/there/yet"}
+	for _, path := range denied {
+		if got, err := env.SandboxPath(path); !errors.Is(err, glisp.ErrSandbox) {
+			t.Errorf("%s got out as %s, %v", path, got, err)
+		}
+	}
+
+	// and the builtins go through it
+	expr, err := env.EvalString(`(fs-read-file "inside.txt")`)
+	if err != nil || string(expr.(glisp.SexpData)) != "in" {
+		t.Errorf("reading inside gave %v, %v", expr, err)
+	}
+	for _, src := range []string{
+		`(fs-read-file "../` + filepath.Base(outside) + `/secret.txt")`,
+		`(fs-read-file "out-link/secret.txt")`,
+		`(fs-read-file "` + secret + `")`,
+		`(fs-append-file "secret-link" (make-data "more"))`,
+		`(fs-append-file "dangling-out" (make-data "more"))`,
+		`(fs-chdir "/")`,
+	} {
+		env.Clear()
+		if _, err := env.EvalString(src); !errors.Is(err, glisp.ErrSandbox) {
+			t.Errorf("%s gave %v", src, err)
+		}
+	}
+	if text, _ := os.ReadFile(secret); string(text) != "out" {
+		t.Errorf("the secret is now %q", text)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "nothing-yet")); err == nil {
+		t.Error("a file was made outside through a dangling link")
+	}
+
+	// no root is no filesystem
+	env = sandboxed(t, glisp.SandboxOptions{})
+	if _, err := env.EvalString(`(fs-read-file "inside.txt")`); !errors.Is(err, glisp.ErrSandbox) {
+		t.Errorf("reading without a root gave %v", err)
+	}
+}
+
+func TestSandboxCommands(t *testing.T) {
+	echo, err := exec.LookPath("echo")
+	if err != nil {
+		t.Skip("no echo")
+	}
+	root := t.TempDir()
+	commands := []string{echo}
+	pwd, err := exec.LookPath("pwd")
+	if err == nil {
+		commands = append(commands, pwd)
+	}
+	env := sandboxed(t, glisp.SandboxOptions{FsRoot: root, Commands: commands})
+
+	expr, err := env.EvalString(`(hget (os-exec ["` + echo + `" "hi"]) "output")`)
+	if err != nil || string(expr.(glisp.SexpData)) != "hi\n" {
+		t.Errorf("running an allowed command gave %v, %v", expr, err)
+	}
+
+	if pwd != "" {
+		env.Clear()
+		expr, err := env.EvalString(`(hget (os-exec ["` + pwd + `"]) "output")`)
+		real, _ := filepath.EvalSymlinks(root)
+		if err != nil || strings.TrimSpace(string(expr.(glisp.SexpData))) != real {
+			t.Errorf("the command ran in %v, %v, want %s", expr, err, real)
+		}
+	}
+
+	// without a root there's nowhere to run it
+	rootless := sandboxed(t, glisp.SandboxOptions{Commands: []string{echo}})
+	for _, src := range []string{`(os-exec ["` + echo + `"])`, `(os-spawn ["` + echo + `"])`} {
+		if _, err := rootless.EvalString(src); !errors.Is(err, glisp.ErrSandbox) {
+			t.Errorf("%s without a root gave %v", src, err)
+		}
+		rootless.Clear()
+	}
+
+	for _, src := range []string{
+		`(os-exec ["echo" "hi"])`, // only as it was allowed
+		`(os-exec ["/bin/sh" "-c" "echo hi"])`,
+		`(os-spawn ["/bin/sh"])`,
+		`(os-lookpath "sh")`,
+		`(os-getenv "HOME")`,
+		`(os-environ)`,
+	} {
+		env.Clear()
+		if _, err := env.EvalString(src); !errors.Is(err, glisp.ErrSandbox) {
+			t.Errorf("%s gave %v", src, err)
+		}
+	}
+
+	// children don't see the host's environment
+	t.Setenv("GLISP_SANDBOX_SECRET", "x")
+	env.Clear()
+	expr, err = env.EvalString(`(hget (os-exec ["` + echo + `"]) "env")`)
+	if err != nil || len(expr.(glisp.SexpArray)) != 0 {
+		t.Errorf("the child's environment is %v, %v", expr, err)
+	}
+}
+
+func TestSandboxSource(t *testing.T) {
+	lib := t.TempDir()
+	writeFile(t, lib, "lib.glisp", "(def from-lib 1)")
+	outside := writeFile(t, t.TempDir(), "other.glisp", "(def from-outside 2)")
+	if err := os.Symlink(outside, filepath.Join(lib, "link.glisp")); err != nil {
+		t.Skip("no symlinks here:", err)
+	}
+	env := sandboxed(t, glisp.SandboxOptions{SourceDirs: []string{lib}})
+
+	path := filepath.Join(lib, "lib.glisp")
+	for _, src := range []string{`(include "` + path + `")`, `(source-file "` + path + `")`} {
+		env.Clear()
+		if _, err := env.EvalString(src + " from-lib"); err != nil {
+			t.Errorf("%s gave %v", src, err)
+		}
+	}
+
+	for _, file := range []string{outside, filepath.Join(lib, "link.glisp"),
+		filepath.Join(lib, "..", filepath.Base(filepath.Dir(outside)), "other.glisp")} {
+		for _, form := range []string{"include", "import", "source-file"} {
+			env.Clear()
+			src := "(" + form + ` "` + file + `")`
+			if _, err := env.EvalString(src); !errors.Is(err, glisp.ErrSandbox) {
+				t.Errorf("%s gave %v", src, err)
+			}
+		}
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	tests := []struct {
+		opts glisp.SandboxOptions
+		src  string
+		err  error
+	}{
+		{glisp.SandboxOptions{}, "(defn down [n] (+ 1 (down n))) (down 0)", glisp.ErrCallDepthLimit},
+		{glisp.SandboxOptions{MaxCallDepth: 50}, "(defn down [n] (cond (= n 0) 0 (+ 1 (down (- n 1))))) (down 100)",
+			glisp.ErrCallDepthLimit},
+		{glisp.SandboxOptions{MaxDataStack: 10}, "(def x 1) (+ x x x x x x x x x x x x)", glisp.ErrDataStackLimit},
+		{glisp.SandboxOptions{MaxHeap: 1}, "(dotimes [i 100000] (list i))", glisp.ErrHeapLimit},
+	}
+	for _, test := range tests {
+		env, err := glisp.NewSandboxedGlisp(test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// limits aren't exceptions, try doesn't stop them
+		_, err = env.EvalString("(try " + "(begin " + test.src + ") (catch e 'caught))")
+		if !errors.Is(err, test.err) || !errors.Is(err, glisp.ErrCancelled) {
+			t.Errorf("%s gave %v", test.src, err)
+		}
+	}
+
+	// under the limits, and with them off, it runs
+	env, _ := glisp.NewSandboxedGlisp(glisp.SandboxOptions{MaxCallDepth: -1, MaxDataStack: -1})
+	expr, err := env.EvalString("(defn down [n] (cond (= n 0) 0 (+ 1 (down (- n 1))))) (down 20000)")
+	if err != nil || expr != glisp.SexpInt(20000) {
+		t.Errorf("without limits gave %v, %v", expr, err)
+	}
+}
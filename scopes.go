@@ -3,16 +3,140 @@ package glisp
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
 type Scope map[int]Sexp
 
 func (s Scope) IsStackElem() {}
 
+// GlobalScope is the bottom of every scope stack. Environments cloned or
+// duplicated from each other share it across goroutines, so it's locked.
+type GlobalScope struct {
+	lock sync.RWMutex
+	vars map[int]Sexp
+	base *GlobalScope // shadowed, never written through this scope
+}
+
+func (g *GlobalScope) IsStackElem() {}
+
+func NewGlobalScope() *GlobalScope {
+	return &GlobalScope{vars: make(map[int]Sexp)}
+}
+
+// overlay makes a scope that sees everything in g but keeps its own
+// bindings, g is left untouched
+func (g *GlobalScope) overlay() *GlobalScope {
+	return &GlobalScope{vars: make(map[int]Sexp), base: g}
+}
+
+func (g *GlobalScope) lookup(sym SexpSymbol) (Sexp, bool) {
+	g.lock.RLock()
+	expr, ok := g.vars[sym.number]
+	g.lock.RUnlock()
+	if !ok && g.base != nil {
+		return g.base.lookup(sym)
+	}
+	return expr, ok
+}
+
+func (g *GlobalScope) bind(sym SexpSymbol, expr Sexp) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.vars[sym.number] = expr
+}
+
+// swap rebinds sym if it's bound
+func (g *GlobalScope) swap(sym SexpSymbol, to Sexp) bool {
+	if _, ok := g.lookup(sym); !ok {
+		return false
+	}
+	g.bind(sym, to)
+	return true
+}
+
+// reset drops the scope's own bindings
+func (g *GlobalScope) reset() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	clear(g.vars)
+}
+
+// Frame is a local scope. The generator gives the symbols bound in it
+// slots, so compiled code gets at them by position instead of by name.
+type Frame struct {
+	syms []SexpSymbol
+	vals []Sexp // nil until the slot is bound
+}
+
+func (f *Frame) IsStackElem() {}
+
+func NewFrame(syms []SexpSymbol) *Frame {
+	return &Frame{
+		// binding an unknown symbol appends, don't let that write into syms
+		syms: syms[:len(syms):len(syms)],
+		vals: make([]Sexp, len(syms)),
+	}
+}
+
+func (f *Frame) slot(sym SexpSymbol) int {
+	for i, s := range f.syms {
+		if s.number == sym.number {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *Frame) lookup(sym SexpSymbol) (Sexp, bool) {
+	i := f.slot(sym)
+	if i < 0 || f.vals[i] == nil {
+		return SexpNull, false
+	}
+	return f.vals[i], true
+}
+
+func (f *Frame) bind(sym SexpSymbol, expr Sexp) {
+	i := f.slot(sym)
+	if i < 0 {
+		f.syms = append(f.syms, sym)
+		f.vals = append(f.vals, expr)
+		return
+	}
+	f.vals[i] = expr
+}
+
+// Symbols lists what's bound in the frame, in slot order
+func (f *Frame) Symbols() []SexpSymbol {
+	syms := make([]SexpSymbol, 0, len(f.syms))
+	for i, sym := range f.syms {
+		if f.vals[i] != nil {
+			syms = append(syms, sym)
+		}
+	}
+	return syms
+}
+
 func (stack *Stack) PushScope() {
 	stack.Push(Scope(make(map[int]Sexp)))
 }
 
+func (stack *Stack) PushFrame(syms []SexpSymbol) {
+	stack.Push(NewFrame(syms))
+}
+
+// localFrame is the frame depth scopes down, if it has the slot
+func (stack *Stack) localFrame(depth int, slot int) (*Frame, error) {
+	if depth > stack.tos {
+		return nil, errors.New(fmt.Sprint("no scope at depth ", depth))
+	}
+	frame, ok := stack.elements[stack.tos-depth].(*Frame)
+	if !ok || slot >= len(frame.vals) {
+		return nil, errors.New(fmt.Sprint("no slot ", slot, " at depth ", depth))
+	}
+	return frame, nil
+}
+
 func (stack *Stack) PopScope() error {
 	_, err := stack.Pop()
 	return err
@@ -25,11 +149,21 @@ func (stack *Stack) swapSymbol(sym SexpSymbol, to Sexp) error {
 			if err != nil {
 				return err
 			}
-			scope := map[int]Sexp(elem.(Scope))
-			_, ok := scope[sym.number]
-			if ok {
-				scope[sym.number] = to
-				return nil
+			switch scope := elem.(type) {
+			case *Frame:
+				if _, ok := scope.lookup(sym); ok {
+					scope.bind(sym, to)
+					return nil
+				}
+			case *GlobalScope:
+				if scope.swap(sym, to) {
+					return nil
+				}
+			case Scope:
+				if _, ok := scope[sym.number]; ok {
+					scope[sym.number] = to
+					return nil
+				}
 			}
 		}
 	}
@@ -43,10 +177,19 @@ func (stack *Stack) lookupSymbol(sym SexpSymbol, minFrame int) (Sexp, error) {
 			if err != nil {
 				return SexpNull, err
 			}
-			scope := map[int]Sexp(elem.(Scope))
-			expr, ok := scope[sym.number]
-			if ok {
-				return expr, nil
+			switch scope := elem.(type) {
+			case *Frame:
+				if expr, ok := scope.lookup(sym); ok {
+					return expr, nil
+				}
+			case *GlobalScope:
+				if expr, ok := scope.lookup(sym); ok {
+					return expr, nil
+				}
+			case Scope:
+				if expr, ok := scope[sym.number]; ok {
+					return expr, nil
+				}
 			}
 		}
 	}
@@ -57,7 +200,7 @@ func (stack *Stack) LookupSymbol(sym SexpSymbol) (Sexp, error) {
 	return stack.lookupSymbol(sym, 0)
 }
 
-// LookupSymbolNonGlobal  - closures use this to only find symbols below the global scope, to avoid copying globals it'll always be-able to ref
+// LookupSymbolNonGlobal  - only finds symbols below the global scope
 func (stack *Stack) LookupSymbolNonGlobal(sym SexpSymbol) (Sexp, error) {
 	return stack.lookupSymbol(sym, 1)
 }
@@ -70,6 +213,13 @@ func (stack *Stack) BindSymbol(sym SexpSymbol, expr Sexp) error {
 	if stack.IsEmpty() {
 		return errors.New("no scope available")
 	}
-	stack.elements[stack.tos].(Scope)[sym.number] = expr
+	switch scope := stack.elements[stack.tos].(type) {
+	case *Frame:
+		scope.bind(sym, expr)
+	case *GlobalScope:
+		scope.bind(sym, expr)
+	case Scope:
+		scope[sym.number] = expr
+	}
 	return nil
 }
@@ -0,0 +1,160 @@
+package glisp_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/chrhlnd/glisp"
+	glispext "github.com/chrhlnd/glisp/extensions"
+)
+
+// files tests/data.glisp writes, its output depends on them
+var testOutputs = []string{"tests/hello.out", "tests/test.out"}
+
+func removeTestOutputs() {
+	for _, out := range testOutputs {
+		os.Remove(out)
+	}
+}
+
+// a Go value printed with %v, like tests/data.glisp does to a function,
+// shows pointers and the compiled code, neither of which has to match
+var goDump = regexp.MustCompile(`(?m)^.*0x[0-9a-f]+.*$`)
+
+type scriptRun struct {
+	output string
+	result string
+	err    string
+}
+
+// scriptEnv is an env with every extension, like the scripts expect
+func scriptEnv(level int) *glisp.Glisp {
+	env := glisp.NewGlisp()
+	env.SetOptLevel(level)
+	env.ImportEval()
+	glispext.ImportRandom(env)
+	glispext.ImportTime(env)
+	glispext.ImportChannels(env)
+	glispext.ImportCoroutines(env)
+	glispext.ImportRegex(env)
+	glispext.ImportFileSys(env)
+	glispext.ImportOs(env)
+	glispext.ImportTesting(env)
+	return env
+}
+
+// runScript runs file at the given optimization level and collects what
+// it prints
+func runScript(t *testing.T, file string, level int) scriptRun {
+	return runLoaded(t, level, func(env *glisp.Glisp) error {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// positions name the file, so failures say where they are
+		return env.LoadFile(f)
+	})
+}
+
+// runLoaded runs whatever load puts in a fresh script env
+func runLoaded(t *testing.T, level int, load func(*glisp.Glisp) error) scriptRun {
+	t.Helper()
+	removeTestOutputs()
+
+	env := scriptEnv(level)
+	var printed bytes.Buffer
+	env.SetOutput(&printed)
+
+	var run scriptRun
+	var expr glisp.Sexp
+	err := load(env)
+	if err == nil {
+		expr, err = env.Run()
+	}
+	if err != nil {
+		run.err = goDump.ReplaceAllString(env.GetStackTrace(err), "")
+	} else {
+		run.result = expr.SexpString()
+	}
+	run.output = goDump.ReplaceAllString(printed.String(), "")
+	return run
+}
+
+// Each of tests/*.glisp runs in a fresh env with every extension loaded. A
+// failing assert shows up as the stack trace, which has the assertion and
+// where it is.
+func TestScripts(t *testing.T) {
+	files, err := filepath.Glob("tests/*.glisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test scripts found")
+	}
+	t.Cleanup(removeTestOutputs)
+
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".glisp"), func(t *testing.T) {
+			run := runScript(t, file, glisp.DefaultOptLevel)
+			if run.err == "" {
+				return
+			}
+			if run.output != "" {
+				t.Logf("output:\n%s", run.output)
+			}
+			t.Error(run.err)
+		})
+	}
+}
+
+// go makes its coroutine while compiling, a Go value no image can hold
+var unsaveable = map[string]bool{"coroutines.glisp": true}
+
+// A script saved with CompileToWriter and run from the image does what
+// running the source does.
+func TestCompiledScripts(t *testing.T) {
+	files, err := filepath.Glob("tests/*.glisp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(removeTestOutputs)
+
+	for _, file := range files {
+		var image bytes.Buffer
+		compiler := scriptEnv(glisp.DefaultOptLevel)
+		src, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = compiler.LoadFile(src)
+		src.Close()
+		if err != nil {
+			// doesn't compile, there's no image to compare
+			continue
+		}
+		err = compiler.CompileToWriter(&image)
+		if unsaveable[filepath.Base(file)] {
+			if err == nil {
+				t.Errorf("%s saved, it's listed as unsaveable", file)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+
+		compiled := runLoaded(t, glisp.DefaultOptLevel, func(env *glisp.Glisp) error {
+			return env.LoadCompiled(&image)
+		})
+		source := runScript(t, file, glisp.DefaultOptLevel)
+		if compiled != source {
+			t.Errorf("%s: the image gave %+v, the source %+v", file, compiled, source)
+		}
+	}
+}
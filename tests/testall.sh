@@ -1,8 +1,12 @@
 #!/bin/sh
 
+# go test runs these too, see TestScripts in scripts_test.go
+
+go build -o glisp ./cmd/glisp || exit 1
+
 for lispfile in tests/*.glisp
 do
-    ./glisp -exitonfail "${lispfile}" && \
+    ./glisp "${lispfile}" && \
         echo "${lispfile} passed" || \
         echo "${lispfile} failed"
 done
@@ -0,0 +1,159 @@
+package glisp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Tracer sees every call an env makes, glisp functions and builtins. Each
+// call it's told about ends in exactly one of OnReturn or OnError.
+type Tracer interface {
+	OnCall(env *Glisp, call *CallEvent)
+	OnReturn(env *Glisp, call *CallEvent, retval Sexp, elapsed time.Duration)
+	// OnError is called for each call an error unwinds, innermost first,
+	// whether or not something catches it further out
+	OnError(env *Glisp, call *CallEvent, err error, elapsed time.Duration)
+}
+
+// CallEvent is one call. IDs are unique across envs.
+type CallEvent struct {
+	ID      uint64
+	Parent  uint64 // the call this one was made in, 0 if none
+	Name    string
+	Args    []Sexp
+	Depth   int        // how many calls deep it is, 1 for one made from the top level
+	Pos     *SourcePos // where it was called from, nil if that isn't known
+	Start   time.Time
+	Builtin bool
+	// a tail call takes over the call it's made from, which returns nil
+	// to the tracer right away. TailOf is that call's ID.
+	TailOf uint64
+}
+
+// HookID identifies a hook or tracer, to remove it again
+type HookID uint64
+
+type preHook struct {
+	id HookID
+	fn PreHook
+}
+
+type postHook struct {
+	id HookID
+	fn PostHook
+}
+
+type tracer struct {
+	id HookID
+	t  Tracer
+}
+
+var nextHookID, nextCallID atomic.Uint64
+
+func (env *Glisp) AddPreHook(fun PreHook) HookID {
+	id := HookID(nextHookID.Add(1))
+	// duplicated envs share these, so never append in place
+	env.before = append(env.before[:len(env.before):len(env.before)], preHook{id, fun})
+	return id
+}
+
+func (env *Glisp) AddPostHook(fun PostHook) HookID {
+	id := HookID(nextHookID.Add(1))
+	env.after = append(env.after[:len(env.after):len(env.after)], postHook{id, fun})
+	return id
+}
+
+func (env *Glisp) AddTracer(t Tracer) HookID {
+	id := HookID(nextHookID.Add(1))
+	env.tracers = append(env.tracers[:len(env.tracers):len(env.tracers)], tracer{id, t})
+	return id
+}
+
+// RemoveHook takes out a hook or tracer, it's false if env doesn't have it.
+// Envs duplicated from this one keep theirs.
+func (env *Glisp) RemoveHook(id HookID) bool {
+	for i, h := range env.before {
+		if h.id == id {
+			env.before = append(env.before[:i:i], env.before[i+1:]...)
+			return true
+		}
+	}
+	for i, h := range env.after {
+		if h.id == id {
+			env.after = append(env.after[:i:i], env.after[i+1:]...)
+			return true
+		}
+	}
+	for i, t := range env.tracers {
+		if t.id == id {
+			env.tracers = append(env.tracers[:i:i], env.tracers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// traceCall starts a call to name, before its arguments are taken off the
+// datastack or anything about the caller changes
+func (env *Glisp) traceCall(name string, nargs int, builtin bool) *CallEvent {
+	args, _ := env.datastack.GetExpressions(nargs)
+	call := &CallEvent{
+		ID:      nextCallID.Add(1),
+		Name:    name,
+		Args:    args,
+		Pos:     env.curfunc.Position(env.pc),
+		Start:   time.Now(),
+		Builtin: builtin,
+	}
+	if len(env.calls) > 0 {
+		call.Parent = env.calls[len(env.calls)-1].ID
+	}
+	return call
+}
+
+// traceEnter is once the call has been pushed on the addrstack
+func (env *Glisp) traceEnter(call *CallEvent) {
+	call.Depth = env.callDepth()
+	env.calls = append(env.calls, call)
+	for _, t := range env.tracers {
+		t.t.OnCall(env, call)
+	}
+}
+
+// traceTail ends the current call for the tail call taking it over
+func (env *Glisp) traceTail(call *CallEvent) {
+	n := len(env.calls)
+	if n > 0 && env.calls[n-1].Depth == env.callDepth() {
+		current := env.calls[n-1]
+		call.TailOf = current.ID
+		call.Parent = current.Parent
+		env.traceReturn(SexpNull)
+	}
+	env.traceEnter(call)
+}
+
+// traceReturn ends the current call, if it's being traced
+func (env *Glisp) traceReturn(retval Sexp) {
+	n := len(env.calls)
+	if n == 0 || env.calls[n-1].Depth != env.callDepth() {
+		return
+	}
+	call := env.calls[n-1]
+	env.calls = env.calls[:n-1]
+	elapsed := time.Since(call.Start)
+	for _, t := range env.tracers {
+		t.t.OnReturn(env, call, retval, elapsed)
+	}
+}
+
+// traceUnwind ends the calls err unwound, those depth or more calls deep
+func (env *Glisp) traceUnwind(depth int, err error) {
+	for n := len(env.calls); n > 0 && env.calls[n-1].Depth >= depth; n-- {
+		call := env.calls[n-1]
+		env.calls = env.calls[:n-1]
+		elapsed := time.Since(call.Start)
+		for _, t := range env.tracers {
+			t.t.OnError(env, call, err, elapsed)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package glisp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chrhlnd/glisp"
+)
+
+type countingTracer struct{ calls, returns, errors int }
+
+func (c *countingTracer) OnCall(*glisp.Glisp, *glisp.CallEvent) { c.calls++ }
+
+func (c *countingTracer) OnReturn(*glisp.Glisp, *glisp.CallEvent, glisp.Sexp, time.Duration) {
+	c.returns++
+}
+
+func (c *countingTracer) OnError(*glisp.Glisp, *glisp.CallEvent, error, time.Duration) {
+	c.errors++
+}
+
+func TestRemoveHook(t *testing.T) {
+	env := glisp.NewGlisp()
+	if _, err := env.EvalString("(defn inc1 [x] (+ x 1))"); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after int
+	tracer := &countingTracer{}
+	ids := []glisp.HookID{
+		env.AddPreHook(func(*glisp.Glisp, string, []glisp.Sexp) { before++ }),
+		env.AddPostHook(func(*glisp.Glisp, string, glisp.Sexp) { after++ }),
+		env.AddTracer(tracer),
+	}
+	counts := func() [5]int {
+		return [5]int{before, after, tracer.calls, tracer.returns, tracer.errors}
+	}
+	dup := env.Duplicate()
+
+	if _, err := env.EvalString("(inc1 1)"); err != nil {
+		t.Fatal(err)
+	}
+	// inc1 and the + in it
+	if got := counts(); got != [5]int{2, 2, 2, 2, 0} {
+		t.Fatalf("the hooks counted %v", got)
+	}
+
+	// what one more (inc1 1) adds with each hook removed in turn
+	deltas := [][5]int{
+		{0, 2, 2, 2, 0},
+		{0, 0, 2, 2, 0},
+		{0, 0, 0, 0, 0},
+	}
+	for i, id := range ids {
+		if !env.RemoveHook(id) {
+			t.Errorf("hook %d wasn't there to remove", i)
+		}
+		if env.RemoveHook(id) {
+			t.Errorf("hook %d was removed twice", i)
+		}
+		start := counts()
+		if _, err := env.EvalString("(inc1 1)"); err != nil {
+			t.Fatal(err)
+		}
+		got := counts()
+		for j := range got {
+			got[j] -= start[j]
+		}
+		if got != deltas[i] {
+			t.Errorf("with hook %d removed a call counted %v, want %v", i, got, deltas[i])
+		}
+	}
+
+	// a duplicate made before keeps its own
+	start := counts()
+	if _, err := dup.EvalString("(inc1 1)"); err != nil {
+		t.Fatal(err)
+	}
+	if got := counts(); got[0] == start[0] || got[1] == start[1] || got[2] == start[2] {
+		t.Errorf("the duplicate lost its hooks, %v then %v", start, got)
+	}
+}
@@ -1,5 +1,7 @@
 package glisp
 
+import "fmt"
+
 func IsData(expr Sexp) bool {
 	_, ok := expr.(SexpData)
 	return ok
@@ -127,3 +129,48 @@ func IsEmpty(expr Sexp) bool {
 
 	return false
 }
+
+// TypeName is what a value is called in glisp, the hashes made by a struct
+// type are called by its name
+func TypeName(expr Sexp) string {
+	switch e := expr.(type) {
+	case SexpSentinel:
+		if e == SexpNull {
+			return "null"
+		}
+		return "sentinel"
+	case SexpPair:
+		if IsList(e) {
+			return "list"
+		}
+		return "pair"
+	case SexpArray:
+		return "array"
+	case SexpHash:
+		if e.TypeName != nil && *e.TypeName != "hash" {
+			return *e.TypeName
+		}
+		return "hash"
+	case SexpInt:
+		return "int"
+	case SexpFloat:
+		return "float"
+	case SexpChar:
+		return "char"
+	case SexpStr:
+		return "string"
+	case SexpBool:
+		return "bool"
+	case SexpData:
+		return "data"
+	case SexpEvent:
+		return "event"
+	case SexpSymbol:
+		return "symbol"
+	case SexpFunction:
+		return "fn"
+	case SexpError:
+		return "error"
+	}
+	return fmt.Sprintf("%T", expr)
+}
@@ -80,35 +80,12 @@ func (p PushInstrClosure) InstrString() string {
 	return "pushC " + p.expr.SexpString()
 }
 
+// Execute captures the scopes below the global one by reference, so the
+// closure shares its variables with the code that made it
 func (p PushInstrClosure) Execute(env *Glisp) error {
-	if p.expr.fun != nil {
-		p.expr.closeScope = NewStack(ScopeStackSize)
-
-		p.expr.closeScope.PushScope()
-
-		var sym SexpSymbol
-		var exp Sexp
-		var err error
-		for _, v := range p.expr.fun {
-
-			switch it := v.(type) {
-			case GetInstr:
-				sym = it.sym
-			case PutInstr:
-				sym = it.sym
-			case CallInstr:
-				sym = it.sym
-			default:
-				continue
-			}
-
-			exp, err = env.scopestack.LookupSymbolNonGlobal(sym)
-			if err == nil {
-				p.expr.closeScope.BindSymbol(sym, exp)
-			}
-		}
-	} else {
-		p.expr.closeScope = env.scopestack.Clone() // for a non script fuction I have no idea what it accesses, so we clone the whole thing
+	p.expr.closeScope = NewStack(env.scopestack.tos)
+	for _, scope := range env.scopestack.elements[1 : env.scopestack.tos+1] {
+		p.expr.closeScope.Push(scope)
 	}
 
 	env.datastack.PushExpr(p.expr)
@@ -193,6 +170,58 @@ func (p PutInstr) Execute(env *Glisp) error {
 	return env.scopestack.BindSymbol(p.sym, expr)
 }
 
+// GetLocalInstr reads a slot the generator resolved, depth counts scopes
+// down from the innermost. A slot that isn't bound yet is looked up by
+// name, like GetInstr would.
+type GetLocalInstr struct {
+	depth int
+	slot  int
+	sym   SexpSymbol
+}
+
+func (g GetLocalInstr) InstrString() string {
+	return fmt.Sprintf("get %s (%d %d)", g.sym.name, g.depth, g.slot)
+}
+
+func (g GetLocalInstr) Execute(env *Glisp) error {
+	frame, err := env.scopestack.localFrame(g.depth, g.slot)
+	if err != nil {
+		return err
+	}
+	expr := frame.vals[g.slot]
+	if expr == nil {
+		return GetInstr{g.sym}.Execute(env)
+	}
+	env.datastack.PushExpr(expr)
+	env.pc++
+	return nil
+}
+
+// SetLocalInstr binds the top of the datastack to a resolved slot
+type SetLocalInstr struct {
+	depth int
+	slot  int
+	sym   SexpSymbol
+}
+
+func (s SetLocalInstr) InstrString() string {
+	return fmt.Sprintf("put %s (%d %d)", s.sym.name, s.depth, s.slot)
+}
+
+func (s SetLocalInstr) Execute(env *Glisp) error {
+	frame, err := env.scopestack.localFrame(s.depth, s.slot)
+	if err != nil {
+		return err
+	}
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	frame.vals[s.slot] = expr
+	env.pc++
+	return nil
+}
+
 type CallInstr struct {
 	sym   SexpSymbol
 	nargs int
@@ -203,23 +232,51 @@ func (c CallInstr) InstrString() string {
 }
 
 func (c CallInstr) Execute(env *Glisp) error {
-	f, ok := env.builtins[c.sym.number]
+	return env.callSymbol(c.sym, c.nargs, false)
+}
+
+// TailCallInstr is a CallInstr in tail position, a script function
+// replaces the current one instead of returning to it
+type TailCallInstr struct {
+	sym   SexpSymbol
+	nargs int
+}
+
+func (c TailCallInstr) InstrString() string {
+	return fmt.Sprintf("tcall %s %d", c.sym.name, c.nargs)
+}
+
+func (c TailCallInstr) Execute(env *Glisp) error {
+	return env.callSymbol(c.sym, c.nargs, true)
+}
+
+func (env *Glisp) callSymbol(sym SexpSymbol, nargs int, tail bool) error {
+	f, ok := env.builtins[sym.number]
 	if ok {
-		return env.CallUserFunction(f, c.sym.name, c.nargs)
+		return env.CallUserFunction(f, sym.name, nargs)
 	}
 
-	funcobj, err := env.scopestack.LookupSymbol(c.sym)
+	funcobj, err := env.scopestack.LookupSymbol(sym)
 	if err != nil {
 		return err
 	}
 	switch f := funcobj.(type) {
 	case SexpFunction:
-		if !f.user {
-			return env.CallFunction(f, c.nargs)
-		}
-		return env.CallUserFunction(f, c.sym.name, c.nargs)
+		return env.dispatch(f, sym.name, nargs, tail)
+	}
+	return errors.New(fmt.Sprintf("%s is not a function", sym.name))
+}
+
+// dispatch calls f with the top nargs values of the datastack
+func (env *Glisp) dispatch(f SexpFunction, name string, nargs int, tail bool) error {
+	if f.user {
+		// builtins return before the next instruction either way
+		return env.CallUserFunction(f, name, nargs)
 	}
-	return errors.New(fmt.Sprintf("%s is not a function", c.sym.name))
+	if tail {
+		return env.TailCallFunction(f, nargs)
+	}
+	return env.CallFunction(f, nargs)
 }
 
 type DispatchInstr struct {
@@ -238,14 +295,81 @@ func (d DispatchInstr) Execute(env *Glisp) error {
 
 	switch f := funcobj.(type) {
 	case SexpFunction:
-		if !f.user {
-			return env.CallFunction(f, d.nargs)
-		}
-		return env.CallUserFunction(f, f.name, d.nargs)
+		return env.dispatch(f, f.name, d.nargs, false)
+	}
+	return errors.New("not a function")
+}
+
+// TailDispatchInstr is a DispatchInstr in tail position
+type TailDispatchInstr struct {
+	nargs int
+}
+
+func (d TailDispatchInstr) InstrString() string {
+	return fmt.Sprintf("tdispatch %d", d.nargs)
+}
+
+func (d TailDispatchInstr) Execute(env *Glisp) error {
+	funcobj, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+
+	switch f := funcobj.(type) {
+	case SexpFunction:
+		return env.dispatch(f, f.name, d.nargs, true)
 	}
 	return errors.New("not a function")
 }
 
+// ApplyInstr is (apply f args) compiled inline, so it doesn't need a
+// nested Run and can be a tail call
+type ApplyInstr struct {
+	tail bool
+}
+
+func (a ApplyInstr) InstrString() string {
+	if a.tail {
+		return "tapply"
+	}
+	return "apply"
+}
+
+func (a ApplyInstr) Execute(env *Glisp) error {
+	args, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	funcobj, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+
+	f, ok := funcobj.(SexpFunction)
+	if !ok {
+		return &CallError{"apply", errors.New("first argument must be function")}
+	}
+
+	var funargs SexpArray
+	switch e := args.(type) {
+	case SexpArray:
+		funargs = e
+	case SexpPair:
+		funargs, err = ListToArray(e)
+		if err != nil {
+			return &CallError{"apply", err}
+		}
+	case SexpSentinel:
+	default:
+		return &CallError{"apply", errors.New("second argument must be array or list")}
+	}
+
+	for _, arg := range funargs {
+		env.datastack.PushExpr(arg)
+	}
+	return env.dispatch(f, f.name, len(funargs), a.tail)
+}
+
 type ReturnInstr struct {
 	err error
 }
@@ -264,14 +388,17 @@ func (r ReturnInstr) InstrString() string {
 	return "ret \"" + r.err.Error() + "\""
 }
 
-type AddScopeInstr int
+// AddScopeInstr pushes a frame laid out the way the generator saw the scope
+type AddScopeInstr struct {
+	scope *lexScope
+}
 
 func (a AddScopeInstr) InstrString() string {
 	return "add scope"
 }
 
 func (a AddScopeInstr) Execute(env *Glisp) error {
-	env.scopestack.PushScope()
+	env.scopestack.PushFrame(a.scope.syms)
 	env.pc++
 	return nil
 }
@@ -427,3 +554,74 @@ func (s HashizeInstr) Execute(env *Glisp) error {
 	env.pc++
 	return nil
 }
+
+// records the current datastack depth, loops keep it so break, continue
+// and recur can throw away whatever a half evaluated expression left behind
+type StackDepthInstr int
+
+func (s StackDepthInstr) InstrString() string {
+	return "depth"
+}
+
+func (s StackDepthInstr) Execute(env *Glisp) error {
+	env.datastack.PushExpr(SexpInt(env.datastack.tos))
+	env.pc++
+	return nil
+}
+
+// pops a depth recorded by StackDepthInstr and truncates the datastack
+// back to it, keeping the top keep values
+type UnwindInstr struct {
+	keep int
+}
+
+func (u UnwindInstr) InstrString() string {
+	return fmt.Sprintf("unwind %d", u.keep)
+}
+
+func (u UnwindInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	depth, ok := expr.(SexpInt)
+	if !ok {
+		return fmt.Errorf("unwind expected depth got %T", expr)
+	}
+
+	vals, err := env.datastack.PopExpressions(u.keep)
+	if err != nil {
+		return err
+	}
+	if int(depth) > env.datastack.tos {
+		return fmt.Errorf("unwind to %d but stack top is %d", depth, env.datastack.tos)
+	}
+	env.datastack.tos = int(depth)
+	for _, val := range vals {
+		env.datastack.PushExpr(val)
+	}
+	env.pc++
+	return nil
+}
+
+// replaces the collection on top of the datastack with an array of its
+// elements, see SeqToArray
+type SeqInstr int
+
+func (s SeqInstr) InstrString() string {
+	return "seq"
+}
+
+func (s SeqInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	arr, err := SeqToArray(expr)
+	if err != nil {
+		return err
+	}
+	env.datastack.PushExpr(arr)
+	env.pc++
+	return nil
+}
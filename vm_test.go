@@ -0,0 +1,107 @@
+package glisp
+
+import (
+	"errors"
+	"testing"
+)
+
+// runInstrs runs instrs as the main function of env
+func runInstrs(env *Glisp, instrs []Instruction) (Sexp, error) {
+	env.mainfunc = MakeFunction("__main", 0, false, instrs)
+	env.curfunc = env.mainfunc
+	env.pc = 0
+	return env.Run()
+}
+
+func TestInstructions(t *testing.T) {
+	env := NewGlisp()
+	if _, err := env.EvalString("(defn inc [x] (+ x 1))"); err != nil {
+		t.Fatal(err)
+	}
+	a := env.MakeSymbol("a")
+	plus := env.MakeSymbol("+")
+	inc := env.MakeSymbol("inc")
+
+	tests := []struct {
+		name   string
+		instrs []Instruction
+		want   string
+	}{
+		{"push pop dup", []Instruction{
+			PushInstr{SexpInt(1)}, PushInstr{SexpInt(2)}, PopInstr(0), DupInstr(0),
+			CallInstr{plus, 2}}, "2"},
+		{"jump", []Instruction{
+			PushInstr{SexpInt(1)}, JumpInstr{2}, PushInstr{SexpInt(2)}}, "1"},
+		{"branch taken", []Instruction{
+			PushInstr{SexpBool(false)}, BranchInstr{false, 3},
+			PushInstr{SexpInt(1)}, JumpInstr{2}, PushInstr{SexpInt(2)}}, "2"},
+		{"branch not taken", []Instruction{
+			PushInstr{SexpBool(true)}, BranchInstr{false, 3},
+			PushInstr{SexpInt(1)}, JumpInstr{2}, PushInstr{SexpInt(2)}}, "1"},
+		{"goto", []Instruction{
+			GotoInstr{3}, PushInstr{SexpInt(1)}, JumpInstr{2}, PushInstr{SexpInt(2)}}, "2"},
+		{"put get", []Instruction{
+			PushInstr{SexpInt(5)}, PutInstr{a}, GetInstr{a}}, "5"},
+		{"squash", []Instruction{
+			PushInstr{SexpMarker}, PushInstr{SexpInt(1)}, PushInstr{SexpInt(2)},
+			SquashInstr(0)}, "(1 2)"},
+		{"vectorize", []Instruction{
+			PushInstr{SexpMarker}, PushInstr{SexpInt(1)}, PushInstr{SexpInt(2)},
+			VectorizeInstr(0)}, "[1 2]"},
+		{"explode", []Instruction{
+			PushInstr{MakeList([]Sexp{SexpInt(3), SexpInt(4)})}, ExplodeInstr(0),
+			CallInstr{plus, 2}}, "7"},
+		// back to the depth on top, 0 is where the 1 is, keeping the 3
+		{"unwind", []Instruction{
+			PushInstr{SexpInt(1)}, PushInstr{SexpInt(2)}, PushInstr{SexpInt(3)},
+			PushInstr{SexpInt(0)}, UnwindInstr{1}, CallInstr{plus, 2}}, "4"},
+		{"depth", []Instruction{
+			PushInstr{SexpInt(1)}, PushInstr{SexpInt(2)}, StackDepthInstr(0)}, "1"},
+		{"call and return", []Instruction{
+			PushInstr{SexpInt(41)}, CallInstr{inc, 1}}, "42"},
+	}
+
+	for _, test := range tests {
+		res, err := runInstrs(env, test.instrs)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if res.SexpString() != test.want {
+			t.Errorf("%s gave %s, want %s", test.name, res.SexpString(), test.want)
+		}
+		env.Clear()
+	}
+}
+
+func TestInstructionErrors(t *testing.T) {
+	env := NewGlisp()
+	tests := []struct {
+		name   string
+		instrs []Instruction
+	}{
+		{"jump out of bounds", []Instruction{JumpInstr{5}}},
+		{"goto out of bounds", []Instruction{GotoInstr{-1}}},
+		{"pop empty stack", []Instruction{PopInstr(0)}},
+		{"unbound symbol", []Instruction{GetInstr{env.MakeSymbol("nothing-here")}}},
+		{"wrong nargs", []Instruction{PushInstr{SexpInt(1)}, CallInstr{env.MakeSymbol("cons"), 1}}},
+	}
+
+	for _, test := range tests {
+		if _, err := runInstrs(env, test.instrs); err == nil {
+			t.Errorf("%s should fail", test.name)
+		}
+		env.Clear()
+	}
+
+	_, err := runInstrs(env, []Instruction{JumpInstr{5}})
+	if !errors.Is(err, OutOfBounds) {
+		t.Errorf("jumping out of bounds gave %v, want %v", err, OutOfBounds)
+	}
+	env.Clear()
+
+	// exit gets past try
+	_, err = env.EvalString("(try (exit 3) (catch e 0))")
+	var exit *ExitError
+	if !errors.As(err, &exit) || exit.Code != 3 {
+		t.Errorf("exit gave %v, want exit status 3", err)
+	}
+}